@@ -0,0 +1,383 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// captureMagic starts every capture file. The last byte is the format version.
+var captureMagic = []byte("MQTTCAP\x01")
+
+// captureRecordHeaderLength is the length of the header of each record: an 8 byte
+// timestamp in nanoseconds since the Unix epoch, a 1 byte direction, an 8 byte
+// connection ID and a 4 byte packet length, all big endian.
+const captureRecordHeaderLength = 21
+
+// CaptureWriter writes MQTT packets to a capture, which can be read back with a
+// CaptureReader. A capture starts with an 8 byte magic string, followed by one record
+// per packet, each holding the time, direction, connection ID and raw bytes of the
+// packet. CaptureWriter is safe for concurrent use, so one capture can record many
+// connections.
+type CaptureWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewCaptureWriter writes the capture header to w, and returns a CaptureWriter that
+// writes records to it. If w is buffered, the caller must flush it when done.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	if _, err := w.Write(captureMagic); err != nil {
+		return nil, err
+	}
+
+	return &CaptureWriter{w: w}, nil
+}
+
+// WritePacket writes a single record to the capture. The bytes should be one complete
+// MQTT packet, but they're recorded as is, so malformed packets are kept for replay.
+func (this *CaptureWriter) WritePacket(t time.Time, dir Direction, connId uint64, b []byte) error {
+	var hdr [captureRecordHeaderLength]byte
+
+	binary.BigEndian.PutUint64(hdr[0:], uint64(t.UnixNano()))
+	hdr[8] = byte(dir)
+	binary.BigEndian.PutUint64(hdr[9:], connId)
+	binary.BigEndian.PutUint32(hdr[17:], uint32(len(b)))
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, err := this.w.Write(hdr[:]); err != nil {
+		return err
+	}
+
+	_, err := this.w.Write(b)
+	return err
+}
+
+// Conn returns a connection that records every packet read from, or written to, conn.
+// Packets read are recorded as Inbound, and packets written as Outbound. Packets are
+// recorded when their last byte goes through the connection, no matter how they're
+// split across Read and Write calls. Errors writing the capture are ignored, so they
+// never affect the connection.
+func (this *CaptureWriter) Conn(conn net.Conn, connId uint64) net.Conn {
+	return &captureConn{
+		Conn:   conn,
+		cw:     this,
+		connId: connId,
+	}
+}
+
+type captureConn struct {
+	net.Conn
+
+	cw     *CaptureWriter
+	connId uint64
+	in     packetSplitter
+	out    packetSplitter
+}
+
+func (this *captureConn) Read(p []byte) (int, error) {
+	n, err := this.Conn.Read(p)
+	if n > 0 {
+		for _, b := range this.in.split(p[:n]) {
+			this.cw.WritePacket(time.Now(), Inbound, this.connId, b)
+		}
+	}
+
+	return n, err
+}
+
+func (this *captureConn) Write(p []byte) (int, error) {
+	n, err := this.Conn.Write(p)
+	if n > 0 {
+		for _, b := range this.out.split(p[:n]) {
+			this.cw.WritePacket(time.Now(), Outbound, this.connId, b)
+		}
+	}
+
+	return n, err
+}
+
+// packetSplitter splits a byte stream into MQTT packets using the remaining length
+// in the fixed header.
+type packetSplitter struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+// split adds p to the stream, and returns the packets that are now complete.
+func (this *packetSplitter) split(p []byte) [][]byte {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.buf = append(this.buf, p...)
+
+	var packets [][]byte
+
+	for len(this.buf) >= 2 {
+		remlen, n, err := readVarint32(nil, bytes.NewReader(this.buf[1:]))
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// The remaining length isn't complete yet.
+			break
+		}
+
+		if err != nil {
+			// The stream can't be split any further, so the rest of it is recorded
+			// as one packet.
+			packets = append(packets, this.buf)
+			this.buf = nil
+			break
+		}
+
+		total := 1 + n + int(remlen)
+		if len(this.buf) < total {
+			break
+		}
+
+		packets = append(packets, append([]byte{}, this.buf[:total]...))
+		this.buf = this.buf[total:]
+	}
+
+	if len(this.buf) == 0 {
+		this.buf = nil
+	}
+
+	return packets
+}
+
+// CaptureRecord is a single packet read from a capture.
+type CaptureRecord struct {
+	// Time is when the packet was recorded.
+	Time time.Time
+
+	// Offset is the time since the first record in the capture.
+	Offset time.Duration
+
+	// Direction is the direction of the packet, relative to where it was recorded.
+	Direction Direction
+
+	// ConnId is the ID of the connection the packet was recorded on.
+	ConnId uint64
+
+	// Data is the raw bytes of the packet.
+	Data []byte
+
+	// Message is the decoded packet, or nil if it couldn't be decoded.
+	Message Message
+
+	// Err is the error returned when decoding the packet.
+	Err error
+}
+
+// CaptureReader reads the records of a capture written by CaptureWriter.
+type CaptureReader struct {
+	r     io.Reader
+	start time.Time
+	opts  *DecodeOptions
+}
+
+// NewCaptureReader reads the capture header from r, and returns a CaptureReader that
+// reads records from it. Packets are decoded with opts, which may be nil.
+func NewCaptureReader(r io.Reader, opts *DecodeOptions) (*CaptureReader, error) {
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("capture/NewCaptureReader: Error reading header: %w", err)
+	}
+
+	if !bytes.Equal(magic, captureMagic) {
+		return nil, fmt.Errorf("capture/NewCaptureReader: Invalid header %q", magic)
+	}
+
+	return &CaptureReader{r: r, opts: opts}, nil
+}
+
+// Next returns the next record in the capture, or io.EOF at the end of the capture.
+// A packet that can't be decoded is not an error: its record is returned with a nil
+// Message, and the decode error in Err.
+func (this *CaptureReader) Next() (*CaptureRecord, error) {
+	var hdr [captureRecordHeaderLength]byte
+
+	if _, err := io.ReadFull(this.r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("capture/Next: Truncated record header: %w", err)
+		}
+
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[17:])
+	if int64(n) > int64(maxRemainingLength)+int64(maxFixedHeaderLength) {
+		return nil, fmt.Errorf("capture/Next: %w: Record length %d exceeds maximum packet size", ErrPacketTooLarge, n)
+	}
+
+	rec := &CaptureRecord{
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(hdr[0:]))),
+		Direction: Direction(hdr[8]),
+		ConnId:    binary.BigEndian.Uint64(hdr[9:]),
+	}
+
+	// The length comes from the file, so the buffer only grows as the data is read,
+	// rather than allocating the whole length up front for a truncated record.
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, this.r, int64(n)); err != nil {
+		return nil, fmt.Errorf("capture/Next: Truncated record: %w", io.ErrUnexpectedEOF)
+	}
+	rec.Data = data.Bytes()
+
+	if this.start.IsZero() {
+		this.start = rec.Time
+	}
+	rec.Offset = rec.Time.Sub(this.start)
+
+	rec.Message, rec.Err = this.decode(rec.Data)
+
+	return rec, nil
+}
+
+func (this *CaptureReader) decode(b []byte) (Message, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("capture/Next: %w: Empty record", io.ErrUnexpectedEOF)
+	}
+
+	msg, err := MessageType(b[0] >> 4).New()
+	if err != nil {
+		return nil, err
+	}
+
+	if o, ok := msg.(interface{ SetDecodeOptions(*DecodeOptions) }); ok {
+		o.SetDecodeOptions(this.opts)
+	}
+
+	if _, err = msg.Decode(bytes.NewBuffer(b)); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Replayer re-sends the client side of a capture to a target server. The client side
+// of each connection is the direction its CONNECT packet was recorded in, so captures
+// taken on either the client or the server can be replayed. Packets recorded before
+// the CONNECT of their connection are skipped. Whatever the target sends back is read
+// and discarded.
+type Replayer struct {
+	// Dial connects to the target. It's called once for each connection in the
+	// capture, when its CONNECT packet is replayed.
+	Dial func() (net.Conn, error)
+
+	// Speed scales the timing of the capture. 1 replays packets with the original
+	// timing, 2 replays them twice as fast, and 0 replays them without any delay.
+	Speed float64
+}
+
+// NewReplayer returns a Replayer that replays with the original timing.
+func NewReplayer(dial func() (net.Conn, error)) *Replayer {
+	return &Replayer{
+		Dial:  dial,
+		Speed: 1,
+	}
+}
+
+type replayConn struct {
+	client Direction
+	conn   net.Conn
+}
+
+// Replay reads the capture to the end, and sends the client side packets to the
+// target. It returns the number of packets sent. Connections to the target are closed
+// when Replay returns.
+func (this *Replayer) Replay(ctx context.Context, r *CaptureReader) (int, error) {
+	conns := make(map[uint64]*replayConn)
+	defer func() {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	sent := 0
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return sent, nil
+		}
+
+		if err != nil {
+			return sent, err
+		}
+
+		c := conns[rec.ConnId]
+		if c == nil {
+			if len(rec.Data) == 0 || MessageType(rec.Data[0]>>4) != CONNECT {
+				continue
+			}
+		} else if rec.Direction != c.client {
+			continue
+		}
+
+		if err := this.wait(ctx, start, rec.Offset); err != nil {
+			return sent, err
+		}
+
+		if c == nil {
+			conn, err := this.Dial()
+			if err != nil {
+				return sent, fmt.Errorf("capture/Replay: Error connecting for connection %d: %w", rec.ConnId, err)
+			}
+
+			c = &replayConn{client: rec.Direction, conn: conn}
+			conns[rec.ConnId] = c
+
+			go io.Copy(io.Discard, conn)
+		}
+
+		if _, err := c.conn.Write(rec.Data); err != nil {
+			return sent, fmt.Errorf("capture/Replay: Error sending %s for connection %d: %w", MessageType(rec.Data[0]>>4).Name(), rec.ConnId, err)
+		}
+		sent++
+	}
+}
+
+// wait waits until the scaled offset since start.
+func (this *Replayer) wait(ctx context.Context, start time.Time, offset time.Duration) error {
+	if this.Speed <= 0 {
+		return ctx.Err()
+	}
+
+	d := time.Until(start.Add(time.Duration(float64(offset) / this.Speed)))
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
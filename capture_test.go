@@ -0,0 +1,279 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func encodeTestMessage(t *testing.T, msg Message) []byte {
+	r, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	b, err := io.ReadAll(r)
+	assert.NoError(t, true, err, "Error reading encoded message.")
+
+	return b
+}
+
+func newTestConnect(t *testing.T) []byte {
+	msg := NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientId([]byte("surgemq"))
+	msg.SetCleanSession(true)
+
+	return encodeTestMessage(t, msg)
+}
+
+func newTestPublish(t *testing.T, topic, payload string) []byte {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte(payload))
+
+	return encodeTestMessage(t, msg)
+}
+
+func TestCaptureConn(t *testing.T) {
+	var buf bytes.Buffer
+
+	cw, err := NewCaptureWriter(&buf)
+	assert.NoError(t, true, err, "Error creating capture writer.")
+
+	client, server := net.Pipe()
+	conn := cw.Conn(server, 7)
+
+	connect := newTestConnect(t)
+	pub1 := newTestPublish(t, "a/b", "hello")
+	pub2 := newTestPublish(t, "a/c", "world")
+
+	go func() {
+		// Split the CONNECT across writes, and send both PUBLISH packets in one.
+		client.Write(connect[:1])
+		client.Write(connect[1:5])
+		client.Write(connect[5:])
+		client.Write(append(append([]byte{}, pub1...), pub2...))
+		io.Copy(io.Discard, client)
+	}()
+
+	b := make([]byte, 3)
+	for n := 0; n < len(connect)+len(pub1)+len(pub2); {
+		m, err := conn.Read(b)
+		assert.NoError(t, true, err, "Error reading from connection.")
+		n += m
+	}
+
+	connack := encodeTestMessage(t, NewConnackMessage())
+	_, err = conn.Write(connack)
+	assert.NoError(t, true, err, "Error writing to connection.")
+	conn.Close()
+
+	cr, err := NewCaptureReader(&buf, nil)
+	assert.NoError(t, true, err, "Error creating capture reader.")
+
+	expected := []struct {
+		dir  Direction
+		data []byte
+	}{
+		{Inbound, connect},
+		{Inbound, pub1},
+		{Inbound, pub2},
+		{Outbound, connack},
+	}
+
+	var last time.Duration
+
+	for _, e := range expected {
+		rec, err := cr.Next()
+		assert.NoError(t, true, err, "Error reading record.")
+		assert.Equal(t, true, e.dir, rec.Direction, "Incorrect direction.")
+		assert.Equal(t, true, uint64(7), rec.ConnId, "Incorrect connection ID.")
+		assert.Equal(t, true, e.data, rec.Data, "Incorrect packet bytes.")
+		assert.NoError(t, true, rec.Err, "Error decoding packet.")
+		assert.Equal(t, true, MessageType(e.data[0]>>4), rec.Message.Type(), "Incorrect message type.")
+		assert.True(t, true, rec.Offset >= last, "Expecting offsets to increase.")
+		last = rec.Offset
+	}
+
+	_, err = cr.Next()
+	assert.Equal(t, true, io.EOF, err, "Expecting end of capture.")
+}
+
+func TestCaptureReaderMalformed(t *testing.T) {
+	var buf bytes.Buffer
+
+	cw, err := NewCaptureWriter(&buf)
+	assert.NoError(t, true, err, "Error creating capture writer.")
+
+	// PUBLISH with a truncated topic is kept, so it can be replayed as is.
+	bad := []byte{byte(PUBLISH << 4), 3, 0, 5, 'a'}
+	cw.WritePacket(time.Unix(100, 0), Inbound, 1, bad)
+
+	cr, err := NewCaptureReader(bytes.NewReader(buf.Bytes()), nil)
+	assert.NoError(t, true, err, "Error creating capture reader.")
+
+	rec, err := cr.Next()
+	assert.NoError(t, true, err, "Error reading record.")
+	assert.Equal(t, true, bad, rec.Data, "Incorrect packet bytes.")
+	assert.True(t, true, rec.Message == nil, "Expecting no message.")
+	assert.Error(t, true, rec.Err, "Expecting decode error.")
+
+	_, err = NewCaptureReader(bytes.NewReader([]byte("NOTACAPTURE")), nil)
+	assert.Error(t, true, err, "Expecting error for invalid header.")
+
+	cr, _ = NewCaptureReader(bytes.NewReader(buf.Bytes()[:len(buf.Bytes())-1]), nil)
+	_, err = cr.Next()
+	assert.Error(t, true, err, "Expecting error for truncated record.")
+}
+
+func TestCaptureReaderTruncatedLength(t *testing.T) {
+	// A record header claiming a 256 MB packet, with no packet after it.
+	hdr := make([]byte, captureRecordHeaderLength)
+	hdr[17], hdr[18], hdr[19], hdr[20] = 0x10, 0, 0, 0
+
+	cr, err := NewCaptureReader(bytes.NewReader(append(append([]byte{}, captureMagic...), hdr...)), nil)
+	assert.NoError(t, true, err, "Error creating capture reader.")
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	_, err = cr.Next()
+	assert.Error(t, true, err, "Expecting error for truncated record.")
+
+	runtime.ReadMemStats(&after)
+	assert.True(t, true, after.TotalAlloc-before.TotalAlloc < 1<<20, "Allocation should not follow the record length.", after.TotalAlloc-before.TotalAlloc)
+}
+
+func TestPacketSplitter(t *testing.T) {
+	var s packetSplitter
+
+	// Remaining length of 200 takes two bytes.
+	pub := newTestPublish(t, "a/b", string(bytes.Repeat([]byte{'x'}, 195)))
+
+	assert.Equal(t, true, 0, len(s.split(pub[:2])), "Expecting incomplete remaining length.")
+	assert.Equal(t, true, 0, len(s.split(pub[2:100])), "Expecting incomplete packet.")
+
+	packets := s.split(append(append([]byte{}, pub[100:]...), 0xe0, 0x00, 0xc0))
+	assert.Equal(t, true, 2, len(packets), "Expecting PUBLISH and DISCONNECT.")
+	assert.Equal(t, true, pub, packets[0], "Incorrect PUBLISH bytes.")
+	assert.Equal(t, true, []byte{0xe0, 0x00}, packets[1], "Incorrect DISCONNECT bytes.")
+
+	packets = s.split([]byte{0x00})
+	assert.Equal(t, true, 1, len(packets), "Expecting PINGREQ.")
+	assert.Equal(t, true, []byte{0xc0, 0x00}, packets[0], "Incorrect PINGREQ bytes.")
+}
+
+func TestReplayer(t *testing.T) {
+	var buf bytes.Buffer
+
+	cw, err := NewCaptureWriter(&buf)
+	assert.NoError(t, true, err, "Error creating capture writer.")
+
+	t0 := time.Unix(1000, 0)
+	connect := newTestConnect(t)
+	pub := newTestPublish(t, "a/b", "hello")
+	connack := encodeTestMessage(t, NewConnackMessage())
+
+	// Captured on the server, so the client side is Inbound. The PUBLISH on
+	// connection 2 has no CONNECT, and is skipped.
+	cw.WritePacket(t0, Inbound, 1, connect)
+	cw.WritePacket(t0.Add(10*time.Millisecond), Outbound, 1, connack)
+	cw.WritePacket(t0.Add(20*time.Millisecond), Inbound, 2, pub)
+	cw.WritePacket(t0.Add(400*time.Millisecond), Inbound, 1, pub)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, true, err, "Error listening.")
+	defer ln.Close()
+
+	received := make(chan Message, 10)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		br := bufio.NewReader(conn)
+		for {
+			b, err := br.Peek(1)
+			if err != nil {
+				close(received)
+				return
+			}
+
+			msg, _ := MessageType(b[0] >> 4).New()
+			if _, err = msg.Decode(br); err != nil {
+				close(received)
+				return
+			}
+
+			received <- msg
+		}
+	}()
+
+	cr, err := NewCaptureReader(&buf, nil)
+	assert.NoError(t, true, err, "Error creating capture reader.")
+
+	rp := NewReplayer(func() (net.Conn, error) {
+		return net.Dial("tcp", ln.Addr().String())
+	})
+	rp.Speed = 4
+
+	start := time.Now()
+	sent, err := rp.Replay(context.Background(), cr)
+	elapsed := time.Since(start)
+
+	assert.NoError(t, true, err, "Error replaying capture.")
+	assert.Equal(t, true, 2, sent, "Incorrect number of packets sent.")
+	assert.True(t, true, elapsed >= 100*time.Millisecond, "Expecting timing to be scaled, took", elapsed)
+	assert.True(t, true, elapsed < 400*time.Millisecond, "Expecting timing to be scaled, took", elapsed)
+
+	var types []MessageType
+	for msg := range received {
+		types = append(types, msg.Type())
+	}
+
+	assert.Equal(t, true, []MessageType{CONNECT, PUBLISH}, types, "Incorrect packets replayed.")
+}
+
+func TestReplayerCancel(t *testing.T) {
+	var buf bytes.Buffer
+
+	cw, _ := NewCaptureWriter(&buf)
+	cw.WritePacket(time.Unix(0, 0), Outbound, 1, newTestConnect(t))
+	cw.WritePacket(time.Unix(60, 0), Outbound, 1, newTestPublish(t, "a/b", "late"))
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	cr, _ := NewCaptureReader(&buf, nil)
+	rp := NewReplayer(func() (net.Conn, error) { return client, nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	sent, err := rp.Replay(ctx, cr)
+	assert.Equal(t, true, context.DeadlineExceeded, err, "Expecting replay to be cancelled.")
+	assert.Equal(t, true, 1, sent, "Expecting only the CONNECT to be sent.")
+}
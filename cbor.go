@@ -0,0 +1,724 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// CBOR major types, RFC 8949 section 3.1.
+const (
+	cborUint byte = iota
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+const (
+	cborFalse byte = 0xf4
+	cborTrue  byte = 0xf5
+	cborNull  byte = 0xf6
+
+	// cborMaxDepth limits how deeply arrays and maps can be nested in a payload, so
+	// a hostile payload can't exhaust the stack.
+	cborMaxDepth = 256
+)
+
+// CBORCodec encodes values in CBOR, RFC 8949. It handles the same kinds of values as
+// encoding/json: booleans, numbers, strings, byte slices, slices, arrays, maps,
+// pointers, interfaces and structs. Struct fields are encoded as map entries named
+// after the field, or after the `cbor` struct tag, which also understands the
+// "omitempty" option and "-". Maps are encoded with their keys sorted, so the same
+// value always has the same encoding.
+//
+// When decoding into an empty interface, integers become int64, or uint64 if they
+// don't fit, floats become float64, and maps become map[string]interface{}, or
+// map[interface{}]interface{} if any key is not a string. Tags are skipped, and
+// indefinite length items are not supported.
+type CBORCodec struct{}
+
+var _ Codec = CBORCodec{}
+
+// Name returns "cbor".
+func (this CBORCodec) Name() string {
+	return "cbor"
+}
+
+// Marshal returns the CBOR encoding of v.
+func (this CBORCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := cborEncode(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes the CBOR payload into v, which must be a non-nil pointer.
+func (this CBORCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cbor/Unmarshal: Cannot decode into %T", v)
+	}
+
+	d := &cborDecoder{data: data}
+
+	if err := d.decode(rv.Elem(), 0); err != nil {
+		return err
+	}
+
+	if d.off != len(data) {
+		return fmt.Errorf("cbor/Unmarshal: %d bytes of trailing data at byte %d", len(data)-d.off, d.off)
+	}
+
+	return nil
+}
+
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	m := major << 5
+
+	switch {
+	case n < 24:
+		buf.WriteByte(m | byte(n))
+
+	case n <= math.MaxUint8:
+		buf.Write([]byte{m | 24, byte(n)})
+
+	case n <= math.MaxUint16:
+		buf.WriteByte(m | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+
+	case n <= math.MaxUint32:
+		buf.WriteByte(m | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+
+	default:
+		buf.WriteByte(m | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func cborEncode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte(cborNull)
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+
+		return cborEncode(buf, v.Elem())
+
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(cborTrue)
+		} else {
+			buf.WriteByte(cborFalse)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n >= 0 {
+			cborHead(buf, cborUint, uint64(n))
+		} else {
+			cborHead(buf, cborNegInt, uint64(-1-n))
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		cborHead(buf, cborUint, v.Uint())
+
+	case reflect.Float32:
+		buf.WriteByte(cborSimple<<5 | 26)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(float32(v.Float())))
+
+	case reflect.Float64:
+		buf.WriteByte(cborSimple<<5 | 27)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v.Float()))
+
+	case reflect.String:
+		cborHead(buf, cborText, uint64(v.Len()))
+		buf.WriteString(v.String())
+
+	case reflect.Slice:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+
+		fallthrough
+
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			cborHead(buf, cborBytes, uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				buf.WriteByte(byte(v.Index(i).Uint()))
+			}
+
+			return nil
+		}
+
+		cborHead(buf, cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := cborEncode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(cborNull)
+			return nil
+		}
+
+		type entry struct{ key, value []byte }
+		entries := make([]entry, 0, v.Len())
+
+		for it := v.MapRange(); it.Next(); {
+			var k, e bytes.Buffer
+
+			if err := cborEncode(&k, it.Key()); err != nil {
+				return err
+			}
+
+			if err := cborEncode(&e, it.Value()); err != nil {
+				return err
+			}
+
+			entries = append(entries, entry{k.Bytes(), e.Bytes()})
+		}
+
+		sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].key, entries[j].key) < 0 })
+
+		cborHead(buf, cborMap, uint64(len(entries)))
+		for _, e := range entries {
+			buf.Write(e.key)
+			buf.Write(e.value)
+		}
+
+	case reflect.Struct:
+		fields := cborFields(v.Type())
+
+		n := 0
+		for _, f := range fields {
+			if !f.omitEmpty || !v.Field(f.index).IsZero() {
+				n++
+			}
+		}
+
+		cborHead(buf, cborMap, uint64(n))
+		for _, f := range fields {
+			fv := v.Field(f.index)
+			if f.omitEmpty && fv.IsZero() {
+				continue
+			}
+
+			cborHead(buf, cborText, uint64(len(f.name)))
+			buf.WriteString(f.name)
+
+			if err := cborEncode(buf, fv); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return fmt.Errorf("cbor/Marshal: Unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+type cborField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// cborFields returns the exported fields of the struct type, in declaration order.
+func cborFields(t reflect.Type) []cborField {
+	var fields []cborField
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		f := cborField{name: sf.Name, index: i}
+
+		if tag, ok := sf.Tag.Lookup("cbor"); ok {
+			if tag == "-" {
+				continue
+			}
+
+			name, opts, _ := strings.Cut(tag, ",")
+			if name != "" {
+				f.name = name
+			}
+
+			f.omitEmpty = opts == "omitempty"
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+type cborDecoder struct {
+	data []byte
+	off  int
+}
+
+var (
+	cborAnyType    = reflect.TypeOf((*interface{})(nil)).Elem()
+	cborAnyMapType = reflect.TypeOf(map[interface{}]interface{}(nil))
+	cborStrMapType = reflect.TypeOf(map[string]interface{}(nil))
+)
+
+// head reads the initial byte of an item and its argument.
+func (this *cborDecoder) head() (byte, byte, uint64, error) {
+	if this.off >= len(this.data) {
+		return 0, 0, 0, fmt.Errorf("cbor/Unmarshal: %w at byte %d", io.ErrUnexpectedEOF, this.off)
+	}
+
+	b := this.data[this.off]
+	major, info := b>>5, b&0x1f
+	this.off++
+
+	var size int
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+
+	case info <= 27:
+		size = 1 << (info - 24)
+
+	default:
+		return 0, 0, 0, fmt.Errorf("cbor/Unmarshal: Unsupported additional information %d at byte %d", info, this.off-1)
+	}
+
+	if len(this.data)-this.off < size {
+		return 0, 0, 0, fmt.Errorf("cbor/Unmarshal: %w at byte %d", io.ErrUnexpectedEOF, this.off)
+	}
+
+	var n uint64
+	for _, c := range this.data[this.off : this.off+size] {
+		n = n<<8 | uint64(c)
+	}
+	this.off += size
+
+	return major, info, n, nil
+}
+
+// bytes returns the next n bytes of the input.
+func (this *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if uint64(len(this.data)-this.off) < n {
+		return nil, fmt.Errorf("cbor/Unmarshal: %w at byte %d", io.ErrUnexpectedEOF, this.off)
+	}
+
+	b := this.data[this.off : this.off+int(n)]
+	this.off += int(n)
+
+	return b, nil
+}
+
+func (this *cborDecoder) mismatch(what string, t reflect.Type, off int) error {
+	return fmt.Errorf("cbor/Unmarshal: Cannot decode %s into %s at byte %d", what, t, off)
+}
+
+func (this *cborDecoder) decode(v reflect.Value, depth int) error {
+	if depth > cborMaxDepth {
+		return fmt.Errorf("cbor/Unmarshal: Nesting deeper than %d at byte %d", cborMaxDepth, this.off)
+	}
+
+	start := this.off
+
+	major, info, n, err := this.head()
+	if err != nil {
+		return err
+	}
+
+	if major == cborTag {
+		return this.decode(v, depth+1)
+	}
+
+	if major == cborSimple && (info == 22 || info == 23) {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+
+		this.off = start
+		return this.decode(v.Elem(), depth+1)
+
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return this.mismatch("value", v.Type(), start)
+		}
+
+		x, err := this.decodeAny(major, info, n, start, depth)
+		if err != nil {
+			return err
+		}
+
+		if x != nil {
+			v.Set(reflect.ValueOf(x))
+		} else {
+			v.Set(reflect.Zero(v.Type()))
+		}
+
+		return nil
+	}
+
+	switch major {
+	case cborUint, cborNegInt:
+		return this.decodeInt(v, major, n, start)
+
+	case cborBytes, cborText:
+		b, err := this.bytes(n)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case major == cborText && v.Kind() == reflect.String:
+			v.SetString(string(b))
+
+		case major == cborBytes && v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte{}, b...))
+
+		case major == cborBytes && v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8 && v.Len() == len(b):
+			reflect.Copy(v, reflect.ValueOf(b))
+
+		case major == cborText:
+			return this.mismatch("text string", v.Type(), start)
+
+		default:
+			return this.mismatch("byte string", v.Type(), start)
+		}
+
+	case cborArray:
+		switch v.Kind() {
+		case reflect.Slice:
+			// Every item takes at least one byte, so a bogus count can't make us
+			// allocate more than the input size.
+			if n > uint64(len(this.data)-this.off) {
+				return fmt.Errorf("cbor/Unmarshal: %w at byte %d", io.ErrUnexpectedEOF, this.off)
+			}
+
+			s := reflect.MakeSlice(v.Type(), int(n), int(n))
+			for i := 0; i < int(n); i++ {
+				if err := this.decode(s.Index(i), depth+1); err != nil {
+					return err
+				}
+			}
+			v.Set(s)
+
+		case reflect.Array:
+			if n != uint64(v.Len()) {
+				return this.mismatch(fmt.Sprintf("array of %d items", n), v.Type(), start)
+			}
+
+			for i := 0; i < int(n); i++ {
+				if err := this.decode(v.Index(i), depth+1); err != nil {
+					return err
+				}
+			}
+
+		default:
+			return this.mismatch("array", v.Type(), start)
+		}
+
+	case cborMap:
+		switch v.Kind() {
+		case reflect.Map:
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+
+			for i := uint64(0); i < n; i++ {
+				k := reflect.New(v.Type().Key()).Elem()
+				if err := this.decode(k, depth+1); err != nil {
+					return err
+				}
+
+				if !k.Comparable() {
+					return this.mismatch("map key", v.Type().Key(), start)
+				}
+
+				e := reflect.New(v.Type().Elem()).Elem()
+				if err := this.decode(e, depth+1); err != nil {
+					return err
+				}
+
+				v.SetMapIndex(k, e)
+			}
+
+		case reflect.Struct:
+			fields := cborFields(v.Type())
+
+			for i := uint64(0); i < n; i++ {
+				var name string
+				if err := this.decode(reflect.ValueOf(&name).Elem(), depth+1); err != nil {
+					return err
+				}
+
+				f := -1
+				for j := range fields {
+					if fields[j].name == name {
+						f = fields[j].index
+						break
+					}
+				}
+
+				if f < 0 {
+					for j := range fields {
+						if strings.EqualFold(fields[j].name, name) {
+							f = fields[j].index
+							break
+						}
+					}
+				}
+
+				// Unknown fields are skipped.
+				if f < 0 {
+					var skip interface{}
+					if err := this.decode(reflect.ValueOf(&skip).Elem(), depth+1); err != nil {
+						return err
+					}
+
+					continue
+				}
+
+				if err := this.decode(v.Field(f), depth+1); err != nil {
+					return err
+				}
+			}
+
+		default:
+			return this.mismatch("map", v.Type(), start)
+		}
+
+	case cborSimple:
+		switch {
+		case info == 20 || info == 21:
+			if v.Kind() != reflect.Bool {
+				return this.mismatch("boolean", v.Type(), start)
+			}
+
+			v.SetBool(info == 21)
+
+		case info >= 25 && info <= 27:
+			if v.Kind() != reflect.Float32 && v.Kind() != reflect.Float64 {
+				return this.mismatch("float", v.Type(), start)
+			}
+
+			f := cborFloat(info, n)
+			if v.OverflowFloat(f) {
+				return this.mismatch(fmt.Sprint(f), v.Type(), start)
+			}
+
+			v.SetFloat(f)
+
+		default:
+			return fmt.Errorf("cbor/Unmarshal: Unsupported simple value %d at byte %d", n, start)
+		}
+	}
+
+	return nil
+}
+
+func (this *cborDecoder) decodeInt(v reflect.Value, major byte, n uint64, start int) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n > math.MaxInt64 {
+			return this.mismatch("integer", v.Type(), start)
+		}
+
+		x := int64(n)
+		if major == cborNegInt {
+			x = -1 - x
+		}
+
+		if v.OverflowInt(x) {
+			return this.mismatch(fmt.Sprint(x), v.Type(), start)
+		}
+
+		v.SetInt(x)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if major == cborNegInt || v.OverflowUint(n) {
+			return this.mismatch("integer", v.Type(), start)
+		}
+
+		v.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f := float64(n)
+		if major == cborNegInt {
+			f = -1 - f
+		}
+
+		v.SetFloat(f)
+
+	default:
+		return this.mismatch("integer", v.Type(), start)
+	}
+
+	return nil
+}
+
+// decodeAny decodes the item whose head has been read into a generic value.
+func (this *cborDecoder) decodeAny(major, info byte, n uint64, start, depth int) (interface{}, error) {
+	switch major {
+	case cborUint:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+
+		return n, nil
+
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("cbor/Unmarshal: Negative integer overflows int64 at byte %d", start)
+		}
+
+		return -1 - int64(n), nil
+
+	case cborBytes:
+		b, err := this.bytes(n)
+		return append([]byte{}, b...), err
+
+	case cborText:
+		b, err := this.bytes(n)
+		return string(b), err
+
+	case cborArray:
+		s := reflect.New(reflect.SliceOf(cborAnyType)).Elem()
+		this.off = start
+		err := this.decode(s, depth+1)
+		return s.Interface(), err
+
+	case cborMap:
+		keys := make([]interface{}, 0)
+		values := make([]interface{}, 0)
+		strs := true
+
+		for i := uint64(0); i < n; i++ {
+			var k, e interface{}
+
+			if err := this.decode(reflect.ValueOf(&k).Elem(), depth+1); err != nil {
+				return nil, err
+			}
+
+			if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, this.mismatch("map key", cborAnyMapType, start)
+			}
+
+			if err := this.decode(reflect.ValueOf(&e).Elem(), depth+1); err != nil {
+				return nil, err
+			}
+
+			_, ok := k.(string)
+			strs = strs && ok
+
+			keys = append(keys, k)
+			values = append(values, e)
+		}
+
+		if strs {
+			m := make(map[string]interface{}, len(keys))
+			for i, k := range keys {
+				m[k.(string)] = values[i]
+			}
+
+			return m, nil
+		}
+
+		m := make(map[interface{}]interface{}, len(keys))
+		for i, k := range keys {
+			m[k] = values[i]
+		}
+
+		return m, nil
+
+	case cborSimple:
+		switch {
+		case info == 20 || info == 21:
+			return info == 21, nil
+
+		case info >= 25 && info <= 27:
+			return cborFloat(info, n), nil
+		}
+
+		return nil, fmt.Errorf("cbor/Unmarshal: Unsupported simple value %d at byte %d", n, start)
+	}
+
+	return nil, fmt.Errorf("cbor/Unmarshal: Unsupported major type %d at byte %d", major, start)
+}
+
+// cborFloat returns the value of a half, single or double precision float.
+func cborFloat(info byte, n uint64) float64 {
+	switch info {
+	case 25:
+		exp, frac := (n>>10)&0x1f, float64(n&0x3ff)
+
+		var f float64
+		switch exp {
+		case 0:
+			f = math.Ldexp(frac, -24)
+		case 31:
+			if frac == 0 {
+				f = math.Inf(1)
+			} else {
+				f = math.NaN()
+			}
+		default:
+			f = math.Ldexp(frac+1024, int(exp)-25)
+		}
+
+		if n&0x8000 != 0 {
+			f = -f
+		}
+
+		return f
+
+	case 26:
+		return float64(math.Float32frombits(uint32(n)))
+	}
+
+	return math.Float64frombits(n)
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+// cborVectors are from RFC 8949 appendix A.
+var cborVectors = []struct {
+	v   interface{}
+	hex string
+}{
+	{uint64(0), "00"},
+	{uint64(23), "17"},
+	{uint64(24), "1818"},
+	{uint64(1000), "1903e8"},
+	{uint64(1000000), "1a000f4240"},
+	{uint64(1000000000000), "1b000000e8d4a51000"},
+	{uint64(18446744073709551615), "1bffffffffffffffff"},
+	{int64(-1), "20"},
+	{int64(-100), "3863"},
+	{int64(-1000), "3903e7"},
+	{1.1, "fb3ff199999999999a"},
+	{float32(100000.0), "fa47c35000"},
+	{false, "f4"},
+	{true, "f5"},
+	{nil, "f6"},
+	{"", "60"},
+	{"IETF", "6449455446"},
+	{"ü", "62c3bc"},
+	{[]byte{1, 2, 3, 4}, "4401020304"},
+	{[]int{}, "80"},
+	{[]int{1, 2, 3}, "83010203"},
+	{map[string]interface{}{}, "a0"},
+	{map[string]interface{}{"a": 1, "b": []int{2, 3}}, "a26161016162820203"},
+}
+
+func TestCBORMarshalVectors(t *testing.T) {
+	for _, v := range cborVectors {
+		b, err := CBORCodec{}.Marshal(v.v)
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, v.hex, hex.EncodeToString(b), "Wrong encoding of", v.v)
+	}
+}
+
+func TestCBORUnmarshalAny(t *testing.T) {
+	tests := []struct {
+		hex string
+		v   interface{}
+	}{
+		{"1818", int64(24)},
+		{"1bffffffffffffffff", uint64(18446744073709551615)},
+		{"3903e7", int64(-1000)},
+		{"f93e00", 1.5},
+		{"f98000", math.Copysign(0, -1)},
+		{"f90001", 5.960464477539063e-8},
+		{"fa47c35000", 100000.0},
+		{"f6", nil},
+		{"6449455446", "IETF"},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"a26161016162820203", map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.hex)
+
+		var v interface{}
+		err := CBORCodec{}.Unmarshal(data, &v)
+		assert.NoError(t, true, err, "Error decoding", test.hex)
+		assert.Equal(t, true, test.v, v, "Wrong value for", test.hex)
+	}
+
+	data, _ := hex.DecodeString("f97c00")
+
+	var f float64
+	assert.NoError(t, true, CBORCodec{}.Unmarshal(data, &f))
+	assert.True(t, true, math.IsInf(f, 1))
+}
+
+type cborTestStruct struct {
+	Name     string            `cbor:"name"`
+	Count    int               `cbor:"count"`
+	Ratio    float64           `cbor:"ratio,omitempty"`
+	Tags     []string          `cbor:"tags"`
+	Labels   map[string]string `cbor:"labels,omitempty"`
+	Raw      []byte            `cbor:"raw"`
+	Next     *cborTestStruct   `cbor:"next,omitempty"`
+	Ignored  string            `cbor:"-"`
+	Untagged bool
+	private  int
+}
+
+func TestCBORStructRoundTrip(t *testing.T) {
+	in := cborTestStruct{
+		Name:     "sensor",
+		Count:    -3,
+		Tags:     []string{"a", "b"},
+		Labels:   map[string]string{"z": "1", "a": "2"},
+		Raw:      []byte{0, 0xff},
+		Next:     &cborTestStruct{Name: "child"},
+		Ignored:  "x",
+		Untagged: true,
+		private:  1,
+	}
+
+	b, err := CBORCodec{}.Marshal(in)
+	assert.NoError(t, true, err)
+
+	var out cborTestStruct
+	assert.NoError(t, true, CBORCodec{}.Unmarshal(b, &out))
+
+	in.Ignored, in.private = "", 0
+	assert.Equal(t, true, in, out)
+
+	var m map[string]interface{}
+	assert.NoError(t, true, CBORCodec{}.Unmarshal(b, &m))
+	_, ok := m["ratio"]
+	assert.False(t, true, ok, "Empty field should be omitted.")
+	assert.Equal(t, true, true, m["Untagged"])
+}
+
+func TestCBORMapDeterministic(t *testing.T) {
+	m := map[string]int{}
+	for _, k := range []string{"d", "bb", "a", "c", "aa"} {
+		m[k] = len(k)
+	}
+
+	first, err := CBORCodec{}.Marshal(m)
+	assert.NoError(t, true, err)
+
+	for i := 0; i < 10; i++ {
+		b, _ := CBORCodec{}.Marshal(m)
+		assert.Equal(t, true, first, b)
+	}
+
+	// Shorter keys sort first, since their length is in the first byte.
+	assert.Equal(t, true, "a56161016163016164016261610262626202", hex.EncodeToString(first))
+}
+
+func TestCBORUnmarshalMismatch(t *testing.T) {
+	tests := []struct {
+		hex string
+		v   interface{}
+	}{
+		{"6161", new(int)},
+		{"01", new(string)},
+		{"20", new(uint)},
+		{"190100", new(uint8)},
+		{"83010203", new(cborTestStruct)},
+		{"a1646e616d6501", new(cborTestStruct)},
+		{"f5", new(float64)},
+		{"4401020304", new([2]byte)},
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.hex)
+		assert.Error(t, true, CBORCodec{}.Unmarshal(data, test.v), "Expected error decoding", test.hex)
+	}
+}
+
+func TestCBORUnmarshalInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"19",
+		"62c3",
+		"830102",
+		"5f",
+		"0101",
+		"9bffffffffffffffff",
+	}
+
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test)
+
+		var v interface{}
+		assert.Error(t, true, CBORCodec{}.Unmarshal(data, &v), "Expected error decoding", test)
+	}
+
+	data, _ := hex.DecodeString("83010203")
+
+	var v []int
+	err := CBORCodec{}.Unmarshal(data[:3], &v)
+	assert.True(t, true, errors.Is(err, io.ErrUnexpectedEOF), "Truncated input should wrap io.ErrUnexpectedEOF.")
+
+	deep := make([]byte, cborMaxDepth+10)
+	for i := range deep {
+		deep[i] = 0x81
+	}
+
+	var x interface{}
+	assert.Error(t, true, CBORCodec{}.Unmarshal(deep, &x))
+
+	assert.Error(t, true, CBORCodec{}.Unmarshal([]byte{0}, x))
+}
+
+func TestCBORUnknownFieldsSkipped(t *testing.T) {
+	b, err := CBORCodec{}.Marshal(map[string]interface{}{
+		"name":  "x",
+		"extra": []interface{}{1, map[string]int{"y": 2}},
+	})
+	assert.NoError(t, true, err)
+
+	var out cborTestStruct
+	assert.NoError(t, true, CBORCodec{}.Unmarshal(b, &out))
+	assert.Equal(t, true, "x", out.Name)
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import "bytes"
+
+// CloneMessage returns a deep copy of the message. It returns nil if the message
+// is not one of the types defined in this package.
+//
+// Decode does not copy the bytes it reads. Topics, payloads and the other byte slices
+// of a decoded message point into the message's internal buffer, and are overwritten
+// the next time the message is decoded or encoded. A clone shares no memory with the
+// original, so it can safely be queued, stored or fanned out to several connections.
+func CloneMessage(msg Message) Message {
+	switch m := msg.(type) {
+	case *ConnectMessage:
+		return m.Clone()
+	case *ConnackMessage:
+		return m.Clone()
+	case *PublishMessage:
+		return m.Clone()
+	case *PubackMessage:
+		return m.Clone()
+	case *PubrecMessage:
+		return m.Clone()
+	case *PubrelMessage:
+		return m.Clone()
+	case *PubcompMessage:
+		return m.Clone()
+	case *SubscribeMessage:
+		return m.Clone()
+	case *SubackMessage:
+		return m.Clone()
+	case *UnsubscribeMessage:
+		return m.Clone()
+	case *UnsubackMessage:
+		return m.Clone()
+	case *PingreqMessage:
+		return m.Clone()
+	case *PingrespMessage:
+		return m.Clone()
+	case *DisconnectMessage:
+		return m.Clone()
+	}
+
+	return nil
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
+
+func cloneBytesList(l [][]byte) [][]byte {
+	if l == nil {
+		return nil
+	}
+
+	c := make([][]byte, len(l))
+	for i, b := range l {
+		c[i] = cloneBytes(b)
+	}
+
+	return c
+}
+
+func equalBytesList(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// clone returns a copy of the fixed header without the internal buffer.
+func (this *fixedHeader) clone() fixedHeader {
+	return fixedHeader{
+		remlen: this.remlen,
+		mtype:  this.mtype,
+		flags:  this.flags,
+		opts:   this.opts,
+	}
+}
+
+// Equal returns true if the other message has the same type and fixed header flags.
+// Messages that have no variable header or payload use this as their Equal method.
+func (this *fixedHeader) Equal(other Message) bool {
+	f, ok := other.(interface {
+		Flags() byte
+	})
+
+	return ok && this.mtype == other.Type() && this.flags == f.Flags()
+}
+
+// Clone returns a deep copy of the message.
+func (this *ConnectMessage) Clone() *ConnectMessage {
+	return &ConnectMessage{
+		fixedHeader:  this.fixedHeader.clone(),
+		connectFlags: this.connectFlags,
+		version:      this.version,
+		keepAlive:    this.keepAlive,
+		protoName:    cloneBytes(this.protoName),
+		clientId:     cloneBytes(this.clientId),
+		willTopic:    cloneBytes(this.willTopic),
+		willMessage:  cloneBytes(this.willMessage),
+		username:     cloneBytes(this.username),
+		password:     cloneBytes(this.password),
+	}
+}
+
+// Equal returns true if the other message is a CONNECT message with the same fields.
+func (this *ConnectMessage) Equal(other Message) bool {
+	m, ok := other.(*ConnectMessage)
+
+	return ok && this.fixedHeader.Equal(m) &&
+		this.connectFlags == m.connectFlags &&
+		this.version == m.version &&
+		this.keepAlive == m.keepAlive &&
+		bytes.Equal(this.protocolName(), m.protocolName()) &&
+		bytes.Equal(this.clientId, m.clientId) &&
+		bytes.Equal(this.willTopic, m.willTopic) &&
+		bytes.Equal(this.willMessage, m.willMessage) &&
+		bytes.Equal(this.username, m.username) &&
+		bytes.Equal(this.password, m.password)
+}
+
+// Clone returns a deep copy of the message.
+func (this *ConnackMessage) Clone() *ConnackMessage {
+	return &ConnackMessage{
+		fixedHeader:    this.fixedHeader.clone(),
+		sessionPresent: this.sessionPresent,
+		returnCode:     this.returnCode,
+	}
+}
+
+// Equal returns true if the other message is a CONNACK message with the same fields.
+func (this *ConnackMessage) Equal(other Message) bool {
+	m, ok := other.(*ConnackMessage)
+
+	return ok && this.fixedHeader.Equal(m) &&
+		this.sessionPresent == m.sessionPresent &&
+		this.returnCode == m.returnCode
+}
+
+// Clone returns a deep copy of the message. A payload stream can only be read once,
+// so it's not copied: the clone of a message with a payload stream has no payload.
+func (this *PublishMessage) Clone() *PublishMessage {
+	return &PublishMessage{
+		fixedHeader: this.fixedHeader.clone(),
+		packetId:    this.packetId,
+		topic:       cloneBytes(this.topic),
+		payload:     cloneBytes(this.payload),
+	}
+}
+
+// Equal returns true if the other message is a PUBLISH message with the same flags,
+// topic and payload. The packet ID is only compared for QoS 1 and 2 messages.
+// Messages with a payload stream are only equal if they share the same stream.
+func (this *PublishMessage) Equal(other Message) bool {
+	m, ok := other.(*PublishMessage)
+
+	return ok && this.fixedHeader.Equal(m) &&
+		(this.QoS() == QosAtMostOnce || this.packetId == m.packetId) &&
+		bytes.Equal(this.topic, m.topic) &&
+		bytes.Equal(this.payload, m.payload) &&
+		this.stream == m.stream && this.size == m.size
+}
+
+// Clone returns a deep copy of the message.
+func (this *PubackMessage) Clone() *PubackMessage {
+	return &PubackMessage{
+		fixedHeader: this.fixedHeader.clone(),
+		packetId:    this.packetId,
+	}
+}
+
+// Equal returns true if the other message has the same type and packet ID. It is
+// also used by PUBREC, PUBREL, PUBCOMP and UNSUBACK messages.
+func (this *PubackMessage) Equal(other Message) bool {
+	m, ok := other.(interface {
+		PacketId() uint16
+	})
+
+	return ok && this.fixedHeader.Equal(other) && this.packetId == m.PacketId()
+}
+
+// Clone returns a deep copy of the message.
+func (this *PubrecMessage) Clone() *PubrecMessage {
+	return &PubrecMessage{*this.PubackMessage.Clone()}
+}
+
+// Clone returns a deep copy of the message.
+func (this *PubrelMessage) Clone() *PubrelMessage {
+	return &PubrelMessage{*this.PubackMessage.Clone()}
+}
+
+// Clone returns a deep copy of the message.
+func (this *PubcompMessage) Clone() *PubcompMessage {
+	return &PubcompMessage{*this.PubackMessage.Clone()}
+}
+
+// Clone returns a deep copy of the message.
+func (this *UnsubackMessage) Clone() *UnsubackMessage {
+	return &UnsubackMessage{*this.PubackMessage.Clone()}
+}
+
+// Clone returns a deep copy of the message.
+func (this *SubscribeMessage) Clone() *SubscribeMessage {
+	return &SubscribeMessage{
+		fixedHeader: this.fixedHeader.clone(),
+		packetId:    this.packetId,
+		topics:      cloneBytesList(this.topics),
+		qos:         cloneBytes(this.qos),
+	}
+}
+
+// Equal returns true if the other message is a SUBSCRIBE message with the same packet
+// ID, and the same topics and QoS in the same order.
+func (this *SubscribeMessage) Equal(other Message) bool {
+	m, ok := other.(*SubscribeMessage)
+
+	return ok && this.fixedHeader.Equal(m) &&
+		this.packetId == m.packetId &&
+		equalBytesList(this.topics, m.topics) &&
+		bytes.Equal(this.qos, m.qos)
+}
+
+// Clone returns a deep copy of the message.
+func (this *SubackMessage) Clone() *SubackMessage {
+	return &SubackMessage{
+		fixedHeader: this.fixedHeader.clone(),
+		packetId:    this.packetId,
+		returnCodes: cloneBytes(this.returnCodes),
+	}
+}
+
+// Equal returns true if the other message is a SUBACK message with the same packet
+// ID and return codes.
+func (this *SubackMessage) Equal(other Message) bool {
+	m, ok := other.(*SubackMessage)
+
+	return ok && this.fixedHeader.Equal(m) &&
+		this.packetId == m.packetId &&
+		bytes.Equal(this.returnCodes, m.returnCodes)
+}
+
+// Clone returns a deep copy of the message.
+func (this *UnsubscribeMessage) Clone() *UnsubscribeMessage {
+	return &UnsubscribeMessage{
+		fixedHeader: this.fixedHeader.clone(),
+		packetId:    this.packetId,
+		topics:      cloneBytesList(this.topics),
+	}
+}
+
+// Equal returns true if the other message is an UNSUBSCRIBE message with the same
+// packet ID, and the same topics in the same order.
+func (this *UnsubscribeMessage) Equal(other Message) bool {
+	m, ok := other.(*UnsubscribeMessage)
+
+	return ok && this.fixedHeader.Equal(m) &&
+		this.packetId == m.packetId &&
+		equalBytesList(this.topics, m.topics)
+}
+
+// Clone returns a deep copy of the message.
+func (this *PingreqMessage) Clone() *PingreqMessage {
+	return &PingreqMessage{this.fixedHeader.clone()}
+}
+
+// Clone returns a deep copy of the message.
+func (this *PingrespMessage) Clone() *PingrespMessage {
+	return &PingrespMessage{this.fixedHeader.clone()}
+}
+
+// Clone returns a deep copy of the message.
+func (this *DisconnectMessage) Clone() *DisconnectMessage {
+	return &DisconnectMessage{this.fixedHeader.clone()}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestPublishMessageClone(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 2,
+		23,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		's', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e',
+	}
+
+	msg := NewPublishMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	clone := msg.Clone()
+	assert.True(t, true, msg.Equal(clone), "Clone is not equal to original.")
+	assert.True(t, true, clone.Equal(msg), "Original is not equal to clone.")
+
+	// Re-encoding the original overwrites the buffer the decoded topic and payload
+	// point into, but must not affect the clone.
+	msg.SetTopic([]byte("another"))
+	msg.SetPayload([]byte("different bytes!"))
+	_, _, err = msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	assert.Equal(t, true, "surgemq", string(clone.Topic()), "Clone topic changed.")
+	assert.Equal(t, true, "send me home", string(clone.Payload()), "Clone payload changed.")
+	assert.False(t, true, msg.Equal(clone), "Modified message should not be equal.")
+
+	dst, _, err := clone.Encode()
+	assert.NoError(t, true, err, "Error encoding clone.")
+	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Incorrect clone encoding.")
+}
+
+func TestPublishMessageCloneStream(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("firmware"))
+	assert.NoError(t, true, msg.SetPayloadStream(bytes.NewReader([]byte("image")), 5), "Error setting payload stream.")
+
+	clone := msg.Clone()
+	r, size := clone.PayloadStream()
+	assert.True(t, true, r == nil, "Expecting clone to drop the payload stream.")
+	assert.Equal(t, true, 0, size, "Incorrect clone payload size.")
+	assert.False(t, true, msg.Equal(clone), "Clone without the stream should not be equal.")
+
+	_, _, err := clone.Encode()
+	assert.Error(t, true, err, "Expecting error encoding clone without a payload.")
+
+	other := NewPublishMessage()
+	other.SetTopic([]byte("firmware"))
+	assert.NoError(t, true, other.SetPayloadStream(bytes.NewReader([]byte("image")), 5), "Error setting payload stream.")
+	assert.False(t, true, msg.Equal(other), "Messages with different streams should not be equal.")
+
+	other.SetPayload(nil)
+	assert.False(t, true, msg.Equal(other), "Message with a stream should not equal one without.")
+}
+
+func TestMessageCloneEqual(t *testing.T) {
+	for _, b := range jsonTestPackets {
+		msg, err := MessageType(b[0] >> 4).New()
+		assert.NoError(t, true, err, "Error creating message.")
+
+		_, err = msg.Decode(bytes.NewBuffer(b))
+		assert.NoError(t, true, err, "Error decoding message.")
+
+		clone := CloneMessage(msg)
+		assert.True(t, true, clone != nil, "Error cloning message.")
+		assert.Equal(t, true, msg.Type(), clone.Type(), "Incorrect clone type.")
+
+		eq := msg.(interface {
+			Equal(Message) bool
+		})
+		assert.True(t, true, eq.Equal(clone), "Clone is not equal to original.", msg.Name())
+
+		dst, _, err := clone.Encode()
+		assert.NoError(t, true, err, "Error encoding clone.")
+		assert.Equal(t, true, b, dst.(*bytes.Buffer).Bytes(), "Incorrect clone encoding.")
+	}
+}
+
+func TestMessageEqual(t *testing.T) {
+	puback := NewPubackMessage()
+	puback.SetPacketId(7)
+
+	pubrec := NewPubrecMessage()
+	pubrec.SetPacketId(7)
+
+	assert.False(t, true, puback.Equal(pubrec), "Different types should not be equal.")
+	assert.True(t, true, pubrec.Equal(pubrec.Clone()), "Clone is not equal to original.")
+
+	pubrec2 := pubrec.Clone()
+	pubrec2.SetPacketId(8)
+	assert.False(t, true, pubrec.Equal(pubrec2), "Different packet IDs should not be equal.")
+
+	sub := NewSubscribeMessage()
+	sub.AddTopic([]byte("a"), 1)
+	sub.AddTopic([]byte("b"), 2)
+
+	sub2 := sub.Clone()
+	assert.True(t, true, sub.Equal(sub2), "Clone is not equal to original.")
+
+	sub2.AddTopic([]byte("b"), 1)
+	assert.False(t, true, sub.Equal(sub2), "Different QoS should not be equal.")
+	assert.Equal(t, true, 2, sub.TopicQos([]byte("b")), "Original QoS changed.")
+
+	connect := NewConnectMessage()
+	connect.SetVersion(0x3)
+	connect.protoName = []byte("MQIsdp")
+
+	connect2 := connect.Clone()
+	assert.True(t, true, connect.Equal(connect2), "Clone is not equal to original.")
+
+	connect2.protoName = []byte("MQIpdp")
+	assert.False(t, true, connect.Equal(connect2), "Different protocol names should not be equal.")
+
+	// A built CONNECT has no protocol name until it's decoded.
+	connect = NewConnectMessage()
+	connect.SetVersion(0x4)
+	connect.SetClientId([]byte("surgemq"))
+
+	dst, _, err := connect.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	connect2 = NewConnectMessage()
+	_, err = connect2.Decode(dst)
+	assert.NoError(t, true, err, "Error decoding message.")
+	assert.True(t, true, connect.Equal(connect2), "Decoded message is not equal to original.")
+	assert.True(t, true, connect2.Equal(connect), "Original is not equal to decoded message.")
+
+	assert.True(t, true, NewPingreqMessage().Equal(NewPingreqMessage()), "PINGREQ messages should be equal.")
+	assert.False(t, true, NewPingreqMessage().Equal(NewPingrespMessage()), "Different types should not be equal.")
+}
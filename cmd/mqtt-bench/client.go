@@ -0,0 +1,142 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/surge/mqtt"
+)
+
+// conn is a connection to the server. Messages are read by a single goroutine, and
+// written by any.
+type conn struct {
+	net.Conn
+
+	br  *bufio.Reader
+	wmu sync.Mutex
+}
+
+// connect dials the server, and sends a CONNECT with a clean session and no keep
+// alive. It waits for the CONNACK before returning.
+func connect(addr string, version byte, clientId string) (*conn, error) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	this := newConn(nc)
+
+	msg := mqtt.NewConnectMessage()
+	msg.SetCleanSession(true)
+
+	if err := msg.SetVersion(version); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if err := msg.SetClientId([]byte(clientId)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if err := this.write(msg); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	ack, err := this.read()
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	connack, ok := ack.(*mqtt.ConnackMessage)
+	if !ok {
+		nc.Close()
+		return nil, fmt.Errorf("Expecting CONNACK, got %s", ack.Name())
+	}
+
+	if connack.ReturnCode() != mqtt.ConnectionAccepted {
+		nc.Close()
+		return nil, connack.ReturnCode().Error()
+	}
+
+	return this, nil
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{Conn: nc, br: bufio.NewReader(nc)}
+}
+
+// read reads the next message from the server.
+func (this *conn) read() (mqtt.Message, error) {
+	b, err := this.br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mqtt.MessageType(b[0] >> 4).New()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = msg.Decode(this.br); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// write sends a message to the server.
+func (this *conn) write(msg mqtt.Message) error {
+	r, _, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	_, err = io.Copy(this.Conn, r)
+	return err
+}
+
+// disconnect sends a DISCONNECT message and closes the connection.
+func (this *conn) disconnect() {
+	this.write(mqtt.NewDisconnectMessage())
+	this.Close()
+}
+
+// ack sends the acknowledgement for a PUBLISH received from the server.
+func (this *conn) ack(msg *mqtt.PublishMessage) error {
+	switch msg.QoS() {
+	case mqtt.QosAtLeastOnce:
+		ack := mqtt.NewPubackMessage()
+		ack.SetPacketId(msg.PacketId())
+		return this.write(ack)
+
+	case mqtt.QosExactlyOnce:
+		ack := mqtt.NewPubrecMessage()
+		ack.SetPacketId(msg.PacketId())
+		return this.write(ack)
+	}
+
+	return nil
+}
@@ -0,0 +1,453 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mqtt-bench measures the throughput and latency of an MQTT server.
+//
+// Usage:
+//
+//	mqtt-bench [flags]
+//
+// It opens -pubs publisher connections and -subs subscriber connections. Each
+// subscriber subscribes to -filter, and the publishers share a total rate of -rate
+// messages per second for -duration. Every payload starts with the time it was sent,
+// so subscribers can measure the end-to-end latency, which means publishers and
+// subscribers must run on the same host, or on hosts with synchronized clocks.
+//
+// The -topic flag is a pattern, where {client} is replaced by the index of the
+// publisher, and {seq} by the sequence number of the message.
+//
+// At the end, it reports the publish and receive throughput, the p50, p99 and p999
+// end-to-end latency, and for QoS 1 and 2 the round-trip time until the PUBACK or
+// PUBCOMP is received.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surge/mqtt"
+)
+
+type config struct {
+	addr     string
+	version  byte
+	pubs     int
+	subs     int
+	rate     float64
+	duration time.Duration
+	qos      byte
+	topic    string
+	filter   string
+	size     int
+	inflight int
+	wait     time.Duration
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mqtt-bench: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	cfg, err := parseFlags(args)
+	if err != nil {
+		return err
+	}
+
+	b := &bench{cfg: cfg, id: "bench" + strconv.Itoa(os.Getpid())}
+
+	return b.run(stdout)
+}
+
+func parseFlags(args []string) (*config, error) {
+	fs := flag.NewFlagSet("mqtt-bench", flag.ContinueOnError)
+
+	host := fs.String("host", "localhost", "server host name")
+	port := fs.Int("port", 1883, "server port")
+	version := fs.Uint("V", 4, "protocol version, 3 for MQTT 3.1 or 4 for 3.1.1")
+	pubs := fs.Int("pubs", 1, "number of publisher connections")
+	subs := fs.Int("subs", 1, "number of subscriber connections")
+	rate := fs.Float64("rate", 1000, "total messages per second, 0 for as fast as possible")
+	duration := fs.Duration("duration", 10*time.Second, "how long to publish for")
+	qos := fs.Uint("qos", 0, "QoS of the messages and subscriptions")
+	topic := fs.String("topic", "bench/{client}", "topic pattern; {client} and {seq} are replaced")
+	filter := fs.String("filter", "bench/#", "topic filter the subscribers subscribe to")
+	size := fs.Int("size", 64, "payload size in bytes, at least 8")
+	inflight := fs.Int("inflight", 100, "maximum unacknowledged messages per publisher for QoS 1 and 2")
+	wait := fs.Duration("wait", 5*time.Second, "how long to wait for acknowledgements and messages after publishing")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := &config{
+		addr:     net.JoinHostPort(*host, strconv.Itoa(*port)),
+		version:  byte(*version),
+		pubs:     *pubs,
+		subs:     *subs,
+		rate:     *rate,
+		duration: *duration,
+		qos:      byte(*qos),
+		topic:    *topic,
+		filter:   *filter,
+		size:     *size,
+		inflight: *inflight,
+		wait:     *wait,
+	}
+
+	switch {
+	case !mqtt.ValidVersion(cfg.version):
+		return nil, fmt.Errorf("Invalid protocol version %d", *version)
+	case cfg.pubs < 1:
+		return nil, fmt.Errorf("Expecting at least 1 publisher")
+	case cfg.subs < 0:
+		return nil, fmt.Errorf("Invalid number of subscribers %d", cfg.subs)
+	case cfg.rate < 0:
+		return nil, fmt.Errorf("Invalid rate %v", cfg.rate)
+	case *qos > uint(mqtt.QosExactlyOnce):
+		return nil, fmt.Errorf("Invalid QoS %d", *qos)
+	case cfg.size < timestampLength:
+		return nil, fmt.Errorf("Payload size must be at least %d bytes", timestampLength)
+	case cfg.inflight < 1 || cfg.inflight > 0xffff:
+		return nil, fmt.Errorf("In-flight window must be between 1 and %d", 0xffff)
+	}
+
+	return cfg, nil
+}
+
+// expandTopic returns the topic for the message.
+func expandTopic(pattern string, client, seq int) string {
+	if strings.IndexByte(pattern, '{') == -1 {
+		return pattern
+	}
+
+	return strings.NewReplacer("{client}", strconv.Itoa(client), "{seq}", strconv.Itoa(seq)).Replace(pattern)
+}
+
+type bench struct {
+	cfg *config
+	id  string
+
+	sent     int64
+	acked    int64
+	received int64
+	last     int64
+
+	latency samples
+	rtt     samples
+}
+
+func (this *bench) run(w io.Writer) error {
+	var subs, pubs []*conn
+
+	defer func() {
+		for _, c := range append(subs, pubs...) {
+			c.Close()
+		}
+	}()
+
+	for i := 0; i < this.cfg.subs; i++ {
+		c, err := this.subscribe(i)
+		if err != nil {
+			return fmt.Errorf("Subscriber %d: %v", i, err)
+		}
+
+		subs = append(subs, c)
+	}
+
+	for i := 0; i < this.cfg.pubs; i++ {
+		c, err := connect(this.cfg.addr, this.cfg.version, this.id+"p"+strconv.Itoa(i))
+		if err != nil {
+			return fmt.Errorf("Publisher %d: %v", i, err)
+		}
+
+		pubs = append(pubs, c)
+	}
+
+	for _, c := range subs {
+		go this.receive(c)
+	}
+
+	stop := make(chan struct{})
+	start := time.Now()
+
+	var wg sync.WaitGroup
+
+	for i, c := range pubs {
+		wg.Add(1)
+		go func(i int, c *conn) {
+			defer wg.Done()
+			this.publish(i, c, stop)
+		}(i, c)
+	}
+
+	time.Sleep(this.cfg.duration)
+	close(stop)
+	elapsed := time.Since(start)
+
+	wg.Wait()
+
+	// Wait for the subscribers to receive everything that was sent, assuming the
+	// filter matches all the topics.
+	expected := atomic.LoadInt64(&this.sent) * int64(this.cfg.subs)
+	deadline := time.Now().Add(this.cfg.wait)
+
+	for atomic.LoadInt64(&this.received) < expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, c := range append(subs, pubs...) {
+		c.disconnect()
+	}
+
+	this.report(w, start, elapsed, expected)
+
+	return nil
+}
+
+// subscribe connects a subscriber and waits for its SUBACK.
+func (this *bench) subscribe(i int) (*conn, error) {
+	c, err := connect(this.cfg.addr, this.cfg.version, this.id+"s"+strconv.Itoa(i))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := mqtt.NewSubscribeMessage()
+	msg.SetPacketId(1)
+
+	if err := msg.AddTopic([]byte(this.cfg.filter), this.cfg.qos); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if err := c.write(msg); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	for {
+		ack, err := c.read()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		if suback, ok := ack.(*mqtt.SubackMessage); ok {
+			if codes := suback.ReturnCodes(); len(codes) == 0 || codes[0] == mqtt.QosFailure {
+				c.Close()
+				return nil, fmt.Errorf("Subscription to %s rejected", this.cfg.filter)
+			}
+
+			return c, nil
+		}
+	}
+}
+
+// receive reads messages on a subscriber connection until it's closed.
+func (this *bench) receive(c *conn) {
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return
+		}
+
+		switch m := msg.(type) {
+		case *mqtt.PublishMessage:
+			now := time.Now()
+
+			if t, ok := payloadTime(m.Payload()); ok {
+				this.latency.add(now.Sub(t))
+			}
+
+			atomic.AddInt64(&this.received, 1)
+			atomic.StoreInt64(&this.last, now.UnixNano())
+
+			if c.ack(m) != nil {
+				return
+			}
+
+		case *mqtt.PubrelMessage:
+			ack := mqtt.NewPubcompMessage()
+			ack.SetPacketId(m.PacketId())
+
+			if c.write(ack) != nil {
+				return
+			}
+		}
+	}
+}
+
+// publish sends messages at the publisher's share of the rate until stop is closed.
+// For QoS 1 and 2, it then waits for the messages in flight to be acknowledged.
+func (this *bench) publish(i int, c *conn, stop chan struct{}) {
+	var (
+		mu       sync.Mutex
+		inflight = make(map[uint16]time.Time)
+		window   = make(chan struct{}, this.cfg.inflight)
+		packetId uint16
+	)
+
+	acked := func(id uint16) {
+		mu.Lock()
+		sent, ok := inflight[id]
+		delete(inflight, id)
+		mu.Unlock()
+
+		if ok {
+			this.rtt.add(time.Since(sent))
+			atomic.AddInt64(&this.acked, 1)
+			<-window
+		}
+	}
+
+	if this.cfg.qos > mqtt.QosAtMostOnce {
+		go func() {
+			for {
+				msg, err := c.read()
+				if err != nil {
+					return
+				}
+
+				switch m := msg.(type) {
+				case *mqtt.PubackMessage:
+					acked(m.PacketId())
+
+				case *mqtt.PubrecMessage:
+					rel := mqtt.NewPubrelMessage()
+					rel.SetPacketId(m.PacketId())
+					c.write(rel)
+
+				case *mqtt.PubcompMessage:
+					acked(m.PacketId())
+				}
+			}
+		}()
+	}
+
+	var interval time.Duration
+	if this.cfg.rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(this.cfg.pubs) / this.cfg.rate)
+	}
+
+	defer this.drain(window)
+
+	next := time.Now()
+
+	for seq := 0; ; seq++ {
+		if interval > 0 {
+			if d := time.Until(next); d > 0 {
+				select {
+				case <-stop:
+					return
+				case <-time.After(d):
+				}
+			}
+
+			next = next.Add(interval)
+		}
+
+		if this.cfg.qos > mqtt.QosAtMostOnce {
+			select {
+			case <-stop:
+				return
+			case window <- struct{}{}:
+			}
+		} else {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+
+		msg := mqtt.NewPublishMessage()
+		msg.SetTopic([]byte(expandTopic(this.cfg.topic, i, seq)))
+		msg.SetQoS(this.cfg.qos)
+
+		payload := make([]byte, this.cfg.size)
+		now := time.Now()
+		stampPayload(payload, now)
+		msg.SetPayload(payload)
+
+		if this.cfg.qos > mqtt.QosAtMostOnce {
+			packetId++
+			if packetId == 0 {
+				packetId++
+			}
+			msg.SetPacketId(packetId)
+
+			mu.Lock()
+			inflight[packetId] = now
+			mu.Unlock()
+		}
+
+		if c.write(msg) != nil {
+			return
+		}
+
+		atomic.AddInt64(&this.sent, 1)
+	}
+}
+
+// drain waits until the in-flight window is empty, or the wait time is up.
+func (this *bench) drain(window chan struct{}) {
+	deadline := time.Now().Add(this.cfg.wait)
+
+	for len(window) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (this *bench) report(w io.Writer, start time.Time, elapsed time.Duration, expected int64) {
+	sent := atomic.LoadInt64(&this.sent)
+	received := atomic.LoadInt64(&this.received)
+
+	fmt.Fprintf(w, "%-12s %d publishers, %d subscribers, QoS %d, %d byte payloads\n", "Setup:", this.cfg.pubs, this.cfg.subs, this.cfg.qos, this.cfg.size)
+	fmt.Fprintf(w, "%-12s %d messages in %v (%.1f msg/s)\n", "Published:", sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds())
+
+	if received > 0 {
+		d := time.Unix(0, atomic.LoadInt64(&this.last)).Sub(start)
+		fmt.Fprintf(w, "%-12s %d of %d messages in %v (%.1f msg/s)\n", "Received:", received, expected, d.Round(time.Millisecond), float64(received)/d.Seconds())
+	} else {
+		fmt.Fprintf(w, "%-12s 0 of %d messages\n", "Received:", expected)
+	}
+
+	this.latency.write(w, "Latency")
+
+	switch this.cfg.qos {
+	case mqtt.QosAtLeastOnce:
+		fmt.Fprintf(w, "%-12s %d of %d messages\n", "Acked:", atomic.LoadInt64(&this.acked), sent)
+		this.rtt.write(w, "PUBACK RTT")
+
+	case mqtt.QosExactlyOnce:
+		fmt.Fprintf(w, "%-12s %d of %d messages\n", "Acked:", atomic.LoadInt64(&this.acked), sent)
+		this.rtt.write(w, "PUBCOMP RTT")
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+	"github.com/surge/mqtt"
+)
+
+// testBroker accepts connections, acknowledges PUBLISH messages at their QoS, and
+// forwards them at QoS 0 to every connection with a matching subscription.
+type testBroker struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	subs map[*conn][]byte
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, true, err, "Error listening.")
+
+	this := &testBroker{ln: ln, subs: make(map[*conn][]byte)}
+
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go this.serve(newConn(nc))
+		}
+	}()
+
+	return this
+}
+
+func (this *testBroker) serve(c *conn) {
+	defer func() {
+		this.mu.Lock()
+		delete(this.subs, c)
+		this.mu.Unlock()
+		c.Close()
+	}()
+
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return
+		}
+
+		switch m := msg.(type) {
+		case *mqtt.ConnectMessage:
+			c.write(mqtt.NewConnackMessage())
+
+		case *mqtt.SubscribeMessage:
+			this.mu.Lock()
+			this.subs[c] = m.Topics()[0]
+			this.mu.Unlock()
+
+			ack := mqtt.NewSubackMessage()
+			ack.SetPacketId(m.PacketId())
+			ack.AddReturnCodes(m.Qos())
+			c.write(ack)
+
+		case *mqtt.PublishMessage:
+			c.ack(m)
+			this.forward(m)
+
+		case *mqtt.PubrelMessage:
+			ack := mqtt.NewPubcompMessage()
+			ack.SetPacketId(m.PacketId())
+			c.write(ack)
+
+		case *mqtt.DisconnectMessage:
+			return
+		}
+	}
+}
+
+func (this *testBroker) forward(m *mqtt.PublishMessage) {
+	pub := mqtt.NewPublishMessage()
+	pub.SetTopic(append([]byte{}, m.Topic()...))
+	pub.SetPayload(append([]byte{}, m.Payload()...))
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for c, filter := range this.subs {
+		if mqtt.MatchTopic(filter, m.Topic()) {
+			c.write(pub)
+		}
+	}
+}
+
+func (this *testBroker) config(qos byte) *config {
+	return &config{
+		addr:     this.ln.Addr().String(),
+		version:  0x4,
+		pubs:     2,
+		subs:     2,
+		rate:     200,
+		duration: 200 * time.Millisecond,
+		qos:      qos,
+		topic:    "bench/{client}",
+		filter:   "bench/#",
+		size:     32,
+		inflight: 10,
+		wait:     2 * time.Second,
+	}
+}
+
+func TestBench(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.ln.Close()
+
+	for _, qos := range []byte{mqtt.QosAtMostOnce, mqtt.QosAtLeastOnce, mqtt.QosExactlyOnce} {
+		b := &bench{cfg: broker.config(qos), id: "test" + strconv.Itoa(int(qos))}
+
+		var out bytes.Buffer
+		assert.NoError(t, true, b.run(&out), "Error running benchmark.")
+
+		sent := atomic.LoadInt64(&b.sent)
+		assert.True(t, true, sent > 0, "Expecting messages to be published.")
+		assert.Equal(t, true, sent*2, atomic.LoadInt64(&b.received), "Expecting every message to reach both subscribers.", out.String())
+		assert.Equal(t, true, int(sent*2), b.latency.len(), "Expecting a latency sample per message.")
+
+		if qos > mqtt.QosAtMostOnce {
+			assert.Equal(t, true, sent, atomic.LoadInt64(&b.acked), "Expecting every message to be acknowledged.", out.String())
+			assert.Equal(t, true, int(sent), b.rtt.len(), "Expecting an RTT sample per message.")
+		}
+
+		assert.True(t, true, regexp.MustCompile(`Latency: +p50=`).Match(out.Bytes()), "Expecting latency report.", out.String())
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	cfg, err := parseFlags([]string{"-host", "127.0.0.1", "-port", "1884", "-pubs", "4", "-qos", "2"})
+	assert.NoError(t, true, err, "Error parsing flags.")
+	assert.Equal(t, true, "127.0.0.1:1884", cfg.addr, "Incorrect address.")
+	assert.Equal(t, true, 4, cfg.pubs, "Incorrect number of publishers.")
+	assert.Equal(t, true, mqtt.QosExactlyOnce, cfg.qos, "Incorrect QoS.")
+
+	_, err = parseFlags([]string{"-size", "4"})
+	assert.Error(t, true, err, "Expecting error for short payload.")
+
+	_, err = parseFlags([]string{"-qos", "3"})
+	assert.Error(t, true, err, "Expecting error for invalid QoS.")
+}
+
+func TestExpandTopic(t *testing.T) {
+	assert.Equal(t, true, "bench/3/17", expandTopic("bench/{client}/{seq}", 3, 17), "Incorrect topic.")
+	assert.Equal(t, true, "bench", expandTopic("bench", 3, 17), "Incorrect topic.")
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// timestampLength is the length of the send time at the start of every payload.
+const timestampLength = 8
+
+// stampPayload writes the time at the start of the payload.
+func stampPayload(payload []byte, t time.Time) {
+	binary.BigEndian.PutUint64(payload, uint64(t.UnixNano()))
+}
+
+// payloadTime returns the time written by stampPayload.
+func payloadTime(payload []byte) (time.Time, bool) {
+	if len(payload) < timestampLength {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(payload))), true
+}
+
+// subBuckets is the number of buckets each power of two range of durations is split
+// into, so percentiles are within 1/128 of the true value.
+const (
+	subBucketBits = 7
+	subBuckets    = 1 << subBucketBits
+)
+
+// numBuckets covers every duration up to the largest int64, in nanoseconds.
+const numBuckets = (64-subBucketBits-1)*subBuckets + 2*subBuckets
+
+// samples is a histogram of durations that percentiles are computed from. Durations
+// are counted in log-linear buckets, so memory use is fixed however many samples
+// are added. It's safe for concurrent use.
+type samples struct {
+	mu     sync.Mutex
+	counts [numBuckets]uint64
+	n      int
+	max    time.Duration
+}
+
+// bucket returns the index of the bucket for the duration. Durations below
+// 2*subBuckets nanoseconds have a bucket each; above that, each power of two range
+// has subBuckets buckets.
+func bucket(d time.Duration) int {
+	if d < 0 {
+		d = 0
+	}
+
+	v := uint64(d)
+
+	shift := bits.Len64(v) - subBucketBits - 1
+	if shift < 0 {
+		shift = 0
+	}
+
+	return shift*subBuckets + int(v>>uint(shift))
+}
+
+// bucketMax returns the largest duration in the bucket.
+func bucketMax(i int) time.Duration {
+	if i < 2*subBuckets {
+		return time.Duration(i)
+	}
+
+	shift := i/subBuckets - 1
+	m := uint64(i - shift*subBuckets)
+
+	return time.Duration((m+1)<<uint(shift) - 1)
+}
+
+func (this *samples) add(d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.counts[bucket(d)]++
+	this.n++
+
+	if d > this.max {
+		this.max = d
+	}
+}
+
+func (this *samples) len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.n
+}
+
+// percentiles returns the durations at each percentile p, from 0 to 100, using the
+// nearest rank method. Each duration is the top of the bucket holding that rank, but
+// no more than the largest duration added.
+func (this *samples) percentiles(p ...float64) []time.Duration {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	r := make([]time.Duration, len(p))
+	if this.n == 0 {
+		return r
+	}
+
+	for i, v := range p {
+		rank := uint64(v/100*float64(this.n) + 0.999999999)
+		if rank < 1 {
+			rank = 1
+		}
+
+		var seen uint64
+		for b, c := range this.counts {
+			seen += c
+			if seen >= rank {
+				r[i] = min(bucketMax(b), this.max)
+				break
+			}
+		}
+
+		if seen < rank {
+			r[i] = this.max
+		}
+	}
+
+	return r
+}
+
+// write writes a line with the p50, p99, p999 and maximum durations.
+func (this *samples) write(w io.Writer, name string) {
+	if this.len() == 0 {
+		fmt.Fprintf(w, "%-12s no samples\n", name+":")
+		return
+	}
+
+	p := this.percentiles(50, 99, 99.9, 100)
+
+	fmt.Fprintf(w, "%-12s p50=%v p99=%v p999=%v max=%v (%d samples)\n", name+":", p[0], p[1], p[2], p[3], this.len())
+}
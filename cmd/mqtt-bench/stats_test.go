@@ -0,0 +1,83 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func TestPercentiles(t *testing.T) {
+	var s samples
+
+	for i := 1000; i >= 1; i-- {
+		s.add(time.Duration(i) * time.Millisecond)
+	}
+
+	p := s.percentiles(50, 99, 99.9, 100)
+	assertNear(t, 500*time.Millisecond, p[0], "Incorrect p50.")
+	assertNear(t, 990*time.Millisecond, p[1], "Incorrect p99.")
+	assertNear(t, 999*time.Millisecond, p[2], "Incorrect p999.")
+	assert.Equal(t, true, 1000*time.Millisecond, p[3], "Incorrect maximum.")
+	assert.Equal(t, true, 1000, s.len(), "Incorrect number of samples.")
+
+	var one samples
+	one.add(time.Second)
+	assert.Equal(t, true, time.Second, one.percentiles(50)[0], "Incorrect p50 of one sample.")
+
+	var none samples
+	assert.Equal(t, true, time.Duration(0), none.percentiles(50)[0], "Expecting 0 with no samples.")
+}
+
+// assertNear checks that the duration is within the bucket resolution of expected.
+func assertNear(t *testing.T, expected, actual time.Duration, msg string) {
+	diff := actual - expected
+	if diff < 0 {
+		diff = -diff
+	}
+
+	assert.True(t, true, diff <= expected/subBuckets, msg, expected, actual)
+}
+
+func TestBuckets(t *testing.T) {
+	last := -1
+
+	for _, d := range []time.Duration{0, 1, 255, 256, 257, 511, 512, time.Microsecond, time.Second, time.Hour, 1<<63 - 1} {
+		b := bucket(d)
+		assert.True(t, true, b >= last, "Buckets are decreasing:", d)
+		assert.True(t, true, b < numBuckets, "Bucket out of range:", d)
+		assert.True(t, true, bucketMax(b) >= d, "Duration above its bucket:", d)
+		assert.True(t, true, b == 0 || bucketMax(b-1) < d, "Duration below its bucket:", d)
+		last = b
+	}
+
+	assert.Equal(t, true, 0, bucket(-time.Second), "Negative durations go in the first bucket.")
+}
+
+func TestPayloadTime(t *testing.T) {
+	now := time.Unix(1400000000, 123456789)
+
+	payload := make([]byte, 16)
+	stampPayload(payload, now)
+
+	ts, ok := payloadTime(payload)
+	assert.True(t, true, ok, "Expecting timestamp.")
+	assert.True(t, true, now.Equal(ts), "Incorrect timestamp.")
+
+	_, ok = payloadTime(payload[:4])
+	assert.False(t, true, ok, "Expecting no timestamp in short payload.")
+}
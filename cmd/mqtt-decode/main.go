@@ -0,0 +1,228 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mqtt-decode decodes a stream of MQTT packets and prints each one.
+//
+// Usage:
+//
+//	mqtt-decode [-in hex|base64|raw] [-fields] [-strict|-lenient] [file]
+//
+// The packets are read from the file, or stdin if no file is given. They must be
+// concatenated with nothing in between, as they are on the wire. Hex input is plain
+// hex digits, optionally with 0x prefixes, and separated by whitespace, commas or
+// colons. Base64 input may be split across lines.
+//
+// By default each packet is printed with its String method. With -fields, the
+// packet is broken down into the fields of the MQTT spec, with the offset and raw
+// bytes of each field.
+//
+// If a packet can't be decoded, the error is printed along with the exact byte
+// offset in the stream where decoding failed, and the packet is dissected field by
+// field. Decoding carries on with the next packet if its length is known. The exit
+// status is 1 if any packet failed to decode.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/surge/mqtt"
+)
+
+var errFailed = errors.New("One or more packets failed to decode")
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mqtt-decode: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("mqtt-decode", flag.ContinueOnError)
+
+	in := fs.String("in", "hex", "input format: hex, base64 or raw")
+	fields := fs.Bool("fields", false, "print a field by field breakdown of each packet")
+	strict := fs.Bool("strict", false, "decode with StrictDecodeOptions")
+	lenient := fs.Bool("lenient", false, "decode with LenientDecodeOptions")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	r := stdin
+
+	if fs.NArg() > 1 {
+		return fmt.Errorf("Expecting at most one file, got %d", fs.NArg())
+	}
+
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	b, err := parseInput(*in, data)
+	if err != nil {
+		return err
+	}
+
+	opts := &mqtt.DefaultDecodeOptions
+	if *strict {
+		opts = &mqtt.StrictDecodeOptions
+	}
+	if *lenient {
+		opts = &mqtt.LenientDecodeOptions
+	}
+
+	d := &decoder{w: stdout, fields: *fields, opts: opts}
+
+	if !d.decode(b) {
+		return errFailed
+	}
+
+	return nil
+}
+
+// parseInput converts the input to raw bytes.
+func parseInput(format string, data []byte) ([]byte, error) {
+	switch format {
+	case "raw":
+		return data, nil
+
+	case "hex":
+		s := strings.NewReplacer("0x", "", "0X", "", ",", "", ":", "").Replace(string(data))
+		s = strings.Join(strings.Fields(s), "")
+
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid hex input: %v", err)
+		}
+
+		return b, nil
+
+	case "base64":
+		s := strings.Join(strings.Fields(string(data)), "")
+
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+			if b, err := enc.DecodeString(s); err == nil {
+				return b, nil
+			}
+		}
+
+		return nil, fmt.Errorf("Invalid base64 input")
+	}
+
+	return nil, fmt.Errorf("Invalid input format %q", format)
+}
+
+type decoder struct {
+	w      io.Writer
+	fields bool
+	opts   *mqtt.DecodeOptions
+}
+
+// decode decodes and prints every packet in b. It returns false if any packet
+// failed to decode.
+func (this *decoder) decode(b []byte) bool {
+	ok := true
+
+	for off, i := 0, 1; off < len(b); i++ {
+		n, err := this.packet(b[off:], off, i)
+		if err != nil {
+			ok = false
+		}
+
+		if n == 0 {
+			break
+		}
+
+		off += n
+	}
+
+	return ok
+}
+
+// packet decodes and prints the packet at the start of b, which is at offset off in
+// the stream. It returns the length of the packet, or 0 if the length is not known
+// and decoding can't carry on.
+func (this *decoder) packet(b []byte, off, i int) (int, error) {
+	field := mqtt.Dissect(b)
+
+	msg, err := mqtt.MessageType(b[0] >> 4).New()
+	if err == nil {
+		msg.(interface {
+			SetDecodeOptions(*mqtt.DecodeOptions)
+		}).SetDecodeOptions(this.opts)
+
+		_, err = msg.Decode(bytes.NewBuffer(b))
+	}
+
+	if err != nil {
+		fmt.Fprintf(this.w, "Packet %d at byte %d: Error at byte %d: %v\n", i, off, off+errorOffset(err), err)
+		fmt.Fprint(this.w, field)
+		fmt.Fprintln(this.w)
+
+		// The root field only has an error if the packet is cut short by the end
+		// of the stream.
+		if field.Length == 0 || field.Err != nil {
+			return 0, err
+		}
+
+		return field.Length, err
+	}
+
+	fmt.Fprintf(this.w, "Packet %d at byte %d, %d bytes\n", i, off, field.Length)
+
+	if this.fields {
+		fmt.Fprint(this.w, field)
+	} else {
+		fmt.Fprint(this.w, msg)
+	}
+	fmt.Fprintln(this.w)
+
+	return field.Length, nil
+}
+
+// errorOffset returns the offset in the packet where decoding failed.
+func errorOffset(err error) int {
+	var e *mqtt.MalformedPacketError
+	if errors.As(err, &e) && e.Offset >= 0 {
+		return e.Offset
+	}
+
+	return 0
+}
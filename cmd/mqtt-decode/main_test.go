@@ -0,0 +1,89 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+// connack and pingreq are two well formed packets. badPublish has a topic length
+// that runs past the end of the packet.
+var (
+	connack    = []byte{0x20, 0x02, 0x00, 0x00}
+	pingreq    = []byte{0xc0, 0x00}
+	badPublish = []byte{0x30, 0x04, 0x00, 0x09, 'a', 'b'}
+)
+
+func TestParseInput(t *testing.T) {
+	b, err := parseInput("hex", []byte("0x20, 0x02,\n0x00 0x00\nc0:00\n"))
+	assert.NoError(t, true, err, "Error parsing hex input.")
+	assert.Equal(t, true, append(append([]byte{}, connack...), pingreq...), b, "Incorrect hex bytes.")
+
+	s := base64.StdEncoding.EncodeToString(connack)
+	b, err = parseInput("base64", []byte(s[:4]+"\n"+s[4:]+"\n"))
+	assert.NoError(t, true, err, "Error parsing base64 input.")
+	assert.Equal(t, true, connack, b, "Incorrect base64 bytes.")
+
+	b, err = parseInput("raw", pingreq)
+	assert.NoError(t, true, err, "Error parsing raw input.")
+	assert.Equal(t, true, pingreq, b, "Incorrect raw bytes.")
+
+	_, err = parseInput("hex", []byte("2g"))
+	assert.Error(t, true, err, "Expecting error for invalid hex.")
+
+	_, err = parseInput("octal", nil)
+	assert.Error(t, true, err, "Expecting error for invalid format.")
+}
+
+func TestRun(t *testing.T) {
+	var out bytes.Buffer
+
+	err := run([]string{"-in", "raw"}, bytes.NewReader(append(append([]byte{}, connack...), pingreq...)), &out)
+	assert.NoError(t, true, err, "Error decoding packets.")
+	assert.True(t, true, strings.Contains(out.String(), "Packet 1 at byte 0, 4 bytes\nPacket type: CONNACK"), "Expecting CONNACK.", out.String())
+	assert.True(t, true, strings.Contains(out.String(), "Packet 2 at byte 4, 2 bytes\nPacket type: PINGREQ"), "Expecting PINGREQ.", out.String())
+}
+
+func TestRunFields(t *testing.T) {
+	var out bytes.Buffer
+
+	err := run([]string{"-in", "raw", "-fields"}, bytes.NewReader(connack), &out)
+	assert.NoError(t, true, err, "Error decoding packets.")
+	assert.True(t, true, strings.Contains(out.String(), "Return Code"), "Expecting field breakdown.", out.String())
+}
+
+func TestRunError(t *testing.T) {
+	var out bytes.Buffer
+
+	// The bad PUBLISH has a known length, so decoding carries on with the PINGREQ.
+	in := append(append(append([]byte{}, connack...), badPublish...), pingreq...)
+
+	err := run([]string{"-in", "raw"}, bytes.NewReader(in), &out)
+	assert.Equal(t, true, errFailed, err, "Expecting decode failure.")
+	assert.True(t, true, strings.Contains(out.String(), "Packet 2 at byte 4: Error at byte 6:"), "Expecting error offset in stream.", out.String())
+	assert.True(t, true, strings.Contains(out.String(), "Packet 3 at byte 10, 2 bytes"), "Expecting PINGREQ after error.", out.String())
+
+	// A truncated packet ends decoding.
+	out.Reset()
+
+	err = run([]string{"-in", "raw"}, bytes.NewReader(append(append([]byte{}, pingreq...), 0x30, 0x0a, 0x00)), &out)
+	assert.Equal(t, true, errFailed, err, "Expecting decode failure.")
+	assert.True(t, true, strings.Contains(out.String(), "Packet 2 at byte 2: Error at byte"), "Expecting error for truncated packet.", out.String())
+}
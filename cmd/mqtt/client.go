@@ -0,0 +1,247 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/surge/mqtt"
+)
+
+// connectFlags are the flags shared by the pub and sub commands.
+type connectFlags struct {
+	host      string
+	port      int
+	clientId  string
+	username  string
+	password  string
+	keepAlive uint
+	clean     bool
+	version   uint
+	timeout   time.Duration
+
+	willTopic   string
+	willMessage string
+	willQos     uint
+	willRetain  bool
+}
+
+func (this *connectFlags) register(fs *flag.FlagSet, name string) {
+	fs.StringVar(&this.host, "host", "localhost", "server host name")
+	fs.IntVar(&this.port, "port", 1883, "server port")
+	fs.StringVar(&this.clientId, "id", name+strconv.Itoa(os.Getpid()), "client ID")
+	fs.StringVar(&this.username, "user", "", "user name")
+	fs.StringVar(&this.password, "pass", "", "password")
+	fs.UintVar(&this.keepAlive, "keepalive", 60, "keep alive in seconds, 0 to disable")
+	fs.BoolVar(&this.clean, "clean", true, "start a clean session")
+	fs.UintVar(&this.version, "V", 4, "protocol version, 3 for MQTT 3.1 or 4 for 3.1.1")
+	fs.DurationVar(&this.timeout, "timeout", 10*time.Second, "time to wait for the server to respond, 0 to wait forever")
+	fs.StringVar(&this.willTopic, "will-topic", "", "Will topic")
+	fs.StringVar(&this.willMessage, "will-message", "", "Will message")
+	fs.UintVar(&this.willQos, "will-qos", 0, "Will QoS")
+	fs.BoolVar(&this.willRetain, "will-retain", false, "retain the Will message")
+}
+
+// connectMessage returns the CONNECT message for the flags.
+func (this *connectFlags) connectMessage() (*mqtt.ConnectMessage, error) {
+	msg := mqtt.NewConnectMessage()
+
+	if err := msg.SetVersion(byte(this.version)); err != nil {
+		return nil, err
+	}
+
+	if err := msg.SetClientId([]byte(this.clientId)); err != nil {
+		return nil, fmt.Errorf("Invalid client ID %q: %v", this.clientId, err)
+	}
+
+	if this.keepAlive > 0xffff {
+		return nil, fmt.Errorf("Keep alive %d is greater than %d seconds", this.keepAlive, 0xffff)
+	}
+
+	msg.SetKeepAlive(uint16(this.keepAlive))
+	msg.SetCleanSession(this.clean)
+	msg.SetUsername([]byte(this.username))
+	msg.SetPassword([]byte(this.password))
+
+	if this.willTopic != "" {
+		msg.SetWillTopic([]byte(this.willTopic))
+		msg.SetWillMessage([]byte(this.willMessage))
+		msg.SetWillRetain(this.willRetain)
+
+		if err := msg.SetWillQos(byte(this.willQos)); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+// client is a connection to the server. Messages are read by a single goroutine,
+// and written by any.
+type client struct {
+	conn    *mqtt.BufferedConn
+	timeout time.Duration
+
+	wmu      sync.Mutex
+	packetId uint16
+
+	done chan struct{}
+	once sync.Once
+}
+
+// dial connects to the server, sends the CONNECT message and waits for the CONNACK,
+// giving up after the timeout in the flags, or when the context is done. If keep
+// alive is set, a PINGREQ is sent every keep alive period until the client is
+// closed.
+func dial(ctx context.Context, flags *connectFlags) (*client, error) {
+	connect, err := flags.connectMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx, flags.timeout)
+	defer cancel()
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(flags.host, strconv.Itoa(flags.port)))
+	if err != nil {
+		return nil, err
+	}
+
+	this := newClient(conn)
+	this.timeout = flags.timeout
+
+	if err := this.write(ctx, connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	msg, err := this.read(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	connack, ok := msg.(*mqtt.ConnackMessage)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("Expecting CONNACK, got %s", msg.Name())
+	}
+
+	if connack.ReturnCode() != mqtt.ConnectionAccepted {
+		conn.Close()
+		return nil, connack.ReturnCode().Error()
+	}
+
+	if connect.KeepAlive() > 0 {
+		go this.ping(time.Duration(connect.KeepAlive()) * time.Second)
+	}
+
+	return this, nil
+}
+
+func newClient(conn net.Conn) *client {
+	return &client{
+		conn: mqtt.NewBufferedConn(conn),
+		done: make(chan struct{}),
+	}
+}
+
+// withTimeout returns a context that's done after the timeout, or the parent
+// context if the timeout is 0.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, d)
+}
+
+// read reads the next message from the server.
+func (this *client) read(ctx context.Context) (mqtt.Message, error) {
+	msg, _, err := mqtt.ReadMessageContext(ctx, this.conn, nil)
+	return msg, err
+}
+
+// write sends a message to the server.
+func (this *client) write(ctx context.Context, msg mqtt.Message) error {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	_, err := mqtt.WriteContext(ctx, this.conn, msg)
+	return err
+}
+
+// nextPacketId returns the packet ID for the next message, skipping 0.
+func (this *client) nextPacketId() uint16 {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	this.packetId++
+	if this.packetId == 0 {
+		this.packetId++
+	}
+
+	return this.packetId
+}
+
+// ping sends a PINGREQ every period. A PINGREQ that can't be written within the
+// period stops the pings.
+func (this *client) ping(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), d)
+			err := this.write(ctx, mqtt.NewPingreqMessage())
+			cancel()
+
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// disconnect sends a DISCONNECT message, waiting no longer than the timeout, and
+// closes the connection.
+func (this *client) disconnect() error {
+	ctx, cancel := withTimeout(context.Background(), this.timeout)
+	defer cancel()
+
+	err := this.write(ctx, mqtt.NewDisconnectMessage())
+	this.close()
+	return err
+}
+
+func (this *client) close() {
+	this.once.Do(func() {
+		close(this.done)
+		this.conn.Close()
+	})
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command mqtt publishes and subscribes to topics on an MQTT server.
+//
+// Usage:
+//
+//	mqtt pub [flags] -t topic [message ...]
+//	mqtt sub [flags] -t filter [-t filter ...]
+//
+// The pub command publishes each message given on the command line. With -f, each
+// line of the file is published as a message, and with no messages or files, each
+// line read from stdin is.
+//
+// The sub command prints every message received, one per line, until it's
+// interrupted or -count messages have been received. With -format json, each line is
+// the JSON encoding of the PUBLISH message.
+//
+// Run "mqtt pub -help" or "mqtt sub -help" for the flags of each command.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: mqtt pub|sub [flags]\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+
+	switch os.Args[1] {
+	case "pub":
+		err = pub(os.Args[2:])
+	case "sub":
+		err = sub(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mqtt %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/surge/mqtt"
+)
+
+// maxLineLength is the longest line that's read as a single message.
+const maxLineLength = 268435455
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (this *stringList) String() string {
+	return strings.Join(*this, ",")
+}
+
+func (this *stringList) Set(v string) error {
+	*this = append(*this, v)
+	return nil
+}
+
+type publisher struct {
+	c      *client
+	topic  []byte
+	qos    byte
+	retain bool
+}
+
+func pub(args []string) error {
+	fs := flag.NewFlagSet("mqtt pub", flag.ContinueOnError)
+
+	var cf connectFlags
+	cf.register(fs, "mqttpub")
+
+	var files stringList
+
+	topic := fs.String("t", "", "topic to publish to")
+	qos := fs.Uint("q", 0, "QoS of the messages")
+	retain := fs.Bool("r", false, "retain the messages")
+	fs.Var(&files, "f", "publish each line of the file as a message, - for stdin; can be repeated")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !mqtt.ValidTopic([]byte(*topic)) {
+		return fmt.Errorf("Invalid topic %q", *topic)
+	}
+
+	if *qos > uint(mqtt.QosExactlyOnce) {
+		return fmt.Errorf("Invalid QoS %d", *qos)
+	}
+
+	if fs.NArg() == 0 && len(files) == 0 {
+		files = append(files, "-")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c, err := dial(ctx, &cf)
+	if err != nil {
+		return err
+	}
+	defer c.disconnect()
+
+	p := &publisher{
+		c:      c,
+		topic:  []byte(*topic),
+		qos:    byte(*qos),
+		retain: *retain,
+	}
+
+	for _, m := range fs.Args() {
+		if err := p.publish(ctx, []byte(m)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range files {
+		if err := p.publishFile(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishFile publishes each line of the file, or stdin if name is "-". Empty lines
+// are skipped.
+func (this *publisher) publishFile(ctx context.Context, name string) error {
+	var r io.Reader = os.Stdin
+
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	return readLines(r, func(payload []byte) error {
+		return this.publish(ctx, payload)
+	})
+}
+
+// readLines calls f with each non-empty line read from r, without the line ending.
+func readLines(r io.Reader, f func([]byte) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), maxLineLength)
+
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+
+		// The scanner reuses its buffer, and the message may hold on to the line.
+		if err := f(append([]byte{}, s.Bytes()...)); err != nil {
+			return err
+		}
+	}
+
+	return s.Err()
+}
+
+// publish sends a PUBLISH message, and waits for it to be acknowledged, giving up
+// after the client's timeout.
+func (this *publisher) publish(ctx context.Context, payload []byte) error {
+	ctx, cancel := withTimeout(ctx, this.c.timeout)
+	defer cancel()
+
+	msg := mqtt.NewPublishMessage()
+	msg.SetTopic(this.topic)
+	msg.SetQoS(this.qos)
+	msg.SetRetain(this.retain)
+	msg.SetPayload(payload)
+
+	if this.qos == mqtt.QosAtMostOnce {
+		return this.c.write(ctx, msg)
+	}
+
+	id := this.c.nextPacketId()
+	msg.SetPacketId(id)
+
+	if err := this.c.write(ctx, msg); err != nil {
+		return err
+	}
+
+	for {
+		ack, err := this.c.read(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch m := ack.(type) {
+		case *mqtt.PubackMessage:
+			if m.PacketId() == id {
+				return nil
+			}
+
+		case *mqtt.PubrecMessage:
+			if m.PacketId() == id {
+				rel := mqtt.NewPubrelMessage()
+				rel.SetPacketId(id)
+
+				if err := this.c.write(ctx, rel); err != nil {
+					return err
+				}
+			}
+
+		case *mqtt.PubcompMessage:
+			if m.PacketId() == id {
+				return nil
+			}
+
+		case *mqtt.PingrespMessage:
+
+		default:
+			return errors.New("Unexpected " + ack.Name() + " message")
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+	"github.com/surge/mqtt"
+)
+
+// testServer is the server end of a net.Pipe connected to a client.
+type testServer struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func newTestServer(t *testing.T) (*client, *testServer) {
+	conn, server := net.Pipe()
+	return newClient(conn), &testServer{t: t, conn: server, br: bufio.NewReader(server)}
+}
+
+func (this *testServer) read() mqtt.Message {
+	b, err := this.br.Peek(1)
+	assert.NoError(this.t, true, err, "Error reading message.")
+
+	msg, err := mqtt.MessageType(b[0] >> 4).New()
+	assert.NoError(this.t, true, err, "Error creating message.")
+
+	_, err = msg.Decode(this.br)
+	assert.NoError(this.t, true, err, "Error decoding message.")
+
+	return msg
+}
+
+func (this *testServer) write(msg mqtt.Message) {
+	r, _, err := msg.Encode()
+	assert.NoError(this.t, true, err, "Error encoding message.")
+
+	_, err = io.Copy(this.conn, r)
+	assert.NoError(this.t, true, err, "Error writing message.")
+}
+
+func TestReadLines(t *testing.T) {
+	var lines []string
+
+	err := readLines(strings.NewReader("one\n\ntwo\r\nthree"), func(b []byte) error {
+		lines = append(lines, string(b))
+		return nil
+	})
+
+	assert.NoError(t, true, err, "Error reading lines.")
+	assert.Equal(t, true, []string{"one", "two", "three"}, lines, "Incorrect lines.")
+}
+
+func TestPublishExactlyOnce(t *testing.T) {
+	c, server := newTestServer(t)
+	defer server.conn.Close()
+
+	p := &publisher{
+		c:      c,
+		topic:  []byte("sensors/temp"),
+		qos:    mqtt.QosExactlyOnce,
+		retain: true,
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- p.publish(context.Background(), []byte("21.5"))
+	}()
+
+	msg, ok := server.read().(*mqtt.PublishMessage)
+	assert.True(t, true, ok, "Expecting PUBLISH.")
+	assert.Equal(t, true, []byte("sensors/temp"), msg.Topic(), "Incorrect topic.")
+	assert.Equal(t, true, []byte("21.5"), msg.Payload(), "Incorrect payload.")
+	assert.Equal(t, true, mqtt.QosExactlyOnce, msg.QoS(), "Incorrect QoS.")
+	assert.True(t, true, msg.Retain(), "Expecting retain flag.")
+
+	rec := mqtt.NewPubrecMessage()
+	rec.SetPacketId(msg.PacketId())
+	server.write(rec)
+
+	rel, ok := server.read().(*mqtt.PubrelMessage)
+	assert.True(t, true, ok, "Expecting PUBREL.")
+	assert.Equal(t, true, msg.PacketId(), rel.PacketId(), "Incorrect packet ID.")
+
+	comp := mqtt.NewPubcompMessage()
+	comp.SetPacketId(msg.PacketId())
+	server.write(comp)
+
+	assert.NoError(t, true, <-done, "Error publishing message.")
+}
+
+func TestConnectFlags(t *testing.T) {
+	cf := connectFlags{
+		clientId:    "sensor1",
+		username:    "user",
+		password:    "secret",
+		keepAlive:   30,
+		version:     3,
+		willTopic:   "sensors/sensor1/status",
+		willMessage: "offline",
+		willQos:     1,
+	}
+
+	msg, err := cf.connectMessage()
+	assert.NoError(t, true, err, "Error creating CONNECT message.")
+	assert.Equal(t, true, byte(3), msg.Version(), "Incorrect version.")
+	assert.Equal(t, true, uint16(30), msg.KeepAlive(), "Incorrect keep alive.")
+	assert.True(t, true, msg.UsernameFlag(), "Expecting user name flag.")
+	assert.True(t, true, msg.PasswordFlag(), "Expecting password flag.")
+	assert.True(t, true, msg.WillFlag(), "Expecting Will flag.")
+	assert.Equal(t, true, byte(1), msg.WillQos(), "Incorrect Will QoS.")
+
+	cf.clientId = "not valid"
+	_, err = cf.connectMessage()
+	assert.Error(t, true, err, "Expecting error for invalid client ID.")
+}
+
+func TestPublishTimeout(t *testing.T) {
+	c, server := newTestServer(t)
+	defer server.conn.Close()
+
+	c.timeout = 50 * time.Millisecond
+
+	p := &publisher{
+		c:     c,
+		topic: []byte("sensors/temp"),
+		qos:   mqtt.QosAtLeastOnce,
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- p.publish(context.Background(), []byte("21.5"))
+	}()
+
+	// Read the PUBLISH but never acknowledge it.
+	server.read()
+
+	err := <-done
+	assert.True(t, true, errors.Is(err, mqtt.ErrTimeout), "Expecting timeout error.")
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/surge/mqtt"
+)
+
+func sub(args []string) error {
+	fs := flag.NewFlagSet("mqtt sub", flag.ContinueOnError)
+
+	var cf connectFlags
+	cf.register(fs, "mqttsub")
+
+	var filters stringList
+
+	fs.Var(&filters, "t", "topic filter to subscribe to; can be repeated")
+	qos := fs.Uint("q", 0, "maximum QoS of the subscriptions")
+	format := fs.String("format", "text", "output format, text or json")
+	count := fs.Int("count", 0, "exit after receiving this many messages, 0 to never exit")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if len(filters) == 0 {
+		return fmt.Errorf("No topic filters given")
+	}
+
+	if *qos > uint(mqtt.QosExactlyOnce) {
+		return fmt.Errorf("Invalid QoS %d", *qos)
+	}
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("Invalid format %q", *format)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c, err := dial(ctx, &cf)
+	if err != nil {
+		return err
+	}
+
+	msg := mqtt.NewSubscribeMessage()
+	msg.SetPacketId(c.nextPacketId())
+
+	for _, f := range filters {
+		if err := msg.AddTopic([]byte(f), byte(*qos)); err != nil {
+			c.close()
+			return err
+		}
+	}
+
+	if err := c.write(ctx, msg); err != nil {
+		c.close()
+		return err
+	}
+
+	err = receive(ctx, c, msg, os.Stdout, *format, *count)
+
+	// If interrupted, the read error is expected.
+	if err == nil || ctx.Err() != nil {
+		return c.disconnect()
+	}
+
+	c.close()
+	return err
+}
+
+// receive prints the messages received, and acknowledges them, until count messages
+// have been printed or there's an error.
+func receive(ctx context.Context, c *client, subscribe *mqtt.SubscribeMessage, w io.Writer, format string, count int) error {
+	for n := 0; count == 0 || n < count; {
+		msg, err := c.read(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch m := msg.(type) {
+		case *mqtt.SubackMessage:
+			for i, code := range m.ReturnCodes() {
+				if code == mqtt.QosFailure && i < len(subscribe.Topics()) {
+					return fmt.Errorf("Subscription to %s rejected", subscribe.Topics()[i])
+				}
+			}
+
+		case *mqtt.PublishMessage:
+			if err := printMessage(w, format, m); err != nil {
+				return err
+			}
+			n++
+
+			switch m.QoS() {
+			case mqtt.QosAtLeastOnce:
+				ack := mqtt.NewPubackMessage()
+				ack.SetPacketId(m.PacketId())
+				err = c.write(ctx, ack)
+
+			case mqtt.QosExactlyOnce:
+				ack := mqtt.NewPubrecMessage()
+				ack.SetPacketId(m.PacketId())
+				err = c.write(ctx, ack)
+			}
+
+			if err != nil {
+				return err
+			}
+
+		case *mqtt.PubrelMessage:
+			ack := mqtt.NewPubcompMessage()
+			ack.SetPacketId(m.PacketId())
+
+			if err := c.write(ctx, ack); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// printMessage writes the message to w on a single line. The text format is the
+// topic, followed by the QoS, retain and DUP flags, and the payload.
+func printMessage(w io.Writer, format string, msg *mqtt.PublishMessage) error {
+	if format == "json" {
+		b, err := mqtt.MarshalMessageJSON(msg, mqtt.DefaultJSONOptions)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%s qos=%d retain=%t dup=%t %s\n", msg.Topic(), msg.QoS(), msg.Retain(), msg.Dup(), msg.Payload())
+	return err
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/dataence/assert"
+	"github.com/surge/mqtt"
+)
+
+func newTestPublish(qos byte) *mqtt.PublishMessage {
+	msg := mqtt.NewPublishMessage()
+	msg.SetTopic([]byte("sensors/temp"))
+	msg.SetQoS(qos)
+	msg.SetPacketId(7)
+	msg.SetPayload([]byte("21.5"))
+
+	return msg
+}
+
+func TestPrintMessage(t *testing.T) {
+	msg := newTestPublish(mqtt.QosAtLeastOnce)
+	msg.SetRetain(true)
+
+	var buf bytes.Buffer
+	assert.NoError(t, true, printMessage(&buf, "text", msg), "Error printing message.")
+	assert.Equal(t, true, "sensors/temp qos=1 retain=true dup=false 21.5\n", buf.String(), "Incorrect text output.")
+
+	buf.Reset()
+	assert.NoError(t, true, printMessage(&buf, "json", msg), "Error printing message.")
+
+	var v map[string]interface{}
+	assert.NoError(t, true, json.Unmarshal(buf.Bytes(), &v), "Error unmarshalling JSON output.")
+	assert.Equal(t, true, "sensors/temp", v["topic"], "Incorrect topic.")
+	assert.Equal(t, true, "21.5", v["payload"], "Incorrect payload.")
+	assert.Equal(t, true, true, v["retain"], "Incorrect retain flag.")
+}
+
+func TestReceive(t *testing.T) {
+	c, server := newTestServer(t)
+	defer server.conn.Close()
+
+	subscribe := mqtt.NewSubscribeMessage()
+	subscribe.SetPacketId(1)
+	subscribe.AddTopic([]byte("sensors/#"), mqtt.QosExactlyOnce)
+
+	var buf bytes.Buffer
+
+	done := make(chan error)
+	go func() {
+		done <- receive(context.Background(), c, subscribe, &buf, "text", 2)
+	}()
+
+	suback := mqtt.NewSubackMessage()
+	suback.SetPacketId(1)
+	suback.AddReturnCode(mqtt.QosExactlyOnce)
+	server.write(suback)
+
+	server.write(newTestPublish(mqtt.QosAtLeastOnce))
+
+	puback, ok := server.read().(*mqtt.PubackMessage)
+	assert.True(t, true, ok, "Expecting PUBACK.")
+	assert.Equal(t, true, uint16(7), puback.PacketId(), "Incorrect packet ID.")
+
+	server.write(newTestPublish(mqtt.QosExactlyOnce))
+
+	pubrec, ok := server.read().(*mqtt.PubrecMessage)
+	assert.True(t, true, ok, "Expecting PUBREC.")
+	assert.Equal(t, true, uint16(7), pubrec.PacketId(), "Incorrect packet ID.")
+
+	assert.NoError(t, true, <-done, "Error receiving messages.")
+	assert.Equal(t, true, 2, bytes.Count(buf.Bytes(), []byte("\n")), "Expecting two messages printed.")
+}
+
+func TestReceiveRejected(t *testing.T) {
+	c, server := newTestServer(t)
+	defer server.conn.Close()
+
+	subscribe := mqtt.NewSubscribeMessage()
+	subscribe.SetPacketId(1)
+	subscribe.AddTopic([]byte("$SYS/#"), mqtt.QosAtMostOnce)
+
+	done := make(chan error)
+	go func() {
+		done <- receive(context.Background(), c, subscribe, &bytes.Buffer{}, "text", 0)
+	}()
+
+	suback := mqtt.NewSubackMessage()
+	suback.SetPacketId(1)
+	suback.AddReturnCode(mqtt.QosFailure)
+	server.write(suback)
+
+	assert.Error(t, true, <-done, "Expecting subscription to be rejected.")
+}
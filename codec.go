@@ -0,0 +1,298 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ErrPayloadSchema matches any *PayloadError when used with errors.Is.
+var ErrPayloadSchema = errors.New("mqtt: Payload does not match schema")
+
+// Codec marshals Go values into PUBLISH payloads, and unmarshals payloads back into
+// Go values. Unlike PayloadCodec, which compresses bytes, a Codec decides what the
+// bytes mean. Codecs are registered by name with RegisterCodec, so both ends of a
+// topic can agree on one by name.
+type Codec interface {
+	// Name returns the name the codec is registered under, such as "json".
+	Name() string
+
+	// Marshal returns the encoding of v.
+	Marshal(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes data into v, which must be a non-nil pointer.
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// PayloadError is returned when a payload can't be decoded into the type expected
+// for its topic, for example because it's not valid JSON, or a field has the wrong
+// type.
+type PayloadError struct {
+	// Topic is the topic name of the message.
+	Topic []byte
+
+	// Codec is the name of the codec used to decode the payload.
+	Codec string
+
+	// Type is the name of the Go type the payload was decoded into.
+	Type string
+
+	// Err is the underlying cause.
+	Err error
+}
+
+func (this *PayloadError) Error() string {
+	return fmt.Sprintf("mqtt: Payload on topic %q does not match %s (%s): %v", this.Topic, this.Type, this.Codec, this.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (this *PayloadError) Unwrap() error {
+	return this.Err
+}
+
+// Is returns true if target is ErrPayloadSchema.
+func (this *PayloadError) Is(target error) bool {
+	return target == ErrPayloadSchema
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"json":  JSONCodec{},
+		"cbor":  CBORCodec{},
+		"proto": ProtoCodec{},
+		"raw":   RawCodec{},
+	}
+)
+
+// RegisterCodec makes the codec available by its name. The names "json", "cbor",
+// "proto" and "raw" are taken by the built-in codecs.
+func RegisterCodec(c Codec) error {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if c.Name() == "" {
+		return fmt.Errorf("codec/RegisterCodec: Empty codec name")
+	}
+
+	if _, ok := codecs[c.Name()]; ok {
+		return fmt.Errorf("codec/RegisterCodec: Codec %q is already registered", c.Name())
+	}
+
+	codecs[c.Name()] = c
+
+	return nil
+}
+
+// LookupCodec returns the codec registered under the name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Codecs returns the names of the registered codecs, sorted.
+func Codecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	names := make([]string, 0, len(codecs))
+	for n := range codecs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// JSONCodec encodes values with encoding/json.
+type JSONCodec struct {
+	// Strict rejects payloads with object keys that don't match any field of the
+	// struct they're decoded into.
+	Strict bool
+}
+
+var _ Codec = JSONCodec{}
+
+// Name returns "json".
+func (this JSONCodec) Name() string {
+	return "json"
+}
+
+// Marshal returns the JSON encoding of v.
+func (this JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes the JSON payload into v. Anything after the first JSON value is
+// an error.
+func (this JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if this.Strict {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+
+	if dec.More() {
+		return fmt.Errorf("codec/Unmarshal: Trailing data after JSON value")
+	}
+
+	return nil
+}
+
+// ProtoMessage is implemented by generated Protocol Buffers types that marshal
+// themselves, such as those generated by gogo/protobuf or with vtprotobuf.
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+// ProtoCodec encodes values in the Protocol Buffers wire format. This package has no
+// Protocol Buffers runtime of its own: by default the values must implement
+// ProtoMessage, and for other runtimes, such as google.golang.org/protobuf, the
+// MarshalFunc and UnmarshalFunc can be set to that runtime's functions.
+type ProtoCodec struct {
+	// MarshalFunc, if set, is used instead of ProtoMessage.Marshal.
+	MarshalFunc func(v interface{}) ([]byte, error)
+
+	// UnmarshalFunc, if set, is used instead of ProtoMessage.Unmarshal.
+	UnmarshalFunc func(data []byte, v interface{}) error
+}
+
+var _ Codec = ProtoCodec{}
+
+// Name returns "proto".
+func (this ProtoCodec) Name() string {
+	return "proto"
+}
+
+// Marshal returns the wire format encoding of v.
+func (this ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	if this.MarshalFunc != nil {
+		return this.MarshalFunc(v)
+	}
+
+	m, ok := protoMessage(v)
+	if !ok {
+		return nil, fmt.Errorf("codec/Marshal: %T does not implement ProtoMessage", v)
+	}
+
+	return m.Marshal()
+}
+
+// Unmarshal decodes the wire format payload into v.
+func (this ProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	if this.UnmarshalFunc != nil {
+		return this.UnmarshalFunc(data, v)
+	}
+
+	m, ok := protoMessage(v)
+	if !ok {
+		return fmt.Errorf("codec/Unmarshal: %T does not implement ProtoMessage", v)
+	}
+
+	return m.Unmarshal(data)
+}
+
+// protoMessage returns v as a ProtoMessage. Generated types implement it with pointer
+// receivers, so a struct value is copied into a new pointer, and a pointer to a nil
+// pointer is allocated first.
+func protoMessage(v interface{}) (ProtoMessage, bool) {
+	if m, ok := v.(ProtoMessage); ok {
+		return m, true
+	}
+
+	rv := reflect.ValueOf(v)
+
+	switch {
+	case !rv.IsValid():
+		return nil, false
+
+	case rv.Kind() == reflect.Pointer && !rv.IsNil() && rv.Elem().Kind() == reflect.Pointer:
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+
+		m, ok := rv.Elem().Interface().(ProtoMessage)
+		return m, ok
+
+	case rv.Kind() != reflect.Pointer:
+		p := reflect.New(rv.Type())
+		p.Elem().Set(rv)
+
+		m, ok := p.Interface().(ProtoMessage)
+		return m, ok
+	}
+
+	return nil, false
+}
+
+// RawCodec passes payloads through as they are. It marshals []byte and string
+// values, and types implementing encoding.BinaryMarshaler, and unmarshals into
+// *[]byte, *string and types implementing encoding.BinaryUnmarshaler.
+type RawCodec struct{}
+
+var _ Codec = RawCodec{}
+
+// Name returns "raw".
+func (this RawCodec) Name() string {
+	return "raw"
+}
+
+// Marshal returns v as bytes.
+func (this RawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case []byte:
+		return x, nil
+
+	case string:
+		return []byte(x), nil
+
+	case encoding.BinaryMarshaler:
+		return x.MarshalBinary()
+	}
+
+	return nil, fmt.Errorf("codec/Marshal: Cannot marshal %T as raw bytes", v)
+}
+
+// Unmarshal sets v to a copy of data.
+func (this RawCodec) Unmarshal(data []byte, v interface{}) error {
+	switch x := v.(type) {
+	case *[]byte:
+		*x = append([]byte(nil), data...)
+		return nil
+
+	case *string:
+		*x = string(data)
+		return nil
+
+	case encoding.BinaryUnmarshaler:
+		return x.UnmarshalBinary(data)
+	}
+
+	return fmt.Errorf("codec/Unmarshal: Cannot unmarshal raw bytes into %T", v)
+}
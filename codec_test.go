@@ -0,0 +1,159 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+// protoTestMessage marshals itself like a generated message with a single uint32
+// field 1, encoded as a varint.
+type protoTestMessage struct {
+	Value uint32
+}
+
+func (this *protoTestMessage) Marshal() ([]byte, error) {
+	return binary.AppendUvarint([]byte{0x08}, uint64(this.Value)), nil
+}
+
+func (this *protoTestMessage) Unmarshal(data []byte) error {
+	if len(data) < 2 || data[0] != 0x08 {
+		return fmt.Errorf("invalid message")
+	}
+
+	v, n := binary.Uvarint(data[1:])
+	if n <= 0 || n != len(data)-1 {
+		return fmt.Errorf("invalid varint")
+	}
+
+	this.Value = uint32(v)
+
+	return nil
+}
+
+func TestCodecRegistry(t *testing.T) {
+	for _, name := range []string{"json", "cbor", "proto", "raw"} {
+		c, ok := LookupCodec(name)
+		assert.True(t, true, ok, "Missing codec", name)
+		assert.Equal(t, true, name, c.Name())
+	}
+
+	_, ok := LookupCodec("xml")
+	assert.False(t, true, ok)
+
+	assert.Error(t, true, RegisterCodec(JSONCodec{Strict: true}))
+	assert.Error(t, true, RegisterCodec(testCodec{}))
+	assert.NoError(t, true, RegisterCodec(testCodec{"test"}))
+	t.Cleanup(func() {
+		codecsMu.Lock()
+		delete(codecs, "test")
+		codecsMu.Unlock()
+	})
+
+	c, ok := LookupCodec("test")
+	assert.True(t, true, ok)
+	assert.Equal(t, true, "test", c.Name())
+	assert.Equal(t, true, []string{"cbor", "json", "proto", "raw", "test"}, Codecs())
+}
+
+type testCodec struct {
+	name string
+}
+
+func (this testCodec) Name() string                          { return this.name }
+func (this testCodec) Marshal(v interface{}) ([]byte, error) { return RawCodec{}.Marshal(v) }
+func (this testCodec) Unmarshal(data []byte, v interface{}) error {
+	return RawCodec{}.Unmarshal(data, v)
+}
+
+func TestJSONCodecStrict(t *testing.T) {
+	var v struct {
+		A int `json:"a"`
+	}
+
+	assert.NoError(t, true, JSONCodec{}.Unmarshal([]byte(`{"a":1,"b":2}`), &v))
+	assert.Equal(t, true, 1, v.A)
+
+	assert.Error(t, true, JSONCodec{Strict: true}.Unmarshal([]byte(`{"a":1,"b":2}`), &v))
+	assert.Error(t, true, JSONCodec{}.Unmarshal([]byte(`{"a":1} {"a":2}`), &v))
+}
+
+func TestProtoCodec(t *testing.T) {
+	c := ProtoCodec{}
+
+	b, err := c.Marshal(protoTestMessage{Value: 300})
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, []byte{0x08, 0xac, 0x02}, b)
+
+	b2, err := c.Marshal(&protoTestMessage{Value: 300})
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, b, b2)
+
+	var v protoTestMessage
+	assert.NoError(t, true, c.Unmarshal(b, &v))
+	assert.Equal(t, true, uint32(300), v.Value)
+
+	var p *protoTestMessage
+	assert.NoError(t, true, c.Unmarshal(b, &p))
+	assert.Equal(t, true, uint32(300), p.Value)
+
+	_, err = c.Marshal(1)
+	assert.Error(t, true, err)
+	assert.Error(t, true, c.Unmarshal(b, new(int)))
+
+	called := false
+	c = ProtoCodec{
+		MarshalFunc: func(v interface{}) ([]byte, error) {
+			called = true
+			return []byte{1}, nil
+		},
+	}
+
+	_, err = c.Marshal(1)
+	assert.NoError(t, true, err)
+	assert.True(t, true, called)
+}
+
+func TestRawCodec(t *testing.T) {
+	c := RawCodec{}
+
+	b, err := c.Marshal("hello")
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, []byte("hello"), b)
+
+	_, err = c.Marshal(1)
+	assert.Error(t, true, err)
+
+	var s string
+	assert.NoError(t, true, c.Unmarshal(b, &s))
+	assert.Equal(t, true, "hello", s)
+
+	var out []byte
+	assert.NoError(t, true, c.Unmarshal(b, &out))
+	b[0] = 'j'
+	assert.Equal(t, true, "hello", string(out), "Unmarshal should copy the payload.")
+}
+
+func TestPayloadError(t *testing.T) {
+	err := error(&PayloadError{Topic: []byte("a/b"), Codec: "json", Type: "int", Err: errors.New("bad")})
+
+	assert.True(t, true, errors.Is(err, ErrPayloadSchema))
+	assert.Equal(t, true, `mqtt: Payload on topic "a/b" does not match int (json): bad`, err.Error())
+}
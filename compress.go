@@ -0,0 +1,333 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	// CompressionNone marks a payload that is not compressed.
+	CompressionNone byte = iota
+
+	// CompressionGzip marks a payload compressed with gzip, RFC 1952.
+	CompressionGzip
+
+	// CompressionDeflate marks a payload compressed with raw deflate, RFC 1951.
+	CompressionDeflate
+)
+
+// CompressionMode is how a PayloadCodec tells receivers which compressor was used.
+type CompressionMode byte
+
+const (
+	// CompressionHeader prefixes every payload with a header byte holding the ID
+	// of the compressor, or CompressionNone.
+	CompressionHeader CompressionMode = iota
+
+	// CompressionTopicSuffix adds the suffix of the compressor to the topic name,
+	// and leaves uncompressed payloads and their topics unchanged.
+	CompressionTopicSuffix
+)
+
+// Compressor compresses and decompresses payloads. Compressors are registered with
+// RegisterCompressor, and looked up by their ID.
+type Compressor interface {
+	// Compress returns a writer that writes compressed data to dst. The data is not
+	// complete until the writer is closed.
+	Compress(dst io.Writer) (io.WriteCloser, error)
+
+	// Decompress returns a reader that reads decompressed data from src.
+	Decompress(src io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCompressor compresses with gzip at the compression level, which is one of the
+// compress/gzip levels. If Level is 0, gzip.DefaultCompression is used.
+type GzipCompressor struct {
+	Level int
+}
+
+// Compress returns a gzip writer.
+func (this GzipCompressor) Compress(dst io.Writer) (io.WriteCloser, error) {
+	level := this.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	return gzip.NewWriterLevel(dst, level)
+}
+
+// Decompress returns a gzip reader.
+func (this GzipCompressor) Decompress(src io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(src)
+}
+
+// DeflateCompressor compresses with raw deflate at the compression level, which is
+// one of the compress/flate levels. If Level is 0, flate.DefaultCompression is used.
+type DeflateCompressor struct {
+	Level int
+}
+
+// Compress returns a deflate writer.
+func (this DeflateCompressor) Compress(dst io.Writer) (io.WriteCloser, error) {
+	level := this.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	return flate.NewWriter(dst, level)
+}
+
+// Decompress returns a deflate reader.
+func (this DeflateCompressor) Decompress(src io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(src), nil
+}
+
+type compressorEntry struct {
+	id     byte
+	suffix string
+	c      Compressor
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[byte]*compressorEntry{
+		CompressionGzip:    {CompressionGzip, ".gz", GzipCompressor{}},
+		CompressionDeflate: {CompressionDeflate, ".zz", DeflateCompressor{}},
+	}
+)
+
+// RegisterCompressor makes a compressor available to all PayloadCodecs under the ID,
+// which is written in the header byte, and the topic suffix, such as ".gz". The
+// suffix must not contain the / level separator, and must not be the same as, or
+// the end of, a suffix that's already registered. A suffix may end with one that's
+// already registered, such as ".tar.gz", in which case the longest suffix matching
+// a topic is used. IDs 1 and 2 are used by gzip and deflate, and 0 means no
+// compression.
+func RegisterCompressor(id byte, suffix string, c Compressor) error {
+	if id == CompressionNone {
+		return fmt.Errorf("compress/RegisterCompressor: ID %d is reserved", id)
+	}
+
+	if suffix == "" || strings.IndexByte(suffix, '/') != -1 || !ValidTopic([]byte(suffix)) {
+		return fmt.Errorf("compress/RegisterCompressor: Invalid topic suffix %q", suffix)
+	}
+
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	for _, e := range compressors {
+		if e.id == id {
+			return fmt.Errorf("compress/RegisterCompressor: ID %d is already registered", id)
+		}
+
+		if strings.HasSuffix(e.suffix, suffix) {
+			return fmt.Errorf("compress/RegisterCompressor: Topic suffix %q overlaps registered suffix %q", suffix, e.suffix)
+		}
+	}
+
+	compressors[id] = &compressorEntry{id, suffix, c}
+
+	return nil
+}
+
+func compressorById(id byte) (*compressorEntry, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	e, ok := compressors[id]
+	return e, ok
+}
+
+func compressorBySuffix(topic []byte) (*compressorEntry, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	// Suffixes can end with other suffixes, so the longest match wins.
+	var match *compressorEntry
+
+	for _, e := range compressors {
+		if bytes.HasSuffix(topic, []byte(e.suffix)) && (match == nil || len(e.suffix) > len(match.suffix)) {
+			match = e
+		}
+	}
+
+	return match, match != nil
+}
+
+// PayloadCodec compresses payloads with PayloadCodec.SetPayload, and decompresses
+// them with PayloadCodec.Payload. Sender and receiver must use the same Mode, and
+// the receiver must have the sender's compressor registered, but not necessarily
+// use it as its own Compressor.
+//
+// Payloads shorter than Threshold, and payloads that don't get smaller when
+// compressed, are sent uncompressed.
+type PayloadCodec struct {
+	// Compressor is the ID of the compressor used by SetPayload. If it's
+	// CompressionNone, payloads are never compressed.
+	Compressor byte
+
+	// Mode is how the compressor is identified to the receiver.
+	Mode CompressionMode
+
+	// Threshold is the smallest payload, in bytes, that is compressed.
+	Threshold int
+
+	// MaxSize is the largest payload, in bytes, that Payload decompresses to. If
+	// 0, the limit is the maximum size of an MQTT packet.
+	MaxSize int
+}
+
+// SetPayload compresses the payload if it's at least Threshold bytes, and sets it
+// as the message's payload. In CompressionTopicSuffix mode the topic of the message
+// must already be set, since the suffix is added to it, and SetPayload must be
+// called only once per message.
+func (this *PayloadCodec) SetPayload(msg *PublishMessage, payload []byte) error {
+	id := CompressionNone
+	data := payload
+
+	if this.Compressor != CompressionNone && len(payload) >= this.Threshold {
+		e, ok := compressorById(this.Compressor)
+		if !ok {
+			return fmt.Errorf("compress/SetPayload: Unknown compressor %d", this.Compressor)
+		}
+
+		var buf bytes.Buffer
+		if this.Mode == CompressionHeader {
+			buf.WriteByte(e.id)
+		}
+
+		w, err := e.c.Compress(&buf)
+		if err != nil {
+			return err
+		}
+
+		if _, err = w.Write(payload); err != nil {
+			return err
+		}
+
+		if err = w.Close(); err != nil {
+			return err
+		}
+
+		if buf.Len() < len(payload) {
+			id, data = e.id, buf.Bytes()
+
+			if this.Mode == CompressionTopicSuffix {
+				if err := msg.SetTopic(append(append([]byte{}, msg.Topic()...), e.suffix...)); err != nil {
+					return err
+				}
+			}
+
+			msg.SetPayload(data)
+			return nil
+		}
+	}
+
+	if this.Mode == CompressionHeader {
+		data = append([]byte{id}, payload...)
+	}
+
+	msg.SetPayload(data)
+	return nil
+}
+
+// Payload returns the decompressed payload of the message. In CompressionHeader mode
+// it returns an error if the payload has no header byte, or the compressor is not
+// registered. In CompressionTopicSuffix mode, payloads whose topic has no registered
+// suffix are returned as is. Payload streams can't be decompressed, and
+// ErrPayloadStream is returned for them.
+func (this *PayloadCodec) Payload(msg *PublishMessage) ([]byte, error) {
+	if r, _ := msg.PayloadStream(); r != nil {
+		return nil, fmt.Errorf("compress/Payload: %w", ErrPayloadStream)
+	}
+
+	payload := msg.Payload()
+
+	var e *compressorEntry
+
+	switch this.Mode {
+	case CompressionHeader:
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("compress/Payload: Missing compression header")
+		}
+
+		id := payload[0]
+		payload = payload[1:]
+
+		if id == CompressionNone {
+			return payload, nil
+		}
+
+		var ok bool
+		if e, ok = compressorById(id); !ok {
+			return nil, fmt.Errorf("compress/Payload: Unknown compressor %d", id)
+		}
+
+	case CompressionTopicSuffix:
+		var ok bool
+		if e, ok = compressorBySuffix(msg.Topic()); !ok {
+			return payload, nil
+		}
+
+	default:
+		return nil, fmt.Errorf("compress/Payload: Invalid compression mode %d", this.Mode)
+	}
+
+	r, err := e.c.Decompress(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("compress/Payload: %w", err)
+	}
+	defer r.Close()
+
+	max := int64(this.MaxSize)
+	if max <= 0 {
+		max = int64(maxRemainingLength)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, fmt.Errorf("compress/Payload: %w", err)
+	}
+
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("compress/Payload: %w: Decompressed payload exceeds %d bytes", ErrPacketTooLarge, max)
+	}
+
+	return data, nil
+}
+
+// Topic returns the topic name of the message without the suffix added by SetPayload
+// in CompressionTopicSuffix mode. In CompressionHeader mode, it returns the topic as
+// is.
+func (this *PayloadCodec) Topic(msg *PublishMessage) []byte {
+	topic := msg.Topic()
+
+	if this.Mode != CompressionTopicSuffix {
+		return topic
+	}
+
+	if e, ok := compressorBySuffix(topic); ok {
+		return topic[:len(topic)-len(e.suffix)]
+	}
+
+	return topic
+}
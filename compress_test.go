@@ -0,0 +1,163 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+var compressTestPayload = bytes.Repeat([]byte(`{"sensor":"temp","value":21.5,"unit":"C"},`), 50)
+
+func TestPayloadCodecHeader(t *testing.T) {
+	for _, id := range []byte{CompressionGzip, CompressionDeflate} {
+		codec := &PayloadCodec{Compressor: id, Threshold: 64}
+
+		msg := NewPublishMessage()
+		msg.SetTopic([]byte("telemetry/device1"))
+		assert.NoError(t, true, codec.SetPayload(msg, compressTestPayload), "Error setting payload.")
+
+		assert.Equal(t, true, id, msg.Payload()[0], "Incorrect header byte.")
+		assert.True(t, true, len(msg.Payload()) < len(compressTestPayload), "Expecting payload to be compressed.")
+
+		// The receiver can use any compressor.
+		receiver := &PayloadCodec{}
+		payload, err := receiver.Payload(roundTripPublish(t, msg))
+		assert.NoError(t, true, err, "Error getting payload.")
+		assert.Equal(t, true, compressTestPayload, payload, "Incorrect decompressed payload.")
+		assert.Equal(t, true, []byte("telemetry/device1"), receiver.Topic(msg), "Incorrect topic.")
+	}
+}
+
+func TestPayloadCodecStream(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("telemetry/device1"))
+	assert.NoError(t, true, msg.SetPayloadStream(bytes.NewReader(compressTestPayload), len(compressTestPayload)))
+
+	_, err := (&PayloadCodec{}).Payload(msg)
+	assert.True(t, true, errors.Is(err, ErrPayloadStream), "Expecting payload stream error.", err)
+}
+
+func TestPayloadCodecUncompressed(t *testing.T) {
+	codec := &PayloadCodec{Compressor: CompressionGzip, Threshold: 64}
+
+	// Below the threshold.
+	msg := NewPublishMessage()
+	assert.NoError(t, true, codec.SetPayload(msg, []byte("21.5")), "Error setting payload.")
+	assert.Equal(t, true, []byte{CompressionNone, '2', '1', '.', '5'}, msg.Payload(), "Expecting uncompressed payload.")
+
+	payload, err := codec.Payload(msg)
+	assert.NoError(t, true, err, "Error getting payload.")
+	assert.Equal(t, true, []byte("21.5"), payload, "Incorrect payload.")
+
+	// Incompressible payloads are not compressed.
+	random := make([]byte, 256)
+	for i := range random {
+		random[i] = byte(i*7919 + i*i*31)
+	}
+
+	msg = NewPublishMessage()
+	assert.NoError(t, true, codec.SetPayload(msg, random), "Error setting payload.")
+	assert.Equal(t, true, CompressionNone, msg.Payload()[0], "Expecting uncompressed payload.")
+
+	// Without a header byte, the payload can't be decoded.
+	msg.SetPayload(nil)
+	_, err = codec.Payload(msg)
+	assert.Error(t, true, err, "Expecting error for missing header.")
+
+	msg.SetPayload([]byte{200, 1, 2})
+	_, err = codec.Payload(msg)
+	assert.Error(t, true, err, "Expecting error for unknown compressor.")
+}
+
+func TestPayloadCodecTopicSuffix(t *testing.T) {
+	codec := &PayloadCodec{Compressor: CompressionGzip, Mode: CompressionTopicSuffix, Threshold: 64}
+
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("telemetry/device1"))
+	assert.NoError(t, true, codec.SetPayload(msg, compressTestPayload), "Error setting payload.")
+	assert.Equal(t, true, []byte("telemetry/device1.gz"), msg.Topic(), "Expecting topic suffix.")
+
+	out := roundTripPublish(t, msg)
+	payload, err := codec.Payload(out)
+	assert.NoError(t, true, err, "Error getting payload.")
+	assert.Equal(t, true, compressTestPayload, payload, "Incorrect decompressed payload.")
+	assert.Equal(t, true, []byte("telemetry/device1"), codec.Topic(out), "Expecting suffix to be removed.")
+
+	msg = NewPublishMessage()
+	msg.SetTopic([]byte("telemetry/device1"))
+	assert.NoError(t, true, codec.SetPayload(msg, []byte("21.5")), "Error setting payload.")
+	assert.Equal(t, true, []byte("telemetry/device1"), msg.Topic(), "Expecting no suffix for small payloads.")
+	assert.Equal(t, true, []byte("21.5"), msg.Payload(), "Expecting no header in topic suffix mode.")
+
+	payload, err = codec.Payload(msg)
+	assert.NoError(t, true, err, "Error getting payload.")
+	assert.Equal(t, true, []byte("21.5"), payload, "Incorrect payload.")
+}
+
+func TestPayloadCodecMaxSize(t *testing.T) {
+	codec := &PayloadCodec{Compressor: CompressionDeflate}
+
+	msg := NewPublishMessage()
+	assert.NoError(t, true, codec.SetPayload(msg, make([]byte, 100000)), "Error setting payload.")
+
+	codec.MaxSize = 1000
+	_, err := codec.Payload(msg)
+	assert.True(t, true, errors.Is(err, ErrPacketTooLarge), "Expecting ErrPacketTooLarge.")
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	assert.NoError(t, true, RegisterCompressor(100, ".gzbest", GzipCompressor{Level: gzip.BestCompression}), "Error registering compressor.")
+	defer func() {
+		compressorsMu.Lock()
+		delete(compressors, 100)
+		compressorsMu.Unlock()
+	}()
+
+	assert.Error(t, true, RegisterCompressor(100, ".other", DeflateCompressor{}), "Expecting error for duplicate ID.")
+	assert.Error(t, true, RegisterCompressor(101, ".gz", DeflateCompressor{}), "Expecting error for duplicate suffix.")
+	assert.Error(t, true, RegisterCompressor(101, "/x", DeflateCompressor{}), "Expecting error for suffix with level separator.")
+	assert.Error(t, true, RegisterCompressor(CompressionNone, ".none", DeflateCompressor{}), "Expecting error for reserved ID.")
+	assert.Error(t, true, RegisterCompressor(101, "z", DeflateCompressor{}), "Expecting error for suffix ending a registered suffix.")
+
+	assert.NoError(t, true, RegisterCompressor(102, ".tar.gz", DeflateCompressor{}), "Error registering compressor.")
+	defer func() {
+		compressorsMu.Lock()
+		delete(compressors, 102)
+		compressorsMu.Unlock()
+	}()
+
+	for i := 0; i < 10; i++ {
+		e, ok := compressorBySuffix([]byte("files/a.tar.gz"))
+		assert.True(t, true, ok && e.id == 102, "Expecting the longest suffix to match.")
+	}
+
+	e, ok := compressorBySuffix([]byte("files/a.gz"))
+	assert.True(t, true, ok && e.id == CompressionGzip, "Expecting the gzip suffix to match.")
+
+	codec := &PayloadCodec{Compressor: 100}
+
+	msg := NewPublishMessage()
+	assert.NoError(t, true, codec.SetPayload(msg, compressTestPayload), "Error setting payload.")
+	assert.Equal(t, true, byte(100), msg.Payload()[0], "Incorrect header byte.")
+
+	payload, err := codec.Payload(msg)
+	assert.NoError(t, true, err, "Error getting payload.")
+	assert.Equal(t, true, compressTestPayload, payload, "Incorrect decompressed payload.")
+}
@@ -89,24 +89,24 @@ func (this *ConnackMessage) Decode(src io.Reader) (int, error) {
 
 	// Read session present flag
 	if b, err = this.buf.ReadByte(); err != nil {
-		return total, err
+		return total, this.malformed("Connect Acknowledge Flags", total, io.ErrUnexpectedEOF)
 	}
 	total += 1
 
-	if b&254 != 0 {
-		return 0, fmt.Errorf("connack/Decode: Bits 7-1 in Connack Acknowledge Flags byte (1) are not 0")
+	if b&254 != 0 && !this.decodeOptions().lenient() {
+		return 0, this.malformed("Connect Acknowledge Flags", total-1, violation("Bits 7-1 in Connack Acknowledge Flags byte (1) are not 0"))
 	}
 
 	this.sessionPresent = b&0x1 == 1
 
 	// Read return code
 	if b, err = this.buf.ReadByte(); err != nil {
-		return total, err
+		return total, this.malformed("Connect Return code", total, io.ErrUnexpectedEOF)
 	}
 	total += 1
 
 	if b > 5 {
-		return 0, fmt.Errorf("connack/Decode: Invalid CONNACK return code (%d)", b)
+		return 0, this.malformed("Connect Return code", total-1, violation("Invalid CONNACK return code (%d)", b))
 	}
 
 	this.returnCode = ConnackCode(b)
@@ -134,7 +134,7 @@ func (this *ConnackMessage) Encode() (io.Reader, int, error) {
 	}
 
 	if this.returnCode > 5 {
-		return nil, 0, fmt.Errorf("connack/Encode: Invalid CONNACK return code (%d)", this.returnCode)
+		return nil, 0, this.malformed("Connect Return code", -1, violation("Invalid CONNACK return code (%d)", this.returnCode))
 	}
 
 	b[1] = this.returnCode.Value()
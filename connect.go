@@ -92,6 +92,16 @@ func (this *ConnectMessage) SetVersion(v byte) error {
 	return nil
 }
 
+// protocolName returns the protocol name the message is encoded with: the decoded
+// name if there is one, and otherwise the name for the version.
+func (this *ConnectMessage) protocolName() []byte {
+	if this.protoName != nil {
+		return this.protoName
+	}
+
+	return []byte(SupportedVersions[this.version])
+}
+
 // CleanSession returns the bit that specifies the handling of the Session state.
 // The Client and Server can store Session state to enable reliable messaging to
 // continue across a sequence of Network Connections. This bit is used to control
@@ -298,8 +308,8 @@ func (this *ConnectMessage) SetPassword(v []byte) {
 // bytes read from io.Reader. The second is error if Decode encounters any problems.
 //
 // For the CONNECT message, the error returned could be a ConnackReturnCode, so
-// be sure to check that. Otherwise it's a generic error. If a generic error is
-// returned, this Message should be considered invalid.
+// be sure to check that. Otherwise it's usually a *MalformedPacketError. If any
+// other error is returned, this Message should be considered invalid.
 //
 // Caller should call ValidConnackError(err) to see if the returned error is
 // a Connack error. If so, caller should send the Client back the corresponding
@@ -328,14 +338,26 @@ func (this *ConnectMessage) Decode(src io.Reader) (int, error) {
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *ConnectMessage) Encode() (io.Reader, int, error) {
 	if this.Type() != CONNECT {
-		return nil, 0, fmt.Errorf("connect/Encode: Invalid message type. Expecting %d, got %d", CONNECT, this.Type())
+		return nil, 0, this.malformed("Packet Type", -1, fmt.Errorf("Invalid message type. Expecting %d, got %d", CONNECT, this.Type()))
 	}
 
 	total := 0
 	var n int
 	verstr, ok := SupportedVersions[this.version]
 	if !ok {
-		return nil, 0, fmt.Errorf("connect/Encode: Unsupported protocol version %d", this.version)
+		return nil, 0, this.malformed("Protocol Level", -1, fmt.Errorf("%w: %d", ErrUnacceptableProtocolVersion, this.version))
+	}
+
+	if !ValidUTF8(this.clientId) {
+		return nil, 0, this.malformed("Client Identifier", -1, ErrMalformedUTF8)
+	}
+
+	if this.WillFlag() && !ValidUTF8(this.willTopic) {
+		return nil, 0, this.malformed("Will Topic", -1, ErrMalformedUTF8)
+	}
+
+	if this.UsernameFlag() && !ValidUTF8(this.username) {
+		return nil, 0, this.malformed("User Name", -1, ErrMalformedUTF8)
 	}
 
 	// 2 bytes protocol name length
@@ -368,7 +390,7 @@ func (this *ConnectMessage) Encode() (io.Reader, int, error) {
 	}
 
 	if err := this.SetRemainingLength(int32(total)); err != nil {
-		return nil, 0, err
+		return nil, 0, this.malformed("Remaining Length", -1, err)
 	}
 
 	total = 0
@@ -392,12 +414,12 @@ func (this *ConnectMessage) encodeMessage() (int, error) {
 
 	verstr, ok := SupportedVersions[this.version]
 	if !ok {
-		return 0, fmt.Errorf("connect/encodeVariableHeader: Unsupported protocol version %d", this.version)
+		return 0, this.malformed("Protocol Level", -1, fmt.Errorf("%w: %d", ErrUnacceptableProtocolVersion, this.version))
 	}
 
 	n, err := writeLPBytes(this.buf, []byte(verstr))
 	if err != nil {
-		return 0, err
+		return 0, this.malformed("Protocol Name", -1, err)
 	}
 	total += int(n)
 
@@ -408,23 +430,23 @@ func (this *ConnectMessage) encodeMessage() (int, error) {
 	total += 1
 
 	if err = writeUint16(this.buf, this.keepAlive); err != nil {
-		return total, err
+		return total, this.malformed("Keep Alive", -1, err)
 	}
 	total += 2
 
 	if n, err = writeLPBytes(this.buf, this.clientId); err != nil {
-		return total + n, err
+		return total + n, this.malformed("Client Identifier", -1, err)
 	}
 	total += n
 
 	if this.WillFlag() {
 		if n, err = writeLPBytes(this.buf, this.willTopic); err != nil {
-			return total + n, err
+			return total + n, this.malformed("Will Topic", -1, err)
 		}
 		total += n
 
 		if n, err = writeLPBytes(this.buf, this.willMessage); err != nil {
-			return total + n, err
+			return total + n, this.malformed("Will Message", -1, err)
 		}
 		total += n
 	}
@@ -433,7 +455,7 @@ func (this *ConnectMessage) encodeMessage() (int, error) {
 	// but the username string is missing.
 	if this.UsernameFlag() && len(this.username) > 0 {
 		if n, err = writeLPBytes(this.buf, this.username); err != nil {
-			return total + n, err
+			return total + n, this.malformed("User Name", -1, err)
 		}
 		total += n
 	}
@@ -442,7 +464,7 @@ func (this *ConnectMessage) encodeMessage() (int, error) {
 	// but the password string is missing.
 	if this.PasswordFlag() && len(this.password) > 0 {
 		if n, err = writeLPBytes(this.buf, this.password); err != nil {
-			return total + n, err
+			return total + n, this.malformed("Password", -1, err)
 		}
 		total += n
 	}
@@ -454,97 +476,139 @@ func (this *ConnectMessage) decodeMessage() (int, error) {
 	var n, total int
 	var err error
 
+	opts := this.decodeOptions()
+
+	// Offsets in errors are from the start of the message, including the fixed header
+	base := this.headerLength()
+
 	if this.protoName, n, err = readLPBytes(this.buf); err != nil {
-		return total + n, err
+		return total + n, this.malformed("Protocol Name", base+total, err)
 	}
 	total += n
 
 	if this.version, err = this.buf.ReadByte(); err != nil {
-		return total, err
+		return total, this.malformed("Protocol Level", base+total, io.ErrUnexpectedEOF)
 	}
 	total += 1
 
 	if verstr, ok := SupportedVersions[this.version]; !ok {
 		return total, ErrUnacceptableProtocolVersion
-	} else if verstr != string(this.protoName) {
+	} else if verstr != string(this.protoName) && !opts.lenient() {
 		return total, ErrUnacceptableProtocolVersion
 	}
 
 	if this.connectFlags, err = this.buf.ReadByte(); err != nil {
-		return total, err
+		return total, this.malformed("Connect Flags", base+total, io.ErrUnexpectedEOF)
 	}
 	total += 1
 
-	if this.connectFlags&0x1 != 0 {
-		return total, fmt.Errorf("connect/decodeMessage: Connect Flags reserved bit 0 is not 0")
+	flagsOffset := base + total - 1
+
+	if this.connectFlags&0x1 != 0 && !opts.lenient() {
+		return total, this.malformed("Connect Flags", flagsOffset, violation("Connect Flags reserved bit 0 is not 0"))
 	}
 
 	if this.WillQos() > QosExactlyOnce {
-		return total, fmt.Errorf("connect/decodeMessage: Invalid QoS level (%d) for %s message", this.WillQos(), this.Name())
+		return total, this.malformed("Connect Flags", flagsOffset, violation("Invalid QoS level (%d) for %s message", this.WillQos(), this.Name()))
 	}
 
-	if !this.WillFlag() && (this.WillRetain() || this.WillQos() != QosAtMostOnce) {
-		return total, fmt.Errorf("connect/decodeMessage: Protocol violation: If the Will Flag (%t) is set to 0 the Will QoS (%d) and Will Retain (%t) fields MUST be set to zero", this.WillFlag(), this.WillQos(), this.WillRetain())
+	if !this.WillFlag() && (this.WillRetain() || this.WillQos() != QosAtMostOnce) && !opts.lenient() {
+		return total, this.malformed("Connect Flags", flagsOffset, violation("If the Will Flag (%t) is set to 0 the Will QoS (%d) and Will Retain (%t) fields MUST be set to zero", this.WillFlag(), this.WillQos(), this.WillRetain()))
 	}
 
-	if this.UsernameFlag() && !this.PasswordFlag() {
-		return total, fmt.Errorf("connect/decodeMessage: Username flag is set but Password flag is not set")
+	switch opts.Mode {
+	case DecodeDefault:
+		if this.UsernameFlag() && !this.PasswordFlag() {
+			return total, this.malformed("Connect Flags", flagsOffset, violation("Username flag is set but Password flag is not set"))
+		}
+
+	case DecodeStrict:
+		// If the User Name Flag is set to 0, the Password Flag MUST be set to 0 [MQTT-3.1.2-22]
+		if this.PasswordFlag() && !this.UsernameFlag() {
+			return total, this.malformed("Connect Flags", flagsOffset, violation("Password flag is set but Username flag is not set"))
+		}
 	}
 
 	if this.keepAlive, err = readUint16(this.buf); err != nil {
-		return total, err
+		return total, this.malformed("Keep Alive", base+total, err)
 	}
 	total += 2
 
 	if this.clientId, n, err = readLPBytes(this.buf); err != nil {
-		return total + n, err
+		return total + n, this.malformed("Client Identifier", base+total, err)
 	}
 	total += n
 
+	if !ValidUTF8(this.clientId) {
+		return total, this.malformed("Client Identifier", base+total-n, ErrMalformedUTF8)
+	}
+
 	// If the Client supplies a zero-byte ClientId, the Client MUST also set CleanSession to 1
 	if len(this.clientId) == 0 && !this.CleanSession() {
 		return total, ErrIdentifierRejected
 	}
 
-	// The ClientId must contain only characters 0-9, a-z, and A-Z
-	// We also support ClientId longer than 23 encoded bytes
-	// We do not support ClientId outside of the above characters
-	if len(this.clientId) > 0 && !ValidClientId(this.clientId) {
+	// By default the ClientId must contain only characters 0-9, a-z, and A-Z.
+	// We also support ClientId longer than 23 encoded bytes. Both can be changed
+	// with the DecodeOptions.
+	if len(this.clientId) > 0 && !opts.ValidClientId(this.clientId) {
 		return total, ErrIdentifierRejected
 	}
 
 	if this.WillFlag() {
 		if this.willTopic, n, err = readLPBytes(this.buf); err != nil {
-			return total + n, err
+			return total + n, this.malformed("Will Topic", base+total, err)
 		}
 		total += n
 
+		topicOffset := base + total - n
+
+		if !ValidUTF8(this.willTopic) {
+			return total, this.malformed("Will Topic", topicOffset, ErrMalformedUTF8)
+		}
+
+		if err = opts.CheckTopic(this.willTopic); err != nil {
+			return total, this.malformed("Will Topic", topicOffset, err)
+		}
+
+		if opts.strict() && !ValidTopic(this.willTopic) {
+			return total, this.malformed("Will Topic", topicOffset, violation("Invalid Will Topic (%s). Must not be empty or contain wildcard characters", string(this.willTopic)))
+		}
+
 		if this.willMessage, n, err = readLPBytes(this.buf); err != nil {
-			return total + n, err
+			return total + n, this.malformed("Will Message", base+total, err)
 		}
 		total += n
 	}
 
-	// According to the 3.1 spec, it's possible that the passwordFlag is set,
-	// but the password string is missing.
-	if this.UsernameFlag() && this.buf.Len() > 0 {
+	// According to the 3.1 spec, it's possible that the usernameFlag is set,
+	// but the username string is missing. This is not allowed in strict mode.
+	if this.UsernameFlag() && (this.buf.Len() > 0 || opts.strict()) {
 		if this.username, n, err = readLPBytes(this.buf); err != nil {
-			return total + n, err
+			return total + n, this.malformed("User Name", base+total, err)
 		}
 		total += n
+
+		if !ValidUTF8(this.username) {
+			return total, this.malformed("User Name", base+total-n, ErrMalformedUTF8)
+		}
 	}
 
 	// According to the 3.1 spec, it's possible that the passwordFlag is set,
-	// but the password string is missing.
-	if this.PasswordFlag() && this.buf.Len() > 0 {
+	// but the password string is missing. This is not allowed in strict mode.
+	if this.PasswordFlag() && (this.buf.Len() > 0 || opts.strict()) {
 		if this.password, n, err = readLPBytes(this.buf); err != nil {
-			return total + n, err
+			return total + n, this.malformed("Password", base+total, err)
 		}
 		total += n
 	}
 
 	if this.buf.Len() > 0 {
-		return total, fmt.Errorf("connect/decodeMessage: Invalid buffer size. Still has %d bytes at the end.", this.buf.Len())
+		if !opts.lenient() {
+			return total, this.malformed("Payload", base+total, fmt.Errorf("Invalid buffer size. Still has %d bytes at the end.", this.buf.Len()))
+		}
+
+		total += len(this.buf.Next(this.buf.Len()))
 	}
 
 	return total, nil
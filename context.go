@@ -0,0 +1,270 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// ErrTimeout matches any *TimeoutError when used with errors.Is.
+var ErrTimeout = errors.New("mqtt: Timeout")
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocked reads and
+// writes when a context is canceled.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// TimeoutError is returned by the context-aware operations when the context's
+// deadline passes, or the connection's own deadline does, before the operation
+// completes. It matches ErrTimeout and context.DeadlineExceeded with errors.Is, and
+// implements net.Error.
+//
+// A message may have been partly read or written when the operation timed out, so
+// the connection should be closed.
+type TimeoutError struct {
+	// Op is the operation that timed out, such as "DecodeContext".
+	Op string
+
+	// Err is the underlying cause.
+	Err error
+}
+
+var _ net.Error = (*TimeoutError)(nil)
+
+func (this *TimeoutError) Error() string {
+	return fmt.Sprintf("mqtt: %s timed out: %v", this.Op, this.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (this *TimeoutError) Unwrap() error {
+	return this.Err
+}
+
+// Is returns true if target is ErrTimeout or context.DeadlineExceeded.
+func (this *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout || target == context.DeadlineExceeded
+}
+
+// Timeout returns true.
+func (this *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary returns false.
+func (this *TimeoutError) Temporary() bool {
+	return false
+}
+
+// ReadDeadliner is implemented by readers that support read deadlines, such as
+// net.Conn and BufferedConn.
+type ReadDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// WriteDeadliner is implemented by writers that support write deadlines, such as
+// net.Conn.
+type WriteDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// DecodeContext decodes the message from src like msg.Decode, but gives up when the
+// context is canceled or its deadline passes. If src implements ReadDeadliner, the
+// context's deadline is set as the read deadline, and a canceled context sets a
+// deadline in the past to interrupt the read; the deadline is cleared afterwards.
+// Other readers can't be interrupted, so the context is only checked before the
+// message is read.
+//
+// If the deadline passes, the error is a *TimeoutError. If the context is canceled,
+// the error wraps context.Canceled.
+func DecodeContext(ctx context.Context, msg Message, src io.Reader) (int, error) {
+	var n int
+
+	err := withReadContext(ctx, "DecodeContext", src, func() (err error) {
+		n, err = msg.Decode(src)
+		return err
+	})
+
+	return n, err
+}
+
+// ReadMessageContext reads the next message from src, honouring the context like
+// DecodeContext. The type of the message is taken from its first byte. If src has a
+// Peek method, such as BufferedConn or bufio.Reader, it's used to read the first
+// byte. The decode options are set on the message before it's decoded, and may be
+// nil.
+func ReadMessageContext(ctx context.Context, src io.Reader, opts *DecodeOptions) (Message, int, error) {
+	var msg Message
+	var n int
+
+	err := withReadContext(ctx, "ReadMessageContext", src, func() error {
+		r := src
+
+		var b byte
+		if p, ok := src.(interface{ Peek(int) ([]byte, error) }); ok {
+			buf, err := p.Peek(1)
+			if err != nil {
+				return err
+			}
+			b = buf[0]
+		} else {
+			var buf [1]byte
+			if _, err := io.ReadFull(src, buf[:]); err != nil {
+				return err
+			}
+			b = buf[0]
+			r = io.MultiReader(bytes.NewReader(buf[:]), src)
+		}
+
+		m, err := MessageType(b >> 4).New()
+		if err != nil {
+			return err
+		}
+
+		if o, ok := m.(interface{ SetDecodeOptions(*DecodeOptions) }); ok {
+			o.SetDecodeOptions(opts)
+		}
+
+		msg = m
+		n, err = m.Decode(r)
+
+		return err
+	})
+
+	if err != nil {
+		return nil, n, err
+	}
+
+	return msg, n, nil
+}
+
+// WriteContext encodes the message and writes it to dst, but gives up when the
+// context is canceled or its deadline passes. Deadlines are handled as in
+// DecodeContext, using the write deadline if dst implements WriteDeadliner. It
+// returns the number of bytes written.
+func WriteContext(ctx context.Context, dst io.Writer, msg Message) (int, error) {
+	r, _, err := msg.Encode()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+
+	var set func(time.Time) error
+	if d, ok := dst.(WriteDeadliner); ok {
+		set = d.SetWriteDeadline
+	}
+
+	err = withContext(ctx, "WriteContext", set, func() (err error) {
+		n, err = io.Copy(dst, r)
+		return err
+	})
+
+	return int(n), err
+}
+
+func withReadContext(ctx context.Context, op string, src io.Reader, f func() error) error {
+	var set func(time.Time) error
+	if d, ok := src.(ReadDeadliner); ok {
+		set = d.SetReadDeadline
+	}
+
+	return withContext(ctx, op, set, f)
+}
+
+// withContext calls f with the deadline of the context set by set, which may be
+// nil, and interrupts f by setting a deadline in the past if the context is
+// canceled.
+func withContext(ctx context.Context, op string, set func(time.Time) error, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return contextError(op, err)
+	}
+
+	if set == nil {
+		return f()
+	}
+
+	if t, ok := ctx.Deadline(); ok {
+		if err := set(t); err != nil {
+			return err
+		}
+	}
+
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		set(aLongTimeAgo)
+		close(fired)
+	})
+
+	err := f()
+
+	// If the context was canceled while f ran, wait for the deadline to be set
+	// before clearing it, so it isn't left in the past.
+	if !stop() {
+		<-fired
+	}
+	set(time.Time{})
+
+	if err == nil {
+		return nil
+	}
+
+	if cerr := ctx.Err(); cerr != nil {
+		return contextError(op, cerr)
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return &TimeoutError{Op: op, Err: err}
+	}
+
+	return err
+}
+
+func contextError(op string, err error) error {
+	if err == context.DeadlineExceeded {
+		return &TimeoutError{Op: op, Err: err}
+	}
+
+	return fmt.Errorf("context/%s: %w", op, err)
+}
+
+// BufferedConn is a net.Conn with buffered reads. Messages can be read from it with
+// ReadMessageContext, which peeks at the first byte, while read deadlines still
+// reach the connection.
+type BufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+// NewBufferedConn creates a BufferedConn reading from conn.
+func NewBufferedConn(conn net.Conn) *BufferedConn {
+	return &BufferedConn{Conn: conn, br: bufio.NewReader(conn)}
+}
+
+// Read reads from the buffer.
+func (this *BufferedConn) Read(p []byte) (int, error) {
+	return this.br.Read(p)
+}
+
+// Peek returns the next n bytes without advancing the reader.
+func (this *BufferedConn) Peek(n int) ([]byte, error) {
+	return this.br.Peek(n)
+}
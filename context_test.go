@@ -0,0 +1,128 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func TestDecodeContextDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := DecodeContext(ctx, NewPublishMessage(), client)
+	assert.True(t, true, time.Since(start) < 5*time.Second, "Decode was not interrupted.")
+	assert.True(t, true, errors.Is(err, ErrTimeout), "Expecting ErrTimeout.")
+	assert.True(t, true, errors.Is(err, context.DeadlineExceeded), "Expecting context.DeadlineExceeded.")
+
+	var nerr net.Error
+	assert.True(t, true, errors.As(err, &nerr) && nerr.Timeout(), "Expecting a net.Error timeout.")
+
+	// The deadline is cleared afterwards, so the connection can still be used.
+	go WriteContext(context.Background(), server, newTestPublishMessage("a/b", "hello"))
+
+	msg := NewPublishMessage()
+	_, err = DecodeContext(context.Background(), msg, client)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "hello", string(msg.Payload()))
+}
+
+func TestDecodeContextCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err := DecodeContext(ctx, NewPublishMessage(), client)
+	assert.True(t, true, errors.Is(err, context.Canceled), "Expecting context.Canceled.")
+	assert.False(t, true, errors.Is(err, ErrTimeout), "Cancellation is not a timeout.")
+
+	_, err = DecodeContext(ctx, NewPublishMessage(), bytes.NewReader(nil))
+	assert.True(t, true, errors.Is(err, context.Canceled), "Expecting context.Canceled before reading.")
+}
+
+func TestDecodeContextConnDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// A deadline set on the connection itself is reported as a timeout too.
+	client.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	_, err := DecodeContext(context.Background(), NewPublishMessage(), client)
+	assert.True(t, true, errors.Is(err, ErrTimeout), "Expecting ErrTimeout.")
+}
+
+func TestWriteContextDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Nobody reads from the other end of the pipe.
+	_, err := WriteContext(ctx, client, newTestPublishMessage("a/b", "hello"))
+	assert.True(t, true, errors.Is(err, ErrTimeout), "Expecting ErrTimeout.")
+}
+
+func TestReadMessageContext(t *testing.T) {
+	var buf bytes.Buffer
+
+	n, err := WriteContext(context.Background(), &buf, newTestPublishMessage("a/b", "hello"))
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, buf.Len(), n)
+
+	b := buf.Bytes()
+
+	// A plain reader has the first byte read and put back.
+	msg, m, err := ReadMessageContext(context.Background(), bytes.NewReader(b), nil)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, len(b), m)
+	assert.Equal(t, true, "hello", string(msg.(*PublishMessage).Payload()))
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go server.Write(b)
+
+	msg, _, err = ReadMessageContext(context.Background(), NewBufferedConn(client), &StrictDecodeOptions)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, PUBLISH, msg.Type())
+
+	_, _, err = ReadMessageContext(context.Background(), bytes.NewReader([]byte{0xf0, 0x00}), nil)
+	assert.Error(t, true, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, _, err = ReadMessageContext(ctx, NewBufferedConn(client), nil)
+	assert.True(t, true, errors.Is(err, ErrTimeout), "Expecting ErrTimeout.")
+}
@@ -0,0 +1,588 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field is a single annotated part of a packet produced by Dissect. Fields form a
+// tree: the root is the whole packet, and composite fields such as the fixed header
+// or a length-prefixed string have sub-fields for each of their parts.
+type Field struct {
+	// Name is the name of the field as used in the MQTT spec, e.g. "Packet Identifier".
+	Name string
+
+	// Offset is the offset of the first byte of the field from the start of the packet.
+	Offset int
+
+	// Length is the number of bytes the field occupies.
+	Length int
+
+	// Raw is the bytes of the field.
+	Raw []byte
+
+	// Value is the interpreted value of the field.
+	Value string
+
+	// Err is set if the field is malformed.
+	Err error
+
+	// Fields are the sub-fields of the field.
+	Fields []*Field
+}
+
+// String returns an indented, multi-line representation of the field tree.
+func (this *Field) String() string {
+	var buf bytes.Buffer
+	this.write(&buf, 0)
+	return buf.String()
+}
+
+// FirstError returns the first malformed field in the tree, walking it depth first,
+// or nil if the packet is well formed.
+func (this *Field) FirstError() *Field {
+	if this.Err != nil {
+		return this
+	}
+
+	for _, f := range this.Fields {
+		if e := f.FirstError(); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (this *Field) write(buf *bytes.Buffer, depth int) {
+	raw := this.Raw
+	more := ""
+	if len(raw) > 16 {
+		raw, more = raw[:16], " ..."
+	}
+
+	fmt.Fprintf(buf, "%s%s @%d+%d [% x%s]", strings.Repeat("  ", depth), this.Name, this.Offset, this.Length, raw, more)
+
+	if this.Value != "" {
+		fmt.Fprintf(buf, ": %s", this.Value)
+	}
+
+	if this.Err != nil {
+		fmt.Fprintf(buf, " !! %v", this.Err)
+	}
+
+	buf.WriteByte('\n')
+
+	for _, f := range this.Fields {
+		f.write(buf, depth+1)
+	}
+}
+
+func (this *Field) add(f *Field) *Field {
+	this.Fields = append(this.Fields, f)
+	return f
+}
+
+// Dissect breaks the first packet in b down into an annotated tree of fields, with
+// the offset, length, raw bytes and interpreted value of each. Unlike Decode, Dissect
+// does not stop at the first problem: malformed fields are annotated with an error
+// and dissection continues wherever the rest of the packet can still be located.
+// If the packet is truncated, the last field is marked and the remaining bytes are
+// reported as unparsed.
+//
+// The Length of the returned root field is the number of bytes of b that belong to
+// the packet, so a stream of packets can be dissected by calling Dissect repeatedly
+// on b[root.Length:].
+func Dissect(b []byte) *Field {
+	d := &dissector{b: b}
+
+	root := &Field{
+		Name: "Packet",
+	}
+
+	if len(b) == 0 {
+		root.Err = fmt.Errorf("dissect: Empty packet")
+		return root
+	}
+
+	mtype := MessageType(b[0] >> 4)
+	root.Name = mtype.Name()
+
+	d.fixedHeader(root, mtype)
+
+	remlen, ok := d.remainingLength(root)
+	if !ok {
+		d.unparsed(root, len(b))
+		d.finish(root)
+		return root
+	}
+
+	end := d.off + remlen
+	if end > len(b) {
+		root.Err = fmt.Errorf("dissect: Insufficient buffer size. Expecting %d bytes, got %d bytes.", end, len(b))
+		end = len(b)
+	}
+
+	d.end = end
+
+	if d.body(root, mtype) && d.off < end {
+		f := d.field(root, "Unexpected Data", end-d.off)
+		f.Err = fmt.Errorf("dissect: %d bytes remaining after %s payload", f.Length, mtype.Name())
+	}
+
+	d.unparsed(root, end)
+	d.finish(root)
+
+	return root
+}
+
+type dissector struct {
+	b   []byte
+	off int
+	end int
+}
+
+func (this *dissector) finish(root *Field) {
+	root.Raw = this.b[:this.off]
+	root.Length = this.off
+}
+
+func (this *dissector) field(parent *Field, name string, n int) *Field {
+	f := &Field{
+		Name:   name,
+		Offset: this.off,
+		Length: n,
+		Raw:    this.b[this.off : this.off+n],
+	}
+	this.off += n
+
+	return parent.add(f)
+}
+
+// need checks that n more bytes are available in the packet body. If not, the
+// remaining bytes are consumed into a field marked with an error.
+func (this *dissector) need(parent *Field, name string, n int) (*Field, bool) {
+	if this.end-this.off < n {
+		f := this.field(parent, name, this.end-this.off)
+		f.Err = fmt.Errorf("dissect: Insufficient buffer size. Expecting %d bytes, got %d bytes.", n, f.Length)
+		return f, false
+	}
+
+	return this.field(parent, name, n), true
+}
+
+func (this *dissector) unparsed(parent *Field, end int) {
+	if this.off < end {
+		f := this.field(parent, "Unparsed", end-this.off)
+		f.Err = fmt.Errorf("dissect: %d bytes could not be parsed", f.Length)
+	}
+}
+
+func (this *dissector) fixedHeader(root *Field, mtype MessageType) {
+	f := this.field(root, "Fixed Header", 1)
+	b := f.Raw[0]
+	f.Value = fmt.Sprintf("%08b", b)
+
+	t := f.add(bitField("Packet Type", f.Offset, b, 0xf0))
+	t.Value += fmt.Sprintf(" (%s)", mtype.Name())
+	if !mtype.Valid() {
+		t.Err = fmt.Errorf("dissect: Invalid message type %d", mtype)
+	}
+
+	if mtype == PUBLISH {
+		f.add(bitField("DUP Flag", f.Offset, b, 0x08))
+
+		q := f.add(bitField("QoS Level", f.Offset, b, 0x06))
+		if !ValidQos((b >> 1) & 0x3) {
+			q.Err = fmt.Errorf("dissect: Invalid QoS (%d) for PUBLISH message", (b>>1)&0x3)
+		}
+
+		f.add(bitField("RETAIN", f.Offset, b, 0x01))
+		return
+	}
+
+	r := f.add(bitField("Reserved Flags", f.Offset, b, 0x0f))
+	if mtype.Valid() && b&0x0f != mtype.DefaultFlags() {
+		r.Err = fmt.Errorf("dissect: Invalid flags for %s. Expecting %d, got %d", mtype.Name(), mtype.DefaultFlags(), b&0x0f)
+	}
+}
+
+func (this *dissector) remainingLength(root *Field) (int, bool) {
+	f := &Field{
+		Name:   "Remaining Length",
+		Offset: this.off,
+	}
+	root.add(f)
+
+	var x, s int
+
+	for i := 0; ; i++ {
+		if this.off >= len(this.b) {
+			f.Err = fmt.Errorf("dissect: Remaining length truncated after %d bytes", i)
+			break
+		}
+
+		if i == 4 {
+			f.Err = fmt.Errorf("dissect: Malformed remaining length. 4th byte has continuation bit set.")
+			break
+		}
+
+		c := this.field(f, "Byte "+strconv.Itoa(i), 1).Raw[0]
+		x |= int(c&0x7f) << uint(s)
+		s += 7
+
+		bf := f.Fields[i]
+		bf.Value = fmt.Sprintf("value %d, continuation %t", c&0x7f, c&0x80 != 0)
+
+		if c < 0x80 {
+			break
+		}
+	}
+
+	f.Length = this.off - f.Offset
+	f.Raw = this.b[f.Offset:this.off]
+	f.Value = strconv.Itoa(x)
+
+	return x, f.Err == nil
+}
+
+// body dissects the variable header and payload. It returns false if the packet is
+// truncated and the rest of the body can't be located.
+func (this *dissector) body(root *Field, mtype MessageType) bool {
+	switch mtype {
+	case CONNECT:
+		return this.connect(root)
+
+	case CONNACK:
+		return this.connack(root)
+
+	case PUBLISH:
+		return this.publish(root)
+
+	case PUBACK, PUBREC, PUBREL, PUBCOMP, UNSUBACK:
+		return this.uint16(root, "Packet Identifier")
+
+	case SUBSCRIBE:
+		return this.subscribe(root)
+
+	case SUBACK:
+		return this.suback(root)
+
+	case UNSUBSCRIBE:
+		return this.unsubscribe(root)
+
+	case PINGREQ, PINGRESP, DISCONNECT:
+		return true
+	}
+
+	return false
+}
+
+func (this *dissector) uint16(parent *Field, name string) bool {
+	f, ok := this.need(parent, name, 2)
+	if ok {
+		f.Value = strconv.Itoa(int(binary.BigEndian.Uint16(f.Raw)))
+	}
+
+	return ok
+}
+
+func (this *dissector) lpString(parent *Field, name string) (*Field, bool) {
+	f := &Field{
+		Name:   name,
+		Offset: this.off,
+	}
+	parent.add(f)
+
+	defer func() {
+		f.Length = this.off - f.Offset
+		f.Raw = this.b[f.Offset:this.off]
+	}()
+
+	l, ok := this.need(f, "Length", 2)
+	if !ok {
+		return f, false
+	}
+
+	n := int(binary.BigEndian.Uint16(l.Raw))
+	l.Value = strconv.Itoa(n)
+
+	v, ok := this.need(f, "Value", n)
+	v.Value = strconv.Quote(string(v.Raw))
+	f.Value = v.Value
+
+	return f, ok
+}
+
+func (this *dissector) connect(root *Field) bool {
+	name, ok := this.lpString(root, "Protocol Name")
+	if !ok {
+		return false
+	}
+
+	level, ok := this.need(root, "Protocol Level", 1)
+	if !ok {
+		return false
+	}
+
+	v := level.Raw[0]
+	level.Value = strconv.Itoa(int(v))
+	if verstr, ok := SupportedVersions[v]; !ok {
+		level.Err = ErrUnacceptableProtocolVersion
+	} else if name.Value != strconv.Quote(verstr) {
+		name.Err = fmt.Errorf("dissect: Protocol name %s does not match protocol level %d", name.Value, v)
+	}
+
+	flags, ok := this.need(root, "Connect Flags", 1)
+	if !ok {
+		return false
+	}
+
+	b := flags.Raw[0]
+	flags.Value = fmt.Sprintf("%08b", b)
+
+	flags.add(bitField("User Name Flag", flags.Offset, b, 0x80))
+	flags.add(bitField("Password Flag", flags.Offset, b, 0x40))
+	flags.add(bitField("Will Retain", flags.Offset, b, 0x20))
+	wq := flags.add(bitField("Will QoS", flags.Offset, b, 0x18))
+	flags.add(bitField("Will Flag", flags.Offset, b, 0x04))
+	flags.add(bitField("Clean Session", flags.Offset, b, 0x02))
+	rf := flags.add(bitField("Reserved", flags.Offset, b, 0x01))
+
+	if b&0x01 != 0 {
+		rf.Err = fmt.Errorf("dissect: Connect Flags reserved bit 0 is not 0")
+	}
+
+	will := b&0x04 != 0
+	if (b>>3)&0x3 > QosExactlyOnce {
+		wq.Err = fmt.Errorf("dissect: Invalid Will QoS %d", (b>>3)&0x3)
+	} else if !will && b&0x38 != 0 {
+		wq.Err = fmt.Errorf("dissect: Will QoS and Will Retain must be 0 if the Will Flag is 0")
+	}
+
+	if !this.uint16(root, "Keep Alive") {
+		return false
+	}
+
+	if _, ok = this.lpString(root, "Client Identifier"); !ok {
+		return false
+	}
+
+	if will {
+		if _, ok = this.lpString(root, "Will Topic"); !ok {
+			return false
+		}
+
+		if _, ok = this.lpString(root, "Will Message"); !ok {
+			return false
+		}
+	}
+
+	// According to the 3.1 spec, it's possible that the username and password
+	// flags are set, but the strings are missing.
+	if b&0x80 != 0 && this.off < this.end {
+		if _, ok = this.lpString(root, "User Name"); !ok {
+			return false
+		}
+	}
+
+	if b&0x40 != 0 && this.off < this.end {
+		if _, ok = this.lpString(root, "Password"); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (this *dissector) connack(root *Field) bool {
+	flags, ok := this.need(root, "Acknowledge Flags", 1)
+	if !ok {
+		return false
+	}
+
+	b := flags.Raw[0]
+	flags.Value = fmt.Sprintf("%08b", b)
+
+	r := flags.add(bitField("Reserved", flags.Offset, b, 0xfe))
+	if b&0xfe != 0 {
+		r.Err = fmt.Errorf("dissect: Bits 7-1 in Connack Acknowledge Flags byte (1) are not 0")
+	}
+
+	flags.add(bitField("Session Present", flags.Offset, b, 0x01))
+
+	code, ok := this.need(root, "Return Code", 1)
+	if !ok {
+		return false
+	}
+
+	c := ConnackCode(code.Raw[0])
+	code.Value = fmt.Sprintf("%d (%s)", c, c.Response())
+	if !c.Valid() {
+		code.Err = fmt.Errorf("dissect: Invalid CONNACK return code (%d)", c)
+	}
+
+	return true
+}
+
+func (this *dissector) publish(root *Field) bool {
+	topic, ok := this.lpString(root, "Topic Name")
+	if !ok {
+		return false
+	}
+
+	if len(topic.Fields) > 1 && !ValidTopic(topic.Fields[1].Raw) {
+		topic.Err = fmt.Errorf("dissect: Invalid topic name. Must not be empty or contain wildcard characters")
+	}
+
+	if (this.b[0]>>1)&0x3 != 0 {
+		if !this.uint16(root, "Packet Identifier") {
+			return false
+		}
+	}
+
+	p := this.field(root, "Payload", this.end-this.off)
+	p.Value = strconv.Itoa(p.Length) + " bytes"
+
+	return true
+}
+
+func (this *dissector) subscribe(root *Field) bool {
+	if !this.uint16(root, "Packet Identifier") {
+		return false
+	}
+
+	if this.off >= this.end {
+		root.add(&Field{
+			Name:   "Payload",
+			Offset: this.off,
+			Err:    fmt.Errorf("dissect: Empty topic list"),
+		})
+		return true
+	}
+
+	for i := 0; this.off < this.end; i++ {
+		sub := &Field{
+			Name:   "Subscription " + strconv.Itoa(i),
+			Offset: this.off,
+		}
+		root.add(sub)
+
+		t, ok := this.lpString(sub, "Topic Filter")
+		sub.Value = t.Value
+		if !ok {
+			return false
+		}
+
+		q, ok := this.need(sub, "Requested QoS", 1)
+		if !ok {
+			return false
+		}
+
+		q.Value = strconv.Itoa(int(q.Raw[0]))
+		if q.Raw[0]&0xfc != 0 {
+			q.Err = fmt.Errorf("dissect: Reserved bits in Requested QoS byte are not 0")
+		} else if !ValidQos(q.Raw[0]) {
+			q.Err = fmt.Errorf("dissect: Invalid QoS %d", q.Raw[0])
+		}
+
+		sub.Length = this.off - sub.Offset
+		sub.Raw = this.b[sub.Offset:this.off]
+	}
+
+	return true
+}
+
+func (this *dissector) suback(root *Field) bool {
+	if !this.uint16(root, "Packet Identifier") {
+		return false
+	}
+
+	for i := 0; this.off < this.end; i++ {
+		f := this.field(root, "Return Code "+strconv.Itoa(i), 1)
+		c := f.Raw[0]
+
+		switch c {
+		case QosAtMostOnce, QosAtLeastOnce, QosExactlyOnce:
+			f.Value = fmt.Sprintf("%d (Success, maximum QoS %d)", c, c)
+		case QosFailure:
+			f.Value = fmt.Sprintf("%d (Failure)", c)
+		default:
+			f.Value = strconv.Itoa(int(c))
+			f.Err = fmt.Errorf("dissect: Invalid return code %d", c)
+		}
+	}
+
+	return true
+}
+
+func (this *dissector) unsubscribe(root *Field) bool {
+	if !this.uint16(root, "Packet Identifier") {
+		return false
+	}
+
+	if this.off >= this.end {
+		root.add(&Field{
+			Name:   "Payload",
+			Offset: this.off,
+			Err:    fmt.Errorf("dissect: Empty topic list"),
+		})
+		return true
+	}
+
+	for i := 0; this.off < this.end; i++ {
+		if _, ok := this.lpString(root, "Topic Filter "+strconv.Itoa(i)); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bitField returns a field describing the bits of b selected by mask. The value shows
+// the bits in place, e.g. "...11... = 3".
+func bitField(name string, offset int, b, mask byte) *Field {
+	var pattern [8]byte
+	shift := uint(0)
+
+	for i := uint(0); i < 8; i++ {
+		bit := byte(0x80) >> i
+		switch {
+		case mask&bit == 0:
+			pattern[i] = '.'
+		case b&bit != 0:
+			pattern[i] = '1'
+		default:
+			pattern[i] = '0'
+		}
+	}
+
+	for mask != 0 && mask&(1<<shift) == 0 {
+		shift++
+	}
+
+	return &Field{
+		Name:   name,
+		Offset: offset,
+		Length: 1,
+		Raw:    []byte{b},
+		Value:  fmt.Sprintf("%s = %d", pattern[:], (b&mask)>>shift),
+	}
+}
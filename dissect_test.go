@@ -0,0 +1,138 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func fieldNames(f *Field) []string {
+	var names []string
+	for _, c := range f.Fields {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestDissectConnect(t *testing.T) {
+	root := Dissect(msgBytes)
+
+	assert.True(t, true, root.FirstError() == nil, "Unexpected error.", root)
+	assert.Equal(t, true, "CONNECT", root.Name, "Incorrect packet name.")
+	assert.Equal(t, true, len(msgBytes), root.Length, "Incorrect packet length.")
+
+	assert.Equal(t, true, []string{
+		"Fixed Header", "Remaining Length", "Protocol Name", "Protocol Level", "Connect Flags",
+		"Keep Alive", "Client Identifier", "Will Topic", "Will Message", "User Name", "Password",
+	}, fieldNames(root), "Incorrect fields.")
+
+	rl := root.Fields[1]
+	assert.Equal(t, true, "60", rl.Value, "Incorrect remaining length.")
+
+	flags := root.Fields[4]
+	assert.Equal(t, true, 9, flags.Offset, "Incorrect connect flags offset.")
+	assert.Equal(t, true, "...01... = 1", flags.Fields[3].Value, "Incorrect will QoS.")
+
+	cid := root.Fields[6]
+	assert.Equal(t, true, 12, cid.Offset, "Incorrect client ID offset.")
+	assert.Equal(t, true, 9, cid.Length, "Incorrect client ID length.")
+	assert.Equal(t, true, `"surgemq"`, cid.Value, "Incorrect client ID.")
+}
+
+func TestDissectPublishMalformed(t *testing.T) {
+	b := []byte{
+		byte(PUBLISH<<4) | 6, // QoS 3
+		13,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		'h', 'i',
+	}
+
+	root := Dissect(b)
+
+	e := root.FirstError()
+	assert.True(t, true, e != nil, "Expecting error.")
+	assert.Equal(t, true, "QoS Level", e.Name, "Incorrect malformed field.")
+	assert.Equal(t, true, 0, e.Offset, "Incorrect malformed offset.")
+
+	// Dissection continues past the bad QoS
+	assert.Equal(t, true, []string{"Fixed Header", "Remaining Length", "Topic Name", "Packet Identifier", "Payload"}, fieldNames(root), "Incorrect fields.")
+	assert.Equal(t, true, "2 bytes", root.Fields[4].Value, "Incorrect payload.")
+}
+
+func TestDissectTruncated(t *testing.T) {
+	b := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		36,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // QoS
+		0, // topic name MSB (0)
+		8, // topic name LSB (8)
+		'/', 'a', '/', 'b',
+	}
+
+	root := Dissect(b)
+	assert.True(t, true, root.Err != nil, "Expecting truncation error.")
+	assert.Equal(t, true, len(b), root.Length, "Incorrect packet length.")
+
+	sub := root.Fields[len(root.Fields)-1]
+	assert.Equal(t, true, "Subscription 1", sub.Name, "Incorrect field.")
+
+	e := sub.FirstError()
+	assert.True(t, true, e != nil, "Expecting error.")
+	assert.Equal(t, true, "Value", e.Name, "Incorrect malformed field.")
+	assert.Equal(t, true, 16, e.Offset, "Incorrect malformed offset.")
+	assert.Equal(t, true, 4, e.Length, "Incorrect malformed length.")
+}
+
+func TestDissectStream(t *testing.T) {
+	b := []byte{
+		byte(PUBACK << 4), 2, 0, 7,
+		byte(PINGREQ << 4), 0,
+		byte(DISCONNECT << 4), 1, 0,
+	}
+
+	var names []string
+	for len(b) > 0 {
+		root := Dissect(b)
+		names = append(names, root.Name)
+		b = b[root.Length:]
+
+		if root.Name == "DISCONNECT" {
+			assert.Equal(t, true, "Unexpected Data", root.FirstError().Name, "Incorrect malformed field.")
+		}
+	}
+
+	assert.Equal(t, true, []string{"PUBACK", "PINGREQ", "DISCONNECT"}, names, "Incorrect packets.")
+}
+
+func TestDissectBadRemainingLength(t *testing.T) {
+	root := Dissect([]byte{byte(PUBLISH << 4), 0xff, 0xff, 0xff, 0xff, 0x01})
+
+	e := root.FirstError()
+	assert.True(t, true, e != nil, "Expecting error.")
+	assert.Equal(t, true, "Remaining Length", e.Name, "Incorrect malformed field.")
+	assert.Equal(t, true, 4, len(e.Fields), "Incorrect number of bytes.")
+	assert.Equal(t, true, 6, root.Length, "Incorrect packet length.")
+}
@@ -0,0 +1,389 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// envelopeVersion is the first byte of every encrypted payload.
+const envelopeVersion byte = 0x01
+
+const (
+	// AlgAESGCM is AES in Galois/Counter Mode, with a 16, 24 or 32 byte key.
+	AlgAESGCM byte = 0x01
+
+	// AlgChaCha20Poly1305 is ChaCha20-Poly1305, RFC 8439. It's not in the standard
+	// library, so it must be registered with RegisterAEAD, for example with
+	// chacha20poly1305.New from golang.org/x/crypto, before it can be used.
+	AlgChaCha20Poly1305 byte = 0x02
+)
+
+var (
+	// ErrNotEncrypted is returned by PayloadCipher.Payload when a payload published
+	// to a topic that has a key is not encrypted.
+	ErrNotEncrypted = errors.New("mqtt: Payload is not encrypted")
+
+	// ErrUnknownKey is returned by KeyProviders when there's no key with the ID.
+	ErrUnknownKey = errors.New("mqtt: Unknown key")
+)
+
+var (
+	aeadsMu sync.RWMutex
+	aeads   = map[byte]func(key []byte) (cipher.AEAD, error){
+		AlgAESGCM: newAESGCM,
+	}
+)
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// RegisterAEAD makes an AEAD algorithm available for payload encryption under the
+// algorithm ID, which is written in every envelope. AlgAESGCM is always registered.
+func RegisterAEAD(alg byte, f func(key []byte) (cipher.AEAD, error)) error {
+	aeadsMu.Lock()
+	defer aeadsMu.Unlock()
+
+	if _, ok := aeads[alg]; ok {
+		return fmt.Errorf("encrypt/RegisterAEAD: Algorithm %d is already registered", alg)
+	}
+
+	aeads[alg] = f
+
+	return nil
+}
+
+// Key is a payload encryption key.
+type Key struct {
+	// Id identifies the key in the envelope, so receivers can pick the right key
+	// while keys are being rotated. It must be at most 255 bytes.
+	Id string
+
+	// Alg is the AEAD algorithm, such as AlgAESGCM.
+	Alg byte
+
+	// Secret is the key itself.
+	Secret []byte
+}
+
+func (this *Key) aead() (cipher.AEAD, error) {
+	aeadsMu.RLock()
+	f, ok := aeads[this.Alg]
+	aeadsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("encrypt/Key: Unknown algorithm %d", this.Alg)
+	}
+
+	return f(this.Secret)
+}
+
+// KeyProvider selects the keys used to encrypt and decrypt payloads.
+type KeyProvider interface {
+	// EncryptionKey returns the key to encrypt payloads published to the topic
+	// with, or nil if payloads published to the topic are not encrypted.
+	EncryptionKey(topic []byte) (*Key, error)
+
+	// DecryptionKey returns the key with the ID, for a payload published to the
+	// topic. It returns ErrUnknownKey if there's no such key.
+	DecryptionKey(topic []byte, id string) (*Key, error)
+}
+
+// TopicKeyring is a KeyProvider that selects keys by topic filter. Rules are checked
+// in the order they were added, and the first filter matching the topic is used.
+// Each filter can have several keys: the last one added encrypts, and all of them
+// decrypt, so a key can be rotated by adding the new key, and removing the old one
+// once no more messages encrypted with it are expected. TopicKeyring is safe for
+// concurrent use.
+type TopicKeyring struct {
+	mu    sync.RWMutex
+	rules []*keyringRule
+}
+
+type keyringRule struct {
+	filter []byte
+	keys   []*Key
+}
+
+var _ KeyProvider = (*TopicKeyring)(nil)
+
+// NewTopicKeyring creates an empty keyring.
+func NewTopicKeyring() *TopicKeyring {
+	return &TopicKeyring{}
+}
+
+// Add adds the key to the topic filter, and makes it the key that encrypts payloads
+// published to topics matching the filter.
+func (this *TopicKeyring) Add(filter string, key *Key) error {
+	if len(key.Id) > 255 {
+		return fmt.Errorf("encrypt/Add: Key ID is longer than 255 bytes")
+	}
+
+	if _, err := key.aead(); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, r := range this.rules {
+		if string(r.filter) == filter {
+			r.keys = append(r.keys, key)
+			return nil
+		}
+	}
+
+	this.rules = append(this.rules, &keyringRule{filter: []byte(filter), keys: []*Key{key}})
+
+	return nil
+}
+
+// Remove removes the key with the ID from the topic filter. If it was the last key
+// of the filter, the filter is removed too.
+func (this *TopicKeyring) Remove(filter, id string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i, r := range this.rules {
+		if string(r.filter) != filter {
+			continue
+		}
+
+		for j, k := range r.keys {
+			if k.Id == id {
+				r.keys = append(r.keys[:j:j], r.keys[j+1:]...)
+				break
+			}
+		}
+
+		if len(r.keys) == 0 {
+			this.rules = append(this.rules[:i:i], this.rules[i+1:]...)
+		}
+
+		return
+	}
+}
+
+// EncryptionKey returns the last key added to the first filter matching the topic.
+func (this *TopicKeyring) EncryptionKey(topic []byte) (*Key, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if r := this.match(topic); r != nil {
+		return r.keys[len(r.keys)-1], nil
+	}
+
+	return nil, nil
+}
+
+// DecryptionKey returns the key with the ID from the first filter matching the topic.
+func (this *TopicKeyring) DecryptionKey(topic []byte, id string) (*Key, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if r := this.match(topic); r != nil {
+		for _, k := range r.keys {
+			if k.Id == id {
+				return k, nil
+			}
+		}
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// match returns the first rule whose filter matches the topic. mu must be held.
+func (this *TopicKeyring) match(topic []byte) *keyringRule {
+	for _, r := range this.rules {
+		if MatchTopic(r.filter, topic) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// PayloadCipher encrypts and decrypts PUBLISH payloads with the keys selected by its
+// KeyProvider. Encrypted payloads are wrapped in an envelope:
+//
+//	version (1 byte) | algorithm (1 byte) | key ID length (1 byte) | key ID | nonce | ciphertext
+//
+// The topic name and the envelope header are authenticated as associated data, so a
+// payload can't be moved to another topic, or have its key ID changed. Intermediate
+// brokers see only the envelope.
+//
+// Payloads published to topics that have no key pass through unchanged. If the
+// payload is also compressed with a PayloadCodec, it must be compressed before it's
+// encrypted, and decrypted before it's decompressed.
+type PayloadCipher struct {
+	// Keys selects the keys.
+	Keys KeyProvider
+
+	// Rand is the source of nonces. If nil, crypto/rand.Reader is used.
+	Rand io.Reader
+}
+
+// NewPayloadCipher creates a PayloadCipher using the keys.
+func NewPayloadCipher(keys KeyProvider) *PayloadCipher {
+	return &PayloadCipher{Keys: keys}
+}
+
+// SetPayload encrypts the payload if the message's topic has a key, and sets it as
+// the message's payload. The topic must be set first.
+func (this *PayloadCipher) SetPayload(msg *PublishMessage, payload []byte) error {
+	key, err := this.Keys.EncryptionKey(msg.Topic())
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		msg.SetPayload(payload)
+		return nil
+	}
+
+	aead, err := key.aead()
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte{envelopeVersion, key.Alg, byte(len(key.Id))}, key.Id...)
+
+	out := make([]byte, len(header)+aead.NonceSize(), len(header)+aead.NonceSize()+len(payload)+aead.Overhead())
+	copy(out, header)
+
+	nonce := out[len(header):]
+
+	r := this.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return fmt.Errorf("encrypt/SetPayload: Error generating nonce: %w", err)
+	}
+
+	msg.SetPayload(aead.Seal(out, nonce, payload, additionalData(header, msg.Topic())))
+
+	return nil
+}
+
+// Payload returns the decrypted payload of the message. If the message's topic has
+// no key, the payload is returned as is. If it has a key, but the payload is not in
+// an envelope, ErrNotEncrypted is returned. Payload streams can't be decrypted, and
+// ErrPayloadStream is returned for them.
+func (this *PayloadCipher) Payload(msg *PublishMessage) ([]byte, error) {
+	if r, _ := msg.PayloadStream(); r != nil {
+		return nil, fmt.Errorf("encrypt/Payload: %w", ErrPayloadStream)
+	}
+
+	topic, payload := msg.Topic(), msg.Payload()
+
+	key, err := this.Keys.EncryptionKey(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return payload, nil
+	}
+
+	if len(payload) < 3 || payload[0] != envelopeVersion || len(payload) < 3+int(payload[2]) {
+		return nil, ErrNotEncrypted
+	}
+
+	n := 3 + int(payload[2])
+	header := payload[:n]
+
+	key, err = this.Keys.DecryptionKey(topic, string(payload[3:n]))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt/Payload: Key %q: %w", payload[3:n], err)
+	}
+
+	if key.Alg != payload[1] {
+		return nil, fmt.Errorf("encrypt/Payload: Key %q is not for algorithm %d", key.Id, payload[1])
+	}
+
+	aead, err := key.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) < n+aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("encrypt/Payload: Envelope is too short")
+	}
+
+	nonce := payload[n : n+aead.NonceSize()]
+
+	plain, err := aead.Open(nil, nonce, payload[n+aead.NonceSize():], additionalData(header, topic))
+	if err != nil {
+		return nil, fmt.Errorf("encrypt/Payload: %w", err)
+	}
+
+	return plain, nil
+}
+
+// Interceptor returns an interceptor that encrypts outbound PUBLISH messages and
+// decrypts inbound ones. Outbound messages are cloned before they're encrypted, so
+// a message that's sent again, such as a QoS 1 retry, isn't encrypted twice.
+// Inbound messages that fail to decrypt are rejected, and so are messages in either
+// direction with a payload stream.
+func (this *PayloadCipher) Interceptor() Interceptor {
+	return func(ctx context.Context, dir Direction, msg Message) (Message, error) {
+		m, ok := msg.(*PublishMessage)
+		if !ok {
+			return msg, nil
+		}
+
+		if dir == Outbound {
+			if r, _ := m.PayloadStream(); r != nil {
+				return nil, fmt.Errorf("encrypt/Interceptor: %w", ErrPayloadStream)
+			}
+
+			c := m.Clone()
+			if err := this.SetPayload(c, m.Payload()); err != nil {
+				return nil, err
+			}
+
+			return c, nil
+		}
+
+		payload, err := this.Payload(m)
+		if err != nil {
+			return nil, err
+		}
+
+		m.SetPayload(payload)
+
+		return m, nil
+	}
+}
+
+// additionalData returns the envelope header followed by the topic.
+func additionalData(header, topic []byte) []byte {
+	return append(append(make([]byte, 0, len(header)+len(topic)), header...), topic...)
+}
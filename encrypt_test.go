@@ -0,0 +1,234 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func newTestKeyring(t *testing.T) *TopicKeyring {
+	k := NewTopicKeyring()
+	assert.NoError(t, true, k.Add("secret/#", &Key{Id: "k1", Alg: AlgAESGCM, Secret: bytes.Repeat([]byte{1}, 32)}))
+	return k
+}
+
+func newEncryptedPublish(t *testing.T, c *PayloadCipher, topic string, payload []byte) *PublishMessage {
+	msg := NewPublishMessage()
+	assert.NoError(t, true, msg.SetTopic([]byte(topic)))
+	assert.NoError(t, true, c.SetPayload(msg, payload))
+	return msg
+}
+
+func TestPayloadCipherRoundTrip(t *testing.T) {
+	c := NewPayloadCipher(newTestKeyring(t))
+	payload := []byte("the eagle has landed")
+
+	msg := newEncryptedPublish(t, c, "secret/a", payload)
+	assert.False(t, true, bytes.Contains(msg.Payload(), payload), "Payload is not encrypted.")
+	assert.Equal(t, true, envelopeVersion, msg.Payload()[0])
+	assert.Equal(t, true, AlgAESGCM, msg.Payload()[1])
+	assert.Equal(t, true, "k1", string(msg.Payload()[3:5]))
+
+	out, err := c.Payload(roundTripPublish(t, msg))
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, payload, out)
+}
+
+func TestPayloadCipherPlainTopic(t *testing.T) {
+	c := NewPayloadCipher(newTestKeyring(t))
+	payload := []byte("hello")
+
+	msg := newEncryptedPublish(t, c, "public/a", payload)
+	assert.Equal(t, true, payload, msg.Payload())
+
+	out, err := c.Payload(msg)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, payload, out)
+}
+
+func TestPayloadCipherNotEncrypted(t *testing.T) {
+	c := NewPayloadCipher(newTestKeyring(t))
+
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("secret/a"))
+	msg.SetPayload([]byte("hello"))
+
+	_, err := c.Payload(msg)
+	assert.True(t, true, errors.Is(err, ErrNotEncrypted), "Expected ErrNotEncrypted")
+}
+
+func TestPayloadCipherTopicBound(t *testing.T) {
+	c := NewPayloadCipher(newTestKeyring(t))
+
+	msg := newEncryptedPublish(t, c, "secret/a", []byte("hello"))
+	msg.SetTopic([]byte("secret/b"))
+
+	_, err := c.Payload(msg)
+	assert.Error(t, true, err, "Payload moved to another topic should not decrypt.")
+}
+
+func TestPayloadCipherTampered(t *testing.T) {
+	c := NewPayloadCipher(newTestKeyring(t))
+
+	msg := newEncryptedPublish(t, c, "secret/a", []byte("hello"))
+	p := msg.Payload()
+	p[len(p)-1] ^= 0xff
+
+	_, err := c.Payload(msg)
+	assert.Error(t, true, err)
+
+	msg.SetPayload(p[:10])
+	_, err = c.Payload(msg)
+	assert.Error(t, true, err)
+}
+
+func TestPayloadCipherRotation(t *testing.T) {
+	k := newTestKeyring(t)
+	c := NewPayloadCipher(k)
+
+	old := newEncryptedPublish(t, c, "secret/a", []byte("old"))
+
+	assert.NoError(t, true, k.Add("secret/#", &Key{Id: "k2", Alg: AlgAESGCM, Secret: bytes.Repeat([]byte{2}, 16)}))
+
+	msg := newEncryptedPublish(t, c, "secret/a", []byte("new"))
+	assert.Equal(t, true, "k2", string(msg.Payload()[3:5]))
+
+	out, err := c.Payload(old)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "old", string(out))
+
+	k.Remove("secret/#", "k1")
+
+	_, err = c.Payload(old)
+	assert.True(t, true, errors.Is(err, ErrUnknownKey), "Expected ErrUnknownKey")
+
+	out, err = c.Payload(msg)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "new", string(out))
+
+	k.Remove("secret/#", "k2")
+
+	key, err := k.EncryptionKey([]byte("secret/a"))
+	assert.NoError(t, true, err)
+	assert.True(t, true, key == nil, "Expected no key after removing the filter.")
+}
+
+func TestTopicKeyringFirstMatch(t *testing.T) {
+	k := NewTopicKeyring()
+	assert.NoError(t, true, k.Add("a/b", &Key{Id: "exact", Alg: AlgAESGCM, Secret: make([]byte, 16)}))
+	assert.NoError(t, true, k.Add("a/+", &Key{Id: "wild", Alg: AlgAESGCM, Secret: make([]byte, 16)}))
+
+	key, _ := k.EncryptionKey([]byte("a/b"))
+	assert.Equal(t, true, "exact", key.Id)
+
+	key, _ = k.EncryptionKey([]byte("a/c"))
+	assert.Equal(t, true, "wild", key.Id)
+}
+
+func TestTopicKeyringConcurrentRotation(t *testing.T) {
+	k := NewTopicKeyring()
+	key := &Key{Id: "k", Alg: AlgAESGCM, Secret: make([]byte, 16)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 1000; i++ {
+			k.Add("a/#", key)
+			k.Remove("a/#", "k")
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		_, err := k.EncryptionKey([]byte("a/b"))
+		assert.NoError(t, true, err)
+
+		k.DecryptionKey([]byte("a/b"), "k")
+	}
+
+	<-done
+}
+
+func TestTopicKeyringInvalidKey(t *testing.T) {
+	k := NewTopicKeyring()
+
+	assert.Error(t, true, k.Add("#", &Key{Id: "k", Alg: AlgAESGCM, Secret: make([]byte, 7)}))
+	assert.Error(t, true, k.Add("#", &Key{Id: "k", Alg: 0x7f, Secret: make([]byte, 16)}))
+	assert.Error(t, true, k.Add("#", &Key{Id: string(make([]byte, 256)), Alg: AlgAESGCM, Secret: make([]byte, 16)}))
+}
+
+func TestRegisterAEAD(t *testing.T) {
+	assert.Error(t, true, RegisterAEAD(AlgAESGCM, newAESGCM))
+
+	const alg = 0x70
+	assert.NoError(t, true, RegisterAEAD(alg, func(key []byte) (cipher.AEAD, error) { return newAESGCM(key) }))
+	t.Cleanup(func() {
+		aeadsMu.Lock()
+		delete(aeads, alg)
+		aeadsMu.Unlock()
+	})
+
+	k := NewTopicKeyring()
+	assert.NoError(t, true, k.Add("#", &Key{Id: "x", Alg: alg, Secret: make([]byte, 16)}))
+
+	c := NewPayloadCipher(k)
+	msg := newEncryptedPublish(t, c, "a", []byte("hello"))
+	assert.Equal(t, true, byte(alg), msg.Payload()[1])
+
+	out, err := c.Payload(msg)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "hello", string(out))
+}
+
+func TestPayloadCipherInterceptor(t *testing.T) {
+	c := NewPayloadCipher(newTestKeyring(t))
+	icpt := c.Interceptor()
+
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("secret/a"))
+	msg.SetPayload([]byte("hello"))
+
+	out, err := icpt(context.Background(), Outbound, msg)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "hello", string(msg.Payload()), "Outbound message should not be modified.")
+
+	sent := out.(*PublishMessage)
+	assert.False(t, true, bytes.Equal(sent.Payload(), msg.Payload()), "Payload is not encrypted.")
+
+	in, err := icpt(context.Background(), Inbound, roundTripPublish(t, sent))
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "hello", string(in.(*PublishMessage).Payload()))
+
+	stream := NewPublishMessage()
+	stream.SetTopic([]byte("secret/a"))
+	assert.NoError(t, true, stream.SetPayloadStream(bytes.NewReader([]byte("hello")), 5))
+
+	_, err = icpt(context.Background(), Outbound, stream)
+	assert.True(t, true, errors.Is(err, ErrPayloadStream), "Expecting payload stream error.", err)
+
+	_, err = icpt(context.Background(), Inbound, stream)
+	assert.True(t, true, errors.Is(err, ErrPayloadStream), "Expecting payload stream error.", err)
+
+	ping := NewPingreqMessage()
+	out, err = icpt(context.Background(), Inbound, ping)
+	assert.NoError(t, true, err)
+	assert.True(t, true, out == Message(ping), "Other messages should pass through.")
+}
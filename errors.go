@@ -0,0 +1,107 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMalformedPacket matches any *MalformedPacketError when used with errors.Is.
+	ErrMalformedPacket = errors.New("mqtt: Malformed packet")
+
+	// ErrPacketTooLarge is returned when a message's remaining length exceeds
+	// 268435455 bytes, or a length prefixed string is longer than 65535 bytes.
+	ErrPacketTooLarge = errors.New("mqtt: Packet too large")
+
+	// ErrProtocolViolation is returned when a message is well-formed, but breaks one
+	// of the rules of the spec, such as a reserved bit that's not 0, or a SUBSCRIBE
+	// message without any topic filters.
+	ErrProtocolViolation = errors.New("mqtt: Protocol violation")
+
+	// ErrPayloadStream is returned when the whole payload of a PUBLISH message is
+	// needed, such as to encrypt or compress it, but the payload is a stream set with
+	// SetPayloadStream or decoded with DecodeStream.
+	ErrPayloadStream = errors.New("mqtt: Payload is a stream")
+)
+
+// MalformedPacketError is returned by Decode and Encode when a message cannot be
+// decoded or encoded. It records the message type, the field that's in error, and
+// where the field starts in the message.
+//
+// The underlying cause can be inspected with errors.Is and errors.As. Messages that
+// end before all their fields are read wrap io.ErrUnexpectedEOF, so truncated input
+// can be told apart from ErrProtocolViolation, ErrPacketTooLarge and
+// ErrMalformedUTF8.
+type MalformedPacketError struct {
+	// Type is the type of the message being decoded or encoded.
+	Type MessageType
+
+	// Field is the name of the field in error, as it's named in the spec.
+	Field string
+
+	// Offset is the byte offset of the field from the start of the message, or -1 if
+	// the error is returned by Encode.
+	Offset int
+
+	// Err is the underlying cause.
+	Err error
+}
+
+func (this *MalformedPacketError) Error() string {
+	if this.Offset < 0 {
+		return fmt.Sprintf("mqtt: Malformed %s packet, %s: %v", this.Type.Name(), this.Field, this.Err)
+	}
+
+	return fmt.Sprintf("mqtt: Malformed %s packet, %s at byte %d: %v", this.Type.Name(), this.Field, this.Offset, this.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (this *MalformedPacketError) Unwrap() error {
+	return this.Err
+}
+
+// Is returns true if target is ErrMalformedPacket.
+func (this *MalformedPacketError) Is(target error) bool {
+	return target == ErrMalformedPacket
+}
+
+// malformed returns a *MalformedPacketError for this message. The offset is from the
+// start of the message, including the fixed header.
+func (this *fixedHeader) malformed(field string, offset int, err error) error {
+	return &MalformedPacketError{
+		Type:   this.mtype,
+		Field:  field,
+		Offset: offset,
+		Err:    err,
+	}
+}
+
+// headerLength returns the number of bytes in the fixed header, based on the
+// remaining length.
+func (this *fixedHeader) headerLength() int {
+	n := 2
+	for x := this.remlen; x >= 0x80; x >>= 7 {
+		n++
+	}
+
+	return n
+}
+
+// violation returns an error wrapping ErrProtocolViolation.
+func violation(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrProtocolViolation}, args...)...)
+}
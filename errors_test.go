@@ -0,0 +1,165 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestMalformedPacketErrorTruncated(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH << 4),
+		10,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', 'b',
+	}
+
+	msg := NewPublishMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+
+	var merr *MalformedPacketError
+	assert.True(t, true, errors.As(err, &merr), "Expecting *MalformedPacketError.", err)
+	assert.Equal(t, true, PUBLISH, merr.Type, "Incorrect message type.")
+	assert.Equal(t, true, "Remaining Length", merr.Field, "Incorrect field.")
+	assert.Equal(t, true, 1, merr.Offset, "Incorrect offset.")
+	assert.True(t, true, errors.Is(err, ErrMalformedPacket), "Expecting ErrMalformedPacket.")
+	assert.True(t, true, errors.Is(err, io.ErrUnexpectedEOF), "Expecting io.ErrUnexpectedEOF.")
+	assert.False(t, true, errors.Is(err, ErrProtocolViolation), "Not expecting ErrProtocolViolation.")
+}
+
+func TestMalformedPacketErrorEOF(t *testing.T) {
+	msg := NewPublishMessage()
+	_, err := msg.Decode(bytes.NewBuffer(nil))
+	assert.True(t, true, err == io.EOF, "Expecting io.EOF for empty input.", err)
+
+	_, err = msg.Decode(bytes.NewBuffer([]byte{byte(PUBLISH << 4)}))
+	assert.True(t, true, errors.Is(err, io.ErrUnexpectedEOF), "Expecting io.ErrUnexpectedEOF.", err)
+}
+
+func TestMalformedPacketErrorTooLarge(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBACK << 4),
+		0xff, 0xff, 0xff, 0xff, 0x01,
+	}
+
+	msg := NewPubackMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+
+	var merr *MalformedPacketError
+	assert.True(t, true, errors.As(err, &merr), "Expecting *MalformedPacketError.", err)
+	assert.Equal(t, true, PUBACK, merr.Type, "Incorrect message type.")
+	assert.Equal(t, true, "Remaining Length", merr.Field, "Incorrect field.")
+	assert.True(t, true, errors.Is(err, ErrPacketTooLarge), "Expecting ErrPacketTooLarge.")
+
+	pub := NewPublishMessage()
+	pub.SetTopic([]byte("a"))
+	pub.SetPayload(make([]byte, maxRemainingLength))
+	_, _, err = pub.Encode()
+	assert.True(t, true, errors.Is(err, ErrPacketTooLarge), "Expecting ErrPacketTooLarge.", err)
+}
+
+func TestMalformedPacketErrorProtocolViolation(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		14,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,  // Protocol level 4
+		3,  // connect flags 00000011, reserved bit set
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		2,  // Client ID LSB (2)
+		'a', 'b',
+	}
+
+	msg := NewConnectMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+
+	var merr *MalformedPacketError
+	assert.True(t, true, errors.As(err, &merr), "Expecting *MalformedPacketError.", err)
+	assert.Equal(t, true, CONNECT, merr.Type, "Incorrect message type.")
+	assert.Equal(t, true, "Connect Flags", merr.Field, "Incorrect field.")
+	assert.Equal(t, true, 9, merr.Offset, "Incorrect offset.")
+	assert.True(t, true, errors.Is(err, ErrProtocolViolation), "Expecting ErrProtocolViolation.")
+	assert.False(t, true, errors.Is(err, io.ErrUnexpectedEOF), "Not expecting io.ErrUnexpectedEOF.")
+
+	msgBytes = []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+	}
+
+	sub := NewSubscribeMessage()
+	_, err = sub.Decode(bytes.NewBuffer(msgBytes))
+	assert.True(t, true, errors.Is(err, ErrProtocolViolation), "Expecting ErrProtocolViolation.", err)
+}
+
+func TestMalformedPacketErrorOffset(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		11,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic filter MSB (0)
+		1, // topic filter LSB (1)
+		'a',
+		0, // QoS
+		0, // topic filter MSB (0)
+		2, // topic filter LSB (2)
+		'b', 0xff,
+		1, // QoS
+	}
+
+	msg := NewSubscribeMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+
+	var merr *MalformedPacketError
+	assert.True(t, true, errors.As(err, &merr), "Expecting *MalformedPacketError.", err)
+	assert.Equal(t, true, "Topic Filter", merr.Field, "Incorrect field.")
+	assert.Equal(t, true, 8, merr.Offset, "Incorrect offset.")
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8.")
+	assert.Equal(t, true, "mqtt: Malformed SUBSCRIBE packet, Topic Filter at byte 8: mqtt: Malformed UTF-8 encoded string", err.Error(), "Incorrect error string.")
+}
+
+func TestMalformedPacketErrorEncode(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetPayload([]byte("send me home"))
+
+	_, _, err := msg.Encode()
+
+	var merr *MalformedPacketError
+	assert.True(t, true, errors.As(err, &merr), "Expecting *MalformedPacketError.", err)
+	assert.Equal(t, true, "Topic Name", merr.Field, "Incorrect field.")
+	assert.Equal(t, true, -1, merr.Offset, "Incorrect offset.")
+	assert.True(t, true, errors.Is(err, ErrProtocolViolation), "Expecting ErrProtocolViolation.")
+}
+
+func TestDecodeErrorCauseTyped(t *testing.T) {
+	assert.Equal(t, true, "eof", DecodeErrorCause(&MalformedPacketError{Err: io.ErrUnexpectedEOF}), "Incorrect cause.")
+	assert.Equal(t, true, "too_large", DecodeErrorCause(&MalformedPacketError{Err: ErrPacketTooLarge}), "Incorrect cause.")
+	assert.Equal(t, true, "protocol", DecodeErrorCause(&MalformedPacketError{Err: violation("test")}), "Incorrect cause.")
+	assert.Equal(t, true, "utf8", DecodeErrorCause(&MalformedPacketError{Err: ErrMalformedUTF8}), "Incorrect cause.")
+	assert.Equal(t, true, "connack", DecodeErrorCause(ErrIdentifierRejected), "Incorrect cause.")
+	assert.Equal(t, true, "malformed", DecodeErrorCause(errors.New("test")), "Incorrect cause.")
+}
@@ -16,10 +16,9 @@ package mqtt
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
-
-	"github.com/dataence/glog"
 )
 
 // Fixed header
@@ -30,6 +29,7 @@ type fixedHeader struct {
 	remlen int32
 	mtype  MessageType
 	flags  byte
+	opts   *DecodeOptions
 }
 
 // String returns a string representation of the message.
@@ -46,11 +46,11 @@ func (this *fixedHeader) Encode() (io.Reader, int, error) {
 	total := 0
 
 	if this.remlen > maxRemainingLength {
-		return nil, 0, fmt.Errorf("header/Encode: remaining length (%d) too big", this.remlen)
+		return nil, 0, this.malformed("Remaining Length", -1, fmt.Errorf("%w: remaining length (%d) too big", ErrPacketTooLarge, this.remlen))
 	}
 
 	if !this.mtype.Valid() {
-		return nil, 0, fmt.Errorf("header/Encode: Invalid message type %d", this.mtype)
+		return nil, 0, this.malformed("Packet Type", -1, fmt.Errorf("Invalid message type %d", this.mtype))
 	}
 
 	this.resetBuf()
@@ -62,7 +62,7 @@ func (this *fixedHeader) Encode() (io.Reader, int, error) {
 
 	n, err := writeVarint32(this.buf, this.remlen)
 	if err != nil {
-		return nil, total + n, err
+		return nil, total + n, this.malformed("Remaining Length", -1, err)
 	}
 	total += n
 
@@ -81,7 +81,7 @@ func (this *fixedHeader) Decode(src io.Reader) (int, error) {
 	}
 
 	if int(this.remlen) != this.buf.Len() {
-		return int(total), fmt.Errorf("header/Decode: Insufficient buffer size. Expecting %d bytes, got %d bytes.", this.remlen, this.buf.Len())
+		return int(total), this.malformed("Remaining Length", 1, fmt.Errorf("%w: Insufficient buffer size. Expecting %d bytes, got %d bytes.", io.ErrUnexpectedEOF, this.remlen, this.buf.Len()))
 	}
 
 	return int(total), nil
@@ -134,10 +134,14 @@ func (this *fixedHeader) RemainingLength() int32 {
 
 // SetRemainingLength sets the length of the non-fixed-header part of the message.
 // It returns error if the length is greater than 268435455, which is the max
-// message length as defined by the MQTT spec.
+// message length as defined by the MQTT spec. The error wraps ErrPacketTooLarge.
 func (this *fixedHeader) SetRemainingLength(remlen int32) error {
-	if remlen > maxRemainingLength || remlen < 0 {
-		return fmt.Errorf("header/SetLength: Value (%d) out of bound (max %d, min 0)", remlen, maxRemainingLength)
+	if remlen > maxRemainingLength {
+		return fmt.Errorf("header/SetLength: %w: Value (%d) out of bound (max %d)", ErrPacketTooLarge, remlen, maxRemainingLength)
+	}
+
+	if remlen < 0 {
+		return fmt.Errorf("header/SetLength: Value (%d) out of bound (min 0)", remlen)
 	}
 
 	this.remlen = remlen
@@ -145,6 +149,25 @@ func (this *fixedHeader) SetRemainingLength(remlen int32) error {
 }
 
 func (this *fixedHeader) copy(src io.Reader) (int64, error) {
+	total, err := this.decodeHeader(src)
+	if err != nil {
+		return total, err
+	}
+
+	n, err := io.CopyN(this.buf, src, int64(this.remlen))
+	if err == io.EOF {
+		err = this.malformed("Remaining Length", 1, fmt.Errorf("%w: Expecting %d bytes, got %d bytes.", io.ErrUnexpectedEOF, this.remlen, n))
+	}
+	if err != nil {
+		return total + n, err
+	}
+
+	return total, nil
+}
+
+// decodeHeader reads the first byte of the fixed header and the remaining length,
+// but none of the bytes that follow.
+func (this *fixedHeader) decodeHeader(src io.Reader) (int64, error) {
 	total, err := io.CopyN(this.buf, src, 1)
 	if err != nil {
 		return 0, err
@@ -157,35 +180,35 @@ func (this *fixedHeader) copy(src io.Reader) (int64, error) {
 
 	mtype := MessageType(b >> 4)
 	if !mtype.Valid() {
-		return total, glog.NewError("Invalid message type %d.", mtype)
+		return total, this.malformed("Packet Type", 0, violation("Invalid message type %d.", mtype))
 	}
 
 	if mtype != this.mtype {
-		return total, glog.NewError("Invalid message type %d. Expecting %d.", mtype, this.mtype)
+		return total, this.malformed("Packet Type", 0, fmt.Errorf("Invalid message type %d. Expecting %d.", mtype, this.mtype))
 	}
 
 	this.flags = b & 0x0f
-	if this.mtype != PUBLISH && this.flags != this.mtype.DefaultFlags() {
-		return total, glog.NewError("Invalid message (%d) flags. Expecting %d, got %d", this.mtype, this.mtype.DefaultFlags, this.flags)
+	if this.mtype != PUBLISH && this.flags != this.mtype.DefaultFlags() && !this.decodeOptions().lenient() {
+		return total, this.malformed("Flags", 0, violation("Invalid message (%d) flags. Expecting %d, got %d", this.mtype, this.mtype.DefaultFlags(), this.flags))
 	}
 
 	if this.mtype == PUBLISH && !ValidQos((this.flags>>1)&0x3) {
-		return total, glog.NewError("Invalid QoS (%d) for PUBLISH message.", (this.flags>>1)&0x3)
+		return total, this.malformed("QoS", 0, violation("Invalid QoS (%d) for PUBLISH message.", (this.flags>>1)&0x3))
 	}
 
 	var m int
 	this.remlen, m, err = readVarint32(this.buf, src)
 	if err != nil {
+		var merr *MalformedPacketError
+		if errors.As(err, &merr) {
+			merr.Type = this.mtype
+		}
+
 		return total + int64(m), err
 	}
 	total += int64(m)
 	this.buf.Next(m)
 
-	n, err := io.CopyN(this.buf, src, int64(this.remlen))
-	if err != nil {
-		return total + n, err
-	}
-
 	return total, nil
 }
 
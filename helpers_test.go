@@ -0,0 +1,47 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+// roundTripPublish encodes the message and decodes it into a new one, as a receiver
+// would see it.
+func roundTripPublish(t *testing.T, msg *PublishMessage) *PublishMessage {
+	var buf bytes.Buffer
+
+	r, _, err := msg.Encode()
+	assert.NoError(t, true, err, "Error encoding message.")
+	buf.ReadFrom(r)
+
+	out := NewPublishMessage()
+	_, err = out.Decode(&buf)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	return out
+}
+
+// newTestPublishMessage returns a QoS 0 PUBLISH message with the topic and payload.
+func newTestPublishMessage(topic, payload string) *PublishMessage {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte(payload))
+
+	return msg
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultMaxInflight is the inflight window size used if InflightOptions.MaxInflight
+// is 0.
+const DefaultMaxInflight = 20
+
+var (
+	// ErrInflightQueueFull is returned by InflightWindow.Publish when the window and
+	// its queue are full, and the policy is QueueReject.
+	ErrInflightQueueFull = errors.New("mqtt: Inflight queue is full")
+
+	// ErrInflightClosed is returned by InflightWindow.Publish after the window is
+	// closed.
+	ErrInflightClosed = errors.New("mqtt: Inflight window is closed")
+)
+
+// QueuePolicy decides what an InflightWindow does with a PUBLISH message when both
+// the window and its queue are full.
+type QueuePolicy byte
+
+const (
+	// QueueBlock blocks Publish until there's room in the queue, or the context is
+	// done. With no queue, Publish blocks until there's room in the window.
+	QueueBlock QueuePolicy = iota
+
+	// QueueDropOldest drops the oldest queued message to make room for the new one.
+	// With no queue, the new message is dropped.
+	QueueDropOldest
+
+	// QueueDropNewest drops the new message.
+	QueueDropNewest
+
+	// QueueReject returns ErrInflightQueueFull from Publish.
+	QueueReject
+)
+
+// String returns the name of the policy.
+func (this QueuePolicy) String() string {
+	switch this {
+	case QueueBlock:
+		return "block"
+	case QueueDropOldest:
+		return "drop_oldest"
+	case QueueDropNewest:
+		return "drop_newest"
+	case QueueReject:
+		return "reject"
+	}
+
+	return "unknown"
+}
+
+// InflightOptions configure an InflightWindow.
+type InflightOptions struct {
+	// MaxInflight is the maximum number of QoS 1 and 2 PUBLISH messages that have
+	// been sent but not yet acknowledged. If 0, DefaultMaxInflight is used.
+	MaxInflight int
+
+	// MaxQueued is the maximum number of messages waiting for room in the window.
+	// If 0, messages are never queued, and Policy applies as soon as the window
+	// is full.
+	MaxQueued int
+
+	// Policy decides what to do when the window and the queue are full.
+	Policy QueuePolicy
+
+	// Metrics, if set, records the window occupancy, and the messages that were
+	// queued and dropped.
+	Metrics *Metrics
+}
+
+// InflightStats is a snapshot of the state of an InflightWindow.
+type InflightStats struct {
+	// Inflight is the number of messages waiting to be acknowledged.
+	Inflight int
+
+	// Queued is the number of messages waiting for room in the window.
+	Queued int
+
+	// Sent is the number of QoS 1 and 2 messages sent.
+	Sent uint64
+
+	// Acked is the number of messages acknowledged with a PUBACK or PUBCOMP.
+	Acked uint64
+
+	// Full is the number of messages that found the window full, and were queued,
+	// blocked, dropped or rejected.
+	Full uint64
+
+	// Dropped is the number of messages dropped by QueueDropOldest or
+	// QueueDropNewest.
+	Dropped uint64
+
+	// Rejected is the number of messages rejected by QueueReject.
+	Rejected uint64
+}
+
+// InflightWindow limits the number of outbound QoS 1 and 2 PUBLISH messages that are
+// waiting to be acknowledged on a connection, so a slow receiver isn't flooded. Each
+// connection has its own window. Messages are sent with the send function given to
+// NewInflightWindow, in the order they were published, and the PUBACK, PUBREC and
+// PUBCOMP messages received on the connection must be passed to Ack. QoS 0 messages
+// are sent right away, since they are never acknowledged.
+//
+// InflightWindow is safe for concurrent use.
+type InflightWindow struct {
+	opts InflightOptions
+	send func(*PublishMessage) error
+
+	mu       sync.Mutex
+	inflight map[uint16]*inflightEntry
+	queue    []*PublishMessage
+	wake     chan struct{}
+	closed   bool
+	stats    InflightStats
+
+	// smu is held while sending, and is locked before mu is unlocked so messages
+	// are sent in the order they're admitted to the window.
+	smu sync.Mutex
+}
+
+type inflightEntry struct {
+	msg *PublishMessage
+
+	// received is set when a PUBREC is received for a QoS 2 message, which then
+	// waits for the PUBCOMP.
+	received bool
+}
+
+// NewInflightWindow creates a window that sends messages with send.
+func NewInflightWindow(opts InflightOptions, send func(*PublishMessage) error) *InflightWindow {
+	if opts.MaxInflight <= 0 {
+		opts.MaxInflight = DefaultMaxInflight
+	}
+
+	if opts.MaxQueued < 0 {
+		opts.MaxQueued = 0
+	}
+
+	return &InflightWindow{
+		opts:     opts,
+		send:     send,
+		inflight: make(map[uint16]*inflightEntry),
+		wake:     make(chan struct{}),
+	}
+}
+
+// Publish sends the message if there's room in the window, and otherwise queues it
+// or applies the window's QueuePolicy. The message must have a packet ID that's not
+// in use by another message in the window. A nil error does not mean the message
+// was sent: it may be queued, or dropped by QueueDropOldest or QueueDropNewest. The
+// message must not be changed until it's acknowledged.
+func (this *InflightWindow) Publish(ctx context.Context, msg *PublishMessage) error {
+	if msg.QoS() == QosAtMostOnce {
+		this.smu.Lock()
+		defer this.smu.Unlock()
+
+		return this.send(msg)
+	}
+
+	this.mu.Lock()
+
+	full := false
+
+	for {
+		if this.closed {
+			this.mu.Unlock()
+			return ErrInflightClosed
+		}
+
+		// Checked on each pass, as the ID may have been taken while blocked.
+		if this.inUse(msg.PacketId()) {
+			this.mu.Unlock()
+			return fmt.Errorf("inflight/Publish: Packet ID %d is already in use", msg.PacketId())
+		}
+
+		if len(this.inflight) < this.opts.MaxInflight && len(this.queue) == 0 {
+			this.add(msg)
+			return this.flush([]*PublishMessage{msg})
+		}
+
+		if !full {
+			full = true
+			this.stats.Full++
+			this.opts.Metrics.inflightFull()
+		}
+
+		if len(this.queue) < this.opts.MaxQueued {
+			this.queue = append(this.queue, msg)
+			this.opts.Metrics.inflightChanged(0, 1)
+			this.mu.Unlock()
+			return nil
+		}
+
+		switch this.opts.Policy {
+		case QueueDropOldest:
+			if len(this.queue) > 0 {
+				copy(this.queue, this.queue[1:])
+				this.queue[len(this.queue)-1] = msg
+			}
+			this.drop()
+			return nil
+
+		case QueueDropNewest:
+			this.drop()
+			return nil
+
+		case QueueReject:
+			this.stats.Rejected++
+			this.opts.Metrics.inflightDropped(QueueReject)
+			this.mu.Unlock()
+			return ErrInflightQueueFull
+		}
+
+		wake := this.wake
+		this.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+
+		this.mu.Lock()
+	}
+}
+
+// Ack updates the window with a PUBACK, PUBREC or PUBCOMP message received on the
+// connection. A PUBACK or PUBCOMP frees a slot in the window, and the first queued
+// messages are sent. Ack returns false if the message doesn't acknowledge a message
+// in the window, and the error from sending queued messages, if any.
+func (this *InflightWindow) Ack(msg Message) (bool, error) {
+	var id uint16
+
+	switch m := msg.(type) {
+	case *PubackMessage:
+		id = m.PacketId()
+	case *PubrecMessage:
+		id = m.PacketId()
+	case *PubcompMessage:
+		id = m.PacketId()
+	default:
+		return false, nil
+	}
+
+	this.mu.Lock()
+
+	e, ok := this.inflight[id]
+	if !ok {
+		this.mu.Unlock()
+		return false, nil
+	}
+
+	qos := e.msg.QoS()
+	t := msg.Type()
+
+	switch {
+	case t == PUBACK && qos == QosAtLeastOnce, t == PUBCOMP && qos == QosExactlyOnce:
+		delete(this.inflight, id)
+		this.stats.Acked++
+		this.opts.Metrics.inflightChanged(-1, 0)
+
+	case t == PUBREC && qos == QosExactlyOnce:
+		e.received = true
+		this.mu.Unlock()
+		return true, nil
+
+	default:
+		this.mu.Unlock()
+		return false, nil
+	}
+
+	var next []*PublishMessage
+
+	for len(this.inflight) < this.opts.MaxInflight && len(this.queue) > 0 {
+		m := this.queue[0]
+		this.queue = this.queue[1:]
+		this.opts.Metrics.inflightChanged(0, -1)
+
+		this.add(m)
+		next = append(next, m)
+	}
+
+	if len(this.queue) == 0 {
+		this.queue = nil
+	}
+
+	// Wake up any blocked publishers, now that there's room in the window or queue.
+	close(this.wake)
+	this.wake = make(chan struct{})
+
+	return true, this.flush(next)
+}
+
+// Stats returns a snapshot of the window.
+func (this *InflightWindow) Stats() InflightStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	s := this.stats
+	s.Inflight = len(this.inflight)
+	s.Queued = len(this.queue)
+
+	return s
+}
+
+// Close drops the queued and inflight messages, and makes blocked and future calls to Publish
+// return ErrInflightClosed. It should be called when the connection is closed.
+func (this *InflightWindow) Close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return
+	}
+
+	this.closed = true
+	this.opts.Metrics.inflightChanged(-len(this.inflight), -len(this.queue))
+	this.inflight = make(map[uint16]*inflightEntry)
+	this.queue = nil
+
+	close(this.wake)
+}
+
+// inUse returns true if a message with the packet ID is inflight or queued. mu must
+// be held.
+func (this *InflightWindow) inUse(id uint16) bool {
+	if _, ok := this.inflight[id]; ok {
+		return true
+	}
+
+	for _, m := range this.queue {
+		if m.PacketId() == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// add puts the message in the window. mu must be held.
+func (this *InflightWindow) add(msg *PublishMessage) {
+	this.inflight[msg.PacketId()] = &inflightEntry{msg: msg}
+	this.stats.Sent++
+	this.opts.Metrics.inflightChanged(1, 0)
+}
+
+// drop records a dropped message, and unlocks mu.
+func (this *InflightWindow) drop() {
+	this.stats.Dropped++
+	this.opts.Metrics.inflightDropped(this.opts.Policy)
+	this.mu.Unlock()
+}
+
+// flush sends the messages that were just added to the window, and unlocks mu. smu
+// is locked before mu is unlocked, so the messages are sent before any that are
+// added later.
+func (this *InflightWindow) flush(msgs []*PublishMessage) error {
+	this.smu.Lock()
+	this.mu.Unlock()
+	defer this.smu.Unlock()
+
+	for _, m := range msgs {
+		if err := this.send(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+// testSender records the packet IDs of the messages sent through a window.
+type testSender struct {
+	mu  sync.Mutex
+	ids []uint16
+}
+
+func (this *testSender) send(msg *PublishMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.ids = append(this.ids, msg.PacketId())
+	return nil
+}
+
+func (this *testSender) sent() []uint16 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]uint16{}, this.ids...)
+}
+
+func newInflightPublish(id uint16, qos byte) *PublishMessage {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("a/b"))
+	msg.SetQoS(qos)
+	msg.SetPacketId(id)
+	msg.SetPayload([]byte("x"))
+
+	return msg
+}
+
+func newInflightAck(mtype MessageType, id uint16) Message {
+	switch mtype {
+	case PUBREC:
+		m := NewPubrecMessage()
+		m.SetPacketId(id)
+		return m
+
+	case PUBCOMP:
+		m := NewPubcompMessage()
+		m.SetPacketId(id)
+		return m
+	}
+
+	m := NewPubackMessage()
+	m.SetPacketId(id)
+	return m
+}
+
+func TestInflightWindowBlock(t *testing.T) {
+	s := &testSender{}
+	w := NewInflightWindow(InflightOptions{MaxInflight: 2}, s.send)
+	ctx := context.Background()
+
+	assert.NoError(t, true, w.Publish(ctx, newInflightPublish(1, QosAtLeastOnce)), "Error publishing.")
+	assert.NoError(t, true, w.Publish(ctx, newInflightPublish(2, QosAtLeastOnce)), "Error publishing.")
+
+	// QoS 0 messages are not limited by the window.
+	assert.NoError(t, true, w.Publish(ctx, newInflightPublish(0, QosAtMostOnce)), "Error publishing.")
+
+	done := make(chan error)
+	go func() {
+		done <- w.Publish(ctx, newInflightPublish(3, QosAtLeastOnce))
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Expecting Publish to block while the window is full.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ok, err := w.Ack(newInflightAck(PUBACK, 1))
+	assert.True(t, true, ok, "Expecting PUBACK to match.")
+	assert.NoError(t, true, err, "Error acknowledging.")
+	assert.NoError(t, true, <-done, "Error publishing.")
+
+	assert.Equal(t, true, []uint16{1, 2, 0, 3}, s.sent(), "Incorrect send order.")
+
+	stats := w.Stats()
+	assert.Equal(t, true, 2, stats.Inflight, "Incorrect inflight count.")
+	assert.Equal(t, true, uint64(3), stats.Sent, "Incorrect sent count.")
+	assert.Equal(t, true, uint64(1), stats.Acked, "Incorrect acked count.")
+	assert.Equal(t, true, uint64(1), stats.Full, "Incorrect full count.")
+
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+
+	err = w.Publish(cctx, newInflightPublish(4, QosAtLeastOnce))
+	assert.Equal(t, true, context.DeadlineExceeded, err, "Expecting context deadline.")
+}
+
+func TestInflightWindowQueue(t *testing.T) {
+	s := &testSender{}
+	w := NewInflightWindow(InflightOptions{MaxInflight: 1, MaxQueued: 2, Policy: QueueReject}, s.send)
+	ctx := context.Background()
+
+	for id := uint16(1); id <= 3; id++ {
+		assert.NoError(t, true, w.Publish(ctx, newInflightPublish(id, QosExactlyOnce)), "Error publishing.")
+	}
+
+	assert.Equal(t, true, ErrInflightQueueFull, w.Publish(ctx, newInflightPublish(4, QosExactlyOnce)), "Expecting queue to be full.")
+	assert.Equal(t, true, []uint16{1}, s.sent(), "Expecting only one message sent.")
+
+	// PUBREC doesn't free the slot, PUBCOMP does.
+	ok, _ := w.Ack(newInflightAck(PUBREC, 1))
+	assert.True(t, true, ok, "Expecting PUBREC to match.")
+	assert.Equal(t, true, []uint16{1}, s.sent(), "Expecting PUBREC to keep the slot.")
+
+	ok, _ = w.Ack(newInflightAck(PUBACK, 1))
+	assert.False(t, true, ok, "Expecting PUBACK not to match a QoS 2 message.")
+
+	ok, _ = w.Ack(newInflightAck(PUBCOMP, 1))
+	assert.True(t, true, ok, "Expecting PUBCOMP to match.")
+	assert.Equal(t, true, []uint16{1, 2}, s.sent(), "Expecting the first queued message to be sent.")
+
+	ok, _ = w.Ack(newInflightAck(PUBCOMP, 9))
+	assert.False(t, true, ok, "Expecting unknown packet ID not to match.")
+
+	stats := w.Stats()
+	assert.Equal(t, true, 1, stats.Queued, "Incorrect queued count.")
+	assert.Equal(t, true, uint64(1), stats.Rejected, "Incorrect rejected count.")
+
+	err := w.Publish(ctx, newInflightPublish(2, QosExactlyOnce))
+	assert.Error(t, true, err, "Expecting error for packet ID in use.")
+
+	err = w.Publish(ctx, newInflightPublish(3, QosExactlyOnce))
+	assert.Error(t, true, err, "Expecting error for queued packet ID.")
+	assert.Equal(t, true, 1, w.Stats().Queued, "Incorrect queued count.")
+}
+
+func TestInflightWindowBlockedDuplicate(t *testing.T) {
+	s := &testSender{}
+	w := NewInflightWindow(InflightOptions{MaxInflight: 1}, s.send)
+	ctx := context.Background()
+
+	assert.NoError(t, true, w.Publish(ctx, newInflightPublish(1, QosAtLeastOnce)), "Error publishing.")
+
+	// Both block on a free ID, only one can have it once there's room.
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- w.Publish(ctx, newInflightPublish(2, QosAtLeastOnce))
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	_, err := w.Ack(newInflightAck(PUBACK, 1))
+	assert.NoError(t, true, err, "Error acknowledging.")
+
+	errs := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				errs++
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expecting the duplicate publish to fail instead of blocking.")
+		}
+	}
+
+	assert.Equal(t, true, 1, errs, "Expecting one publish to fail with the packet ID in use.")
+	assert.Equal(t, true, []uint16{1, 2}, s.sent(), "Incorrect send order.")
+
+	stats := w.Stats()
+	assert.Equal(t, true, 1, stats.Inflight, "Incorrect inflight count.")
+	assert.Equal(t, true, uint64(2), stats.Sent, "Incorrect sent count.")
+}
+
+func TestInflightWindowDrop(t *testing.T) {
+	ctx := context.Background()
+
+	for _, policy := range []QueuePolicy{QueueDropOldest, QueueDropNewest} {
+		s := &testSender{}
+		w := NewInflightWindow(InflightOptions{MaxInflight: 1, MaxQueued: 2, Policy: policy}, s.send)
+
+		for id := uint16(1); id <= 4; id++ {
+			assert.NoError(t, true, w.Publish(ctx, newInflightPublish(id, QosAtLeastOnce)), "Error publishing.")
+		}
+
+		w.Ack(newInflightAck(PUBACK, 1))
+		w.Ack(newInflightAck(PUBACK, 2))
+		w.Ack(newInflightAck(PUBACK, 3))
+		w.Ack(newInflightAck(PUBACK, 4))
+
+		expected := []uint16{1, 3, 4}
+		if policy == QueueDropNewest {
+			expected = []uint16{1, 2, 3}
+		}
+
+		assert.Equal(t, true, expected, s.sent(), "Incorrect messages sent for", policy)
+		assert.Equal(t, true, uint64(1), w.Stats().Dropped, "Incorrect dropped count for", policy)
+		assert.Equal(t, true, 0, w.Stats().Inflight, "Expecting empty window for", policy)
+	}
+}
+
+func TestInflightWindowClose(t *testing.T) {
+	s := &testSender{}
+	w := NewInflightWindow(InflightOptions{MaxInflight: 1}, s.send)
+	ctx := context.Background()
+
+	assert.NoError(t, true, w.Publish(ctx, newInflightPublish(1, QosAtLeastOnce)), "Error publishing.")
+
+	done := make(chan error)
+	go func() {
+		done <- w.Publish(ctx, newInflightPublish(2, QosAtLeastOnce))
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	w.Close()
+
+	assert.Equal(t, true, ErrInflightClosed, <-done, "Expecting blocked Publish to fail.")
+	assert.Equal(t, true, ErrInflightClosed, w.Publish(ctx, newInflightPublish(3, QosAtLeastOnce)), "Expecting Publish to fail.")
+
+	ok, _ := w.Ack(newInflightAck(PUBACK, 1))
+	assert.False(t, true, ok, "Expecting closed window to be empty.")
+}
+
+func TestInflightWindowMetrics(t *testing.T) {
+	m := NewMetrics()
+	s := &testSender{}
+	w := NewInflightWindow(InflightOptions{MaxInflight: 2, MaxQueued: 1, Policy: QueueDropNewest, Metrics: m}, s.send)
+	ctx := context.Background()
+
+	for id := uint16(1); id <= 4; id++ {
+		w.Publish(ctx, newInflightPublish(id, QosAtLeastOnce))
+	}
+
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		"mqtt_inflight_messages 2",
+		"mqtt_inflight_queued_messages 1",
+		"mqtt_inflight_full_total 2",
+		`mqtt_inflight_dropped_total{policy="drop_newest"} 1`,
+		`mqtt_inflight_dropped_total{policy="reject"} 0`,
+	} {
+		assert.True(t, false, strings.Contains(out, line+"\n"), "Missing metric line:", line)
+	}
+
+	w.Close()
+
+	buf.Reset()
+	m.WriteTo(&buf)
+	assert.True(t, true, strings.Contains(buf.String(), "mqtt_inflight_messages 0\n"), "Expecting Close to empty the window.")
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+)
+
+// Direction is the direction a message is travelling relative to the local end
+// of the connection.
+type Direction byte
+
+const (
+	// Inbound messages have been read from the network.
+	Inbound Direction = iota
+
+	// Outbound messages are about to be written to the network.
+	Outbound
+)
+
+// String returns the name of the direction.
+func (this Direction) String() string {
+	switch this {
+	case Inbound:
+		return "inbound"
+	case Outbound:
+		return "outbound"
+	}
+
+	return "unknown"
+}
+
+// Interceptor is called for every message travelling through a connection. It can:
+//
+//	pass the message on unchanged by returning it
+//	modify the message, e.g. with PublishMessage.SetTopic, and return it
+//	replace the message by returning a different one
+//	drop the message by returning nil and no error
+//	reject the message by returning an error
+//
+// A rejected message means the connection should be closed. For an outbound
+// message on the client side, a DISCONNECT should be sent first.
+type Interceptor func(ctx context.Context, dir Direction, msg Message) (Message, error)
+
+// Interceptors is an ordered chain of interceptors. Both client and server loops
+// call Intercept on every message read from, or about to be written to, the
+// network.
+type Interceptors []Interceptor
+
+// InterceptError is the error returned by Interceptors when one of the interceptors
+// rejects a message.
+type InterceptError struct {
+	// Direction is the direction of the rejected message.
+	Direction Direction
+
+	// Type is the message type of the rejected message.
+	Type MessageType
+
+	// Err is the error returned by the interceptor.
+	Err error
+}
+
+// Error returns the error string.
+func (this *InterceptError) Error() string {
+	return fmt.Sprintf("interceptor: %s %s rejected: %v", this.Direction, this.Type.Name(), this.Err)
+}
+
+// Unwrap returns the error returned by the interceptor.
+func (this *InterceptError) Unwrap() error {
+	return this.Err
+}
+
+// Intercept runs the message through each interceptor in order, passing the message
+// returned by one interceptor to the next. If an interceptor drops the message, nil
+// is returned and the remaining interceptors are not called. If an interceptor
+// rejects the message, an *InterceptError is returned and the caller should close
+// the connection.
+func (this Interceptors) Intercept(ctx context.Context, dir Direction, msg Message) (Message, error) {
+	for _, f := range this {
+		mtype := msg.Type()
+
+		var err error
+		if msg, err = f(ctx, dir, msg); err != nil {
+			return nil, &InterceptError{
+				Direction: dir,
+				Type:      mtype,
+				Err:       err,
+			}
+		}
+
+		if msg == nil {
+			return nil, nil
+		}
+	}
+
+	return msg, nil
+}
+
+// Use returns a new chain with the interceptors added to the end.
+func (this Interceptors) Use(f ...Interceptor) Interceptors {
+	return append(append(Interceptors(nil), this...), f...)
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestInterceptorsRewrite(t *testing.T) {
+	var seen []string
+
+	audit := func(ctx context.Context, dir Direction, msg Message) (Message, error) {
+		seen = append(seen, dir.String()+" "+msg.Name())
+		return msg, nil
+	}
+
+	rewrite := func(ctx context.Context, dir Direction, msg Message) (Message, error) {
+		if pub, ok := msg.(*PublishMessage); ok && dir == Inbound {
+			if err := pub.SetTopic(append([]byte("tenant/"), pub.Topic()...)); err != nil {
+				return nil, err
+			}
+		}
+		return msg, nil
+	}
+
+	chain := Interceptors{audit}.Use(rewrite)
+	assert.Equal(t, true, 2, len(chain), "Incorrect chain length.")
+
+	pub := NewPublishMessage()
+	pub.SetTopic([]byte("sensors"))
+
+	msg, err := chain.Intercept(context.Background(), Inbound, pub)
+	assert.NoError(t, true, err, "Error intercepting message.")
+	assert.Equal(t, true, "tenant/sensors", string(msg.(*PublishMessage).Topic()), "Topic not rewritten.")
+
+	msg, err = chain.Intercept(context.Background(), Outbound, NewPingrespMessage())
+	assert.NoError(t, true, err, "Error intercepting message.")
+	assert.Equal(t, true, PINGRESP, msg.Type(), "Incorrect message.")
+
+	assert.Equal(t, true, []string{"inbound PUBLISH", "outbound PINGRESP"}, seen, "Incorrect interceptor calls.")
+}
+
+func TestInterceptorsDrop(t *testing.T) {
+	called := false
+
+	chain := Interceptors{
+		func(ctx context.Context, dir Direction, msg Message) (Message, error) {
+			if msg.Type() == PINGREQ {
+				return nil, nil
+			}
+			return msg, nil
+		},
+		func(ctx context.Context, dir Direction, msg Message) (Message, error) {
+			called = true
+			return msg, nil
+		},
+	}
+
+	msg, err := chain.Intercept(context.Background(), Inbound, NewPingreqMessage())
+	assert.NoError(t, true, err, "Error intercepting message.")
+	assert.True(t, true, msg == nil, "Message should be dropped.")
+	assert.False(t, true, called, "Chain should stop after a drop.")
+}
+
+func TestInterceptorsReject(t *testing.T) {
+	errDenied := errors.New("denied")
+
+	chain := Interceptors{
+		func(ctx context.Context, dir Direction, msg Message) (Message, error) {
+			return nil, errDenied
+		},
+	}
+
+	msg, err := chain.Intercept(context.Background(), Outbound, NewSubscribeMessage())
+	assert.True(t, true, msg == nil, "Message should be rejected.")
+	assert.True(t, true, errors.Is(err, errDenied), "Incorrect error.")
+
+	var ierr *InterceptError
+	assert.True(t, true, errors.As(err, &ierr), "Incorrect error type.")
+	assert.Equal(t, true, Outbound, ierr.Direction, "Incorrect direction.")
+	assert.Equal(t, true, SUBSCRIBE, ierr.Type, "Incorrect message type.")
+}
@@ -0,0 +1,589 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// JSONOptions controls how messages are marshalled into JSON by MarshalMessageJSON.
+type JSONOptions struct {
+	// RedactPassword omits the CONNECT password from the output and sets the
+	// "password_redacted" field instead. A message with a redacted password no
+	// longer round-trips byte-exactly.
+	RedactPassword bool
+}
+
+// DefaultJSONOptions are the options used by the MarshalJSON methods of the messages.
+var DefaultJSONOptions = JSONOptions{}
+
+// jsonBytes is a byte slice that is marshalled as a JSON string if it is valid
+// UTF-8, or as an object of the form {"base64": "..."} otherwise.
+type jsonBytes []byte
+
+func (this jsonBytes) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(this) {
+		return json.Marshal(string(this))
+	}
+
+	return json.Marshal(struct {
+		Base64 string `json:"base64"`
+	}{base64.StdEncoding.EncodeToString(this)})
+}
+
+func (this *jsonBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*this = jsonBytes(s)
+		return nil
+	}
+
+	var b struct {
+		Base64 string `json:"base64"`
+	}
+
+	if err := json.Unmarshal(data, &b); err != nil {
+		return fmt.Errorf("json/UnmarshalJSON: Expecting a string or a base64 object, got %s", string(data))
+	}
+
+	v, err := base64.StdEncoding.DecodeString(b.Base64)
+	if err != nil {
+		return err
+	}
+
+	*this = v
+	return nil
+}
+
+type jsonSubscription struct {
+	Topic jsonBytes `json:"topic"`
+	Qos   byte      `json:"qos"`
+}
+
+type jsonWill struct {
+	Topic   jsonBytes `json:"topic"`
+	Message jsonBytes `json:"message"`
+	Qos     byte      `json:"qos"`
+	Retain  bool      `json:"retain"`
+}
+
+// jsonMessage is the JSON representation of all the message types. Only the fields
+// relevant to the message type are set.
+type jsonMessage struct {
+	Type  string `json:"type"`
+	Flags *byte  `json:"flags,omitempty"`
+
+	// PUBLISH
+	Dup    *bool     `json:"dup,omitempty"`
+	Qos    *byte     `json:"qos,omitempty"`
+	Retain *bool     `json:"retain,omitempty"`
+	Topic  jsonBytes `json:"topic,omitempty"`
+
+	PacketId *uint16 `json:"packet_id,omitempty"`
+
+	Payload *jsonBytes `json:"payload,omitempty"`
+
+	// SUBSCRIBE, SUBACK and UNSUBSCRIBE
+	Subscriptions []jsonSubscription `json:"subscriptions,omitempty"`
+	ReturnCodes   []int              `json:"return_codes,omitempty"`
+	Topics        []jsonBytes        `json:"topics,omitempty"`
+
+	// CONNECT
+	ProtocolName     string     `json:"protocol_name,omitempty"`
+	Version          byte       `json:"version,omitempty"`
+	ConnectFlags     *byte      `json:"connect_flags,omitempty"`
+	CleanSession     bool       `json:"clean_session,omitempty"`
+	KeepAlive        uint16     `json:"keep_alive,omitempty"`
+	ClientId         *jsonBytes `json:"client_id,omitempty"`
+	Will             *jsonWill  `json:"will,omitempty"`
+	Username         jsonBytes  `json:"username,omitempty"`
+	Password         jsonBytes  `json:"password,omitempty"`
+	PasswordRedacted bool       `json:"password_redacted,omitempty"`
+
+	// CONNACK
+	SessionPresent bool   `json:"session_present,omitempty"`
+	ReturnCode     *byte  `json:"return_code,omitempty"`
+	Response       string `json:"response,omitempty"`
+}
+
+type jsonMessager interface {
+	toJSON(opts JSONOptions) *jsonMessage
+	fromJSON(v *jsonMessage) error
+}
+
+// MarshalMessageJSON returns the JSON encoding of the message using the options.
+func MarshalMessageJSON(msg Message, opts JSONOptions) ([]byte, error) {
+	m, ok := msg.(jsonMessager)
+	if !ok {
+		return nil, fmt.Errorf("json/MarshalMessageJSON: Unsupported message type %T", msg)
+	}
+
+	return json.Marshal(m.toJSON(opts))
+}
+
+// UnmarshalMessageJSON creates a new message of the type named in the "type" field
+// of the JSON data, and unmarshals the data into it.
+func UnmarshalMessageJSON(data []byte) (Message, error) {
+	var v jsonMessage
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	mtype, err := messageTypeByName(v.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mtype.New()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := msg.(jsonMessager).fromJSON(&v); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func messageTypeByName(name string) (MessageType, error) {
+	for t := CONNECT; t < RESERVED2; t++ {
+		if t.Name() == name {
+			return t, nil
+		}
+	}
+
+	return RESERVED, fmt.Errorf("json/UnmarshalJSON: Invalid message type %q", name)
+}
+
+func unmarshalJSON(data []byte, m jsonMessager) error {
+	var v jsonMessage
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	return m.fromJSON(&v)
+}
+
+// MarshalJSON returns the JSON encoding of the message.
+func (this *fixedHeader) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.toJSON(DefaultJSONOptions))
+}
+
+// UnmarshalJSON sets the message from its JSON encoding.
+func (this *fixedHeader) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, this)
+}
+
+func (this *fixedHeader) toJSON(opts JSONOptions) *jsonMessage {
+	flags := this.flags
+
+	return &jsonMessage{
+		Type:  this.mtype.Name(),
+		Flags: &flags,
+	}
+}
+
+func (this *fixedHeader) fromJSON(v *jsonMessage) error {
+	mtype, err := messageTypeByName(v.Type)
+	if err != nil {
+		return err
+	}
+
+	// A zero value message takes the type from the JSON data.
+	if this.mtype == RESERVED {
+		if err := this.SetType(mtype); err != nil {
+			return err
+		}
+	} else if mtype != this.mtype {
+		return fmt.Errorf("json/UnmarshalJSON: Invalid message type %s. Expecting %s.", mtype.Name(), this.mtype.Name())
+	}
+
+	if v.Flags == nil {
+		return nil
+	}
+
+	if this.mtype != PUBLISH && *v.Flags != this.mtype.DefaultFlags() {
+		return fmt.Errorf("json/UnmarshalJSON: Invalid message (%s) flags. Expecting %d, got %d", this.mtype.Name(), this.mtype.DefaultFlags(), *v.Flags)
+	}
+
+	if this.mtype == PUBLISH && !ValidQos((*v.Flags>>1)&0x3) {
+		return fmt.Errorf("json/UnmarshalJSON: Invalid QoS (%d) for PUBLISH message.", (*v.Flags>>1)&0x3)
+	}
+
+	this.flags = *v.Flags
+	return nil
+}
+
+// MarshalJSON returns the JSON encoding of the message. The password is included
+// unless DefaultJSONOptions.RedactPassword is set.
+func (this *ConnectMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.toJSON(DefaultJSONOptions))
+}
+
+// UnmarshalJSON sets the message from its JSON encoding. If "connect_flags" is
+// present it is used as is, otherwise the flags are derived from the other fields.
+func (this *ConnectMessage) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, this)
+}
+
+func (this *ConnectMessage) toJSON(opts JSONOptions) *jsonMessage {
+	v := this.fixedHeader.toJSON(opts)
+
+	flags := this.connectFlags
+	cid := jsonBytes(this.clientId)
+
+	v.ProtocolName = string(this.protocolName())
+	v.Version = this.version
+	v.ConnectFlags = &flags
+	v.CleanSession = this.CleanSession()
+	v.KeepAlive = this.keepAlive
+	v.ClientId = &cid
+	v.Username = jsonBytes(this.username)
+
+	if this.WillFlag() {
+		v.Will = &jsonWill{
+			Topic:   jsonBytes(this.willTopic),
+			Message: jsonBytes(this.willMessage),
+			Qos:     this.WillQos(),
+			Retain:  this.WillRetain(),
+		}
+	}
+
+	if opts.RedactPassword && len(this.password) > 0 {
+		v.PasswordRedacted = true
+	} else {
+		v.Password = jsonBytes(this.password)
+	}
+
+	return v
+}
+
+func (this *ConnectMessage) fromJSON(v *jsonMessage) error {
+	if err := this.fixedHeader.fromJSON(v); err != nil {
+		return err
+	}
+
+	if err := this.SetVersion(v.Version); err != nil {
+		return err
+	}
+
+	if v.ProtocolName != "" {
+		this.protoName = []byte(v.ProtocolName)
+	}
+
+	this.SetCleanSession(v.CleanSession)
+	this.SetKeepAlive(v.KeepAlive)
+
+	if v.ClientId != nil {
+		if err := this.SetClientId(*v.ClientId); err != nil {
+			return err
+		}
+	}
+
+	if v.Will != nil {
+		this.SetWillTopic(v.Will.Topic)
+		this.SetWillMessage(v.Will.Message)
+		this.SetWillFlag(true)
+		this.SetWillRetain(v.Will.Retain)
+
+		if err := this.SetWillQos(v.Will.Qos); err != nil {
+			return err
+		}
+	}
+
+	this.SetUsername(v.Username)
+	this.SetPassword(v.Password)
+
+	if v.ConnectFlags != nil {
+		this.connectFlags = *v.ConnectFlags
+	}
+
+	return nil
+}
+
+// MarshalJSON returns the JSON encoding of the message.
+func (this *ConnackMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.toJSON(DefaultJSONOptions))
+}
+
+// UnmarshalJSON sets the message from its JSON encoding.
+func (this *ConnackMessage) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, this)
+}
+
+func (this *ConnackMessage) toJSON(opts JSONOptions) *jsonMessage {
+	v := this.fixedHeader.toJSON(opts)
+
+	code := this.returnCode.Value()
+
+	v.SessionPresent = this.sessionPresent
+	v.ReturnCode = &code
+	v.Response = this.returnCode.Response()
+
+	return v
+}
+
+func (this *ConnackMessage) fromJSON(v *jsonMessage) error {
+	if err := this.fixedHeader.fromJSON(v); err != nil {
+		return err
+	}
+
+	this.SetSessionPresent(v.SessionPresent)
+
+	if v.ReturnCode != nil {
+		if !ConnackCode(*v.ReturnCode).Valid() {
+			return fmt.Errorf("json/UnmarshalJSON: Invalid CONNACK return code (%d)", *v.ReturnCode)
+		}
+
+		this.SetReturnCode(ConnackCode(*v.ReturnCode))
+	}
+
+	return nil
+}
+
+// MarshalJSON returns the JSON encoding of the message. The payload is a string if
+// it is valid UTF-8, or a base64 object otherwise.
+func (this *PublishMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.toJSON(DefaultJSONOptions))
+}
+
+// UnmarshalJSON sets the message from its JSON encoding. If "flags" is present it
+// is used as is, otherwise the flags are set from "dup", "qos" and "retain".
+func (this *PublishMessage) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, this)
+}
+
+func (this *PublishMessage) toJSON(opts JSONOptions) *jsonMessage {
+	v := this.fixedHeader.toJSON(opts)
+
+	dup, qos, retain := this.Dup(), this.QoS(), this.Retain()
+	payload := jsonBytes(this.payload)
+
+	v.Dup = &dup
+	v.Qos = &qos
+	v.Retain = &retain
+	v.Topic = jsonBytes(this.topic)
+	v.Payload = &payload
+
+	if qos != QosAtMostOnce {
+		id := this.packetId
+		v.PacketId = &id
+	}
+
+	return v
+}
+
+func (this *PublishMessage) fromJSON(v *jsonMessage) error {
+	if err := this.fixedHeader.fromJSON(v); err != nil {
+		return err
+	}
+
+	if v.Flags == nil {
+		if v.Dup != nil {
+			this.SetDup(*v.Dup)
+		}
+
+		if v.Qos != nil {
+			if err := this.SetQoS(*v.Qos); err != nil {
+				return err
+			}
+		}
+
+		if v.Retain != nil {
+			this.SetRetain(*v.Retain)
+		}
+	}
+
+	if err := this.SetTopic(v.Topic); err != nil {
+		return err
+	}
+
+	if v.PacketId != nil {
+		this.SetPacketId(*v.PacketId)
+	}
+
+	if v.Payload != nil {
+		this.SetPayload(*v.Payload)
+	}
+
+	return nil
+}
+
+// MarshalJSON returns the JSON encoding of the message.
+func (this *PubackMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.toJSON(DefaultJSONOptions))
+}
+
+// UnmarshalJSON sets the message from its JSON encoding.
+func (this *PubackMessage) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, this)
+}
+
+func (this *PubackMessage) toJSON(opts JSONOptions) *jsonMessage {
+	v := this.fixedHeader.toJSON(opts)
+
+	id := this.packetId
+	v.PacketId = &id
+
+	return v
+}
+
+func (this *PubackMessage) fromJSON(v *jsonMessage) error {
+	if err := this.fixedHeader.fromJSON(v); err != nil {
+		return err
+	}
+
+	if v.PacketId != nil {
+		this.SetPacketId(*v.PacketId)
+	}
+
+	return nil
+}
+
+// MarshalJSON returns the JSON encoding of the message.
+func (this *SubscribeMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.toJSON(DefaultJSONOptions))
+}
+
+// UnmarshalJSON sets the message from its JSON encoding.
+func (this *SubscribeMessage) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, this)
+}
+
+func (this *SubscribeMessage) toJSON(opts JSONOptions) *jsonMessage {
+	v := this.fixedHeader.toJSON(opts)
+
+	id := this.packetId
+	v.PacketId = &id
+
+	for i, t := range this.topics {
+		v.Subscriptions = append(v.Subscriptions, jsonSubscription{jsonBytes(t), this.qos[i]})
+	}
+
+	return v
+}
+
+func (this *SubscribeMessage) fromJSON(v *jsonMessage) error {
+	if err := this.fixedHeader.fromJSON(v); err != nil {
+		return err
+	}
+
+	if v.PacketId != nil {
+		this.SetPacketId(*v.PacketId)
+	}
+
+	this.topics, this.qos = nil, nil
+
+	// The topics are set directly rather than with AddTopic so that the message
+	// round-trips exactly, even if the topics are repeated.
+	for _, s := range v.Subscriptions {
+		this.topics = append(this.topics, s.Topic)
+		this.qos = append(this.qos, s.Qos)
+	}
+
+	return nil
+}
+
+// MarshalJSON returns the JSON encoding of the message.
+func (this *SubackMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.toJSON(DefaultJSONOptions))
+}
+
+// UnmarshalJSON sets the message from its JSON encoding.
+func (this *SubackMessage) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, this)
+}
+
+func (this *SubackMessage) toJSON(opts JSONOptions) *jsonMessage {
+	v := this.fixedHeader.toJSON(opts)
+
+	id := this.packetId
+	v.PacketId = &id
+
+	for _, c := range this.returnCodes {
+		v.ReturnCodes = append(v.ReturnCodes, int(c))
+	}
+
+	return v
+}
+
+func (this *SubackMessage) fromJSON(v *jsonMessage) error {
+	if err := this.fixedHeader.fromJSON(v); err != nil {
+		return err
+	}
+
+	if v.PacketId != nil {
+		this.SetPacketId(*v.PacketId)
+	}
+
+	this.returnCodes = nil
+
+	for _, c := range v.ReturnCodes {
+		if c < 0 || c > 0xff {
+			return fmt.Errorf("json/UnmarshalJSON: Invalid return code %d", c)
+		}
+
+		if err := this.AddReturnCode(byte(c)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MarshalJSON returns the JSON encoding of the message.
+func (this *UnsubscribeMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.toJSON(DefaultJSONOptions))
+}
+
+// UnmarshalJSON sets the message from its JSON encoding.
+func (this *UnsubscribeMessage) UnmarshalJSON(data []byte) error {
+	return unmarshalJSON(data, this)
+}
+
+func (this *UnsubscribeMessage) toJSON(opts JSONOptions) *jsonMessage {
+	v := this.fixedHeader.toJSON(opts)
+
+	id := this.packetId
+	v.PacketId = &id
+
+	for _, t := range this.topics {
+		v.Topics = append(v.Topics, jsonBytes(t))
+	}
+
+	return v
+}
+
+func (this *UnsubscribeMessage) fromJSON(v *jsonMessage) error {
+	if err := this.fixedHeader.fromJSON(v); err != nil {
+		return err
+	}
+
+	if v.PacketId != nil {
+		this.SetPacketId(*v.PacketId)
+	}
+
+	this.topics = nil
+
+	for _, t := range v.Topics {
+		this.topics = append(this.topics, []byte(t))
+	}
+
+	return nil
+}
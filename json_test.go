@@ -0,0 +1,172 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+var jsonTestPackets = [][]byte{
+	msgBytes,
+	// CONNECT 3.1 with username flag set but no username
+	{
+		byte(CONNECT << 4),
+		21,
+		0, 6, 'M', 'Q', 'I', 's', 'd', 'p',
+		3,
+		194, // connect flags 11000010
+		0, 10,
+		0, 7, 's', 'u', 'r', 'g', 'e', 'm', 'q',
+	},
+	{byte(CONNACK << 4), 2, 1, 0},
+	{byte(CONNACK << 4), 2, 0, 5},
+	// PUBLISH with DUP, QoS 1 and RETAIN
+	{
+		byte(PUBLISH<<4) | 11,
+		14,
+		0, 7, 's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, 7,
+		'h', 'i', '!',
+	},
+	// PUBLISH with binary payload
+	{
+		byte(PUBLISH << 4),
+		13,
+		0, 7, 's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0xff, 0xfe, 0x00, 0x80,
+	},
+	{byte(PUBACK << 4), 2, 0, 7},
+	{byte(PUBREC << 4), 2, 0, 7},
+	{byte(PUBREL<<4) | 2, 2, 0, 7},
+	{byte(PUBCOMP << 4), 2, 0, 7},
+	{
+		byte(SUBSCRIBE<<4) | 2,
+		21,
+		0, 7,
+		0, 7, 's', 'u', 'r', 'g', 'e', 'm', 'q',
+		1,
+		0, 6, '/', 'a', '/', 'b', '/', '#',
+		2,
+	},
+	{byte(SUBACK << 4), 5, 0, 7, 0, 2, 0x80},
+	{
+		byte(UNSUBSCRIBE<<4) | 2,
+		11,
+		0, 7,
+		0, 7, 's', 'u', 'r', 'g', 'e', 'm', 'q',
+	},
+	{byte(UNSUBACK << 4), 2, 0, 7},
+	{byte(PINGREQ << 4), 0},
+	{byte(PINGRESP << 4), 0},
+	{byte(DISCONNECT << 4), 0},
+}
+
+func TestMessageJSONRoundTrip(t *testing.T) {
+	for _, b := range jsonTestPackets {
+		msg, err := MessageType(b[0] >> 4).New()
+		assert.NoError(t, true, err, "Error creating message.")
+
+		_, err = msg.Decode(bytes.NewBuffer(b))
+		assert.NoError(t, true, err, "Error decoding message.")
+
+		data, err := json.Marshal(msg)
+		assert.NoError(t, true, err, "Error marshalling message.")
+
+		msg2, err := UnmarshalMessageJSON(data)
+		assert.NoError(t, true, err, "Error unmarshalling message.", string(data))
+
+		dst, n, err := msg2.Encode()
+		assert.NoError(t, true, err, "Error encoding message.", string(data))
+
+		assert.Equal(t, true, len(b), n, "Incorrect encoded length.", string(data))
+		assert.Equal(t, true, b, dst.(*bytes.Buffer).Bytes(), "Incorrect round trip.", string(data))
+	}
+}
+
+func TestPublishMessageJSON(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("surgemq"))
+	msg.SetQoS(1)
+	msg.SetPacketId(7)
+	msg.SetPayload([]byte{0xff, 0x00})
+
+	data, err := json.Marshal(msg)
+	assert.NoError(t, true, err, "Error marshalling message.")
+	assert.Equal(t, true, `{"type":"PUBLISH","flags":2,"dup":false,"qos":1,"retain":false,"topic":"surgemq","packet_id":7,"payload":{"base64":"/wA="}}`, string(data), "Incorrect JSON.")
+
+	// Flags are derived from the readable fields when missing
+	msg2 := NewPublishMessage()
+	err = json.Unmarshal([]byte(`{"type":"PUBLISH","qos":2,"retain":true,"topic":"a/b","packet_id":9,"payload":"hello"}`), msg2)
+	assert.NoError(t, true, err, "Error unmarshalling message.")
+	assert.Equal(t, true, 2, msg2.QoS(), "Incorrect QoS.")
+	assert.True(t, true, msg2.Retain(), "Incorrect RETAIN flag.")
+	assert.Equal(t, true, 9, msg2.PacketId(), "Incorrect packet ID.")
+	assert.Equal(t, true, "hello", string(msg2.Payload()), "Incorrect payload.")
+
+	err = json.Unmarshal([]byte(`{"type":"PUBACK","packet_id":9}`), msg2)
+	assert.Error(t, true, err)
+
+	err = json.Unmarshal([]byte(`{"type":"PUBLISH","topic":"a/#"}`), NewPublishMessage())
+	assert.Error(t, true, err)
+}
+
+func TestConnectMessageJSONRedactPassword(t *testing.T) {
+	msg := NewConnectMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	data, err := json.Marshal(msg)
+	assert.NoError(t, true, err, "Error marshalling message.")
+	assert.True(t, true, strings.Contains(string(data), `"password":"verysecret"`), "Missing password.")
+
+	data, err = MarshalMessageJSON(msg, JSONOptions{RedactPassword: true})
+	assert.NoError(t, true, err, "Error marshalling message.")
+	assert.False(t, true, strings.Contains(string(data), "verysecret"), "Password not redacted.")
+	assert.True(t, true, strings.Contains(string(data), `"password_redacted":true`), "Missing redacted flag.")
+}
+
+func TestUnmarshalMessageJSONInvalid(t *testing.T) {
+	_, err := UnmarshalMessageJSON([]byte(`{"type":"RESERVED"}`))
+	assert.Error(t, true, err)
+
+	_, err = UnmarshalMessageJSON([]byte(`{"type":"PINGREQ","flags":3}`))
+	assert.Error(t, true, err)
+
+	_, err = UnmarshalMessageJSON([]byte(`{"type":"SUBACK","return_codes":[3]}`))
+	assert.Error(t, true, err)
+
+	var msg PingreqMessage
+	err = json.Unmarshal([]byte(`{"type":"PINGREQ"}`), &msg)
+	assert.NoError(t, true, err, "Error unmarshalling message.")
+	assert.Equal(t, true, PINGREQ, msg.Type(), "Incorrect message type.")
+}
+
+func TestSubscribeMessageJSONAfterFailedDecode(t *testing.T) {
+	// The QoS byte of the only topic is missing.
+	msg := NewSubscribeMessage()
+	_, err := msg.Decode(bytes.NewReader([]byte{0x82, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'}))
+	assert.Error(t, true, err)
+	assert.Equal(t, true, 0, len(msg.Topics()), "Topic without a QoS should not be kept.")
+	assert.Equal(t, true, len(msg.Topics()), len(msg.Qos()), "Topics and QoS should stay paired.")
+
+	data, err := MarshalMessageJSON(msg, DefaultJSONOptions)
+	assert.NoError(t, true, err, "Error marshalling message.")
+	assert.False(t, true, strings.Contains(string(data), `"subscriptions"`), "Unexpected subscriptions.")
+}
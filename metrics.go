@@ -0,0 +1,354 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultLatencyBuckets are the upper bounds, in seconds, of the encode latency
+	// histogram buckets.
+	DefaultLatencyBuckets = []float64{0.000001, 0.000005, 0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01}
+
+	// DefaultSizeBuckets are the upper bounds, in bytes, of the PUBLISH payload size
+	// histogram buckets.
+	DefaultSizeBuckets = []float64{16, 64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (this *histogram) observe(v float64) {
+	for i, b := range this.buckets {
+		if v <= b {
+			this.counts[i]++
+		}
+	}
+
+	this.sum += v
+	this.count++
+}
+
+func (this *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+
+	for i, b := range this.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(b), this.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, this.count)
+
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(this.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, this.count)
+}
+
+// Metrics collects per packet type traffic counters and histograms. Metrics is an
+// http.Handler that renders the collected values in the Prometheus text exposition
+// format. It is safe for concurrent use.
+type Metrics struct {
+	mu sync.Mutex
+
+	packetsIn  [RESERVED2 + 1]uint64
+	packetsOut [RESERVED2 + 1]uint64
+	bytesIn    [RESERVED2 + 1]uint64
+	bytesOut   [RESERVED2 + 1]uint64
+
+	decodeErrors map[MessageType]map[string]uint64
+	connacks     map[ConnackCode]uint64
+
+	encodeLatency [RESERVED2 + 1]*histogram
+	payloadIn     *histogram
+	payloadOut    *histogram
+
+	inflight       int64
+	inflightQueued int64
+	inflightFulls  uint64
+	inflightDrops  [QueueReject + 1]uint64
+}
+
+var _ http.Handler = (*Metrics)(nil)
+
+// NewMetrics creates a new metrics collector.
+func NewMetrics() *Metrics {
+	this := &Metrics{
+		decodeErrors: make(map[MessageType]map[string]uint64),
+		connacks:     make(map[ConnackCode]uint64),
+		payloadIn:    newHistogram(DefaultSizeBuckets),
+		payloadOut:   newHistogram(DefaultSizeBuckets),
+	}
+
+	for i := range this.encodeLatency {
+		this.encodeLatency[i] = newHistogram(DefaultLatencyBuckets)
+	}
+
+	return this
+}
+
+// Received records a message of n bytes that was read from the network. PUBLISH
+// payload sizes and CONNACK return codes are recorded as well.
+func (this *Metrics) Received(msg Message, n int) {
+	t := msg.Type()
+	if t > RESERVED2 {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.packetsIn[t]++
+	this.bytesIn[t] += uint64(n)
+	this.observe(msg, this.payloadIn)
+}
+
+// Sent records a message of n bytes that was written to the network. PUBLISH
+// payload sizes and CONNACK return codes are recorded as well.
+func (this *Metrics) Sent(msg Message, n int) {
+	t := msg.Type()
+	if t > RESERVED2 {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.packetsOut[t]++
+	this.bytesOut[t] += uint64(n)
+	this.observe(msg, this.payloadOut)
+}
+
+// DecodeError records a failure to decode a message of the message type. The error
+// is classified into a cause by DecodeErrorCause. Types above RESERVED2 can't come
+// from the wire, and are not recorded.
+func (this *Metrics) DecodeError(mtype MessageType, err error) {
+	if mtype > RESERVED2 {
+		return
+	}
+
+	cause := DecodeErrorCause(err)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	causes, ok := this.decodeErrors[mtype]
+	if !ok {
+		causes = make(map[string]uint64)
+		this.decodeErrors[mtype] = causes
+	}
+
+	causes[cause]++
+}
+
+// ObserveEncode records the time it took to encode a message of the message type.
+func (this *Metrics) ObserveEncode(mtype MessageType, d time.Duration) {
+	if mtype > RESERVED2 {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.encodeLatency[mtype].observe(d.Seconds())
+}
+
+// Encode calls Encode on the message and records how long it took.
+func (this *Metrics) Encode(msg Message) (io.Reader, int, error) {
+	start := time.Now()
+	r, n, err := msg.Encode()
+	this.ObserveEncode(msg.Type(), time.Since(start))
+
+	return r, n, err
+}
+
+// DecodeErrorCause returns a short label describing why decoding failed: "eof" if
+// the input ended before a full message was read, "connack" if the error is one of
+// the CONNACK return code errors, "too_large" or "protocol" if the error wraps
+// ErrPacketTooLarge or ErrProtocolViolation, "utf8" if a string is not well-formed
+// UTF-8, or "malformed" for any other error.
+func DecodeErrorCause(err error) string {
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+
+	case ValidConnackError(err):
+		return "connack"
+
+	case errors.Is(err, ErrPacketTooLarge):
+		return "too_large"
+
+	case errors.Is(err, ErrProtocolViolation):
+		return "protocol"
+
+	case errors.Is(err, ErrMalformedUTF8):
+		return "utf8"
+	}
+
+	return "malformed"
+}
+
+// ServeHTTP renders the metrics in the Prometheus text exposition format.
+func (this *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	this.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format to w.
+func (this *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+
+	this.mu.Lock()
+	this.write(&buf)
+	this.mu.Unlock()
+
+	return buf.WriteTo(w)
+}
+
+func (this *Metrics) observe(msg Message, h *histogram) {
+	switch m := msg.(type) {
+	case *PublishMessage:
+		if _, size := m.PayloadStream(); size > 0 {
+			h.observe(float64(size))
+		} else {
+			h.observe(float64(len(m.Payload())))
+		}
+
+	case *ConnackMessage:
+		this.connacks[m.ReturnCode()]++
+	}
+}
+
+// inflightChanged records a change in the number of messages in an inflight window,
+// and in its queue. It does nothing if this is nil, so windows without metrics can
+// call it.
+func (this *Metrics) inflightChanged(inflight, queued int) {
+	if this == nil {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.inflight += int64(inflight)
+	this.inflightQueued += int64(queued)
+}
+
+// inflightFull records a message that found an inflight window full.
+func (this *Metrics) inflightFull() {
+	if this == nil {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.inflightFulls++
+}
+
+// inflightDropped records a message that was dropped or rejected by the policy.
+func (this *Metrics) inflightDropped(policy QueuePolicy) {
+	if this == nil || policy > QueueReject {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.inflightDrops[policy]++
+}
+
+func (this *Metrics) write(w io.Writer) {
+	counter := func(name, help string, values *[RESERVED2 + 1]uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for t := CONNECT; t < RESERVED2; t++ {
+			fmt.Fprintf(w, "%s{type=\"%s\"} %d\n", name, t.Name(), values[t])
+		}
+	}
+
+	counter("mqtt_packets_received_total", "Number of packets received.", &this.packetsIn)
+	counter("mqtt_packets_sent_total", "Number of packets sent.", &this.packetsOut)
+	counter("mqtt_bytes_received_total", "Number of bytes received.", &this.bytesIn)
+	counter("mqtt_bytes_sent_total", "Number of bytes sent.", &this.bytesOut)
+
+	fmt.Fprintf(w, "# HELP mqtt_decode_errors_total Number of packets that failed to decode.\n# TYPE mqtt_decode_errors_total counter\n")
+	for t := RESERVED; t <= RESERVED2; t++ {
+		causes := this.decodeErrors[t]
+
+		keys := make([]string, 0, len(causes))
+		for c := range causes {
+			keys = append(keys, c)
+		}
+		sort.Strings(keys)
+
+		for _, c := range keys {
+			fmt.Fprintf(w, "mqtt_decode_errors_total{type=\"%s\",cause=\"%s\"} %d\n", t.Name(), c, causes[c])
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP mqtt_connack_total Number of CONNACK packets by return code.\n# TYPE mqtt_connack_total counter\n")
+	for c := ConnectionAccepted; c <= NotAuthorized; c++ {
+		fmt.Fprintf(w, "mqtt_connack_total{code=\"%d\",response=\"%s\"} %d\n", c, c.Response(), this.connacks[c])
+	}
+
+	fmt.Fprintf(w, "# HELP mqtt_encode_duration_seconds Time taken to encode packets.\n# TYPE mqtt_encode_duration_seconds histogram\n")
+	for t := CONNECT; t < RESERVED2; t++ {
+		this.encodeLatency[t].write(w, "mqtt_encode_duration_seconds", fmt.Sprintf("type=\"%s\"", t.Name()))
+	}
+
+	fmt.Fprintf(w, "# HELP mqtt_publish_payload_bytes Size of PUBLISH payloads.\n# TYPE mqtt_publish_payload_bytes histogram\n")
+	this.payloadIn.write(w, "mqtt_publish_payload_bytes", "direction=\"received\"")
+	this.payloadOut.write(w, "mqtt_publish_payload_bytes", "direction=\"sent\"")
+
+	fmt.Fprintf(w, "# HELP mqtt_inflight_messages Number of QoS 1 and 2 PUBLISH packets waiting to be acknowledged.\n# TYPE mqtt_inflight_messages gauge\n")
+	fmt.Fprintf(w, "mqtt_inflight_messages %d\n", this.inflight)
+
+	fmt.Fprintf(w, "# HELP mqtt_inflight_queued_messages Number of PUBLISH packets waiting for room in an inflight window.\n# TYPE mqtt_inflight_queued_messages gauge\n")
+	fmt.Fprintf(w, "mqtt_inflight_queued_messages %d\n", this.inflightQueued)
+
+	fmt.Fprintf(w, "# HELP mqtt_inflight_full_total Number of PUBLISH packets that found the inflight window full.\n# TYPE mqtt_inflight_full_total counter\n")
+	fmt.Fprintf(w, "mqtt_inflight_full_total %d\n", this.inflightFulls)
+
+	fmt.Fprintf(w, "# HELP mqtt_inflight_dropped_total Number of PUBLISH packets dropped or rejected because the inflight queue was full.\n# TYPE mqtt_inflight_dropped_total counter\n")
+	for _, p := range []QueuePolicy{QueueDropOldest, QueueDropNewest, QueueReject} {
+		fmt.Fprintf(w, "mqtt_inflight_dropped_total{policy=\"%s\"} %d\n", p, this.inflightDrops[p])
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func TestMetricsCounters(t *testing.T) {
+	metrics := NewMetrics()
+
+	pub := NewPublishMessage()
+	pub.SetTopic([]byte("surgemq"))
+	pub.SetPayload(make([]byte, 100))
+
+	metrics.Received(pub, 111)
+	metrics.Received(pub, 111)
+	metrics.Sent(NewPubackMessage(), 4)
+
+	stream := NewPublishMessage()
+	stream.SetTopic([]byte("surgemq"))
+	assert.NoError(t, true, stream.SetPayloadStream(bytes.NewReader(make([]byte, 1000)), 1000))
+	metrics.Sent(stream, 1011)
+
+	connack := NewConnackMessage()
+	connack.SetReturnCode(NotAuthorized)
+	metrics.Sent(connack, 4)
+
+	metrics.DecodeError(CONNECT, io.EOF)
+	metrics.DecodeError(CONNECT, ErrIdentifierRejected)
+	metrics.DecodeError(CONNECT, ErrIdentifierRejected)
+	metrics.DecodeError(RESERVED2+1, io.EOF)
+
+	_, _, err := metrics.Encode(pub)
+	assert.NoError(t, true, err, "Error encoding message.")
+
+	metrics.ObserveEncode(PUBACK, time.Millisecond)
+
+	var buf bytes.Buffer
+	_, err = metrics.WriteTo(&buf)
+	assert.NoError(t, true, err, "Error writing metrics.")
+
+	out := buf.String()
+
+	expected := []string{
+		`mqtt_packets_received_total{type="PUBLISH"} 2`,
+		`mqtt_bytes_received_total{type="PUBLISH"} 222`,
+		`mqtt_packets_sent_total{type="PUBACK"} 1`,
+		`mqtt_bytes_sent_total{type="CONNACK"} 4`,
+		`mqtt_decode_errors_total{type="CONNECT",cause="eof"} 1`,
+		`mqtt_decode_errors_total{type="CONNECT",cause="connack"} 2`,
+		`mqtt_connack_total{code="5",response="Connection Refused, not authorized"} 1`,
+		`mqtt_connack_total{code="0",response="Connection Accepted"} 0`,
+		`mqtt_encode_duration_seconds_count{type="PUBLISH"} 1`,
+		`mqtt_encode_duration_seconds_bucket{type="PUBACK",le="0.001"} 1`,
+		`mqtt_encode_duration_seconds_bucket{type="PUBACK",le="0.0005"} 0`,
+		`mqtt_publish_payload_bytes_bucket{direction="received",le="64"} 0`,
+		`mqtt_publish_payload_bytes_bucket{direction="received",le="256"} 2`,
+		`mqtt_publish_payload_bytes_bucket{direction="received",le="+Inf"} 2`,
+		`mqtt_publish_payload_bytes_sum{direction="received"} 200`,
+		`mqtt_publish_payload_bytes_count{direction="sent"} 1`,
+		`mqtt_publish_payload_bytes_sum{direction="sent"} 1000`,
+		`# TYPE mqtt_encode_duration_seconds histogram`,
+	}
+
+	for _, line := range expected {
+		assert.True(t, false, strings.Contains(out, line+"\n"), "Missing metric line:", line)
+	}
+
+	assert.Equal(t, true, 0, len(metrics.decodeErrors[RESERVED2+1]), "Decode errors for invalid types should not be recorded.")
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.Received(NewPingreqMessage(), 2)
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, true, 200, w.Code, "Incorrect status code.")
+	assert.True(t, true, strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4"), "Incorrect content type.")
+	assert.True(t, true, strings.Contains(w.Body.String(), `mqtt_packets_received_total{type="PINGREQ"} 1`), "Missing metric line.")
+}
@@ -28,10 +28,9 @@ package mqtt
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"regexp"
-
-	"github.com/dataence/glog"
 )
 
 var clientIdRegexp *regexp.Regexp
@@ -106,10 +105,47 @@ func CopyMessage(dst io.Writer, src io.Reader) (int64, error) {
 }
 
 // ValidTopic checks the topic, which is a slice of bytes, to see if it's valid. Topic is
-// considered valid if it's longer than 0 bytes, and doesn't contain any wildcard characters
-// such as * and #.
+// considered valid if it's longer than 0 bytes, is a well-formed UTF-8 string, and doesn't
+// contain any wildcard characters such as * and #.
 func ValidTopic(topic []byte) bool {
-	return len(topic) > 0 && bytes.IndexByte(topic, '#') == -1 && bytes.IndexByte(topic, '*') == -1
+	return len(topic) > 0 && bytes.IndexByte(topic, '#') == -1 && bytes.IndexByte(topic, '*') == -1 && ValidUTF8(topic)
+}
+
+// MatchTopic checks to see if the topic name matches the topic filter. The filter may
+// contain the multi-level wildcard # as its last level, and the single-level wildcard +
+// in any level. As required by the spec, a filter starting with a wildcard character
+// does not match topic names beginning with $, such as the $SYS topics [MQTT-4.7.2-1].
+func MatchTopic(filter, topic []byte) bool {
+	if len(filter) == 0 || len(topic) == 0 {
+		return false
+	}
+
+	if topic[0] == '$' && (filter[0] == '#' || filter[0] == '+') {
+		return false
+	}
+
+	flevels := bytes.Split(filter, []byte("/"))
+	tlevels := bytes.Split(topic, []byte("/"))
+
+	for i, f := range flevels {
+		if len(f) == 1 && f[0] == '#' {
+			return i == len(flevels)-1
+		}
+
+		if i >= len(tlevels) {
+			return false
+		}
+
+		if len(f) == 1 && f[0] == '+' {
+			continue
+		}
+
+		if !bytes.Equal(f, tlevels[i]) {
+			return false
+		}
+	}
+
+	return len(flevels) == len(tlevels)
 }
 
 // ValidQos checks the QoS value to see if it's valid. Valid QoS are QosAtMostOnce,
@@ -153,7 +189,7 @@ func writeByte(dst io.Writer, b byte) error {
 
 func readUint16(buf *bytes.Buffer) (uint16, error) {
 	if buf.Len() < 2 {
-		return 0, glog.NewError("Insufficient buffer size. Expecting %d, got %d.", 2, buf.Len())
+		return 0, fmt.Errorf("%w: Insufficient buffer size. Expecting %d, got %d.", io.ErrUnexpectedEOF, 2, buf.Len())
 	}
 
 	return binary.BigEndian.Uint16(buf.Next(2)), nil
@@ -178,7 +214,7 @@ func readLPBytes(buf *bytes.Buffer) ([]byte, int, error) {
 	}
 
 	if buf.Len() < int(n) {
-		return nil, total, glog.NewError("Insufficient buffer size. Expecting %d, got %d.", n, buf.Len())
+		return nil, total, fmt.Errorf("%w: Insufficient buffer size. Expecting %d, got %d.", io.ErrUnexpectedEOF, n, buf.Len())
 	}
 
 	total += int(n)
@@ -188,7 +224,7 @@ func readLPBytes(buf *bytes.Buffer) ([]byte, int, error) {
 
 func writeLPBytes(buf *bytes.Buffer, b []byte) (int, error) {
 	if len(b) > int(maxLPString) {
-		return 0, glog.NewError("Length greater than %d bytes.", maxLPString)
+		return 0, fmt.Errorf("%w: Length greater than %d bytes.", ErrPacketTooLarge, maxLPString)
 	}
 
 	total := 0
@@ -208,6 +244,10 @@ func writeLPBytes(buf *bytes.Buffer, b []byte) (int, error) {
 	return total, nil
 }
 
+// readVarint32 reads the remaining length of a message. A malformed remaining length
+// is returned as a *MalformedPacketError with the offset from the start of the message,
+// and the caller is expected to fill in the message type.
+//
 // Modified from http://golang.org/src/pkg/encoding/binary/varint.go#106
 func readVarint32(dst io.Writer, src io.Reader) (int32, int, error) {
 	var x int32
@@ -217,6 +257,11 @@ func readVarint32(dst io.Writer, src io.Reader) (int32, int, error) {
 
 	for i = 0; i < 4; i++ {
 		_, err := src.Read(buf[i : i+1])
+		if err == io.EOF {
+			// The first byte of the fixed header has already been read, so the
+			// message is truncated.
+			err = &MalformedPacketError{Field: "Remaining Length", Offset: 1, Err: io.ErrUnexpectedEOF}
+		}
 		if err != nil {
 			return 0, i + 1, err
 		}
@@ -231,12 +276,16 @@ func readVarint32(dst io.Writer, src io.Reader) (int32, int, error) {
 	}
 
 	if i > 3 || (i == 3 && buf[3]&0x80 > 0) {
-		return x, i + 1, glog.NewError("Malformed remaining length. 4th byte has continuation bit set.")
+		return x, i + 1, &MalformedPacketError{
+			Field:  "Remaining Length",
+			Offset: 1,
+			Err:    fmt.Errorf("%w: 4th byte has continuation bit set", ErrPacketTooLarge),
+		}
 	}
 
 	if dst != nil {
 		if n, err := dst.Write(buf[:i+1]); err != nil {
-			return x, n, glog.NewError("Error writing data: %v", err)
+			return x, n, fmt.Errorf("Error writing data: %w", err)
 		}
 	}
 
@@ -245,7 +294,7 @@ func readVarint32(dst io.Writer, src io.Reader) (int32, int, error) {
 
 func writeVarint32(dst io.Writer, x int32) (int, error) {
 	if x > maxRemainingLength {
-		return 0, glog.NewError("Exceeded maximum of %d", maxRemainingLength)
+		return 0, fmt.Errorf("%w: Exceeded maximum of %d", ErrPacketTooLarge, maxRemainingLength)
 	}
 
 	var buf [4]byte
@@ -260,7 +309,7 @@ func writeVarint32(dst io.Writer, x int32) (int, error) {
 
 	n, err := dst.Write(buf[:i+1])
 	if err != nil {
-		return n, glog.NewError("Error writing data: %v", err)
+		return n, fmt.Errorf("Error writing data: %w", err)
 	}
 
 	return n, nil
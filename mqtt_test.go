@@ -235,3 +235,33 @@ func TestSupportedVersions(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchTopic(t *testing.T) {
+	matches := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+		{"sport/#", "sport", true},
+		{"#", "sport/tennis", true},
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"sport/tennis", "sport/tennis", true},
+		{"sport/tennis", "sport/tennis/player1", false},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/broker/+", "$SYS/broker/uptime", true},
+	}
+
+	for _, m := range matches {
+		assert.Equal(t, false, m.match, MatchTopic([]byte(m.filter), []byte(m.topic)), "Incorrect match for", m.filter, m.topic)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import "encoding/binary"
+
+// ConnectMessage is sent by a client to set up a connection.
+type ConnectMessage struct {
+	// Flags holds the Will and CleanSession flags.
+	Flags Flags
+
+	// ProtocolId is always ProtocolId.
+	ProtocolId byte
+
+	// Duration is the keep alive timer in seconds.
+	Duration uint16
+
+	// ClientId identifies the client to the gateway.
+	ClientId []byte
+}
+
+// Type returns CONNECT.
+func (this *ConnectMessage) Type() MessageType {
+	return CONNECT
+}
+
+func (this *ConnectMessage) encodeBody(dst []byte) []byte {
+	dst = append(dst, this.Flags.encode(), this.ProtocolId)
+	dst = appendUint16(dst, this.Duration)
+	return append(dst, this.ClientId...)
+}
+
+func (this *ConnectMessage) decodeBody(b []byte) error {
+	if err := checkLength(CONNECT, b, 4); err != nil {
+		return err
+	}
+
+	this.Flags = decodeFlags(b[0])
+	this.ProtocolId = b[1]
+	this.Duration = binary.BigEndian.Uint16(b[2:])
+	this.ClientId = b[4:]
+
+	if this.ProtocolId != ProtocolId {
+		return malformed("Decode", "Invalid protocol ID %d", this.ProtocolId)
+	}
+
+	return nil
+}
+
+// ConnackMessage is sent by the gateway in response to a CONNECT message.
+type ConnackMessage struct {
+	ReturnCode ReturnCode
+}
+
+// Type returns CONNACK.
+func (this *ConnackMessage) Type() MessageType {
+	return CONNACK
+}
+
+func (this *ConnackMessage) encodeBody(dst []byte) []byte {
+	return append(dst, byte(this.ReturnCode))
+}
+
+func (this *ConnackMessage) decodeBody(b []byte) error {
+	if err := checkLength(CONNACK, b, 1); err != nil {
+		return err
+	}
+
+	this.ReturnCode = ReturnCode(b[0])
+
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package mqttsn is an encoder/decoder library for MQTT-SN 1.2 messages, and a transparent
+gateway that connects MQTT-SN clients over UDP to an MQTT server. You can find the
+MQTT-SN spec at the following location:
+
+	1.2 - http://mqtt.org/new/wp-content/uploads/2009/06/MQTT-SN_spec_v1.2.pdf
+
+MQTT-SN messages are sent in datagrams, so unlike the mqtt package, messages are
+encoded to and decoded from byte slices. Each message type is a struct with exported
+fields, and the package level Encode and Decode functions handle the message header:
+
+	msg := &mqttsn.RegisterMessage{MsgId: 1, TopicName: []byte("sensors/temp")}
+
+	b, err := mqttsn.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	m, err := mqttsn.Decode(b)
+	if err != nil {
+		return err
+	}
+
+	reg := m.(*mqttsn.RegisterMessage)
+
+Decoded messages point into the byte slice they're decoded from, so the slice must
+not be reused while the message is in use.
+
+The Gateway translates between MQTT-SN and MQTT. Each MQTT-SN client gets its own
+connection to the MQTT server, and its own topic ID registry. Messages for clients that
+are asleep are buffered until they wake up.
+*/
+package mqttsn
@@ -0,0 +1,801 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/surge/mqtt"
+)
+
+// DefaultMaxBuffered is the number of messages buffered for a sleeping client if
+// Gateway.MaxBuffered is 0.
+const DefaultMaxBuffered = 100
+
+// Gateway is a transparent MQTT-SN gateway. It reads MQTT-SN messages from a UDP
+// socket, and gives each client its own connection to the MQTT server. Messages are
+// translated to and from the mqtt package types, so the server sees an ordinary MQTT
+// 3.1.1 client.
+//
+// Clients may only use QoS -1 after they're connected, in which case it's treated as
+// QoS 0. The Will topic and message can be set with CONNECT, but WILLTOPICUPD and
+// WILLMSGUPD are rejected since MQTT has no way to change them after connecting.
+type Gateway struct {
+	// GwId is the gateway ID sent in GWINFO messages.
+	GwId byte
+
+	// Predefined maps predefined topic IDs to topic names. It's shared by all
+	// clients, and must not be changed once Serve is called.
+	Predefined map[uint16][]byte
+
+	// MaxBuffered is the maximum number of messages buffered for a sleeping client.
+	// When the buffer is full, the oldest message is dropped.
+	MaxBuffered int
+
+	conn net.PacketConn
+	dial func() (net.Conn, error)
+
+	mu      sync.Mutex
+	clients map[string]*client
+	closed  bool
+}
+
+// NewGateway returns a gateway that reads MQTT-SN messages from conn, and calls dial
+// to connect to the MQTT server for each client.
+func NewGateway(conn net.PacketConn, dial func() (net.Conn, error)) *Gateway {
+	return &Gateway{
+		conn:    conn,
+		dial:    dial,
+		clients: make(map[string]*client),
+	}
+}
+
+// Serve reads and handles messages until the gateway is closed. Datagrams that
+// can't be decoded are dropped.
+func (this *Gateway) Serve() error {
+	buf := make([]byte, maxMessageLength)
+
+	for {
+		n, addr, err := this.conn.ReadFrom(buf)
+		if err != nil {
+			this.mu.Lock()
+			closed := this.closed
+			this.mu.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		// Decoded messages point into the datagram, so each one gets its own copy.
+		msg, err := Decode(append([]byte{}, buf[:n]...))
+		if err != nil {
+			continue
+		}
+
+		this.handle(addr, msg)
+	}
+}
+
+// Close closes the UDP socket and the connections of all clients.
+func (this *Gateway) Close() error {
+	this.mu.Lock()
+	this.closed = true
+	clients := this.clients
+	this.clients = make(map[string]*client)
+	this.mu.Unlock()
+
+	for _, c := range clients {
+		c.close()
+	}
+
+	return this.conn.Close()
+}
+
+// Clients returns the number of connected, or sleeping, clients.
+func (this *Gateway) Clients() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.clients)
+}
+
+func (this *Gateway) handle(addr net.Addr, msg Message) {
+	switch m := msg.(type) {
+	case *SearchgwMessage:
+		this.write(addr, &GwinfoMessage{GwId: this.GwId})
+		return
+
+	case *ConnectMessage:
+		this.connect(addr, m)
+		return
+	}
+
+	this.mu.Lock()
+	c := this.clients[addr.String()]
+	this.mu.Unlock()
+
+	if c != nil {
+		c.handle(msg)
+	}
+}
+
+func (this *Gateway) connect(addr net.Addr, m *ConnectMessage) {
+	this.mu.Lock()
+	c := this.clients[addr.String()]
+	this.mu.Unlock()
+
+	// A sleeping client that sends CONNECT becomes active again, and keeps its
+	// connection to the server.
+	if c != nil && c.wake() {
+		return
+	}
+
+	if c != nil {
+		c.close()
+	}
+
+	connect := mqtt.NewConnectMessage()
+	connect.SetVersion(0x4)
+	connect.SetCleanSession(m.Flags.CleanSession)
+	connect.SetKeepAlive(m.Duration)
+
+	if err := connect.SetClientId(append([]byte{}, m.ClientId...)); err != nil {
+		this.write(addr, &ConnackMessage{ReturnCode: RejectedNotSupported})
+		return
+	}
+
+	c = &client{
+		gw:       this,
+		addr:     addr,
+		topics:   NewTopicRegistry(),
+		connect:  connect,
+		pubs:     make(map[uint16]uint16),
+		subs:     make(map[uint16]pendingSub),
+		state:    stateConnecting,
+		duration: m.Duration,
+	}
+
+	this.mu.Lock()
+	this.clients[addr.String()] = c
+	this.mu.Unlock()
+
+	if m.Flags.Will {
+		c.setState(stateWillTopic)
+		this.write(addr, &WilltopicreqMessage{})
+		return
+	}
+
+	go c.dial()
+}
+
+func (this *Gateway) remove(c *client) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.clients[c.addr.String()] == c {
+		delete(this.clients, c.addr.String())
+	}
+}
+
+func (this *Gateway) write(addr net.Addr, msg Message) error {
+	b, err := Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.conn.WriteTo(b, addr)
+	return err
+}
+
+func (this *Gateway) maxBuffered() int {
+	if this.MaxBuffered > 0 {
+		return this.MaxBuffered
+	}
+
+	return DefaultMaxBuffered
+}
+
+// predefinedId returns the predefined topic ID for the topic name.
+func (this *Gateway) predefinedId(name []byte) (uint16, bool) {
+	for id, n := range this.Predefined {
+		if bytes.Equal(n, name) {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
+
+type clientState int
+
+const (
+	stateConnecting clientState = iota
+	stateWillTopic
+	stateWillMsg
+	stateActive
+	stateAsleep
+	stateLost
+)
+
+type pendingSub struct {
+	name        []byte
+	topicIdType byte
+	topicId     uint16
+}
+
+// client is the gateway side of one MQTT-SN client, and its connection to the server.
+type client struct {
+	gw       *Gateway
+	addr     net.Addr
+	topics   *TopicRegistry
+	duration uint16
+
+	// mu protects the fields below. It's never held while writing to the server,
+	// since the server may be blocked writing to us.
+	mu       sync.Mutex
+	state    clientState
+	connect  *mqtt.ConnectMessage
+	broker   net.Conn
+	buffered []Message
+	pubs     map[uint16]uint16
+	subs     map[uint16]pendingSub
+	msgId    uint16
+	sleep    chan struct{}
+
+	// wmu serializes writes to the server.
+	wmu sync.Mutex
+}
+
+func (this *client) setState(s clientState) {
+	this.mu.Lock()
+	this.state = s
+	this.mu.Unlock()
+}
+
+func (this *client) handle(msg Message) {
+	switch m := msg.(type) {
+	case *WilltopicMessage:
+		this.mu.Lock()
+		if this.state != stateWillTopic {
+			this.mu.Unlock()
+			return
+		}
+
+		if len(m.WillTopic) == 0 {
+			this.state = stateConnecting
+			this.mu.Unlock()
+			go this.dial()
+			return
+		}
+
+		this.connect.SetWillFlag(true)
+		this.connect.SetWillTopic(append([]byte{}, m.WillTopic...))
+		this.connect.SetWillQos(m.Flags.Qos)
+		this.connect.SetWillRetain(m.Flags.Retain)
+		this.state = stateWillMsg
+		this.mu.Unlock()
+
+		this.gw.write(this.addr, &WillmsgreqMessage{})
+
+	case *WillmsgMessage:
+		this.mu.Lock()
+		if this.state != stateWillMsg {
+			this.mu.Unlock()
+			return
+		}
+
+		this.connect.SetWillMessage(append([]byte{}, m.WillMsg...))
+		this.state = stateConnecting
+		this.mu.Unlock()
+
+		go this.dial()
+
+	case *RegisterMessage:
+		id, _, err := this.topics.Register(m.TopicName)
+		rc := Accepted
+		if err != nil {
+			rc = RejectedNotSupported
+		}
+
+		this.gw.write(this.addr, &RegackMessage{TopicId: id, MsgId: m.MsgId, ReturnCode: rc})
+
+	case *RegackMessage:
+		if m.ReturnCode != Accepted {
+			this.topics.Unregister(m.TopicId)
+		}
+
+	case *PublishMessage:
+		this.publish(m)
+
+	case *PubackMessage:
+		ack := mqtt.NewPubackMessage()
+		ack.SetPacketId(m.MsgId)
+		this.write(ack)
+
+	case *PubrecMessage:
+		ack := mqtt.NewPubrecMessage()
+		ack.SetPacketId(m.MsgId)
+		this.write(ack)
+
+	case *PubrelMessage:
+		ack := mqtt.NewPubrelMessage()
+		ack.SetPacketId(m.MsgId)
+		this.write(ack)
+
+	case *PubcompMessage:
+		ack := mqtt.NewPubcompMessage()
+		ack.SetPacketId(m.MsgId)
+		this.write(ack)
+
+	case *SubscribeMessage:
+		this.subscribe(m)
+
+	case *UnsubscribeMessage:
+		name, ok := this.topicFilter(m.Flags, m.TopicName, m.TopicId)
+		if !ok {
+			return
+		}
+
+		unsub := mqtt.NewUnsubscribeMessage()
+		unsub.SetPacketId(m.MsgId)
+		unsub.AddTopic(name)
+		this.write(unsub)
+
+	case *PingreqMessage:
+		this.mu.Lock()
+		asleep := this.state == stateAsleep
+		this.mu.Unlock()
+
+		// A sleeping client wakes up to get its buffered messages, and goes back
+		// to sleep after the PINGRESP.
+		if asleep {
+			this.flush()
+		} else {
+			this.write(mqtt.NewPingreqMessage())
+		}
+
+		this.gw.write(this.addr, &PingrespMessage{})
+
+	case *DisconnectMessage:
+		if m.Duration > 0 {
+			this.asleep()
+			this.gw.write(this.addr, &DisconnectMessage{})
+			return
+		}
+
+		this.write(mqtt.NewDisconnectMessage())
+		this.gw.write(this.addr, &DisconnectMessage{})
+		this.gw.remove(this)
+		this.close()
+
+	case *WilltopicupdMessage:
+		this.gw.write(this.addr, &WilltopicrespMessage{ReturnCode: RejectedNotSupported})
+
+	case *WillmsgupdMessage:
+		this.gw.write(this.addr, &WillmsgrespMessage{ReturnCode: RejectedNotSupported})
+	}
+}
+
+// topicName returns the topic name for the topic ID in a PUBLISH message.
+func (this *client) topicName(flags Flags, id uint16) ([]byte, bool) {
+	switch flags.TopicIdType {
+	case TopicIdPredefined:
+		name, ok := this.gw.Predefined[id]
+		return name, ok
+
+	case TopicIdShort:
+		return ShortTopicName(id), true
+	}
+
+	return this.topics.Name(id)
+}
+
+// topicFilter returns the topic filter in a SUBSCRIBE or UNSUBSCRIBE message.
+func (this *client) topicFilter(flags Flags, name []byte, id uint16) ([]byte, bool) {
+	if flags.TopicIdType == TopicIdPredefined {
+		name, ok := this.gw.Predefined[id]
+		return name, ok
+	}
+
+	return append([]byte{}, name...), len(name) > 0
+}
+
+func (this *client) publish(m *PublishMessage) {
+	name, ok := this.topicName(m.Flags, m.TopicId)
+
+	pub := mqtt.NewPublishMessage()
+	if ok && pub.SetTopic(name) != nil {
+		ok = false
+	}
+
+	if !ok {
+		this.gw.write(this.addr, &PubackMessage{TopicId: m.TopicId, MsgId: m.MsgId, ReturnCode: RejectedInvalidTopicId})
+		return
+	}
+
+	qos := m.Flags.Qos
+	if qos == QosMinusOne {
+		qos = mqtt.QosAtMostOnce
+	}
+
+	pub.SetQoS(qos)
+	pub.SetRetain(m.Flags.Retain)
+	pub.SetDup(m.Flags.Dup)
+	pub.SetPacketId(m.MsgId)
+	pub.SetPayload(m.Data)
+
+	if qos != mqtt.QosAtMostOnce {
+		this.mu.Lock()
+		this.pubs[m.MsgId] = m.TopicId
+		this.mu.Unlock()
+	}
+
+	this.write(pub)
+}
+
+func (this *client) subscribe(m *SubscribeMessage) {
+	name, ok := this.topicFilter(m.Flags, m.TopicName, m.TopicId)
+	if !ok {
+		this.gw.write(this.addr, &SubackMessage{MsgId: m.MsgId, ReturnCode: RejectedInvalidTopicId})
+		return
+	}
+
+	qos := m.Flags.Qos
+	if qos > mqtt.QosExactlyOnce {
+		qos = mqtt.QosAtMostOnce
+	}
+
+	sub := mqtt.NewSubscribeMessage()
+	sub.SetPacketId(m.MsgId)
+	sub.AddTopic(name, qos)
+
+	this.mu.Lock()
+	this.subs[m.MsgId] = pendingSub{name: name, topicIdType: m.Flags.TopicIdType, topicId: m.TopicId}
+	this.mu.Unlock()
+
+	this.write(sub)
+}
+
+// dial connects to the server, sends the CONNECT message, and reads messages from
+// the server until the connection is closed.
+func (this *client) dial() {
+	conn, err := this.gw.dial()
+	if err != nil {
+		this.gw.write(this.addr, &ConnackMessage{ReturnCode: RejectedCongestion})
+		this.gw.remove(this)
+		return
+	}
+
+	this.mu.Lock()
+	if this.state == stateLost {
+		this.mu.Unlock()
+		conn.Close()
+		return
+	}
+	this.broker = conn
+	connect := this.connect
+	this.mu.Unlock()
+
+	if err := this.write(connect); err != nil {
+		this.lost()
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	for {
+		msg, err := readMessage(br)
+		if err != nil {
+			this.lost()
+			return
+		}
+
+		this.fromBroker(msg)
+	}
+}
+
+func (this *client) fromBroker(msg mqtt.Message) {
+	switch m := msg.(type) {
+	case *mqtt.ConnackMessage:
+		if m.ReturnCode() != mqtt.ConnectionAccepted {
+			this.gw.write(this.addr, &ConnackMessage{ReturnCode: RejectedNotSupported})
+			this.gw.remove(this)
+			this.close()
+			return
+		}
+
+		this.setState(stateActive)
+		this.gw.write(this.addr, &ConnackMessage{ReturnCode: Accepted})
+
+	case *mqtt.PublishMessage:
+		this.deliver(m)
+
+	case *mqtt.PubackMessage:
+		this.mu.Lock()
+		id := this.pubs[m.PacketId()]
+		delete(this.pubs, m.PacketId())
+		this.mu.Unlock()
+
+		this.send(&PubackMessage{TopicId: id, MsgId: m.PacketId(), ReturnCode: Accepted})
+
+	case *mqtt.PubrecMessage:
+		this.send(&PubrecMessage{MsgId: m.PacketId()})
+
+	case *mqtt.PubrelMessage:
+		this.send(&PubrelMessage{MsgId: m.PacketId()})
+
+	case *mqtt.PubcompMessage:
+		this.mu.Lock()
+		delete(this.pubs, m.PacketId())
+		this.mu.Unlock()
+
+		this.send(&PubcompMessage{MsgId: m.PacketId()})
+
+	case *mqtt.SubackMessage:
+		this.suback(m)
+
+	case *mqtt.UnsubackMessage:
+		this.send(&UnsubackMessage{MsgId: m.PacketId()})
+	}
+}
+
+func (this *client) suback(m *mqtt.SubackMessage) {
+	this.mu.Lock()
+	sub, ok := this.subs[m.PacketId()]
+	delete(this.subs, m.PacketId())
+	this.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	codes := m.ReturnCodes()
+	if len(codes) == 0 || codes[0] == mqtt.QosFailure {
+		this.send(&SubackMessage{MsgId: m.PacketId(), ReturnCode: RejectedNotSupported})
+		return
+	}
+
+	ack := &SubackMessage{
+		Flags:      Flags{Qos: codes[0]},
+		MsgId:      m.PacketId(),
+		ReturnCode: Accepted,
+	}
+
+	switch sub.topicIdType {
+	case TopicIdPredefined:
+		ack.TopicId = sub.topicId
+
+	case TopicIdNormal:
+		// Topic names without wildcards get a topic ID, so the client can publish
+		// to them as well.
+		if bytes.IndexAny(sub.name, "+#") == -1 {
+			if id, _, err := this.topics.Register(sub.name); err == nil {
+				ack.TopicId = id
+			}
+		}
+	}
+
+	this.send(ack)
+}
+
+// deliver sends a PUBLISH message from the server to the client. If the topic name
+// has no topic ID yet, the gateway registers it and sends a REGISTER message first.
+// The PUBLISH follows right away without waiting for the REGACK.
+func (this *client) deliver(m *mqtt.PublishMessage) {
+	pub := &PublishMessage{
+		Flags: Flags{
+			Dup:    m.Dup(),
+			Qos:    m.QoS(),
+			Retain: m.Retain(),
+		},
+		MsgId: m.PacketId(),
+		Data:  m.Payload(),
+	}
+
+	topic := m.Topic()
+
+	if id, ok := this.gw.predefinedId(topic); ok {
+		pub.Flags.TopicIdType = TopicIdPredefined
+		pub.TopicId = id
+	} else if len(topic) == 2 {
+		pub.Flags.TopicIdType = TopicIdShort
+		pub.TopicId, _ = ShortTopicId(topic)
+	} else {
+		id, registered, err := this.topics.Register(topic)
+		if err != nil {
+			return
+		}
+
+		if registered {
+			this.send(&RegisterMessage{TopicId: id, MsgId: this.nextMsgId(), TopicName: topic})
+		}
+
+		pub.TopicId = id
+	}
+
+	this.send(pub)
+}
+
+func (this *client) nextMsgId() uint16 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.msgId++
+	if this.msgId == 0 {
+		this.msgId++
+	}
+
+	return this.msgId
+}
+
+// send sends a message to the client, or buffers it if the client is asleep.
+func (this *client) send(msg Message) {
+	this.mu.Lock()
+	if this.state == stateAsleep {
+		if len(this.buffered) >= this.gw.maxBuffered() {
+			this.buffered = this.buffered[1:]
+		}
+		this.buffered = append(this.buffered, msg)
+		this.mu.Unlock()
+		return
+	}
+	this.mu.Unlock()
+
+	this.gw.write(this.addr, msg)
+}
+
+// flush sends the buffered messages to the client.
+func (this *client) flush() {
+	this.mu.Lock()
+	buffered := this.buffered
+	this.buffered = nil
+	this.mu.Unlock()
+
+	for _, msg := range buffered {
+		this.gw.write(this.addr, msg)
+	}
+}
+
+// asleep puts the client to sleep. While it's asleep, the gateway keeps its
+// connection to the server alive with PINGREQ messages.
+func (this *client) asleep() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.state != stateActive {
+		return
+	}
+
+	this.state = stateAsleep
+	this.sleep = make(chan struct{})
+
+	if this.duration > 0 {
+		go this.keepAlive(time.Duration(this.duration)*time.Second, this.sleep)
+	}
+}
+
+// wake makes a sleeping client active again, and sends it a CONNACK followed by its
+// buffered messages. It returns false if the client is not asleep.
+func (this *client) wake() bool {
+	this.mu.Lock()
+	if this.state != stateAsleep {
+		this.mu.Unlock()
+		return false
+	}
+
+	this.state = stateActive
+	close(this.sleep)
+	this.mu.Unlock()
+
+	this.gw.write(this.addr, &ConnackMessage{ReturnCode: Accepted})
+	this.flush()
+
+	return true
+}
+
+func (this *client) keepAlive(d time.Duration, done chan struct{}) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-t.C:
+			if this.write(mqtt.NewPingreqMessage()) != nil {
+				return
+			}
+		}
+	}
+}
+
+// write sends a message to the server.
+func (this *client) write(msg mqtt.Message) error {
+	this.mu.Lock()
+	conn := this.broker
+	this.mu.Unlock()
+
+	if conn == nil {
+		return io.ErrClosedPipe
+	}
+
+	r, _, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	_, err = io.Copy(conn, r)
+	return err
+}
+
+// lost is called when the connection to the server is closed. The client is told it
+// is disconnected.
+func (this *client) lost() {
+	this.mu.Lock()
+	lost := this.state == stateLost
+	this.mu.Unlock()
+
+	this.gw.remove(this)
+	this.close()
+
+	if !lost {
+		this.gw.write(this.addr, &DisconnectMessage{})
+	}
+}
+
+func (this *client) close() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.state == stateAsleep {
+		close(this.sleep)
+	}
+
+	this.state = stateLost
+
+	if this.broker != nil {
+		this.broker.Close()
+	}
+}
+
+// readMessage reads the next MQTT message from the server.
+func readMessage(br *bufio.Reader) (mqtt.Message, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mqtt.MessageType(b[0] >> 4).New()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = msg.Decode(br); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,390 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+	"github.com/surge/mqtt"
+)
+
+// testBroker is a minimal MQTT server that acknowledges everything, and sends each
+// PUBLISH back to the client if it matches one of its subscriptions.
+type testBroker struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	conn    net.Conn
+	filters [][]byte
+	connect *mqtt.ConnectMessage
+
+	wmu sync.Mutex
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, true, err, "Error listening.")
+
+	b := &testBroker{ln: ln}
+	go b.serve()
+
+	return b
+}
+
+func (this *testBroker) serve() {
+	for {
+		conn, err := this.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		this.mu.Lock()
+		this.conn = conn
+		this.mu.Unlock()
+
+		go this.handle(conn)
+	}
+}
+
+func (this *testBroker) handle(conn net.Conn) {
+	br := bufio.NewReader(conn)
+
+	for {
+		msg, err := readMessage(br)
+		if err != nil {
+			return
+		}
+
+		switch m := msg.(type) {
+		case *mqtt.ConnectMessage:
+			this.mu.Lock()
+			this.connect = m
+			this.mu.Unlock()
+
+			this.write(conn, mqtt.NewConnackMessage())
+
+		case *mqtt.SubscribeMessage:
+			this.mu.Lock()
+			this.filters = append(this.filters, m.Topics()...)
+			this.mu.Unlock()
+
+			ack := mqtt.NewSubackMessage()
+			ack.SetPacketId(m.PacketId())
+			ack.AddReturnCodes(m.Qos())
+			this.write(conn, ack)
+
+		case *mqtt.PublishMessage:
+			if m.QoS() == mqtt.QosAtLeastOnce {
+				ack := mqtt.NewPubackMessage()
+				ack.SetPacketId(m.PacketId())
+				this.write(conn, ack)
+			}
+
+			this.publish(m.Topic(), m.Payload())
+
+		case *mqtt.PingreqMessage:
+			this.write(conn, mqtt.NewPingrespMessage())
+
+		case *mqtt.DisconnectMessage:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// publish sends a QoS 0 PUBLISH to the client if the topic matches a subscription.
+func (this *testBroker) publish(topic, payload []byte) {
+	this.mu.Lock()
+	conn := this.conn
+	match := false
+	for _, f := range this.filters {
+		match = match || mqtt.MatchTopic(f, topic)
+	}
+	this.mu.Unlock()
+
+	if !match {
+		return
+	}
+
+	pub := mqtt.NewPublishMessage()
+	pub.SetTopic(append([]byte{}, topic...))
+	pub.SetPayload(append([]byte{}, payload...))
+	this.write(conn, pub)
+}
+
+func (this *testBroker) write(conn net.Conn, msg mqtt.Message) {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	if r, _, err := msg.Encode(); err == nil {
+		io.Copy(conn, r)
+	}
+}
+
+func (this *testBroker) dial() (net.Conn, error) {
+	return net.Dial("tcp", this.ln.Addr().String())
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.PacketConn
+	gw   net.Addr
+}
+
+func (this *testClient) send(msg Message) {
+	b, err := Encode(msg)
+	assert.NoError(this.t, true, err, "Error encoding "+msg.Type().Name())
+
+	_, err = this.conn.WriteTo(b, this.gw)
+	assert.NoError(this.t, true, err, "Error sending "+msg.Type().Name())
+}
+
+func (this *testClient) receive() Message {
+	buf := make([]byte, maxMessageLength)
+
+	this.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := this.conn.ReadFrom(buf)
+	assert.NoError(this.t, true, err, "Error receiving message.")
+
+	msg, err := Decode(buf[:n])
+	assert.NoError(this.t, true, err, "Error decoding message.")
+
+	return msg
+}
+
+func newTestGateway(t *testing.T, predefined map[uint16][]byte) (*Gateway, *testBroker, *testClient) {
+	broker := newTestBroker(t)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, true, err, "Error listening.")
+
+	gw := NewGateway(pc, broker.dial)
+	gw.GwId = 3
+	gw.Predefined = predefined
+	go gw.Serve()
+
+	cc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, true, err, "Error listening.")
+
+	return gw, broker, &testClient{t: t, conn: cc, gw: pc.LocalAddr()}
+}
+
+func TestGatewaySearch(t *testing.T) {
+	gw, broker, c := newTestGateway(t, nil)
+	defer broker.ln.Close()
+	defer gw.Close()
+
+	c.send(&SearchgwMessage{Radius: 1})
+
+	info, ok := c.receive().(*GwinfoMessage)
+	assert.True(t, true, ok, "Expecting GWINFO.")
+	assert.Equal(t, true, byte(3), info.GwId, "Incorrect gateway ID.")
+}
+
+func TestGatewaySession(t *testing.T) {
+	gw, broker, c := newTestGateway(t, nil)
+	defer broker.ln.Close()
+	defer gw.Close()
+
+	c.send(&ConnectMessage{Flags: Flags{CleanSession: true}, ProtocolId: ProtocolId, Duration: 60, ClientId: []byte("sensor1")})
+
+	connack, ok := c.receive().(*ConnackMessage)
+	assert.True(t, true, ok, "Expecting CONNACK.")
+	assert.Equal(t, true, Accepted, connack.ReturnCode, "Incorrect return code.")
+
+	broker.mu.Lock()
+	assert.Equal(t, true, []byte("sensor1"), broker.connect.ClientId(), "Incorrect client ID.")
+	assert.Equal(t, true, uint16(60), broker.connect.KeepAlive(), "Incorrect keep alive.")
+	broker.mu.Unlock()
+
+	c.send(&RegisterMessage{MsgId: 1, TopicName: []byte("sensors/temp")})
+
+	regack, ok := c.receive().(*RegackMessage)
+	assert.True(t, true, ok, "Expecting REGACK.")
+	assert.Equal(t, true, uint16(1), regack.TopicId, "Incorrect topic ID.")
+	assert.Equal(t, true, uint16(1), regack.MsgId, "Incorrect MsgId.")
+
+	c.send(&SubscribeMessage{Flags: Flags{Qos: 1}, MsgId: 2, TopicName: []byte("sensors/#")})
+
+	suback, ok := c.receive().(*SubackMessage)
+	assert.True(t, true, ok, "Expecting SUBACK.")
+	assert.Equal(t, true, uint16(2), suback.MsgId, "Incorrect MsgId.")
+	assert.Equal(t, true, uint16(0), suback.TopicId, "Expecting no topic ID for a wildcard filter.")
+	assert.Equal(t, true, byte(1), suback.Flags.Qos, "Incorrect granted QoS.")
+
+	c.send(&PublishMessage{Flags: Flags{Qos: 1}, TopicId: 1, MsgId: 3, Data: []byte("21.5")})
+
+	puback, ok := c.receive().(*PubackMessage)
+	assert.True(t, true, ok, "Expecting PUBACK.")
+	assert.Equal(t, true, uint16(1), puback.TopicId, "Incorrect topic ID.")
+	assert.Equal(t, true, uint16(3), puback.MsgId, "Incorrect MsgId.")
+	assert.Equal(t, true, Accepted, puback.ReturnCode, "Incorrect return code.")
+
+	pub, ok := c.receive().(*PublishMessage)
+	assert.True(t, true, ok, "Expecting PUBLISH.")
+	assert.Equal(t, true, uint16(1), pub.TopicId, "Incorrect topic ID.")
+	assert.Equal(t, true, []byte("21.5"), pub.Data, "Incorrect data.")
+
+	c.send(&PublishMessage{TopicId: 9, MsgId: 4, Data: []byte("x")})
+
+	puback, ok = c.receive().(*PubackMessage)
+	assert.True(t, true, ok, "Expecting PUBACK.")
+	assert.Equal(t, true, RejectedInvalidTopicId, puback.ReturnCode, "Expecting unknown topic ID to be rejected.")
+
+	c.send(&DisconnectMessage{})
+
+	_, ok = c.receive().(*DisconnectMessage)
+	assert.True(t, true, ok, "Expecting DISCONNECT.")
+	assert.Equal(t, true, 0, gw.Clients(), "Expecting client to be removed.")
+}
+
+func TestGatewaySleep(t *testing.T) {
+	gw, broker, c := newTestGateway(t, nil)
+	defer broker.ln.Close()
+	defer gw.Close()
+
+	c.send(&ConnectMessage{ProtocolId: ProtocolId, Duration: 60, ClientId: []byte("sensor1")})
+	_, ok := c.receive().(*ConnackMessage)
+	assert.True(t, true, ok, "Expecting CONNACK.")
+
+	c.send(&SubscribeMessage{MsgId: 1, TopicName: []byte("sensors/humidity")})
+
+	suback, ok := c.receive().(*SubackMessage)
+	assert.True(t, true, ok, "Expecting SUBACK.")
+	assert.Equal(t, true, uint16(1), suback.TopicId, "Expecting topic ID for a topic name.")
+
+	c.send(&DisconnectMessage{Duration: 300})
+	_, ok = c.receive().(*DisconnectMessage)
+	assert.True(t, true, ok, "Expecting DISCONNECT.")
+
+	broker.publish([]byte("sensors/humidity"), []byte("40"))
+	broker.publish([]byte("sensors/humidity"), []byte("41"))
+
+	// Wait for the gateway to buffer the messages.
+	time.Sleep(100 * time.Millisecond)
+
+	c.send(&PingreqMessage{ClientId: []byte("sensor1")})
+
+	for _, data := range []string{"40", "41"} {
+		pub, ok := c.receive().(*PublishMessage)
+		assert.True(t, true, ok, "Expecting PUBLISH.")
+		assert.Equal(t, true, uint16(1), pub.TopicId, "Incorrect topic ID.")
+		assert.Equal(t, true, []byte(data), pub.Data, "Incorrect data.")
+	}
+
+	_, ok = c.receive().(*PingrespMessage)
+	assert.True(t, true, ok, "Expecting PINGRESP.")
+
+	assert.Equal(t, true, 1, gw.Clients(), "Expecting sleeping client to be kept.")
+}
+
+func TestGatewayRegister(t *testing.T) {
+	gw, broker, c := newTestGateway(t, map[uint16][]byte{20: []byte("config/sensor1")})
+	defer broker.ln.Close()
+	defer gw.Close()
+
+	c.send(&ConnectMessage{ProtocolId: ProtocolId, Duration: 60, ClientId: []byte("sensor1")})
+	_, ok := c.receive().(*ConnackMessage)
+	assert.True(t, true, ok, "Expecting CONNACK.")
+
+	c.send(&SubscribeMessage{MsgId: 1, TopicName: []byte("#")})
+	_, ok = c.receive().(*SubackMessage)
+	assert.True(t, true, ok, "Expecting SUBACK.")
+
+	// The gateway registers new topic names before publishing to them.
+	broker.publish([]byte("sensors/temp"), []byte("21.5"))
+
+	reg, ok := c.receive().(*RegisterMessage)
+	assert.True(t, true, ok, "Expecting REGISTER.")
+	assert.Equal(t, true, []byte("sensors/temp"), reg.TopicName, "Incorrect topic name.")
+
+	pub, ok := c.receive().(*PublishMessage)
+	assert.True(t, true, ok, "Expecting PUBLISH.")
+	assert.Equal(t, true, reg.TopicId, pub.TopicId, "Incorrect topic ID.")
+	assert.Equal(t, true, TopicIdNormal, pub.Flags.TopicIdType, "Incorrect topic ID type.")
+
+	c.send(&RegackMessage{TopicId: reg.TopicId, MsgId: reg.MsgId, ReturnCode: Accepted})
+
+	broker.publish([]byte("config/sensor1"), []byte("on"))
+
+	pub, ok = c.receive().(*PublishMessage)
+	assert.True(t, true, ok, "Expecting PUBLISH.")
+	assert.Equal(t, true, uint16(20), pub.TopicId, "Incorrect predefined topic ID.")
+	assert.Equal(t, true, TopicIdPredefined, pub.Flags.TopicIdType, "Incorrect topic ID type.")
+
+	broker.publish([]byte("ab"), []byte("1"))
+
+	pub, ok = c.receive().(*PublishMessage)
+	assert.True(t, true, ok, "Expecting PUBLISH.")
+	assert.Equal(t, true, ShortTopicName(pub.TopicId), []byte("ab"), "Incorrect short topic.")
+	assert.Equal(t, true, TopicIdShort, pub.Flags.TopicIdType, "Incorrect topic ID type.")
+}
+
+func TestGatewayWill(t *testing.T) {
+	gw, broker, c := newTestGateway(t, nil)
+	defer broker.ln.Close()
+	defer gw.Close()
+
+	c.send(&ConnectMessage{Flags: Flags{Will: true}, ProtocolId: ProtocolId, Duration: 60, ClientId: []byte("sensor1")})
+
+	_, ok := c.receive().(*WilltopicreqMessage)
+	assert.True(t, true, ok, "Expecting WILLTOPICREQ.")
+
+	c.send(&WilltopicMessage{Flags: Flags{Qos: 1}, WillTopic: []byte("sensors/sensor1/status")})
+
+	_, ok = c.receive().(*WillmsgreqMessage)
+	assert.True(t, true, ok, "Expecting WILLMSGREQ.")
+
+	c.send(&WillmsgMessage{WillMsg: []byte("offline")})
+
+	_, ok = c.receive().(*ConnackMessage)
+	assert.True(t, true, ok, "Expecting CONNACK.")
+
+	broker.mu.Lock()
+	assert.True(t, true, broker.connect.WillFlag(), "Expecting Will flag.")
+	assert.Equal(t, true, []byte("sensors/sensor1/status"), broker.connect.WillTopic(), "Incorrect Will topic.")
+	assert.Equal(t, true, []byte("offline"), broker.connect.WillMessage(), "Incorrect Will message.")
+	assert.Equal(t, true, byte(1), broker.connect.WillQos(), "Incorrect Will QoS.")
+	broker.mu.Unlock()
+
+	c.send(&WillmsgupdMessage{WillMsg: []byte("gone")})
+
+	resp, ok := c.receive().(*WillmsgrespMessage)
+	assert.True(t, true, ok, "Expecting WILLMSGRESP.")
+	assert.Equal(t, true, RejectedNotSupported, resp.ReturnCode, "Expecting Will update to be rejected.")
+}
+
+func TestGatewayBrokerLost(t *testing.T) {
+	gw, broker, c := newTestGateway(t, nil)
+	defer broker.ln.Close()
+	defer gw.Close()
+
+	c.send(&ConnectMessage{ProtocolId: ProtocolId, Duration: 60, ClientId: []byte("sensor1")})
+	_, ok := c.receive().(*ConnackMessage)
+	assert.True(t, true, ok, "Expecting CONNACK.")
+
+	broker.mu.Lock()
+	broker.conn.Close()
+	broker.mu.Unlock()
+
+	_, ok = c.receive().(*DisconnectMessage)
+	assert.True(t, true, ok, "Expecting DISCONNECT.")
+}
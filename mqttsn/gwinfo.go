@@ -0,0 +1,103 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import "encoding/binary"
+
+// AdvertiseMessage is broadcast periodically by a gateway to advertise its presence.
+type AdvertiseMessage struct {
+	// GwId is the ID of the gateway.
+	GwId byte
+
+	// Duration is the number of seconds until the next ADVERTISE is broadcast.
+	Duration uint16
+}
+
+// Type returns ADVERTISE.
+func (this *AdvertiseMessage) Type() MessageType {
+	return ADVERTISE
+}
+
+func (this *AdvertiseMessage) encodeBody(dst []byte) []byte {
+	return appendUint16(append(dst, this.GwId), this.Duration)
+}
+
+func (this *AdvertiseMessage) decodeBody(b []byte) error {
+	if err := checkLength(ADVERTISE, b, 3); err != nil {
+		return err
+	}
+
+	this.GwId = b[0]
+	this.Duration = binary.BigEndian.Uint16(b[1:])
+
+	return nil
+}
+
+// SearchgwMessage is broadcast by a client to search for a gateway.
+type SearchgwMessage struct {
+	// Radius is the broadcast radius of the message.
+	Radius byte
+}
+
+// Type returns SEARCHGW.
+func (this *SearchgwMessage) Type() MessageType {
+	return SEARCHGW
+}
+
+func (this *SearchgwMessage) encodeBody(dst []byte) []byte {
+	return append(dst, this.Radius)
+}
+
+func (this *SearchgwMessage) decodeBody(b []byte) error {
+	if err := checkLength(SEARCHGW, b, 1); err != nil {
+		return err
+	}
+
+	this.Radius = b[0]
+
+	return nil
+}
+
+// GwinfoMessage is sent in response to a SEARCHGW message.
+type GwinfoMessage struct {
+	// GwId is the ID of the gateway.
+	GwId byte
+
+	// GwAdd is the address of the gateway. It's only present if the GWINFO message
+	// is sent by a client.
+	GwAdd []byte
+}
+
+// Type returns GWINFO.
+func (this *GwinfoMessage) Type() MessageType {
+	return GWINFO
+}
+
+func (this *GwinfoMessage) encodeBody(dst []byte) []byte {
+	return append(append(dst, this.GwId), this.GwAdd...)
+}
+
+func (this *GwinfoMessage) decodeBody(b []byte) error {
+	if err := checkLength(GWINFO, b, 1); err != nil {
+		return err
+	}
+
+	this.GwId = b[0]
+	if len(b) > 1 {
+		this.GwAdd = b[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,435 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/surge/mqtt"
+)
+
+// MessageType is the type representing the MQTT-SN message types.
+type MessageType byte
+
+// Message is an interface defined for all MQTT-SN message types.
+type Message interface {
+	// Type returns the MessageType of the Message.
+	Type() MessageType
+
+	// encodeBody appends the message variable part to dst.
+	encodeBody(dst []byte) []byte
+
+	// decodeBody decodes the message variable part, which doesn't include the
+	// Length and MsgType fields.
+	decodeBody(b []byte) error
+}
+
+const (
+	// ADVERTISE: Gateway to Clients. Gateway advertisement.
+	ADVERTISE MessageType = 0x00
+
+	// SEARCHGW: Client to Gateways. Search for a gateway.
+	SEARCHGW MessageType = 0x01
+
+	// GWINFO: Gateway or Client to Client. Response to SEARCHGW.
+	GWINFO MessageType = 0x02
+
+	// CONNECT: Client to Gateway. Client request to connect.
+	CONNECT MessageType = 0x04
+
+	// CONNACK: Gateway to Client. Connect acknowledgement.
+	CONNACK MessageType = 0x05
+
+	// WILLTOPICREQ: Gateway to Client. Request for the Will topic.
+	WILLTOPICREQ MessageType = 0x06
+
+	// WILLTOPIC: Client to Gateway. Will topic.
+	WILLTOPIC MessageType = 0x07
+
+	// WILLMSGREQ: Gateway to Client. Request for the Will message.
+	WILLMSGREQ MessageType = 0x08
+
+	// WILLMSG: Client to Gateway. Will message.
+	WILLMSG MessageType = 0x09
+
+	// REGISTER: Client to Gateway, or Gateway to Client. Register a topic name.
+	REGISTER MessageType = 0x0a
+
+	// REGACK: Client to Gateway, or Gateway to Client. Register acknowledgement.
+	REGACK MessageType = 0x0b
+
+	// PUBLISH: Client to Gateway, or Gateway to Client. Publish message.
+	PUBLISH MessageType = 0x0c
+
+	// PUBACK: Client to Gateway, or Gateway to Client. Publish acknowledgement.
+	PUBACK MessageType = 0x0d
+
+	// PUBCOMP: Client to Gateway, or Gateway to Client. Publish complete for QoS 2.
+	PUBCOMP MessageType = 0x0e
+
+	// PUBREC: Client to Gateway, or Gateway to Client. Publish received for QoS 2.
+	PUBREC MessageType = 0x0f
+
+	// PUBREL: Client to Gateway, or Gateway to Client. Publish release for QoS 2.
+	PUBREL MessageType = 0x10
+
+	// SUBSCRIBE: Client to Gateway. Subscribe request.
+	SUBSCRIBE MessageType = 0x12
+
+	// SUBACK: Gateway to Client. Subscribe acknowledgement.
+	SUBACK MessageType = 0x13
+
+	// UNSUBSCRIBE: Client to Gateway. Unsubscribe request.
+	UNSUBSCRIBE MessageType = 0x14
+
+	// UNSUBACK: Gateway to Client. Unsubscribe acknowledgement.
+	UNSUBACK MessageType = 0x15
+
+	// PINGREQ: Client to Gateway, or Gateway to Client. PING request.
+	PINGREQ MessageType = 0x16
+
+	// PINGRESP: Client to Gateway, or Gateway to Client. PING response.
+	PINGRESP MessageType = 0x17
+
+	// DISCONNECT: Client to Gateway, or Gateway to Client. Disconnect, or go to sleep.
+	DISCONNECT MessageType = 0x18
+
+	// WILLTOPICUPD: Client to Gateway. Will topic update.
+	WILLTOPICUPD MessageType = 0x1a
+
+	// WILLTOPICRESP: Gateway to Client. Will topic update response.
+	WILLTOPICRESP MessageType = 0x1b
+
+	// WILLMSGUPD: Client to Gateway. Will message update.
+	WILLMSGUPD MessageType = 0x1c
+
+	// WILLMSGRESP: Gateway to Client. Will message update response.
+	WILLMSGRESP MessageType = 0x1d
+)
+
+// Name returns the name of the message type.
+func (this MessageType) Name() string {
+	switch this {
+	case ADVERTISE:
+		return "ADVERTISE"
+	case SEARCHGW:
+		return "SEARCHGW"
+	case GWINFO:
+		return "GWINFO"
+	case CONNECT:
+		return "CONNECT"
+	case CONNACK:
+		return "CONNACK"
+	case WILLTOPICREQ:
+		return "WILLTOPICREQ"
+	case WILLTOPIC:
+		return "WILLTOPIC"
+	case WILLMSGREQ:
+		return "WILLMSGREQ"
+	case WILLMSG:
+		return "WILLMSG"
+	case REGISTER:
+		return "REGISTER"
+	case REGACK:
+		return "REGACK"
+	case PUBLISH:
+		return "PUBLISH"
+	case PUBACK:
+		return "PUBACK"
+	case PUBCOMP:
+		return "PUBCOMP"
+	case PUBREC:
+		return "PUBREC"
+	case PUBREL:
+		return "PUBREL"
+	case SUBSCRIBE:
+		return "SUBSCRIBE"
+	case SUBACK:
+		return "SUBACK"
+	case UNSUBSCRIBE:
+		return "UNSUBSCRIBE"
+	case UNSUBACK:
+		return "UNSUBACK"
+	case PINGREQ:
+		return "PINGREQ"
+	case PINGRESP:
+		return "PINGRESP"
+	case DISCONNECT:
+		return "DISCONNECT"
+	case WILLTOPICUPD:
+		return "WILLTOPICUPD"
+	case WILLTOPICRESP:
+		return "WILLTOPICRESP"
+	case WILLMSGUPD:
+		return "WILLMSGUPD"
+	case WILLMSGRESP:
+		return "WILLMSGRESP"
+	}
+
+	return "UNKNOWN"
+}
+
+// New creates a new message based on the message type. It returns an error if the
+// message type is invalid, or not supported, such as the Encapsulated message.
+func (this MessageType) New() (Message, error) {
+	switch this {
+	case ADVERTISE:
+		return &AdvertiseMessage{}, nil
+	case SEARCHGW:
+		return &SearchgwMessage{}, nil
+	case GWINFO:
+		return &GwinfoMessage{}, nil
+	case CONNECT:
+		return &ConnectMessage{ProtocolId: ProtocolId}, nil
+	case CONNACK:
+		return &ConnackMessage{}, nil
+	case WILLTOPICREQ:
+		return &WilltopicreqMessage{}, nil
+	case WILLTOPIC:
+		return &WilltopicMessage{}, nil
+	case WILLMSGREQ:
+		return &WillmsgreqMessage{}, nil
+	case WILLMSG:
+		return &WillmsgMessage{}, nil
+	case REGISTER:
+		return &RegisterMessage{}, nil
+	case REGACK:
+		return &RegackMessage{}, nil
+	case PUBLISH:
+		return &PublishMessage{}, nil
+	case PUBACK:
+		return &PubackMessage{}, nil
+	case PUBCOMP:
+		return &PubcompMessage{}, nil
+	case PUBREC:
+		return &PubrecMessage{}, nil
+	case PUBREL:
+		return &PubrelMessage{}, nil
+	case SUBSCRIBE:
+		return &SubscribeMessage{}, nil
+	case SUBACK:
+		return &SubackMessage{}, nil
+	case UNSUBSCRIBE:
+		return &UnsubscribeMessage{}, nil
+	case UNSUBACK:
+		return &UnsubackMessage{}, nil
+	case PINGREQ:
+		return &PingreqMessage{}, nil
+	case PINGRESP:
+		return &PingrespMessage{}, nil
+	case DISCONNECT:
+		return &DisconnectMessage{}, nil
+	case WILLTOPICUPD:
+		return &WilltopicupdMessage{}, nil
+	case WILLTOPICRESP:
+		return &WilltopicrespMessage{}, nil
+	case WILLMSGUPD:
+		return &WillmsgupdMessage{}, nil
+	case WILLMSGRESP:
+		return &WillmsgrespMessage{}, nil
+	}
+
+	return nil, fmt.Errorf("mqttsn/New: Invalid message type %d", this)
+}
+
+// ReturnCode is the return code sent in CONNACK, REGACK, PUBACK, SUBACK, WILLTOPICRESP
+// and WILLMSGRESP messages.
+type ReturnCode byte
+
+const (
+	// Accepted means the request was accepted.
+	Accepted ReturnCode = iota
+
+	// RejectedCongestion means the request was rejected because of congestion, and
+	// should be retried later.
+	RejectedCongestion
+
+	// RejectedInvalidTopicId means the topic ID is not known.
+	RejectedInvalidTopicId
+
+	// RejectedNotSupported means the request is not supported.
+	RejectedNotSupported
+)
+
+// QosMinusOne is the MQTT-SN QoS level -1, used by clients to publish without setting
+// up a connection. It's encoded in the flags as 0b11.
+const QosMinusOne byte = 3
+
+// The types of topic ID carried in PUBLISH, SUBSCRIBE and UNSUBSCRIBE messages.
+const (
+	// TopicIdNormal is a topic ID registered with REGISTER, or a topic name in
+	// SUBSCRIBE and UNSUBSCRIBE messages.
+	TopicIdNormal byte = iota
+
+	// TopicIdPredefined is a topic ID that's known in advance by the client and the
+	// gateway.
+	TopicIdPredefined
+
+	// TopicIdShort is a two character topic name.
+	TopicIdShort
+)
+
+// ProtocolId is the only protocol ID defined by MQTT-SN 1.2.
+const ProtocolId byte = 0x01
+
+// maxMessageLength is the largest message that can be encoded with the three byte
+// Length field.
+const maxMessageLength = 65535
+
+// Flags is the Flags field of MQTT-SN messages.
+type Flags struct {
+	// Dup is set if the message is being retransmitted.
+	Dup bool
+
+	// Qos is the QoS level 0, 1, 2, or QosMinusOne.
+	Qos byte
+
+	// Retain is the same as the MQTT Retain flag.
+	Retain bool
+
+	// Will is set if the client is asking for the Will topic and message.
+	Will bool
+
+	// CleanSession is the same as the MQTT Clean Session flag.
+	CleanSession bool
+
+	// TopicIdType is TopicIdNormal, TopicIdPredefined or TopicIdShort.
+	TopicIdType byte
+}
+
+func (this Flags) encode() byte {
+	var b byte
+
+	if this.Dup {
+		b |= 0x80
+	}
+
+	b |= (this.Qos & 0x3) << 5
+
+	if this.Retain {
+		b |= 0x10
+	}
+
+	if this.Will {
+		b |= 0x08
+	}
+
+	if this.CleanSession {
+		b |= 0x04
+	}
+
+	return b | this.TopicIdType&0x3
+}
+
+func decodeFlags(b byte) Flags {
+	return Flags{
+		Dup:          b&0x80 != 0,
+		Qos:          (b >> 5) & 0x3,
+		Retain:       b&0x10 != 0,
+		Will:         b&0x08 != 0,
+		CleanSession: b&0x04 != 0,
+		TopicIdType:  b & 0x3,
+	}
+}
+
+// ShortTopicId returns the topic ID for a two character topic name.
+func ShortTopicId(name []byte) (uint16, error) {
+	if len(name) != 2 {
+		return 0, fmt.Errorf("mqttsn/ShortTopicId: Short topic name (%s) must be 2 characters", string(name))
+	}
+
+	return binary.BigEndian.Uint16(name), nil
+}
+
+// ShortTopicName returns the two character topic name for a short topic ID.
+func ShortTopicName(id uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], id)
+	return b[:]
+}
+
+// Encode returns the encoded message, including the Length and MsgType fields. The
+// three byte form of the Length field is used for messages of 256 bytes or longer.
+func Encode(msg Message) ([]byte, error) {
+	body := msg.encodeBody(make([]byte, 0, 64))
+
+	n := len(body) + 2
+	if n < 256 {
+		return append([]byte{byte(n), byte(msg.Type())}, body...), nil
+	}
+
+	n += 2
+	if n > maxMessageLength {
+		return nil, fmt.Errorf("mqttsn/Encode: %w: %s message length %d exceeds maximum of %d bytes", mqtt.ErrPacketTooLarge, msg.Type().Name(), n, maxMessageLength)
+	}
+
+	b := make([]byte, 4, n)
+	b[0] = 0x01
+	binary.BigEndian.PutUint16(b[1:], uint16(n))
+	b[3] = byte(msg.Type())
+
+	return append(b, body...), nil
+}
+
+// Decode decodes the first message in b. The message points into b, so b must not
+// be changed while the message is in use. Bytes after the end of the message, as
+// given by its Length field, are ignored.
+func Decode(b []byte) (Message, error) {
+	if len(b) < 2 {
+		return nil, malformed("Decode", "Message is too short (%d bytes)", len(b))
+	}
+
+	n, hl := int(b[0]), 1
+	if n == 0x01 {
+		if len(b) < 4 {
+			return nil, malformed("Decode", "Message is too short (%d bytes)", len(b))
+		}
+
+		n, hl = int(binary.BigEndian.Uint16(b[1:])), 3
+	}
+
+	if n < hl+1 || n > len(b) {
+		return nil, malformed("Decode", "Invalid message length %d, got %d bytes", n, len(b))
+	}
+
+	msg, err := MessageType(b[hl]).New()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = msg.decodeBody(b[hl+1 : n]); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func malformed(fn, format string, args ...interface{}) error {
+	return fmt.Errorf("mqttsn/%s: %w: %s", fn, mqtt.ErrMalformedPacket, fmt.Sprintf(format, args...))
+}
+
+// checkLength returns an error if the message body is shorter than n bytes.
+func checkLength(mtype MessageType, b []byte, n int) error {
+	if len(b) < n {
+		return malformed("Decode", "%s message is too short. Expecting %d bytes, got %d", mtype.Name(), n, len(b))
+	}
+
+	return nil
+}
+
+func appendUint16(dst []byte, v uint16) []byte {
+	return append(dst, byte(v>>8), byte(v))
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/dataence/assert"
+	"github.com/surge/mqtt"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msgs := []Message{
+		&AdvertiseMessage{GwId: 1, Duration: 900},
+		&SearchgwMessage{Radius: 2},
+		&GwinfoMessage{GwId: 1, GwAdd: []byte{10, 0, 0, 1}},
+		&ConnectMessage{Flags: Flags{Will: true, CleanSession: true}, ProtocolId: ProtocolId, Duration: 60, ClientId: []byte("sensor1")},
+		&ConnackMessage{ReturnCode: RejectedCongestion},
+		&WilltopicreqMessage{},
+		&WilltopicMessage{Flags: Flags{Qos: 1, Retain: true}, WillTopic: []byte("sensors/lost")},
+		&WillmsgreqMessage{},
+		&WillmsgMessage{WillMsg: []byte("gone")},
+		&RegisterMessage{TopicId: 7, MsgId: 3, TopicName: []byte("sensors/temp")},
+		&RegackMessage{TopicId: 7, MsgId: 3, ReturnCode: Accepted},
+		&PublishMessage{Flags: Flags{Dup: true, Qos: 2, TopicIdType: TopicIdShort}, TopicId: 0x6162, MsgId: 9, Data: []byte("21.5")},
+		&PubackMessage{TopicId: 7, MsgId: 9, ReturnCode: RejectedInvalidTopicId},
+		&PubrecMessage{MsgId: 9},
+		&PubrelMessage{MsgId: 9},
+		&PubcompMessage{MsgId: 9},
+		&SubscribeMessage{Flags: Flags{Qos: 1}, MsgId: 4, TopicName: []byte("sensors/#")},
+		&SubscribeMessage{Flags: Flags{TopicIdType: TopicIdPredefined}, MsgId: 5, TopicId: 12},
+		&SubackMessage{Flags: Flags{Qos: 1}, TopicId: 7, MsgId: 4, ReturnCode: Accepted},
+		&UnsubscribeMessage{Flags: Flags{TopicIdType: TopicIdShort}, MsgId: 6, TopicName: []byte("ab")},
+		&UnsubackMessage{MsgId: 6},
+		&PingreqMessage{ClientId: []byte("sensor1")},
+		&PingrespMessage{},
+		&DisconnectMessage{Duration: 300},
+		&WilltopicupdMessage{Flags: Flags{Qos: 1}, WillTopic: []byte("sensors/lost")},
+		&WilltopicrespMessage{ReturnCode: RejectedNotSupported},
+		&WillmsgupdMessage{WillMsg: []byte("bye")},
+		&WillmsgrespMessage{ReturnCode: Accepted},
+	}
+
+	for _, msg := range msgs {
+		b, err := Encode(msg)
+		assert.NoError(t, true, err, "Error encoding "+msg.Type().Name())
+		assert.Equal(t, true, len(b), int(b[0]), "Incorrect length for "+msg.Type().Name())
+		assert.Equal(t, true, byte(msg.Type()), b[1], "Incorrect type for "+msg.Type().Name())
+
+		dec, err := Decode(b)
+		assert.NoError(t, true, err, "Error decoding "+msg.Type().Name())
+		assert.True(t, true, reflect.DeepEqual(msg, dec), "Decoded message differs for "+msg.Type().Name())
+	}
+}
+
+func TestMessageLongLength(t *testing.T) {
+	msg := &PublishMessage{TopicId: 1, MsgId: 1, Data: bytes.Repeat([]byte{'x'}, 300)}
+
+	b, err := Encode(msg)
+	assert.NoError(t, true, err, "Error encoding message.")
+	assert.Equal(t, true, []byte{0x01, 0x01, 0x35, byte(PUBLISH)}, b[:4], "Incorrect three byte length.")
+	assert.Equal(t, true, 309, len(b), "Incorrect message length.")
+
+	dec, err := Decode(b)
+	assert.NoError(t, true, err, "Error decoding message.")
+	assert.True(t, true, reflect.DeepEqual(msg, dec), "Decoded message differs.")
+
+	msg.Data = make([]byte, maxMessageLength)
+	_, err = Encode(msg)
+	assert.True(t, true, errors.Is(err, mqtt.ErrPacketTooLarge), "Expecting ErrPacketTooLarge.")
+}
+
+func TestMessageDecodeMalformed(t *testing.T) {
+	tests := [][]byte{
+		{},
+		{0x02},
+		{0x05, byte(PUBACK), 0, 1},
+		{0x01, 0x00},
+		{0x03, 0xff, 0x00},
+		{0x06, byte(CONNECT), 0x04, 0x02, 0, 60},
+		{0x04, byte(SUBSCRIBE), byte(TopicIdPredefined), 0},
+	}
+
+	for _, b := range tests {
+		_, err := Decode(b)
+		assert.Error(t, true, err, "Expecting error decoding", b)
+	}
+
+	_, err := Decode([]byte{0x03, byte(PUBACK), 0})
+	assert.True(t, true, errors.Is(err, mqtt.ErrMalformedPacket), "Expecting ErrMalformedPacket.")
+}
+
+func TestMessageExtraBytes(t *testing.T) {
+	msg, err := Decode([]byte{0x04, byte(PUBREL), 0, 5, 0xde, 0xad})
+	assert.NoError(t, true, err, "Error decoding message.")
+	assert.Equal(t, true, uint16(5), msg.(*PubrelMessage).MsgId, "Incorrect MsgId.")
+}
+
+func TestFlags(t *testing.T) {
+	f := Flags{Dup: true, Qos: QosMinusOne, Retain: true, Will: true, CleanSession: true, TopicIdType: TopicIdShort}
+	assert.Equal(t, true, byte(0xfe), f.encode(), "Incorrect flags byte.")
+	assert.Equal(t, true, f, decodeFlags(0xfe), "Incorrect decoded flags.")
+}
+
+func TestShortTopic(t *testing.T) {
+	id, err := ShortTopicId([]byte("ab"))
+	assert.NoError(t, true, err, "Error getting short topic ID.")
+	assert.Equal(t, true, uint16(0x6162), id, "Incorrect short topic ID.")
+	assert.Equal(t, true, []byte("ab"), ShortTopicName(id), "Incorrect short topic name.")
+
+	_, err = ShortTopicId([]byte("abc"))
+	assert.Error(t, true, err, "Expecting error for 3 character topic.")
+}
+
+func TestMessageTypeNew(t *testing.T) {
+	for mtype := ADVERTISE; mtype <= WILLMSGRESP; mtype++ {
+		msg, err := mtype.New()
+		if err != nil {
+			continue
+		}
+
+		assert.Equal(t, true, mtype, msg.Type(), "Incorrect type for "+mtype.Name())
+	}
+
+	_, err := MessageType(0x03).New()
+	assert.Error(t, true, err, "Expecting error for reserved type.")
+}
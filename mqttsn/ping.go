@@ -0,0 +1,85 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import "encoding/binary"
+
+// PingreqMessage is sent to check that the other side is alive. A sleeping client
+// includes its ClientId to wake up and receive its buffered messages.
+type PingreqMessage struct {
+	ClientId []byte
+}
+
+// Type returns PINGREQ.
+func (this *PingreqMessage) Type() MessageType {
+	return PINGREQ
+}
+
+func (this *PingreqMessage) encodeBody(dst []byte) []byte {
+	return append(dst, this.ClientId...)
+}
+
+func (this *PingreqMessage) decodeBody(b []byte) error {
+	if len(b) > 0 {
+		this.ClientId = b
+	}
+
+	return nil
+}
+
+// PingrespMessage is sent in response to a PINGREQ message. The gateway also sends it
+// to a client that's awake once all its buffered messages are sent.
+type PingrespMessage struct{}
+
+// Type returns PINGRESP.
+func (this *PingrespMessage) Type() MessageType {
+	return PINGRESP
+}
+
+func (this *PingrespMessage) encodeBody(dst []byte) []byte {
+	return dst
+}
+
+func (this *PingrespMessage) decodeBody(b []byte) error {
+	return nil
+}
+
+// DisconnectMessage is sent by a client to disconnect, or by the gateway to tell the
+// client it's disconnected. A client that sets Duration goes to sleep for that many
+// seconds instead of disconnecting.
+type DisconnectMessage struct {
+	Duration uint16
+}
+
+// Type returns DISCONNECT.
+func (this *DisconnectMessage) Type() MessageType {
+	return DISCONNECT
+}
+
+func (this *DisconnectMessage) encodeBody(dst []byte) []byte {
+	if this.Duration == 0 {
+		return dst
+	}
+
+	return appendUint16(dst, this.Duration)
+}
+
+func (this *DisconnectMessage) decodeBody(b []byte) error {
+	if len(b) >= 2 {
+		this.Duration = binary.BigEndian.Uint16(b)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import "encoding/binary"
+
+// PublishMessage carries an application message for a topic ID.
+type PublishMessage struct {
+	// Flags holds the Dup, Qos, Retain and TopicIdType flags.
+	Flags Flags
+
+	// TopicId is a registered or predefined topic ID, or a short topic name,
+	// depending on Flags.TopicIdType.
+	TopicId uint16
+
+	// MsgId is only used for QoS 1 and 2 messages.
+	MsgId uint16
+
+	Data []byte
+}
+
+// Type returns PUBLISH.
+func (this *PublishMessage) Type() MessageType {
+	return PUBLISH
+}
+
+func (this *PublishMessage) encodeBody(dst []byte) []byte {
+	dst = append(dst, this.Flags.encode())
+	dst = appendUint16(appendUint16(dst, this.TopicId), this.MsgId)
+	return append(dst, this.Data...)
+}
+
+func (this *PublishMessage) decodeBody(b []byte) error {
+	if err := checkLength(PUBLISH, b, 5); err != nil {
+		return err
+	}
+
+	this.Flags = decodeFlags(b[0])
+	this.TopicId = binary.BigEndian.Uint16(b[1:])
+	this.MsgId = binary.BigEndian.Uint16(b[3:])
+	this.Data = b[5:]
+
+	return nil
+}
+
+// PubackMessage is sent in response to a QoS 1 PUBLISH message, or to reject a PUBLISH
+// message with an unknown topic ID.
+type PubackMessage struct {
+	TopicId    uint16
+	MsgId      uint16
+	ReturnCode ReturnCode
+}
+
+// Type returns PUBACK.
+func (this *PubackMessage) Type() MessageType {
+	return PUBACK
+}
+
+func (this *PubackMessage) encodeBody(dst []byte) []byte {
+	dst = appendUint16(appendUint16(dst, this.TopicId), this.MsgId)
+	return append(dst, byte(this.ReturnCode))
+}
+
+func (this *PubackMessage) decodeBody(b []byte) error {
+	if err := checkLength(PUBACK, b, 5); err != nil {
+		return err
+	}
+
+	this.TopicId = binary.BigEndian.Uint16(b)
+	this.MsgId = binary.BigEndian.Uint16(b[2:])
+	this.ReturnCode = ReturnCode(b[4])
+
+	return nil
+}
+
+// PubrecMessage is the first response to a QoS 2 PUBLISH message.
+type PubrecMessage struct {
+	MsgId uint16
+}
+
+// Type returns PUBREC.
+func (this *PubrecMessage) Type() MessageType {
+	return PUBREC
+}
+
+func (this *PubrecMessage) encodeBody(dst []byte) []byte {
+	return appendUint16(dst, this.MsgId)
+}
+
+func (this *PubrecMessage) decodeBody(b []byte) error {
+	return decodeMsgId(PUBREC, b, &this.MsgId)
+}
+
+// PubrelMessage is sent in response to a PUBREC message.
+type PubrelMessage struct {
+	MsgId uint16
+}
+
+// Type returns PUBREL.
+func (this *PubrelMessage) Type() MessageType {
+	return PUBREL
+}
+
+func (this *PubrelMessage) encodeBody(dst []byte) []byte {
+	return appendUint16(dst, this.MsgId)
+}
+
+func (this *PubrelMessage) decodeBody(b []byte) error {
+	return decodeMsgId(PUBREL, b, &this.MsgId)
+}
+
+// PubcompMessage is sent in response to a PUBREL message.
+type PubcompMessage struct {
+	MsgId uint16
+}
+
+// Type returns PUBCOMP.
+func (this *PubcompMessage) Type() MessageType {
+	return PUBCOMP
+}
+
+func (this *PubcompMessage) encodeBody(dst []byte) []byte {
+	return appendUint16(dst, this.MsgId)
+}
+
+func (this *PubcompMessage) decodeBody(b []byte) error {
+	return decodeMsgId(PUBCOMP, b, &this.MsgId)
+}
+
+func decodeMsgId(mtype MessageType, b []byte, id *uint16) error {
+	if err := checkLength(mtype, b, 2); err != nil {
+		return err
+	}
+
+	*id = binary.BigEndian.Uint16(b)
+
+	return nil
+}
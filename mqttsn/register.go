@@ -0,0 +1,80 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import "encoding/binary"
+
+// RegisterMessage is sent by a client to ask the gateway for a topic ID for a topic
+// name, or by the gateway to tell a client the topic ID it's about to use.
+type RegisterMessage struct {
+	// TopicId is 0 when sent by a client, and the assigned topic ID when sent by the
+	// gateway.
+	TopicId uint16
+
+	MsgId uint16
+
+	TopicName []byte
+}
+
+// Type returns REGISTER.
+func (this *RegisterMessage) Type() MessageType {
+	return REGISTER
+}
+
+func (this *RegisterMessage) encodeBody(dst []byte) []byte {
+	dst = appendUint16(appendUint16(dst, this.TopicId), this.MsgId)
+	return append(dst, this.TopicName...)
+}
+
+func (this *RegisterMessage) decodeBody(b []byte) error {
+	if err := checkLength(REGISTER, b, 4); err != nil {
+		return err
+	}
+
+	this.TopicId = binary.BigEndian.Uint16(b)
+	this.MsgId = binary.BigEndian.Uint16(b[2:])
+	this.TopicName = b[4:]
+
+	return nil
+}
+
+// RegackMessage is sent in response to a REGISTER message.
+type RegackMessage struct {
+	TopicId    uint16
+	MsgId      uint16
+	ReturnCode ReturnCode
+}
+
+// Type returns REGACK.
+func (this *RegackMessage) Type() MessageType {
+	return REGACK
+}
+
+func (this *RegackMessage) encodeBody(dst []byte) []byte {
+	dst = appendUint16(appendUint16(dst, this.TopicId), this.MsgId)
+	return append(dst, byte(this.ReturnCode))
+}
+
+func (this *RegackMessage) decodeBody(b []byte) error {
+	if err := checkLength(REGACK, b, 5); err != nil {
+		return err
+	}
+
+	this.TopicId = binary.BigEndian.Uint16(b)
+	this.MsgId = binary.BigEndian.Uint16(b[2:])
+	this.ReturnCode = ReturnCode(b[4])
+
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TopicRegistry maps topic names to topic IDs for a client. Topic IDs 0x0000 and
+// 0xffff are reserved, so a registry holds at most 65534 topics.
+type TopicRegistry struct {
+	mu    sync.RWMutex
+	next  uint16
+	ids   map[string]uint16
+	names map[uint16][]byte
+}
+
+// NewTopicRegistry returns an empty registry.
+func NewTopicRegistry() *TopicRegistry {
+	return &TopicRegistry{
+		next:  1,
+		ids:   make(map[string]uint16),
+		names: make(map[uint16][]byte),
+	}
+}
+
+// Register returns the topic ID for the topic name, assigning a new one if the name
+// is not registered yet. The second return value is true if a new ID was assigned.
+func (this *TopicRegistry) Register(name []byte) (uint16, bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if id, ok := this.ids[string(name)]; ok {
+		return id, false, nil
+	}
+
+	if len(this.names) >= 0xfffe {
+		return 0, false, fmt.Errorf("mqttsn/Register: No topic IDs left for topic %s", string(name))
+	}
+
+	for this.next == 0 || this.next == 0xffff || this.names[this.next] != nil {
+		this.next++
+	}
+
+	id := this.next
+	this.next++
+
+	this.ids[string(name)] = id
+	this.names[id] = append([]byte{}, name...)
+
+	return id, true, nil
+}
+
+// Id returns the topic ID for the topic name.
+func (this *TopicRegistry) Id(name []byte) (uint16, bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	id, ok := this.ids[string(name)]
+	return id, ok
+}
+
+// Name returns the topic name for the topic ID.
+func (this *TopicRegistry) Name(id uint16) ([]byte, bool) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	name, ok := this.names[id]
+	return name, ok
+}
+
+// Unregister removes the topic ID from the registry.
+func (this *TopicRegistry) Unregister(id uint16) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if name, ok := this.names[id]; ok {
+		delete(this.ids, string(name))
+		delete(this.names, id)
+	}
+}
+
+// Len returns the number of registered topics.
+func (this *TopicRegistry) Len() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return len(this.names)
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestTopicRegistry(t *testing.T) {
+	r := NewTopicRegistry()
+
+	id, isNew, err := r.Register([]byte("sensors/temp"))
+	assert.NoError(t, true, err, "Error registering topic.")
+	assert.True(t, true, isNew, "Expecting new topic ID.")
+	assert.Equal(t, true, uint16(1), id, "Incorrect topic ID.")
+
+	id, isNew, err = r.Register([]byte("sensors/temp"))
+	assert.NoError(t, true, err, "Error registering topic.")
+	assert.False(t, true, isNew, "Expecting existing topic ID.")
+	assert.Equal(t, true, uint16(1), id, "Incorrect topic ID.")
+
+	id, _, _ = r.Register([]byte("sensors/humidity"))
+	assert.Equal(t, true, uint16(2), id, "Incorrect topic ID.")
+	assert.Equal(t, true, 2, r.Len(), "Incorrect number of topics.")
+
+	name, ok := r.Name(2)
+	assert.True(t, true, ok, "Expecting topic ID 2.")
+	assert.Equal(t, true, []byte("sensors/humidity"), name, "Incorrect topic name.")
+
+	r.Unregister(1)
+	_, ok = r.Id([]byte("sensors/temp"))
+	assert.False(t, true, ok, "Expecting topic to be unregistered.")
+	_, ok = r.Name(1)
+	assert.False(t, true, ok, "Expecting topic ID to be unregistered.")
+}
+
+func TestTopicRegistryReserved(t *testing.T) {
+	r := NewTopicRegistry()
+	r.next = 0xfffe
+
+	id, _, _ := r.Register([]byte("a/b"))
+	assert.Equal(t, true, uint16(0xfffe), id, "Incorrect topic ID.")
+
+	id, _, _ = r.Register([]byte("a/c"))
+	assert.Equal(t, true, uint16(1), id, "Expecting IDs 0xffff and 0 to be skipped.")
+}
+
+func TestTopicRegistryCopiesName(t *testing.T) {
+	r := NewTopicRegistry()
+
+	b := []byte("sensors/temp")
+	id, _, _ := r.Register(b)
+	b[0] = 'x'
+
+	name, _ := r.Name(id)
+	assert.Equal(t, true, []byte("sensors/temp"), name, "Expecting registry to copy the topic name.")
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import "encoding/binary"
+
+// SubscribeMessage is sent by a client to subscribe to a topic name, which may contain
+// wildcards, a predefined topic ID, or a short topic name.
+type SubscribeMessage struct {
+	// Flags holds the Dup, Qos and TopicIdType flags.
+	Flags Flags
+
+	MsgId uint16
+
+	// TopicName is used if Flags.TopicIdType is TopicIdNormal or TopicIdShort.
+	TopicName []byte
+
+	// TopicId is used if Flags.TopicIdType is TopicIdPredefined.
+	TopicId uint16
+}
+
+// Type returns SUBSCRIBE.
+func (this *SubscribeMessage) Type() MessageType {
+	return SUBSCRIBE
+}
+
+func (this *SubscribeMessage) encodeBody(dst []byte) []byte {
+	return encodeTopic(appendUint16(append(dst, this.Flags.encode()), this.MsgId), this.Flags, this.TopicName, this.TopicId)
+}
+
+func (this *SubscribeMessage) decodeBody(b []byte) error {
+	var err error
+	this.Flags, this.MsgId, this.TopicName, this.TopicId, err = decodeTopic(SUBSCRIBE, b)
+	return err
+}
+
+// SubackMessage is sent by the gateway in response to a SUBSCRIBE message.
+type SubackMessage struct {
+	// Flags holds the granted QoS.
+	Flags Flags
+
+	// TopicId is the topic ID the gateway uses for the topic name, or 0 if the topic
+	// name contains wildcards.
+	TopicId uint16
+
+	MsgId      uint16
+	ReturnCode ReturnCode
+}
+
+// Type returns SUBACK.
+func (this *SubackMessage) Type() MessageType {
+	return SUBACK
+}
+
+func (this *SubackMessage) encodeBody(dst []byte) []byte {
+	dst = append(dst, this.Flags.encode())
+	dst = appendUint16(appendUint16(dst, this.TopicId), this.MsgId)
+	return append(dst, byte(this.ReturnCode))
+}
+
+func (this *SubackMessage) decodeBody(b []byte) error {
+	if err := checkLength(SUBACK, b, 6); err != nil {
+		return err
+	}
+
+	this.Flags = decodeFlags(b[0])
+	this.TopicId = binary.BigEndian.Uint16(b[1:])
+	this.MsgId = binary.BigEndian.Uint16(b[3:])
+	this.ReturnCode = ReturnCode(b[5])
+
+	return nil
+}
+
+// UnsubscribeMessage is sent by a client to unsubscribe from a topic.
+type UnsubscribeMessage struct {
+	// Flags holds the TopicIdType flag.
+	Flags Flags
+
+	MsgId uint16
+
+	// TopicName is used if Flags.TopicIdType is TopicIdNormal or TopicIdShort.
+	TopicName []byte
+
+	// TopicId is used if Flags.TopicIdType is TopicIdPredefined.
+	TopicId uint16
+}
+
+// Type returns UNSUBSCRIBE.
+func (this *UnsubscribeMessage) Type() MessageType {
+	return UNSUBSCRIBE
+}
+
+func (this *UnsubscribeMessage) encodeBody(dst []byte) []byte {
+	return encodeTopic(appendUint16(append(dst, this.Flags.encode()), this.MsgId), this.Flags, this.TopicName, this.TopicId)
+}
+
+func (this *UnsubscribeMessage) decodeBody(b []byte) error {
+	var err error
+	this.Flags, this.MsgId, this.TopicName, this.TopicId, err = decodeTopic(UNSUBSCRIBE, b)
+	return err
+}
+
+// UnsubackMessage is sent by the gateway in response to an UNSUBSCRIBE message.
+type UnsubackMessage struct {
+	MsgId uint16
+}
+
+// Type returns UNSUBACK.
+func (this *UnsubackMessage) Type() MessageType {
+	return UNSUBACK
+}
+
+func (this *UnsubackMessage) encodeBody(dst []byte) []byte {
+	return appendUint16(dst, this.MsgId)
+}
+
+func (this *UnsubackMessage) decodeBody(b []byte) error {
+	return decodeMsgId(UNSUBACK, b, &this.MsgId)
+}
+
+func encodeTopic(dst []byte, flags Flags, name []byte, id uint16) []byte {
+	if flags.TopicIdType == TopicIdPredefined {
+		return appendUint16(dst, id)
+	}
+
+	return append(dst, name...)
+}
+
+func decodeTopic(mtype MessageType, b []byte) (flags Flags, msgId uint16, name []byte, id uint16, err error) {
+	if err = checkLength(mtype, b, 3); err != nil {
+		return
+	}
+
+	flags = decodeFlags(b[0])
+	msgId = binary.BigEndian.Uint16(b[1:])
+
+	switch flags.TopicIdType {
+	case TopicIdPredefined:
+		if err = checkLength(mtype, b, 5); err == nil {
+			id = binary.BigEndian.Uint16(b[3:])
+		}
+
+	case TopicIdShort:
+		if err = checkLength(mtype, b, 5); err == nil {
+			name = b[3:5]
+		}
+
+	default:
+		name = b[3:]
+	}
+
+	return
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+// WilltopicreqMessage is sent by the gateway to ask a connecting client for its Will
+// topic.
+type WilltopicreqMessage struct{}
+
+// Type returns WILLTOPICREQ.
+func (this *WilltopicreqMessage) Type() MessageType {
+	return WILLTOPICREQ
+}
+
+func (this *WilltopicreqMessage) encodeBody(dst []byte) []byte {
+	return dst
+}
+
+func (this *WilltopicreqMessage) decodeBody(b []byte) error {
+	return nil
+}
+
+// WilltopicMessage is sent by the client in response to WILLTOPICREQ. An empty message,
+// with no flags and no topic, deletes the Will.
+type WilltopicMessage struct {
+	// Flags holds the Will QoS and Retain flags.
+	Flags Flags
+
+	// WillTopic is the Will topic name.
+	WillTopic []byte
+}
+
+// Type returns WILLTOPIC.
+func (this *WilltopicMessage) Type() MessageType {
+	return WILLTOPIC
+}
+
+func (this *WilltopicMessage) encodeBody(dst []byte) []byte {
+	if len(this.WillTopic) == 0 {
+		return dst
+	}
+
+	return append(append(dst, this.Flags.encode()), this.WillTopic...)
+}
+
+func (this *WilltopicMessage) decodeBody(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	this.Flags = decodeFlags(b[0])
+	this.WillTopic = b[1:]
+
+	return nil
+}
+
+// WillmsgreqMessage is sent by the gateway to ask a connecting client for its Will
+// message.
+type WillmsgreqMessage struct{}
+
+// Type returns WILLMSGREQ.
+func (this *WillmsgreqMessage) Type() MessageType {
+	return WILLMSGREQ
+}
+
+func (this *WillmsgreqMessage) encodeBody(dst []byte) []byte {
+	return dst
+}
+
+func (this *WillmsgreqMessage) decodeBody(b []byte) error {
+	return nil
+}
+
+// WillmsgMessage is sent by the client in response to WILLMSGREQ.
+type WillmsgMessage struct {
+	WillMsg []byte
+}
+
+// Type returns WILLMSG.
+func (this *WillmsgMessage) Type() MessageType {
+	return WILLMSG
+}
+
+func (this *WillmsgMessage) encodeBody(dst []byte) []byte {
+	return append(dst, this.WillMsg...)
+}
+
+func (this *WillmsgMessage) decodeBody(b []byte) error {
+	this.WillMsg = b
+	return nil
+}
+
+// WilltopicupdMessage is sent by a client to update its Will topic.
+type WilltopicupdMessage struct {
+	// Flags holds the Will QoS and Retain flags.
+	Flags Flags
+
+	// WillTopic is the Will topic name. If empty, the Will is deleted.
+	WillTopic []byte
+}
+
+// Type returns WILLTOPICUPD.
+func (this *WilltopicupdMessage) Type() MessageType {
+	return WILLTOPICUPD
+}
+
+func (this *WilltopicupdMessage) encodeBody(dst []byte) []byte {
+	if len(this.WillTopic) == 0 {
+		return dst
+	}
+
+	return append(append(dst, this.Flags.encode()), this.WillTopic...)
+}
+
+func (this *WilltopicupdMessage) decodeBody(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	this.Flags = decodeFlags(b[0])
+	this.WillTopic = b[1:]
+
+	return nil
+}
+
+// WilltopicrespMessage is sent by the gateway in response to WILLTOPICUPD.
+type WilltopicrespMessage struct {
+	ReturnCode ReturnCode
+}
+
+// Type returns WILLTOPICRESP.
+func (this *WilltopicrespMessage) Type() MessageType {
+	return WILLTOPICRESP
+}
+
+func (this *WilltopicrespMessage) encodeBody(dst []byte) []byte {
+	return append(dst, byte(this.ReturnCode))
+}
+
+func (this *WilltopicrespMessage) decodeBody(b []byte) error {
+	if err := checkLength(WILLTOPICRESP, b, 1); err != nil {
+		return err
+	}
+
+	this.ReturnCode = ReturnCode(b[0])
+
+	return nil
+}
+
+// WillmsgupdMessage is sent by a client to update its Will message.
+type WillmsgupdMessage struct {
+	WillMsg []byte
+}
+
+// Type returns WILLMSGUPD.
+func (this *WillmsgupdMessage) Type() MessageType {
+	return WILLMSGUPD
+}
+
+func (this *WillmsgupdMessage) encodeBody(dst []byte) []byte {
+	return append(dst, this.WillMsg...)
+}
+
+func (this *WillmsgupdMessage) decodeBody(b []byte) error {
+	this.WillMsg = b
+	return nil
+}
+
+// WillmsgrespMessage is sent by the gateway in response to WILLMSGUPD.
+type WillmsgrespMessage struct {
+	ReturnCode ReturnCode
+}
+
+// Type returns WILLMSGRESP.
+func (this *WillmsgrespMessage) Type() MessageType {
+	return WILLMSGRESP
+}
+
+func (this *WillmsgrespMessage) encodeBody(dst []byte) []byte {
+	return append(dst, byte(this.ReturnCode))
+}
+
+func (this *WillmsgrespMessage) decodeBody(b []byte) error {
+	if err := checkLength(WILLMSGRESP, b, 1); err != nil {
+		return err
+	}
+
+	this.ReturnCode = ReturnCode(b[0])
+
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Negotiator decides which protocol versions a listener accepts. Each listener can
+// have its own Negotiator, for example to accept 3.1 clients on a legacy port only.
+// Negotiators are created with NewNegotiator.
+type Negotiator struct {
+	versions []byte
+}
+
+// NewNegotiator returns a Negotiator that accepts the given protocol versions. If no
+// versions are given, all of the SupportedVersions are accepted. It returns an error
+// if any of the versions is not supported.
+func NewNegotiator(versions ...byte) (*Negotiator, error) {
+	if len(versions) == 0 {
+		for v := range SupportedVersions {
+			versions = append(versions, v)
+		}
+	}
+
+	this := &Negotiator{}
+
+	for _, v := range versions {
+		if !ValidVersion(v) {
+			return nil, fmt.Errorf("negotiate/NewNegotiator: Unsupported protocol version %d", v)
+		}
+
+		if !this.Allowed(v) {
+			this.versions = append(this.versions, v)
+		}
+	}
+
+	sort.Slice(this.versions, func(i, j int) bool { return this.versions[i] < this.versions[j] })
+
+	return this, nil
+}
+
+// Versions returns the accepted protocol versions, lowest first.
+func (this *Negotiator) Versions() []byte {
+	return append([]byte{}, this.versions...)
+}
+
+// Allowed returns true if the protocol version is accepted.
+func (this *Negotiator) Allowed(v byte) bool {
+	for _, x := range this.versions {
+		if x == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Negotiate takes a CONNECT message and the error returned when decoding it, and
+// returns the Dialect for the rest of the connection.
+//
+// If the error is nil, the connection can go ahead. If the error is one of the
+// CONNACK errors, such as ErrUnacceptableProtocolVersion when the client asks for a
+// version this listener doesn't accept, the Server should send the CONNACK returned
+// by Dialect.Reject and close the connection. For any other error the Dialect is nil,
+// and the Server should close the connection without sending a CONNACK.
+func (this *Negotiator) Negotiate(msg *ConnectMessage, err error) (*Dialect, error) {
+	if msg == nil || (err != nil && !ValidConnackError(err)) {
+		return nil, err
+	}
+
+	v := msg.Version()
+
+	if !this.Allowed(v) {
+		// The CONNACK is encoded the same way in all versions when the connection
+		// is refused, so fall back to the highest version this listener accepts.
+		if !ValidVersion(v) && len(this.versions) > 0 {
+			v = this.versions[len(this.versions)-1]
+		}
+
+		return &Dialect{version: v}, ErrUnacceptableProtocolVersion
+	}
+
+	return &Dialect{version: v}, err
+}
+
+// ReadConnect decodes a CONNECT message from src and negotiates its protocol version.
+// The decode options are set on the message before it's decoded, and may be nil. The
+// return values are the same as for Negotiate, along with the message.
+func (this *Negotiator) ReadConnect(src io.Reader, opts *DecodeOptions) (*ConnectMessage, *Dialect, error) {
+	msg := NewConnectMessage()
+	msg.SetDecodeOptions(opts)
+
+	_, err := msg.Decode(src)
+	if err != nil && !ValidConnackError(err) {
+		return nil, nil, err
+	}
+
+	d, err := this.Negotiate(msg, err)
+
+	return msg, d, err
+}
+
+// Dialect records the protocol version of a connection, and encodes messages the
+// way that version expects.
+type Dialect struct {
+	version byte
+}
+
+// NewDialect returns the Dialect for the protocol version, or an error if the
+// version is not supported.
+func NewDialect(version byte) (*Dialect, error) {
+	if !ValidVersion(version) {
+		return nil, fmt.Errorf("negotiate/NewDialect: Unsupported protocol version %d", version)
+	}
+
+	return &Dialect{version: version}, nil
+}
+
+// Version returns the protocol version, 0x3 for 3.1 or 0x4 for 3.1.1.
+func (this *Dialect) Version() byte {
+	return this.version
+}
+
+// ProtocolName returns the protocol name for the version, "MQIsdp" or "MQTT".
+func (this *Dialect) ProtocolName() string {
+	return SupportedVersions[this.version]
+}
+
+// Connack returns a CONNACK message for the connection. The Session Present flag is
+// only set for 3.1.1 connections that are accepted, since 3.1 has no such flag and
+// it must be 0 when the connection is refused [MQTT-3.2.2-4].
+func (this *Dialect) Connack(code ConnackCode, sessionPresent bool) *ConnackMessage {
+	msg := NewConnackMessage()
+	msg.SetReturnCode(code)
+	msg.SetSessionPresent(sessionPresent && code == ConnectionAccepted && this.version >= 0x4)
+
+	return msg
+}
+
+// Reject returns the CONNACK message for one of the CONNACK errors returned by
+// Negotiate, or nil if err is not a CONNACK error. Wrapped errors are matched with
+// errors.Is.
+func (this *Dialect) Reject(err error) *ConnackMessage {
+	for code := UnacceptableProtocolVersion; code.Valid(); code++ {
+		if errors.Is(err, code.Error()) {
+			return this.Connack(code, false)
+		}
+	}
+
+	return nil
+}
+
+// Encode encodes the message for the connection. For 3.1 connections, CONNACK
+// messages are encoded with the Session Present flag cleared, since 3.1 clients
+// expect the first byte of the variable header to be 0. The message itself is not
+// changed.
+func (this *Dialect) Encode(msg Message) (io.Reader, int, error) {
+	if m, ok := msg.(*ConnackMessage); ok && this.version < 0x4 && m.SessionPresent() {
+		c := m.Clone()
+		c.SetSessionPresent(false)
+		msg = c
+	}
+
+	return msg.Encode()
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func negotiateConnectBytes(name string, version byte) []byte {
+	b := []byte{
+		byte(CONNECT << 4),
+		byte(2 + len(name) + 1 + 1 + 2 + 2 + 7),
+		0, // Length MSB (0)
+		byte(len(name)),
+	}
+	b = append(b, name...)
+	b = append(b,
+		version,
+		2,  // connect flags 00000010, clean session
+		0,  // Keep Alive MSB (0)
+		10, // Keep Alive LSB (10)
+		0,  // Client ID MSB (0)
+		7,  // Client ID LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+	)
+
+	return b
+}
+
+func TestNewNegotiator(t *testing.T) {
+	n, err := NewNegotiator()
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, []byte{0x3, 0x4}, n.Versions(), "Incorrect versions.")
+
+	n, err = NewNegotiator(0x4, 0x4)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, []byte{0x4}, n.Versions(), "Incorrect versions.")
+	assert.False(t, true, n.Allowed(0x3), "Not expecting version 3 to be allowed.")
+
+	_, err = NewNegotiator(0x5)
+	assert.Error(t, true, err)
+}
+
+func TestNegotiatorFallback(t *testing.T) {
+	n, _ := NewNegotiator()
+
+	msg, d, err := n.ReadConnect(bytes.NewBuffer(negotiateConnectBytes("MQIsdp", 0x3)), nil)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 0x3, d.Version(), "Incorrect version.")
+	assert.Equal(t, true, "MQIsdp", d.ProtocolName(), "Incorrect protocol name.")
+	assert.Equal(t, true, "surgemq", string(msg.ClientId()), "Incorrect client ID.")
+
+	// 3.1 has no Session Present flag
+	r, _, err := d.Encode(d.Connack(ConnectionAccepted, true))
+	assert.NoError(t, true, err)
+	b, _ := ioutil.ReadAll(r)
+	assert.Equal(t, true, []byte{byte(CONNACK << 4), 2, 0, 0}, b, "Incorrect CONNACK.")
+
+	ack := NewConnackMessage()
+	ack.SetSessionPresent(true)
+	r, _, err = d.Encode(ack)
+	assert.NoError(t, true, err)
+	b, _ = ioutil.ReadAll(r)
+	assert.Equal(t, true, []byte{byte(CONNACK << 4), 2, 0, 0}, b, "Incorrect CONNACK.")
+	assert.True(t, true, ack.SessionPresent(), "Encode should not change the message.")
+
+	_, d, err = n.ReadConnect(bytes.NewBuffer(negotiateConnectBytes("MQTT", 0x4)), nil)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 0x4, d.Version(), "Incorrect version.")
+
+	r, _, err = d.Encode(d.Connack(ConnectionAccepted, true))
+	assert.NoError(t, true, err)
+	b, _ = ioutil.ReadAll(r)
+	assert.Equal(t, true, []byte{byte(CONNACK << 4), 2, 1, 0}, b, "Incorrect CONNACK.")
+}
+
+func TestNegotiatorReject(t *testing.T) {
+	n, _ := NewNegotiator(0x4)
+
+	_, d, err := n.ReadConnect(bytes.NewBuffer(negotiateConnectBytes("MQIsdp", 0x3)), nil)
+	assert.True(t, true, err == ErrUnacceptableProtocolVersion, "Expecting ErrUnacceptableProtocolVersion.", err)
+
+	r, _, err := d.Encode(d.Reject(err))
+	assert.NoError(t, true, err)
+	b, _ := ioutil.ReadAll(r)
+	assert.Equal(t, true, []byte{byte(CONNACK << 4), 2, 0, 1}, b, "Incorrect CONNACK.")
+
+	// Unknown version falls back to the highest allowed version
+	_, d, err = n.ReadConnect(bytes.NewBuffer(negotiateConnectBytes("MQTT", 0x5)), nil)
+	assert.True(t, true, err == ErrUnacceptableProtocolVersion, "Expecting ErrUnacceptableProtocolVersion.", err)
+	assert.Equal(t, true, 0x4, d.Version(), "Incorrect version.")
+
+	// Protocol name doesn't match the level
+	_, d, err = n.ReadConnect(bytes.NewBuffer(negotiateConnectBytes("MQIsdp", 0x4)), nil)
+	assert.True(t, true, err == ErrUnacceptableProtocolVersion, "Expecting ErrUnacceptableProtocolVersion.", err)
+	assert.True(t, true, d.Reject(err) != nil, "Expecting CONNACK.")
+
+	wrapped := d.Reject(fmt.Errorf("listener: %w", ErrNotAuthorized))
+	assert.True(t, true, wrapped != nil && wrapped.ReturnCode() == NotAuthorized, "Expecting CONNACK for wrapped error.")
+
+	// Malformed messages get no CONNACK
+	_, d, err = n.ReadConnect(bytes.NewBuffer([]byte{byte(CONNECT << 4), 2, 0, 4}), nil)
+	assert.Error(t, true, err)
+	assert.True(t, true, d == nil, "Expecting no dialect.")
+
+	dd, _ := NewDialect(0x4)
+	assert.True(t, true, dd.Reject(nil) == nil, "Expecting no CONNACK.")
+	assert.Equal(t, true, false, dd.Connack(NotAuthorized, true).SessionPresent(), "Expecting Session Present to be 0.")
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// DecodeMode selects how strictly the decoders check messages against the spec.
+type DecodeMode byte
+
+const (
+	// DecodeDefault is the historical behaviour of this package. It follows the
+	// 3.1.1 spec, but tolerates CONNECT messages from 3.1 clients that set the
+	// User Name or Password flags without sending the strings.
+	DecodeDefault DecodeMode = iota
+
+	// DecodeStrict enforces MQTT 3.1.1 conformance. User Name and Password must be
+	// present if their flags are set, the Password Flag must not be set without the
+	// User Name Flag [MQTT-3.1.2-22], and Will Topics must not contain wildcards.
+	DecodeStrict
+
+	// DecodeLenient accepts messages from legacy and non-conforming clients, such
+	// as gateways might see. Reserved bits and fixed header flags are ignored, the
+	// protocol name is not checked against the protocol level, Will QoS and Retain
+	// are accepted without the Will Flag, the SUBSCRIBE requested QoS is not checked,
+	// and extra bytes at the end of a CONNECT message are skipped.
+	DecodeLenient
+)
+
+// ClientIdChars are the characters the Server MUST allow in a ClientId, according
+// to the spec.
+const ClientIdChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// DecodeOptions controls the checks that the decoders perform. Options are set on a
+// message with SetDecodeOptions before calling Decode. Messages without options use
+// DefaultDecodeOptions.
+type DecodeOptions struct {
+	// Mode selects how strictly messages are checked against the spec.
+	Mode DecodeMode
+
+	// MaxClientIdLength is the maximum length of the CONNECT ClientId in bytes. If 0,
+	// the length is not checked.
+	MaxClientIdLength int
+
+	// ClientIdCharset is the set of characters allowed in the CONNECT ClientId. If
+	// empty, any character is allowed.
+	ClientIdCharset string
+
+	// MaxTopicLength is the maximum length in bytes of topic names and topic filters
+	// in PUBLISH, SUBSCRIBE and UNSUBSCRIBE messages, and of the CONNECT Will Topic.
+	// If 0, the length is not checked.
+	MaxTopicLength int
+
+	// MaxTopicLevels is the maximum number of levels in topic names and topic filters.
+	// If 0, the number of levels is not checked.
+	MaxTopicLevels int
+}
+
+var (
+	// DefaultDecodeOptions are used by messages that have no options set. They keep
+	// the historical behaviour of this package: ClientIds may only contain the
+	// characters in ClientIdChars, but may be longer than 23 bytes.
+	DefaultDecodeOptions = DecodeOptions{
+		Mode:            DecodeDefault,
+		ClientIdCharset: ClientIdChars,
+	}
+
+	// StrictDecodeOptions enforce MQTT 3.1.1 conformance, and are suitable for
+	// conformance testing.
+	StrictDecodeOptions = DecodeOptions{
+		Mode:            DecodeStrict,
+		ClientIdCharset: ClientIdChars,
+	}
+
+	// LenientDecodeOptions accept messages from legacy and non-conforming clients,
+	// with any characters in the ClientId.
+	LenientDecodeOptions = DecodeOptions{
+		Mode: DecodeLenient,
+	}
+)
+
+// SetDecodeOptions sets the options used when the message is decoded. If opts is
+// nil, DefaultDecodeOptions are used.
+func (this *fixedHeader) SetDecodeOptions(opts *DecodeOptions) {
+	this.opts = opts
+}
+
+func (this *fixedHeader) decodeOptions() *DecodeOptions {
+	if this.opts == nil {
+		return &DefaultDecodeOptions
+	}
+
+	return this.opts
+}
+
+func (this *DecodeOptions) strict() bool {
+	return this.Mode == DecodeStrict
+}
+
+func (this *DecodeOptions) lenient() bool {
+	return this.Mode == DecodeLenient
+}
+
+// ValidClientId checks the client ID against MaxClientIdLength and ClientIdCharset.
+func (this *DecodeOptions) ValidClientId(cid []byte) bool {
+	if this.MaxClientIdLength > 0 && len(cid) > this.MaxClientIdLength {
+		return false
+	}
+
+	if this.ClientIdCharset == "" {
+		return true
+	}
+
+	for len(cid) > 0 {
+		r, n := utf8.DecodeRune(cid)
+		if r == utf8.RuneError || !strings.ContainsRune(this.ClientIdCharset, r) {
+			return false
+		}
+
+		cid = cid[n:]
+	}
+
+	return true
+}
+
+// CheckTopic checks the topic name or topic filter against MaxTopicLength and
+// MaxTopicLevels. It returns an error describing the first limit that's exceeded.
+func (this *DecodeOptions) CheckTopic(topic []byte) error {
+	if this.MaxTopicLength > 0 && len(topic) > this.MaxTopicLength {
+		return fmt.Errorf("options/CheckTopic: Topic (%s) length %d exceeds maximum of %d bytes", string(topic), len(topic), this.MaxTopicLength)
+	}
+
+	if this.MaxTopicLevels > 0 && bytes.Count(topic, []byte("/"))+1 > this.MaxTopicLevels {
+		return fmt.Errorf("options/CheckTopic: Topic (%s) exceeds maximum of %d levels", string(topic), this.MaxTopicLevels)
+	}
+
+	return nil
+}
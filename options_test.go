@@ -0,0 +1,199 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func decodeWithOptions(msg Message, b []byte, opts *DecodeOptions) error {
+	msg.(interface {
+		SetDecodeOptions(*DecodeOptions)
+	}).SetDecodeOptions(opts)
+
+	_, err := msg.Decode(bytes.NewBuffer(b))
+	return err
+}
+
+func TestDecodeOptionsClientId(t *testing.T) {
+	connect := func(cid string) []byte {
+		b := []byte{
+			byte(CONNECT << 4),
+			byte(12 + len(cid)),
+			0, 4, 'M', 'Q', 'T', 'T',
+			4,
+			2, // clean session
+			0, 10,
+			0, byte(len(cid)),
+		}
+		return append(b, cid...)
+	}
+
+	err := decodeWithOptions(NewConnectMessage(), connect("surge-mq"), nil)
+	assert.Equal(t, true, ErrIdentifierRejected, err, "Expecting identifier rejected.")
+
+	err = decodeWithOptions(NewConnectMessage(), connect("surge-mq"), &LenientDecodeOptions)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	opts := DecodeOptions{
+		MaxClientIdLength: 8,
+		ClientIdCharset:   ClientIdChars + "-",
+	}
+
+	err = decodeWithOptions(NewConnectMessage(), connect("surge-mq"), &opts)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	err = decodeWithOptions(NewConnectMessage(), connect("surge-mq1"), &opts)
+	assert.Equal(t, true, ErrIdentifierRejected, err, "Expecting identifier rejected.")
+}
+
+func TestDecodeOptionsCredentials(t *testing.T) {
+	// Username flag set but username missing, as allowed by 3.1
+	missing := []byte{
+		byte(CONNECT << 4),
+		21,
+		0, 6, 'M', 'Q', 'I', 's', 'd', 'p',
+		3,
+		194, // connect flags 11000010
+		0, 10,
+		0, 7, 's', 'u', 'r', 'g', 'e', 'm', 'q',
+	}
+
+	err := decodeWithOptions(NewConnectMessage(), missing, nil)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	err = decodeWithOptions(NewConnectMessage(), missing, &StrictDecodeOptions)
+	assert.Error(t, true, err)
+
+	// Username without password is allowed by 3.1.1
+	usernameOnly := []byte{
+		byte(CONNECT << 4),
+		22,
+		0, 4, 'M', 'Q', 'T', 'T',
+		4,
+		130, // connect flags 10000010
+		0, 10,
+		0, 1, 'c',
+		0, 7, 's', 'u', 'r', 'g', 'e', 'm', 'q',
+	}
+
+	err = decodeWithOptions(NewConnectMessage(), usernameOnly, nil)
+	assert.Error(t, true, err)
+
+	err = decodeWithOptions(NewConnectMessage(), usernameOnly, &StrictDecodeOptions)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	// Password without username is not allowed by 3.1.1
+	passwordOnly := append([]byte(nil), usernameOnly...)
+	passwordOnly[9] = 66 // connect flags 01000010
+
+	err = decodeWithOptions(NewConnectMessage(), passwordOnly, &StrictDecodeOptions)
+	assert.Error(t, true, err)
+
+	err = decodeWithOptions(NewConnectMessage(), passwordOnly, &LenientDecodeOptions)
+	assert.NoError(t, true, err, "Error decoding message.")
+}
+
+func TestDecodeOptionsLenientFlags(t *testing.T) {
+	// Reserved bit set, and MQTT protocol name with level 3
+	b := []byte{
+		byte(CONNECT << 4),
+		12,
+		0, 4, 'M', 'Q', 'T', 'T',
+		3,
+		3, // connect flags 00000011
+		0, 10,
+		0, 0,
+	}
+
+	err := decodeWithOptions(NewConnectMessage(), b, nil)
+	assert.Error(t, true, err)
+
+	err = decodeWithOptions(NewConnectMessage(), b, &LenientDecodeOptions)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	// SUBSCRIBE with fixed header flags set to 0
+	sub := []byte{
+		byte(SUBSCRIBE << 4),
+		6,
+		0, 7,
+		0, 1, 'a',
+		0,
+	}
+
+	err = decodeWithOptions(NewSubscribeMessage(), sub, nil)
+	assert.Error(t, true, err)
+
+	err = decodeWithOptions(NewSubscribeMessage(), sub, &LenientDecodeOptions)
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	// CONNACK with reserved bits set
+	connack := []byte{byte(CONNACK << 4), 2, 0x81, 0}
+
+	err = decodeWithOptions(NewConnackMessage(), connack, nil)
+	assert.Error(t, true, err)
+
+	err = decodeWithOptions(NewConnackMessage(), connack, &LenientDecodeOptions)
+	assert.NoError(t, true, err, "Error decoding message.")
+}
+
+func TestDecodeOptionsSubscribeQos(t *testing.T) {
+	sub := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		6,
+		0, 7,
+		0, 1, 'a',
+		3,
+	}
+
+	err := decodeWithOptions(NewSubscribeMessage(), sub, nil)
+	assert.Error(t, true, err)
+
+	err = decodeWithOptions(NewSubscribeMessage(), sub, &StrictDecodeOptions)
+	assert.Error(t, true, err)
+
+	err = decodeWithOptions(NewSubscribeMessage(), sub, &LenientDecodeOptions)
+	assert.NoError(t, true, err, "Error decoding message.")
+}
+
+func TestDecodeOptionsTopicLimits(t *testing.T) {
+	opts := DecodeOptions{
+		MaxTopicLength: 5,
+		MaxTopicLevels: 2,
+	}
+
+	pub := func(topic string) []byte {
+		b := []byte{byte(PUBLISH << 4), byte(3 + len(topic)), 0, byte(len(topic))}
+		return append(append(b, topic...), 'x')
+	}
+
+	assert.NoError(t, true, decodeWithOptions(NewPublishMessage(), pub("a/b"), &opts), "Error decoding message.")
+	assert.Error(t, true, decodeWithOptions(NewPublishMessage(), pub("abcdef"), &opts))
+	assert.Error(t, true, decodeWithOptions(NewPublishMessage(), pub("a/b/c"), &opts))
+	assert.NoError(t, true, decodeWithOptions(NewPublishMessage(), pub("a/b/c"), nil), "Error decoding message.")
+
+	unsub := []byte{
+		byte(UNSUBSCRIBE<<4) | 2,
+		9,
+		0, 7,
+		0, 5, 'a', '/', '+', '/', '#',
+	}
+
+	assert.Error(t, true, decodeWithOptions(NewUnsubscribeMessage(), unsub, &opts))
+	assert.NoError(t, true, decodeWithOptions(NewUnsubscribeMessage(), unsub, nil), "Error decoding message.")
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import "sync"
+
+// maxPooledBufferSize is the largest internal buffer, in bytes, that's kept when a
+// message is released to the pool. Larger buffers are dropped so that one large
+// PUBLISH message doesn't pin its memory for the life of the pool.
+const maxPooledBufferSize = 64 * 1024
+
+var messagePools [RESERVED2 + 1]sync.Pool
+
+func init() {
+	for t := CONNECT; t < RESERVED2; t++ {
+		mtype := t
+		messagePools[mtype].New = func() interface{} {
+			msg, _ := mtype.New()
+			return msg
+		}
+	}
+}
+
+// AcquireMessage returns a message of the given type from a pool, or creates a new
+// one if the pool is empty. The message is in the same state as one returned by the
+// New*Message functions. It returns an error if the message type is invalid.
+//
+// Messages should be given back with ReleaseMessage once they're no longer used,
+// such as after a decoded message is handled, or an encoded message is written.
+func AcquireMessage(mtype MessageType) (Message, error) {
+	if !mtype.Valid() {
+		return mtype.New()
+	}
+
+	return messagePools[mtype].Get().(Message), nil
+}
+
+// ReleaseMessage resets the message, clears its decode options, and puts it back in
+// the pool for its type. The message, and any slices returned by it, such as the
+// topic and payload of a decoded PUBLISH message, must not be used after it's
+// released. Use CloneMessage to keep a copy.
+func ReleaseMessage(msg Message) {
+	mtype := pooledType(msg)
+	if mtype == RESERVED || msg.Type() != mtype {
+		return
+	}
+
+	msg.(interface {
+		Reset()
+	}).Reset()
+
+	h := msg.(interface {
+		header() *fixedHeader
+	}).header()
+
+	h.opts = nil
+	if h.buf != nil && h.buf.Cap() > maxPooledBufferSize {
+		h.buf = nil
+	}
+
+	messagePools[mtype].Put(msg)
+}
+
+// pooledType returns the message type for the concrete type of the message, or
+// RESERVED if the message is not one of the types defined in this package.
+func pooledType(msg Message) MessageType {
+	switch msg.(type) {
+	case *ConnectMessage:
+		return CONNECT
+	case *ConnackMessage:
+		return CONNACK
+	case *PublishMessage:
+		return PUBLISH
+	case *PubackMessage:
+		return PUBACK
+	case *PubrecMessage:
+		return PUBREC
+	case *PubrelMessage:
+		return PUBREL
+	case *PubcompMessage:
+		return PUBCOMP
+	case *SubscribeMessage:
+		return SUBSCRIBE
+	case *SubackMessage:
+		return SUBACK
+	case *UnsubscribeMessage:
+		return UNSUBSCRIBE
+	case *UnsubackMessage:
+		return UNSUBACK
+	case *PingreqMessage:
+		return PINGREQ
+	case *PingrespMessage:
+		return PINGRESP
+	case *DisconnectMessage:
+		return DISCONNECT
+	}
+
+	return RESERVED
+}
+
+func (this *fixedHeader) header() *fixedHeader {
+	return this
+}
+
+// Reset clears the message so it can be reused to decode or encode another message
+// of the same type. The message type and decode options are kept, and the internal
+// buffer keeps its capacity. ReleaseMessage also clears the decode options, so
+// pooled messages always start with DefaultDecodeOptions. Messages that have no
+// variable header or payload use this as their Reset method.
+func (this *fixedHeader) Reset() {
+	this.remlen = 0
+	this.flags = this.mtype.DefaultFlags()
+
+	if this.buf != nil {
+		this.buf.Reset()
+	}
+}
+
+// Reset clears the message so it can be reused.
+func (this *ConnectMessage) Reset() {
+	this.fixedHeader.Reset()
+	this.connectFlags = 0
+	this.version = 0
+	this.keepAlive = 0
+	this.protoName = nil
+	this.clientId = nil
+	this.willTopic = nil
+	this.willMessage = nil
+	this.username = nil
+	this.password = nil
+}
+
+// Reset clears the message so it can be reused.
+func (this *ConnackMessage) Reset() {
+	this.fixedHeader.Reset()
+	this.sessionPresent = false
+	this.returnCode = ConnectionAccepted
+}
+
+// Reset clears the message so it can be reused.
+func (this *PublishMessage) Reset() {
+	this.fixedHeader.Reset()
+	this.packetId = 0
+	this.topic = nil
+	this.payload = nil
+	this.stream, this.size = nil, 0
+}
+
+// Reset clears the message so it can be reused. It is also used by PUBREC, PUBREL,
+// PUBCOMP and UNSUBACK messages.
+func (this *PubackMessage) Reset() {
+	this.fixedHeader.Reset()
+	this.packetId = 0
+}
+
+// Reset clears the message so it can be reused. The topic and QoS lists keep their
+// capacity.
+func (this *SubscribeMessage) Reset() {
+	this.fixedHeader.Reset()
+	this.packetId = 0
+
+	for i := range this.topics {
+		this.topics[i] = nil
+	}
+	this.topics = this.topics[:0]
+	this.qos = this.qos[:0]
+}
+
+// Reset clears the message so it can be reused. The return codes of a decoded
+// message point into the internal buffer, so they're not kept.
+func (this *SubackMessage) Reset() {
+	this.fixedHeader.Reset()
+	this.packetId = 0
+	this.returnCodes = nil
+}
+
+// Reset clears the message so it can be reused. The topic list keeps its capacity.
+func (this *UnsubscribeMessage) Reset() {
+	this.fixedHeader.Reset()
+	this.packetId = 0
+
+	for i := range this.topics {
+		this.topics[i] = nil
+	}
+	this.topics = this.topics[:0]
+}
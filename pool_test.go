@@ -0,0 +1,206 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+var (
+	poolPublishBytes = []byte{
+		byte(PUBLISH<<4) | 2,
+		23,
+		0, // topic name MSB (0)
+		7, // topic name LSB (7)
+		's', 'u', 'r', 'g', 'e', 'm', 'q',
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		's', 'e', 'n', 'd', ' ', 'm', 'e', ' ', 'h', 'o', 'm', 'e',
+	}
+
+	poolPubackBytes = []byte{
+		byte(PUBACK << 4),
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+	}
+)
+
+func TestMessageReset(t *testing.T) {
+	for _, b := range jsonTestPackets {
+		mtype := MessageType(b[0] >> 4)
+
+		msg, err := mtype.New()
+		assert.NoError(t, true, err)
+
+		_, err = msg.Decode(bytes.NewBuffer(b))
+		assert.NoError(t, true, err, "Error decoding", mtype.Name())
+
+		msg.(interface {
+			Reset()
+		}).Reset()
+
+		fresh, _ := mtype.New()
+		assert.True(t, true, CloneMessage(msg).(interface {
+			Equal(Message) bool
+		}).Equal(fresh), "Reset message is not the same as a new one.", mtype.Name())
+
+		_, err = msg.Decode(bytes.NewBuffer(b))
+		assert.NoError(t, true, err, "Error decoding reset", mtype.Name())
+
+		_, n, err := msg.Encode()
+		assert.NoError(t, true, err, "Error encoding reset", mtype.Name())
+		assert.Equal(t, true, len(b), n, "Incorrect length", mtype.Name())
+	}
+}
+
+func TestMessageResetKeepsOptions(t *testing.T) {
+	msg := NewConnectMessage()
+	msg.SetDecodeOptions(&StrictDecodeOptions)
+	msg.SetClientId([]byte("surgemq"))
+	msg.Reset()
+
+	assert.True(t, true, msg.decodeOptions() == &StrictDecodeOptions, "Expecting decode options to be kept.")
+	assert.Equal(t, true, 0, len(msg.ClientId()), "Expecting client ID to be cleared.")
+}
+
+func TestAcquireReleaseMessage(t *testing.T) {
+	_, err := AcquireMessage(RESERVED)
+	assert.Error(t, true, err)
+
+	for mtype := CONNECT; mtype < RESERVED2; mtype++ {
+		msg, err := AcquireMessage(mtype)
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, mtype, msg.Type(), "Incorrect message type.")
+		assert.Equal(t, true, pooledType(msg), msg.Type(), "Incorrect concrete type.")
+		ReleaseMessage(msg)
+	}
+
+	msg, _ := AcquireMessage(PUBLISH)
+	pub := msg.(*PublishMessage)
+	pub.SetDecodeOptions(&LenientDecodeOptions)
+	_, err = pub.Decode(bytes.NewBuffer(poolPublishBytes))
+	assert.NoError(t, true, err)
+	ReleaseMessage(pub)
+
+	msg, _ = AcquireMessage(PUBLISH)
+	pub = msg.(*PublishMessage)
+	assert.True(t, true, pub.opts == nil, "Expecting decode options to be cleared.")
+	assert.Equal(t, true, 0, len(pub.Topic()), "Expecting topic to be cleared.")
+	assert.Equal(t, true, 0, pub.PacketId(), "Expecting packet ID to be cleared.")
+
+	assert.NoError(t, true, pub.SetPayloadStream(bytes.NewReader([]byte("firmware")), 8))
+	ReleaseMessage(pub)
+
+	msg, _ = AcquireMessage(PUBLISH)
+	pub = msg.(*PublishMessage)
+	r, size := pub.PayloadStream()
+	assert.True(t, true, r == nil, "Expecting payload stream to be cleared.")
+	assert.Equal(t, true, 0, size, "Expecting payload size to be cleared.")
+
+	// A message whose type doesn't match its concrete type is not pooled.
+	ack := NewPubackMessage()
+	ack.SetType(PUBREC)
+	ReleaseMessage(ack)
+}
+
+func BenchmarkPublishDecodeNew(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		msg := NewPublishMessage()
+		if _, err := msg.Decode(bytes.NewReader(poolPublishBytes)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishDecodePool(b *testing.B) {
+	b.ReportAllocs()
+
+	src := bytes.NewReader(poolPublishBytes)
+
+	for i := 0; i < b.N; i++ {
+		msg, _ := AcquireMessage(PUBLISH)
+		src.Reset(poolPublishBytes)
+		if _, err := msg.Decode(src); err != nil {
+			b.Fatal(err)
+		}
+		ReleaseMessage(msg)
+	}
+}
+
+func BenchmarkPubackDecodeNew(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		msg := NewPubackMessage()
+		if _, err := msg.Decode(bytes.NewReader(poolPubackBytes)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPubackDecodePool(b *testing.B) {
+	b.ReportAllocs()
+
+	src := bytes.NewReader(poolPubackBytes)
+
+	for i := 0; i < b.N; i++ {
+		msg, _ := AcquireMessage(PUBACK)
+		src.Reset(poolPubackBytes)
+		if _, err := msg.Decode(src); err != nil {
+			b.Fatal(err)
+		}
+		ReleaseMessage(msg)
+	}
+}
+
+func BenchmarkPublishEncodeNew(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		msg := NewPublishMessage()
+		msg.SetTopic([]byte("surgemq"))
+		msg.SetQoS(1)
+		msg.SetPacketId(7)
+		msg.SetPayload([]byte("send me home"))
+		if _, _, err := msg.Encode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPublishEncodePool(b *testing.B) {
+	b.ReportAllocs()
+
+	topic, payload := []byte("surgemq"), []byte("send me home")
+
+	for i := 0; i < b.N; i++ {
+		msg, _ := AcquireMessage(PUBLISH)
+		pub := msg.(*PublishMessage)
+		pub.SetTopic(topic)
+		pub.SetQoS(1)
+		pub.SetPacketId(7)
+		pub.SetPayload(payload)
+		if _, _, err := pub.Encode(); err != nil {
+			b.Fatal(err)
+		}
+		ReleaseMessage(pub)
+	}
+}
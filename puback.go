@@ -56,7 +56,7 @@ func (this *PubackMessage) Decode(src io.Reader) (int, error) {
 	total += n
 
 	if this.packetId, err = readUint16(this.buf); err != nil {
-		return 0, err
+		return 0, this.malformed("Packet Identifier", total, err)
 	}
 	total += 2
 
@@ -27,6 +27,11 @@ type PublishMessage struct {
 	packetId uint16
 	topic    []byte
 	payload  []byte
+
+	// stream and size are the payload of a streaming message, see SetPayloadStream
+	// and DecodeStream.
+	stream io.Reader
+	size   int
 }
 
 var _ Message = (*PublishMessage)(nil)
@@ -130,9 +135,35 @@ func (this *PublishMessage) Payload() []byte {
 	return this.payload
 }
 
-// SetPayload sets the application message that's part of the PUBLISH message.
+// SetPayload sets the application message that's part of the PUBLISH message. It
+// replaces any payload stream set with SetPayloadStream.
 func (this *PublishMessage) SetPayload(v []byte) {
 	this.payload = v
+	this.stream, this.size = nil, 0
+}
+
+// PayloadStream returns the payload of a message decoded with DecodeStream, or set
+// with SetPayloadStream, and its size in bytes. The reader is nil if the message
+// has no payload stream, in which case Payload returns the payload.
+func (this *PublishMessage) PayloadStream() (io.Reader, int) {
+	return this.stream, this.size
+}
+
+// SetPayloadStream sets the payload to the next size bytes of r, so that large
+// payloads, such as firmware images, can be sent without holding them in memory.
+// Encode returns a reader that reads the payload from r as it's read, so a message
+// with a payload stream can only be encoded once: Encode returns an error if the
+// stream has already been encoded or read from. If r ends before size bytes are
+// read, the encoded reader returns io.ErrUnexpectedEOF.
+func (this *PublishMessage) SetPayloadStream(r io.Reader, size int) error {
+	if size <= 0 || size > int(maxRemainingLength) {
+		return fmt.Errorf("publish/SetPayloadStream: Invalid payload size %d", size)
+	}
+
+	this.payload = nil
+	this.stream, this.size = &payloadStream{r: r, n: int64(size)}, size
+
+	return nil
 }
 
 // Decode reads from the io.Reader parameter until a full message is decoded, or
@@ -141,33 +172,110 @@ func (this *PublishMessage) SetPayload(v []byte) {
 func (this *PublishMessage) Decode(src io.Reader) (int, error) {
 	total := 0
 
+	this.stream, this.size = nil, 0
+
 	n, err := this.fixedHeader.Decode(src)
 	if err != nil {
 		return total + n, err
 	}
 	total += n
 
+	if total, err = this.decodeVariableHeader(total); err != nil {
+		return total, err
+	}
+
+	this.payload = this.buf.Next(this.buf.Len())
+	total += len(this.payload)
+
+	return total, nil
+}
+
+// DecodeStream reads the fixed and variable headers of the message from src, but
+// not the payload, which is returned by PayloadStream as a reader limited to the
+// rest of the message. Memory use doesn't depend on the size of the payload. The
+// return value is the number of bytes read, excluding the payload.
+//
+// The payload must be read to the end before the next message is read from src.
+// If src ends before the whole payload is read, the payload reader returns
+// io.ErrUnexpectedEOF.
+func (this *PublishMessage) DecodeStream(src io.Reader) (int, error) {
+	this.resetBuf()
+	this.payload, this.stream, this.size = nil, nil, 0
+
+	n, err := this.decodeHeader(src)
+	if err != nil {
+		return int(n), err
+	}
+	total := int(n)
+
+	// Read the topic length first, then the topic and packet ID, so that no more
+	// than the variable header is read.
+	vlen := 2
+	if this.QoS() != 0 {
+		vlen += 2
+	}
+
+	if int(this.remlen) < 2 {
+		return total, this.malformed("Topic Name", total, fmt.Errorf("%w: Insufficient buffer size. Expecting %d, got %d.", io.ErrUnexpectedEOF, 2, this.remlen))
+	}
+
+	if _, err = io.CopyN(this.buf, src, 2); err != nil {
+		return total, this.malformed("Topic Name", total, io.ErrUnexpectedEOF)
+	}
+
+	vlen += int(this.buf.Bytes()[0])<<8 | int(this.buf.Bytes()[1])
+
+	if vlen > int(this.remlen) {
+		vlen = int(this.remlen)
+	}
+
+	if m, err := io.CopyN(this.buf, src, int64(vlen-2)); err != nil {
+		return total + 2 + int(m), this.malformed("Remaining Length", 1, fmt.Errorf("%w: Expecting %d bytes, got %d bytes.", io.ErrUnexpectedEOF, this.remlen, 2+m))
+	}
+
+	if total, err = this.decodeVariableHeader(total); err != nil {
+		return total, err
+	}
+
+	this.size = int(this.remlen) - vlen
+	this.stream = &payloadStream{r: src, n: int64(this.size)}
+
+	return total, nil
+}
+
+// decodeVariableHeader decodes the topic and packet ID from the buffer. The offset
+// is the number of bytes read before the variable header, and the return value is
+// the offset after it.
+func (this *PublishMessage) decodeVariableHeader(total int) (int, error) {
+	var n int
+	var err error
+
 	if this.topic, n, err = readLPBytes(this.buf); err != nil {
-		return total + n, err
+		return total + n, this.malformed("Topic Name", total, err)
 	}
 	total += n
 
+	if !ValidUTF8(this.topic) {
+		return total, this.malformed("Topic Name", total-n, ErrMalformedUTF8)
+	}
+
 	if !ValidTopic(this.topic) {
-		return total, fmt.Errorf("publish/Decode: Invalid topic name (%s). Must not be empty or contain wildcard characters", string(this.topic))
+		return total, this.malformed("Topic Name", total-n, violation("Invalid topic name (%s). Must not be empty or contain wildcard characters", string(this.topic)))
+	}
+
+	if err = this.decodeOptions().CheckTopic(this.topic); err != nil {
+		return total, this.malformed("Topic Name", total-n, err)
 	}
 
 	// The packet identifier field is only present in the PUBLISH packets where the
 	// QoS level is 1 or 2
 	if this.QoS() != 0 {
 		if this.packetId, err = readUint16(this.buf); err != nil {
-			return 0, err
+			return 0, this.malformed("Packet Identifier", total, err)
 		}
 		total += 2
 	}
 
-	this.payload = this.buf.Next(this.buf.Len())
-	total += len(this.payload)
-
 	return total, nil
 }
 
@@ -178,18 +286,36 @@ func (this *PublishMessage) Decode(src io.Reader) (int, error) {
 // Any changes to the message after Encode() is called will invalidate the io.Reader.
 func (this *PublishMessage) Encode() (io.Reader, int, error) {
 	if len(this.topic) == 0 {
-		return nil, 0, fmt.Errorf("publish/Encode: Topic name is empty.")
+		return nil, 0, this.malformed("Topic Name", -1, violation("Topic name is empty."))
+	}
+
+	size := len(this.payload)
+	if this.stream != nil {
+		size = this.size
+
+		// The stream can only be read once, so a second Encode would send a header
+		// without the payload it promises.
+		if s, ok := this.stream.(*payloadStream); ok && (s.encoded || s.n != int64(size)) {
+			return nil, 0, this.malformed("Payload", -1, fmt.Errorf("%w: Payload stream has already been read.", ErrPayloadStream))
+		}
+	}
+
+	if size == 0 {
+		return nil, 0, this.malformed("Payload", -1, fmt.Errorf("Payload is empty."))
 	}
 
-	if len(this.payload) == 0 {
-		return nil, 0, fmt.Errorf("publish/Encode: Payload is empty.")
+	if !ValidUTF8(this.topic) {
+		return nil, 0, this.malformed("Topic Name", -1, ErrMalformedUTF8)
 	}
 
-	total := 2 + len(this.topic) + len(this.payload)
+	total := 2 + len(this.topic) + size
 	if this.QoS() != 0 {
 		total += 2
 	}
-	this.SetRemainingLength(int32(total))
+
+	if err := this.SetRemainingLength(int32(total)); err != nil {
+		return nil, 0, this.malformed("Remaining Length", -1, err)
+	}
 
 	total = 0
 
@@ -200,7 +326,7 @@ func (this *PublishMessage) Encode() (io.Reader, int, error) {
 	total += n
 
 	if n, err = writeLPBytes(this.buf, this.topic); err != nil {
-		return nil, total, err
+		return nil, total, this.malformed("Topic Name", -1, err)
 	}
 	total += n
 
@@ -212,6 +338,14 @@ func (this *PublishMessage) Encode() (io.Reader, int, error) {
 		total += 2
 	}
 
+	if this.stream != nil {
+		if s, ok := this.stream.(*payloadStream); ok {
+			s.encoded = true
+		}
+
+		return io.MultiReader(this.buf, this.stream), total + size, nil
+	}
+
 	if n, err = this.buf.Write(this.payload); err != nil {
 		return nil, total, err
 	}
@@ -219,3 +353,30 @@ func (this *PublishMessage) Encode() (io.Reader, int, error) {
 
 	return this.buf, total, nil
 }
+
+// payloadStream reads exactly n bytes from r. It returns io.ErrUnexpectedEOF if r
+// ends first. encoded is set once the stream is part of an encoded message.
+type payloadStream struct {
+	r       io.Reader
+	n       int64
+	encoded bool
+}
+
+func (this *payloadStream) Read(p []byte) (int, error) {
+	if this.n <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > this.n {
+		p = p[:this.n]
+	}
+
+	n, err := this.r.Read(p)
+	this.n -= int64(n)
+
+	if err == io.EOF && this.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
@@ -16,6 +16,8 @@ package mqtt
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"testing"
 
 	"github.com/dataence/assert"
@@ -198,3 +200,133 @@ func TestPublishMessageEncode3(t *testing.T) {
 
 	assert.Equal(t, true, msgBytes, dst.(*bytes.Buffer).Bytes(), "Error decoding message.")
 }
+
+func TestPublishMessageStreamRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("firmware"), 1<<17)
+
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("devices/1/fw"))
+	msg.SetQoS(QosAtLeastOnce)
+	msg.SetPacketId(7)
+	assert.NoError(t, true, msg.SetPayloadStream(bytes.NewReader(payload), len(payload)))
+
+	r, n, err := msg.Encode()
+	assert.NoError(t, true, err)
+
+	var buf bytes.Buffer
+	m, err := buf.ReadFrom(r)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, n, int(m))
+
+	ref := NewPublishMessage()
+	ref.SetTopic([]byte("devices/1/fw"))
+	ref.SetQoS(QosAtLeastOnce)
+	ref.SetPacketId(7)
+	ref.SetPayload(payload)
+
+	rr, _, err := ref.Encode()
+	assert.NoError(t, true, err)
+
+	var want bytes.Buffer
+	want.ReadFrom(rr)
+	assert.True(t, true, bytes.Equal(want.Bytes(), buf.Bytes()), "Streamed encoding differs from buffered encoding.")
+
+	// A second message after the first checks that DecodeStream reads no further
+	// than the end of the payload.
+	buf.Write([]byte{0xc0, 0x00})
+
+	out := NewPublishMessage()
+	hn, err := out.DecodeStream(&buf)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 1+3+2+len("devices/1/fw")+2, hn)
+	assert.Equal(t, true, "devices/1/fw", string(out.Topic()))
+	assert.Equal(t, true, 7, int(out.PacketId()))
+	assert.True(t, true, out.Payload() == nil, "Payload should not be buffered.")
+	assert.True(t, true, out.buf.Cap() < 64*1024, "Payload should not be buffered.")
+
+	pr, size := out.PayloadStream()
+	assert.Equal(t, true, len(payload), size)
+
+	got, err := io.ReadAll(pr)
+	assert.NoError(t, true, err)
+	assert.True(t, true, bytes.Equal(payload, got), "Wrong payload.")
+
+	ping := NewPingreqMessage()
+	_, err = ping.Decode(&buf)
+	assert.NoError(t, true, err)
+}
+
+func TestPublishMessageDecodeStreamTruncated(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("a/b"))
+	msg.SetPayload([]byte("hello world"))
+
+	r, _, err := msg.Encode()
+	assert.NoError(t, true, err)
+
+	b, _ := io.ReadAll(r)
+
+	out := NewPublishMessage()
+	_, err = out.DecodeStream(bytes.NewReader(b[:len(b)-3]))
+	assert.NoError(t, true, err)
+
+	pr, _ := out.PayloadStream()
+	got, err := io.ReadAll(pr)
+	assert.True(t, true, errors.Is(err, io.ErrUnexpectedEOF), "Expected io.ErrUnexpectedEOF.")
+	assert.Equal(t, true, "hello wo", string(got))
+
+	for _, n := range []int{1, 3, 6} {
+		_, err = NewPublishMessage().DecodeStream(bytes.NewReader(b[:n]))
+		assert.True(t, true, errors.Is(err, io.ErrUnexpectedEOF), "Expected io.ErrUnexpectedEOF for", n, "bytes.")
+	}
+
+	// Topic length longer than the remaining length.
+	_, err = NewPublishMessage().DecodeStream(bytes.NewReader([]byte{0x30, 0x04, 0x00, 0x10, 'a', 'b'}))
+	assert.True(t, true, errors.Is(err, ErrMalformedPacket), "Expected a malformed packet error.")
+}
+
+func TestPublishMessageEncodeStreamTwice(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("a/b"))
+	assert.NoError(t, true, msg.SetPayloadStream(bytes.NewReader([]byte("hello")), 5))
+
+	r, n, err := msg.Encode()
+	assert.NoError(t, true, err)
+
+	b, err := io.ReadAll(r)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, n, len(b), "Incorrect encoded length.")
+
+	_, _, err = msg.Encode()
+	assert.True(t, true, errors.Is(err, ErrPayloadStream), "Expecting error encoding the stream twice.", err)
+
+	// Encoding again before the first reader is read is also an error.
+	assert.NoError(t, true, msg.SetPayloadStream(bytes.NewReader([]byte("hello")), 5))
+
+	_, _, err = msg.Encode()
+	assert.NoError(t, true, err)
+
+	_, _, err = msg.Encode()
+	assert.True(t, true, errors.Is(err, ErrPayloadStream), "Expecting error encoding the stream twice.", err)
+}
+
+func TestPublishMessageEncodeStreamShort(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("a/b"))
+	assert.NoError(t, true, msg.SetPayloadStream(bytes.NewReader([]byte("short")), 10))
+
+	r, _, err := msg.Encode()
+	assert.NoError(t, true, err)
+
+	_, err = io.ReadAll(r)
+	assert.True(t, true, errors.Is(err, io.ErrUnexpectedEOF), "Expected io.ErrUnexpectedEOF.")
+
+	_, _, err = msg.Encode()
+	assert.True(t, true, errors.Is(err, ErrPayloadStream), "Expecting error encoding a read stream.", err)
+
+	assert.Error(t, true, msg.SetPayloadStream(bytes.NewReader(nil), 0))
+
+	msg.SetPayload([]byte("x"))
+	pr, _ := msg.PayloadStream()
+	assert.True(t, true, pr == nil, "SetPayload should clear the payload stream.")
+}
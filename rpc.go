@@ -0,0 +1,504 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultRPCTimeout is how long a Requester waits for a reply if its Timeout is 0.
+const DefaultRPCTimeout = 30 * time.Second
+
+// rpcVersion is the first byte of every RPC envelope.
+const rpcVersion byte = 0x01
+
+// Kinds of RPC envelopes.
+const (
+	rpcRequest byte = iota
+	rpcReply
+	rpcError
+)
+
+var (
+	// ErrRPCClosed is returned by calls that are still waiting for a reply when the
+	// Requester is closed.
+	ErrRPCClosed = errors.New("mqtt: RPC requester closed")
+
+	// ErrNoHandler is returned in an error reply when the Responder has no handler
+	// for the request topic.
+	ErrNoHandler = errors.New("mqtt: No RPC handler for topic")
+)
+
+// RemoteError is returned by a Call when the responder's handler returned an error.
+type RemoteError struct {
+	// Message is the text of the handler's error.
+	Message string
+}
+
+func (this *RemoteError) Error() string {
+	return "mqtt: Remote error: " + this.Message
+}
+
+// RPCRequest is a request received by a Responder.
+type RPCRequest struct {
+	// Topic is the topic the request was published to.
+	Topic []byte
+
+	// CorrelationId identifies the request, and is copied into the reply.
+	CorrelationId []byte
+
+	// ReplyTo is the topic the reply is published to.
+	ReplyTo []byte
+
+	// Payload is the body of the request.
+	Payload []byte
+}
+
+// RPCHandler handles a request, and returns the body of the reply. If it returns an
+// error, the requester gets a *RemoteError with the error's text instead.
+type RPCHandler func(ctx context.Context, req *RPCRequest) ([]byte, error)
+
+// encodeRPC returns an RPC envelope. Requests and replies are carried in the payload
+// of PUBLISH messages, since MQTT 3.1.1 has no message properties to put them in:
+//
+//	version (1 byte) | kind (1 byte) | correlation ID (length prefixed) | reply topic (length prefixed) | body
+//
+// The kind is 0 for requests, 1 for replies and 2 for error replies, whose body is
+// the error text. Replies have an empty reply topic. Length prefixes are 2 bytes, as
+// for strings in MQTT packets.
+func encodeRPC(kind byte, id, replyTo, body []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, 6+len(id)+len(replyTo)+len(body)))
+	buf.WriteByte(rpcVersion)
+	buf.WriteByte(kind)
+
+	if _, err := writeLPBytes(buf, id); err != nil {
+		return nil, err
+	}
+
+	if _, err := writeLPBytes(buf, replyTo); err != nil {
+		return nil, err
+	}
+
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// decodeRPC decodes an RPC envelope.
+func decodeRPC(b []byte) (kind byte, id, replyTo, body []byte, err error) {
+	if len(b) < 2 || b[0] != rpcVersion || b[1] > rpcError {
+		return 0, nil, nil, nil, fmt.Errorf("rpc/decodeRPC: Not an RPC envelope")
+	}
+
+	buf := bytes.NewBuffer(b[2:])
+
+	if id, _, err = readLPBytes(buf); err != nil {
+		return 0, nil, nil, nil, fmt.Errorf("rpc/decodeRPC: Correlation ID: %w", err)
+	}
+
+	if replyTo, _, err = readLPBytes(buf); err != nil {
+		return 0, nil, nil, nil, fmt.Errorf("rpc/decodeRPC: Reply topic: %w", err)
+	}
+
+	return b[1], id, replyTo, buf.Bytes(), nil
+}
+
+// validReplyTopic checks that replies can be published to the topic: it must be a
+// valid topic name, with no + or # wildcards.
+func validReplyTopic(topic []byte) bool {
+	return ValidTopic(topic) && bytes.IndexByte(topic, '+') == -1
+}
+
+// Requester publishes requests, and matches the replies to them by correlation ID.
+// All replies come back on a single reply topic, which the client subscribes to
+// once, so any number of calls can be waiting at the same time. Incoming PUBLISH
+// messages are passed to Handle by the client's read loop. Requester is safe for
+// concurrent use.
+type Requester struct {
+	// Qos is the QoS of the requests, and of the reply subscription.
+	Qos byte
+
+	// Timeout is how long a call waits for its reply. If 0, DefaultRPCTimeout is
+	// used.
+	Timeout time.Duration
+
+	send    func(*PublishMessage) error
+	replyTo []byte
+	prefix  string
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[string]*Call
+	closed  bool
+}
+
+// NewRequester creates a Requester whose replies are published to the reply topic,
+// which should be unique to the client, such as "replies/" followed by the client
+// ID. Requests are published with send, which must set the packet ID of QoS 1 and 2
+// messages.
+func NewRequester(replyTo string, send func(*PublishMessage) error) (*Requester, error) {
+	if !validReplyTopic([]byte(replyTo)) {
+		return nil, fmt.Errorf("rpc/NewRequester: Invalid reply topic %q", replyTo)
+	}
+
+	// The random prefix keeps the correlation IDs of a restarted client from
+	// matching replies to requests made before it restarted.
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+
+	return &Requester{
+		send:    send,
+		replyTo: []byte(replyTo),
+		prefix:  hex.EncodeToString(b[:]) + "-",
+		pending: make(map[string]*Call),
+	}, nil
+}
+
+// ReplyTopic returns the topic replies are published to.
+func (this *Requester) ReplyTopic() []byte {
+	return this.replyTo
+}
+
+// Subscribe returns the SUBSCRIBE message for the reply topic, which must be sent
+// before the first call. The packet ID is left for the caller to set.
+func (this *Requester) Subscribe() (*SubscribeMessage, error) {
+	msg := NewSubscribeMessage()
+
+	if err := msg.AddTopic(this.replyTo, this.Qos); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Call publishes a request to the topic, and returns a Call that completes when the
+// reply arrives, or when the timeout passes. The context only applies to
+// publishing the request; use Call.Wait to stop waiting for the reply earlier.
+func (this *Requester) Call(ctx context.Context, topic []byte, payload []byte) (*Call, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, contextError("Call", err)
+	}
+
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return nil, ErrRPCClosed
+	}
+
+	this.seq++
+	id := this.prefix + strconv.FormatUint(this.seq, 36)
+
+	timeout := this.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRPCTimeout
+	}
+
+	// The reply can arrive before send returns, so the call is pending, with its
+	// timer running, before the request is published.
+	call := &Call{id: id, done: make(chan struct{})}
+	call.timer = time.AfterFunc(timeout, func() {
+		if this.remove(id) {
+			call.complete(nil, &TimeoutError{Op: "Call", Err: context.DeadlineExceeded})
+		}
+	})
+
+	this.pending[id] = call
+	this.mu.Unlock()
+
+	body, err := encodeRPC(rpcRequest, []byte(id), this.replyTo, payload)
+	if err != nil {
+		this.remove(id)
+		return nil, err
+	}
+
+	msg := NewPublishMessage()
+
+	if err := msg.SetTopic(topic); err != nil {
+		this.remove(id)
+		return nil, err
+	}
+
+	if err := msg.SetQoS(this.Qos); err != nil {
+		this.remove(id)
+		return nil, err
+	}
+
+	msg.SetPayload(body)
+
+	if err := this.send(msg); err != nil {
+		this.remove(id)
+		return nil, err
+	}
+
+	return call, nil
+}
+
+// Request calls Call and waits for the reply.
+func (this *Requester) Request(ctx context.Context, topic []byte, payload []byte) ([]byte, error) {
+	call, err := this.Call(ctx, topic, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return call.Wait(ctx)
+}
+
+// Handle completes the call the message is a reply to. It returns false if the
+// message is not a reply to a pending call of this Requester, so the client can
+// handle it some other way. Late replies to calls that have timed out are dropped,
+// and Handle returns true for them.
+func (this *Requester) Handle(msg *PublishMessage) bool {
+	if !bytes.Equal(msg.Topic(), this.replyTo) {
+		return false
+	}
+
+	kind, id, _, body, err := decodeRPC(msg.Payload())
+	if err != nil || kind == rpcRequest {
+		return false
+	}
+
+	this.mu.Lock()
+	call, ok := this.pending[string(id)]
+	delete(this.pending, string(id))
+	this.mu.Unlock()
+
+	if !ok {
+		return bytes.HasPrefix(id, []byte(this.prefix))
+	}
+
+	call.timer.Stop()
+
+	// The body points into the message, which the caller may decode into again.
+	if kind == rpcError {
+		call.complete(nil, &RemoteError{Message: string(body)})
+	} else {
+		call.complete(append([]byte(nil), body...), nil)
+	}
+
+	return true
+}
+
+// Pending returns the number of calls waiting for a reply.
+func (this *Requester) Pending() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.pending)
+}
+
+// Close fails all pending calls with ErrRPCClosed. Calls made after Close fail too.
+func (this *Requester) Close() {
+	this.mu.Lock()
+	pending := this.pending
+	this.pending = make(map[string]*Call)
+	this.closed = true
+	this.mu.Unlock()
+
+	for _, call := range pending {
+		call.timer.Stop()
+		call.complete(nil, ErrRPCClosed)
+	}
+}
+
+// remove removes the pending call and stops its timer. It returns false if it had
+// already been removed.
+func (this *Requester) remove(id string) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	call, ok := this.pending[id]
+	if ok {
+		call.timer.Stop()
+		delete(this.pending, id)
+	}
+
+	return ok
+}
+
+// Call is a request waiting for its reply.
+type Call struct {
+	id    string
+	timer *time.Timer
+	done  chan struct{}
+
+	reply []byte
+	err   error
+}
+
+// CorrelationId returns the correlation ID of the request.
+func (this *Call) CorrelationId() string {
+	return this.id
+}
+
+// Done returns a channel that's closed when the call completes.
+func (this *Call) Done() <-chan struct{} {
+	return this.done
+}
+
+// Result returns the reply and error of a completed call. It must not be called
+// before Done is closed.
+func (this *Call) Result() ([]byte, error) {
+	return this.reply, this.err
+}
+
+// Wait waits for the call to complete and returns the reply. The error is a
+// *TimeoutError if no reply arrived in time, or a *RemoteError if the handler
+// failed. If the context is done first, Wait returns its error, but the call stays
+// pending until it completes or times out.
+func (this *Call) Wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-this.done:
+		return this.reply, this.err
+
+	case <-ctx.Done():
+		return nil, contextError("Wait", ctx.Err())
+	}
+}
+
+func (this *Call) complete(reply []byte, err error) {
+	this.reply, this.err = reply, err
+	close(this.done)
+}
+
+// Responder dispatches requests to handlers registered by topic filter, and publishes
+// their replies. Handlers are tried in the order they were registered, and the
+// first one whose filter matches the request topic handles it. Responder is safe for
+// concurrent use.
+type Responder struct {
+	// Qos is the QoS of the replies, and of the request subscriptions.
+	Qos byte
+
+	send func(*PublishMessage) error
+
+	mu       sync.RWMutex
+	handlers []rpcRoute
+}
+
+type rpcRoute struct {
+	filter []byte
+	h      RPCHandler
+}
+
+// NewResponder creates a Responder that publishes replies with send, which must set
+// the packet ID of QoS 1 and 2 messages.
+func NewResponder(send func(*PublishMessage) error) *Responder {
+	return &Responder{send: send}
+}
+
+// HandleFunc registers the handler for requests published to topics matching the
+// filter.
+func (this *Responder) HandleFunc(filter string, h RPCHandler) error {
+	if len(filter) == 0 || !ValidUTF8([]byte(filter)) {
+		return fmt.Errorf("rpc/HandleFunc: Invalid topic filter %q", filter)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.handlers = append(this.handlers, rpcRoute{[]byte(filter), h})
+
+	return nil
+}
+
+// Subscribe returns the SUBSCRIBE message for the filters of all the handlers. The
+// packet ID is left for the caller to set.
+func (this *Responder) Subscribe() (*SubscribeMessage, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	msg := NewSubscribeMessage()
+
+	for _, r := range this.handlers {
+		if err := msg.AddTopic(r.filter, this.Qos); err != nil {
+			return nil, err
+		}
+	}
+
+	return msg, nil
+}
+
+// Handle runs the handler for the request in the message, and publishes its reply.
+// It returns false if the message is not an RPC request. If no handler matches the
+// topic, an error reply wrapping ErrNoHandler is published. The handler runs on the
+// calling goroutine, so read loops that must not block should call Handle in a
+// goroutine of its own. The request is copied out of the message before the handler
+// runs, so the message can be reused once the handler has started. The error is the
+// error from publishing the reply.
+func (this *Responder) Handle(ctx context.Context, msg *PublishMessage) (bool, error) {
+	topic := append([]byte(nil), msg.Topic()...)
+
+	kind, id, replyTo, body, err := decodeRPC(append([]byte(nil), msg.Payload()...))
+	if err != nil || kind != rpcRequest || !validReplyTopic(replyTo) {
+		return false, nil
+	}
+
+	var h RPCHandler
+
+	this.mu.RLock()
+	for _, r := range this.handlers {
+		if MatchTopic(r.filter, topic) {
+			h = r.h
+			break
+		}
+	}
+	this.mu.RUnlock()
+
+	var reply []byte
+
+	if h == nil {
+		err = fmt.Errorf("%w %s", ErrNoHandler, topic)
+	} else {
+		reply, err = h(ctx, &RPCRequest{
+			Topic:         topic,
+			CorrelationId: id,
+			ReplyTo:       replyTo,
+			Payload:       body,
+		})
+	}
+
+	kind = rpcReply
+	if err != nil {
+		kind, reply = rpcError, []byte(err.Error())
+	}
+
+	payload, err := encodeRPC(kind, id, nil, reply)
+	if err != nil {
+		return true, err
+	}
+
+	out := NewPublishMessage()
+
+	if err := out.SetTopic(replyTo); err != nil {
+		return true, err
+	}
+
+	if err := out.SetQoS(this.Qos); err != nil {
+		return true, err
+	}
+
+	out.SetPayload(payload)
+
+	return true, this.send(out)
+}
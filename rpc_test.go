@@ -0,0 +1,334 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+// newTestRPC connects a Requester and a Responder directly, as if through a broker
+// that routes each message to the other side.
+func newTestRPC(t *testing.T) (*Requester, *Responder) {
+	var req *Requester
+
+	resp := NewResponder(func(msg *PublishMessage) error {
+		go req.Handle(roundTripPublish(t, msg))
+		return nil
+	})
+
+	req, err := NewRequester("replies/client1", func(msg *PublishMessage) error {
+		go resp.Handle(context.Background(), roundTripPublish(t, msg))
+		return nil
+	})
+	assert.NoError(t, true, err)
+
+	return req, resp
+}
+
+func TestRPCEnvelope(t *testing.T) {
+	b, err := encodeRPC(rpcRequest, []byte("id1"), []byte("replies/a"), []byte("body"))
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "\x01\x00\x00\x03id1\x00\x09replies/abody", string(b))
+
+	kind, id, replyTo, body, err := decodeRPC(b)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, rpcRequest, kind)
+	assert.Equal(t, true, "id1", string(id))
+	assert.Equal(t, true, "replies/a", string(replyTo))
+	assert.Equal(t, true, "body", string(body))
+
+	for _, bad := range []string{"", "\x01", "\x02\x00", "\x01\x07\x00\x00\x00\x00", "\x01\x00\x00\x05id", "\x01\x00\x00\x00\x00"} {
+		_, _, _, _, err = decodeRPC([]byte(bad))
+		assert.Error(t, true, err, "Expecting error for", []byte(bad))
+	}
+}
+
+func TestRPCConcurrentCalls(t *testing.T) {
+	req, resp := newTestRPC(t)
+
+	assert.NoError(t, true, resp.HandleFunc("devices/+/echo", func(ctx context.Context, r *RPCRequest) ([]byte, error) {
+		return append([]byte(strings.Split(string(r.Topic), "/")[1]+":"), r.Payload...), nil
+	}))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			want := fmt.Sprintf("d%d:%d", i%5, i)
+
+			reply, err := req.Request(context.Background(), []byte(fmt.Sprintf("devices/d%d/echo", i%5)), []byte(fmt.Sprint(i)))
+			if err == nil && string(reply) != want {
+				err = fmt.Errorf("got reply %q, want %q", reply, want)
+			}
+
+			errs <- err
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, true, err)
+	}
+
+	assert.Equal(t, true, 0, req.Pending())
+}
+
+func TestRPCRemoteError(t *testing.T) {
+	req, resp := newTestRPC(t)
+
+	resp.HandleFunc("cmd/reboot", func(ctx context.Context, r *RPCRequest) ([]byte, error) {
+		return nil, errors.New("device busy")
+	})
+
+	_, err := req.Request(context.Background(), []byte("cmd/reboot"), []byte("now"))
+
+	var rerr *RemoteError
+	assert.True(t, true, errors.As(err, &rerr), "Expecting RemoteError.")
+	assert.Equal(t, true, "device busy", rerr.Message)
+
+	_, err = req.Request(context.Background(), []byte("cmd/unknown"), []byte("x"))
+	assert.True(t, true, errors.As(err, &rerr), "Expecting RemoteError.")
+	assert.True(t, true, strings.Contains(rerr.Message, ErrNoHandler.Error()), "Expecting no handler error.")
+}
+
+func TestRPCTimeout(t *testing.T) {
+	var sent *PublishMessage
+
+	req, err := NewRequester("replies/client1", func(msg *PublishMessage) error {
+		sent = msg
+		return nil
+	})
+	assert.NoError(t, true, err)
+
+	req.Timeout = 20 * time.Millisecond
+
+	call, err := req.Call(context.Background(), []byte("cmd/slow"), []byte("x"))
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, 1, req.Pending())
+
+	_, err = call.Wait(context.Background())
+	assert.True(t, true, errors.Is(err, ErrTimeout), "Expecting ErrTimeout.")
+	assert.Equal(t, true, 0, req.Pending())
+
+	// A late reply is recognised, but dropped.
+	_, id, _, _, _ := decodeRPC(sent.Payload())
+	payload, _ := encodeRPC(rpcReply, id, nil, []byte("late"))
+
+	reply := NewPublishMessage()
+	reply.SetTopic([]byte("replies/client1"))
+	reply.SetPayload(payload)
+	assert.True(t, true, req.Handle(reply))
+
+	// Messages that are not replies are left to the caller.
+	other := NewPublishMessage()
+	other.SetTopic([]byte("replies/client1"))
+	other.SetPayload([]byte("hello"))
+	assert.False(t, true, req.Handle(other))
+
+	other.SetTopic([]byte("sensors/temp"))
+	other.SetPayload(payload)
+	assert.False(t, true, req.Handle(other))
+}
+
+func TestRPCWaitContext(t *testing.T) {
+	req, err := NewRequester("replies/client1", func(msg *PublishMessage) error { return nil })
+	assert.NoError(t, true, err)
+
+	call, err := req.Call(context.Background(), []byte("cmd/slow"), []byte("x"))
+	assert.NoError(t, true, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = call.Wait(ctx)
+	assert.True(t, true, errors.Is(err, context.Canceled), "Expecting context.Canceled.")
+	assert.Equal(t, true, 1, req.Pending(), "The call should still be pending.")
+
+	_, err = req.Call(ctx, []byte("cmd/slow"), []byte("x"))
+	assert.True(t, true, errors.Is(err, context.Canceled), "Expecting context.Canceled.")
+
+	req.Close()
+
+	<-call.Done()
+	_, err = call.Result()
+	assert.True(t, true, errors.Is(err, ErrRPCClosed), "Expecting ErrRPCClosed.")
+
+	_, err = req.Call(context.Background(), []byte("cmd/slow"), []byte("x"))
+	assert.True(t, true, errors.Is(err, ErrRPCClosed), "Expecting ErrRPCClosed.")
+}
+
+func TestRPCSendError(t *testing.T) {
+	req, err := NewRequester("replies/client1", func(msg *PublishMessage) error {
+		return errors.New("connection lost")
+	})
+	assert.NoError(t, true, err)
+
+	_, err = req.Call(context.Background(), []byte("cmd/a"), []byte("x"))
+	assert.Error(t, true, err)
+	assert.Equal(t, true, 0, req.Pending())
+
+	_, err = req.Call(context.Background(), []byte("cmd/#"), []byte("x"))
+	assert.Error(t, true, err, "Expecting error for wildcard request topic.")
+}
+
+func TestRPCSubscribe(t *testing.T) {
+	_, err := NewRequester("replies/+", nil)
+	assert.Error(t, true, err)
+
+	req, resp := newTestRPC(t)
+	req.Qos = QosAtLeastOnce
+
+	sub, err := req.Subscribe()
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, [][]byte{[]byte("replies/client1")}, sub.Topics())
+	assert.Equal(t, true, []byte{QosAtLeastOnce}, sub.Qos())
+
+	resp.HandleFunc("cmd/a", nil)
+	resp.HandleFunc("devices/+/cmd/#", nil)
+
+	sub, err = resp.Subscribe()
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, [][]byte{[]byte("cmd/a"), []byte("devices/+/cmd/#")}, sub.Topics())
+
+	assert.Error(t, true, resp.HandleFunc("", nil))
+}
+
+func TestResponderIgnoresOtherMessages(t *testing.T) {
+	resp := NewResponder(func(msg *PublishMessage) error {
+		t.Fatal("Unexpected reply.")
+		return nil
+	})
+
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("cmd/a"))
+	msg.SetPayload([]byte("not an envelope"))
+
+	ok, err := resp.Handle(context.Background(), msg)
+	assert.False(t, true, ok)
+	assert.NoError(t, true, err)
+
+	payload, _ := encodeRPC(rpcReply, []byte("id"), nil, []byte("x"))
+	msg.SetPayload(payload)
+
+	ok, _ = resp.Handle(context.Background(), msg)
+	assert.False(t, true, ok, "Replies are not requests.")
+}
+
+func TestRPCReplyCopied(t *testing.T) {
+	var sent *PublishMessage
+
+	req, err := NewRequester("replies/client1", func(msg *PublishMessage) error {
+		sent = msg
+		return nil
+	})
+	assert.NoError(t, true, err)
+
+	call, err := req.Call(context.Background(), []byte("cmd/a"), []byte("x"))
+	assert.NoError(t, true, err)
+
+	_, id, _, _, _ := decodeRPC(sent.Payload())
+	first, _ := encodeRPC(rpcReply, id, nil, []byte("first-reply"))
+	second, _ := encodeRPC(rpcReply, id, nil, []byte("XXXXXXXXXXX"))
+
+	reply := NewPublishMessage()
+	reply.SetTopic([]byte("replies/client1"))
+	reply.SetPayload(first)
+	reply = roundTripPublish(t, reply)
+	assert.True(t, true, req.Handle(reply))
+
+	// The read loop decodes the next message into the same PUBLISH.
+	next := NewPublishMessage()
+	next.SetTopic([]byte("replies/client1"))
+	next.SetPayload(second)
+
+	r, _, err := next.Encode()
+	assert.NoError(t, true, err)
+	_, err = reply.Decode(r)
+	assert.NoError(t, true, err)
+
+	out, err := call.Wait(context.Background())
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "first-reply", string(out), "Reply changed when the message was reused.")
+}
+
+func TestResponderRequestCopied(t *testing.T) {
+	got := make(chan *RPCRequest, 1)
+
+	resp := NewResponder(func(msg *PublishMessage) error { return nil })
+	assert.NoError(t, true, resp.HandleFunc("cmd/#", func(ctx context.Context, r *RPCRequest) ([]byte, error) {
+		got <- r
+		return nil, nil
+	}))
+
+	payload, _ := encodeRPC(rpcRequest, []byte("id1"), []byte("replies/a"), []byte("body"))
+
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("cmd/a"))
+	msg.SetPayload(payload)
+
+	ok, err := resp.Handle(context.Background(), msg)
+	assert.True(t, true, ok)
+	assert.NoError(t, true, err)
+
+	for i := range payload {
+		payload[i] = 'X'
+	}
+	msg.Topic()[0] = 'X'
+
+	r := <-got
+	assert.Equal(t, true, "cmd/a", string(r.Topic), "Request topic changed with the message.")
+	assert.Equal(t, true, "id1", string(r.CorrelationId), "Correlation ID changed with the message.")
+	assert.Equal(t, true, "replies/a", string(r.ReplyTo), "Reply topic changed with the message.")
+	assert.Equal(t, true, "body", string(r.Payload), "Payload changed with the message.")
+}
+
+func TestResponderWildcardReplyTopic(t *testing.T) {
+	resp := NewResponder(func(msg *PublishMessage) error {
+		t.Fatal("Unexpected reply.")
+		return nil
+	})
+	assert.NoError(t, true, resp.HandleFunc("cmd/#", func(ctx context.Context, r *RPCRequest) ([]byte, error) {
+		return nil, nil
+	}))
+
+	for _, replyTo := range []string{"a/+", "a/#", "+"} {
+		payload, _ := encodeRPC(rpcRequest, []byte("id1"), []byte(replyTo), []byte("body"))
+
+		msg := NewPublishMessage()
+		msg.SetTopic([]byte("cmd/a"))
+		msg.SetPayload(payload)
+
+		ok, err := resp.Handle(context.Background(), msg)
+		assert.False(t, true, ok, "Expecting request with wildcard reply topic to be ignored.", replyTo)
+		assert.NoError(t, true, err)
+	}
+
+	_, err := NewRequester("a/+", func(msg *PublishMessage) error { return nil })
+	assert.Error(t, true, err, "Expecting error for wildcard reply topic.")
+}
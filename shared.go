@@ -0,0 +1,472 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// SharedTopicPrefix is the prefix of a shared subscription topic filter. A shared
+// subscription has the form $share/{group}/{filter}, and each message matching the
+// filter is delivered to only one of the subscribers in the group.
+const SharedTopicPrefix = "$share/"
+
+// IsSharedTopic checks to see if the topic filter is a shared subscription.
+func IsSharedTopic(topic []byte) bool {
+	return bytes.HasPrefix(topic, []byte(SharedTopicPrefix))
+}
+
+// ParseSharedTopic splits a shared subscription of the form $share/{group}/{filter}
+// into the group name and the topic filter. An error is returned if the topic is not
+// a shared subscription, if the group name is empty or contains wildcards, or if the
+// filter is empty.
+func ParseSharedTopic(topic []byte) ([]byte, []byte, error) {
+	if !IsSharedTopic(topic) {
+		return nil, nil, fmt.Errorf("shared/ParseSharedTopic: Topic (%s) is not a shared subscription", string(topic))
+	}
+
+	rest := topic[len(SharedTopicPrefix):]
+
+	i := bytes.IndexByte(rest, '/')
+	if i <= 0 {
+		return nil, nil, fmt.Errorf("shared/ParseSharedTopic: Missing group name in shared subscription (%s)", string(topic))
+	}
+
+	group, filter := rest[:i], rest[i+1:]
+
+	if bytes.IndexAny(group, "+#") != -1 {
+		return nil, nil, fmt.Errorf("shared/ParseSharedTopic: Group name (%s) must not contain wildcard characters", string(group))
+	}
+
+	if len(filter) == 0 {
+		return nil, nil, fmt.Errorf("shared/ParseSharedTopic: Empty topic filter in shared subscription (%s)", string(topic))
+	}
+
+	return group, filter, nil
+}
+
+// ShareMember is a single subscriber in a shared subscription group.
+type ShareMember struct {
+	id       string
+	qos      byte
+	inflight map[uint16]SharedDelivery
+}
+
+// Id returns the ID of the subscriber, usually the client ID.
+func (this *ShareMember) Id() string {
+	return this.id
+}
+
+// Qos returns the maximum QoS granted to the subscriber.
+func (this *ShareMember) Qos() byte {
+	return this.qos
+}
+
+// Inflight returns the number of QoS 1 and 2 messages delivered to the subscriber
+// that have not yet been acknowledged.
+func (this *ShareMember) Inflight() int {
+	return len(this.inflight)
+}
+
+func (this *ShareMember) clone() *ShareMember {
+	m := &ShareMember{
+		id:       this.id,
+		qos:      this.qos,
+		inflight: make(map[uint16]SharedDelivery, len(this.inflight)),
+	}
+
+	for id, d := range this.inflight {
+		m.inflight[id] = d
+	}
+
+	return m
+}
+
+// ShareGroup is the list of subscribers sharing a single topic filter.
+type ShareGroup struct {
+	name    string
+	filter  []byte
+	members []*ShareMember
+	next    int
+}
+
+// Name returns the name of the group.
+func (this *ShareGroup) Name() string {
+	return this.name
+}
+
+// Filter returns the topic filter of the group, without the $share/{group}/ prefix.
+func (this *ShareGroup) Filter() []byte {
+	return this.filter
+}
+
+// Members returns the current subscribers in the group.
+func (this *ShareGroup) Members() []*ShareMember {
+	return append([]*ShareMember(nil), this.members...)
+}
+
+func (this *ShareGroup) clone() *ShareGroup {
+	g := &ShareGroup{
+		name:    this.name,
+		filter:  this.filter,
+		members: make([]*ShareMember, len(this.members)),
+		next:    this.next,
+	}
+
+	for i, m := range this.members {
+		g.members[i] = m.clone()
+	}
+
+	return g
+}
+
+func (this *ShareGroup) member(id string) (int, *ShareMember) {
+	for i, m := range this.members {
+		if m.id == id {
+			return i, m
+		}
+	}
+
+	return -1, nil
+}
+
+// ShareStrategy picks the subscriber in the group that should receive the message.
+// The group always has at least one member when the strategy is called.
+type ShareStrategy func(group *ShareGroup, msg *PublishMessage) *ShareMember
+
+// ShareRoundRobin delivers messages to each member of the group in turn.
+func ShareRoundRobin(group *ShareGroup, msg *PublishMessage) *ShareMember {
+	m := group.members[group.next%len(group.members)]
+	group.next = (group.next + 1) % len(group.members)
+
+	return m
+}
+
+// ShareRandom delivers each message to a randomly selected member of the group.
+func ShareRandom(group *ShareGroup, msg *PublishMessage) *ShareMember {
+	return group.members[rand.Intn(len(group.members))]
+}
+
+// ShareSticky delivers all messages published to the same topic to the same member
+// of the group, for as long as the group membership doesn't change.
+func ShareSticky(group *ShareGroup, msg *PublishMessage) *ShareMember {
+	h := fnv.New32a()
+	h.Write(msg.Topic())
+
+	return group.members[h.Sum32()%uint32(len(group.members))]
+}
+
+// ShareLeastInflight delivers each message to the member with the fewest unacknowledged
+// messages. Ties go to the member that joined the group first.
+func ShareLeastInflight(group *ShareGroup, msg *PublishMessage) *ShareMember {
+	least := group.members[0]
+
+	for _, m := range group.members[1:] {
+		if m.Inflight() < least.Inflight() {
+			least = m
+		}
+	}
+
+	return least
+}
+
+// SharedDelivery is a message that should be sent to a single subscriber of a shared
+// subscription group.
+type SharedDelivery struct {
+	// Group is the name of the group the message was delivered through.
+	Group string
+
+	// Filter is the topic filter of the group.
+	Filter []byte
+
+	// Subscriber is the ID of the member selected to receive the message.
+	Subscriber string
+
+	// Qos is the QoS the message should be delivered with, which is the lower of the
+	// message QoS and the QoS granted to the subscriber.
+	Qos byte
+
+	// Message is the message to deliver.
+	Message *PublishMessage
+}
+
+// SharedSubscriptions is the registry of shared subscription groups. For every
+// PUBLISH message, exactly one member of each matching group is picked using the
+// configured ShareStrategy. QoS 1 messages that are still unacknowledged when a
+// member leaves the group are redistributed to the remaining members. It is safe
+// for concurrent use.
+type SharedSubscriptions struct {
+	mu       sync.Mutex
+	strategy ShareStrategy
+	groups   []*ShareGroup
+}
+
+// NewSharedSubscriptions creates a new registry using the strategy to distribute
+// messages. If strategy is nil, ShareRoundRobin is used.
+func NewSharedSubscriptions(strategy ShareStrategy) *SharedSubscriptions {
+	if strategy == nil {
+		strategy = ShareRoundRobin
+	}
+
+	return &SharedSubscriptions{
+		strategy: strategy,
+	}
+}
+
+// Subscribe adds the subscriber to the group named in the shared subscription topic,
+// creating the group if needed. If the subscriber is already a member, its QoS is
+// updated.
+func (this *SharedSubscriptions) Subscribe(subscriber string, topic []byte, qos byte) error {
+	if !ValidQos(qos) {
+		return fmt.Errorf("shared/Subscribe: Invalid QoS %d", qos)
+	}
+
+	name, filter, err := ParseSharedTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	g := this.group(name, filter)
+	if g == nil {
+		g = &ShareGroup{
+			name:   string(name),
+			filter: append([]byte(nil), filter...),
+		}
+		this.groups = append(this.groups, g)
+	}
+
+	if _, m := g.member(subscriber); m != nil {
+		m.qos = qos
+		return nil
+	}
+
+	g.members = append(g.members, &ShareMember{
+		id:       subscriber,
+		qos:      qos,
+		inflight: make(map[uint16]SharedDelivery),
+	})
+
+	return nil
+}
+
+// AddSubscriptions adds the subscriber to the groups of all the shared subscriptions
+// in the SUBSCRIBE message, using the QoS requested for each. Topics that are not
+// shared subscriptions are skipped.
+func (this *SharedSubscriptions) AddSubscriptions(subscriber string, msg *SubscribeMessage) error {
+	for i, t := range msg.Topics() {
+		if !IsSharedTopic(t) {
+			continue
+		}
+
+		if err := this.Subscribe(subscriber, t, msg.Qos()[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Unsubscribe removes the subscriber from the group named in the shared subscription
+// topic. The unacknowledged QoS 1 messages of the subscriber are redistributed to
+// the remaining members of the group and returned.
+func (this *SharedSubscriptions) Unsubscribe(subscriber string, topic []byte) ([]SharedDelivery, error) {
+	name, filter, err := ParseSharedTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	g := this.group(name, filter)
+	if g == nil {
+		return nil, nil
+	}
+
+	return this.leave(g, subscriber), nil
+}
+
+// Leave removes the subscriber from every group, for example when the client
+// disconnects. The unacknowledged QoS 1 messages of the subscriber are redistributed
+// to the remaining members of each group and returned.
+func (this *SharedSubscriptions) Leave(subscriber string) []SharedDelivery {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var ds []SharedDelivery
+
+	for _, g := range append([]*ShareGroup(nil), this.groups...) {
+		ds = append(ds, this.leave(g, subscriber)...)
+	}
+
+	return ds
+}
+
+// Dispatch returns one delivery for every group whose filter matches the topic of
+// the message. QoS 1 and 2 deliveries should be registered with Track once the
+// caller has assigned the packet ID.
+func (this *SharedSubscriptions) Dispatch(msg *PublishMessage) []SharedDelivery {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var ds []SharedDelivery
+
+	for _, g := range this.groups {
+		if !MatchTopic(g.filter, msg.Topic()) {
+			continue
+		}
+
+		if d, ok := this.pick(g, msg); ok {
+			ds = append(ds, d)
+		}
+	}
+
+	return ds
+}
+
+// Track records that the delivery was sent with the packet ID and is waiting to be
+// acknowledged. Deliveries with QoS 0 are ignored.
+func (this *SharedSubscriptions) Track(d SharedDelivery, packetId uint16) {
+	if d.Qos == QosAtMostOnce {
+		return
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, g := range this.groups {
+		if g.name != d.Group || !bytes.Equal(g.filter, d.Filter) {
+			continue
+		}
+
+		if _, m := g.member(d.Subscriber); m != nil {
+			m.inflight[packetId] = d
+			return
+		}
+	}
+}
+
+// Ack removes the message with the packet ID from the subscriber's unacknowledged
+// messages. It should be called when a PUBACK or PUBCOMP is received.
+func (this *SharedSubscriptions) Ack(subscriber string, packetId uint16) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, g := range this.groups {
+		if _, m := g.member(subscriber); m != nil {
+			delete(m.inflight, packetId)
+		}
+	}
+}
+
+// Groups returns a snapshot of the shared subscription groups. The groups and their
+// members are copies taken under the lock, so they can be read while messages are
+// dispatched, but don't change when the subscriptions do.
+func (this *SharedSubscriptions) Groups() []*ShareGroup {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	gs := make([]*ShareGroup, len(this.groups))
+	for i, g := range this.groups {
+		gs[i] = g.clone()
+	}
+
+	return gs
+}
+
+func (this *SharedSubscriptions) group(name, filter []byte) *ShareGroup {
+	for _, g := range this.groups {
+		if g.name == string(name) && bytes.Equal(g.filter, filter) {
+			return g
+		}
+	}
+
+	return nil
+}
+
+func (this *SharedSubscriptions) pick(g *ShareGroup, msg *PublishMessage) (SharedDelivery, bool) {
+	if len(g.members) == 0 {
+		return SharedDelivery{}, false
+	}
+
+	m := this.strategy(g, msg)
+	if m == nil {
+		return SharedDelivery{}, false
+	}
+
+	qos := msg.QoS()
+	if m.qos < qos {
+		qos = m.qos
+	}
+
+	return SharedDelivery{
+		Group:      g.name,
+		Filter:     g.filter,
+		Subscriber: m.id,
+		Qos:        qos,
+		Message:    msg,
+	}, true
+}
+
+func (this *SharedSubscriptions) leave(g *ShareGroup, subscriber string) []SharedDelivery {
+	i, m := g.member(subscriber)
+	if m == nil {
+		return nil
+	}
+
+	g.members = append(g.members[:i], g.members[i+1:]...)
+	if g.next > i {
+		g.next--
+	}
+
+	if len(g.members) == 0 {
+		for j, t := range this.groups {
+			if t == g {
+				this.groups = append(this.groups[:j], this.groups[j+1:]...)
+				break
+			}
+		}
+
+		return nil
+	}
+
+	ids := make([]int, 0, len(m.inflight))
+	for id := range m.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	var ds []SharedDelivery
+
+	for _, id := range ids {
+		if m.inflight[uint16(id)].Qos != QosAtLeastOnce {
+			continue
+		}
+
+		if d, ok := this.pick(g, m.inflight[uint16(id)].Message); ok {
+			ds = append(ds, d)
+		}
+	}
+
+	return ds
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func newSharedTestMessage(topic string, qos byte) *PublishMessage {
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetQoS(qos)
+	msg.SetPayload([]byte("payload"))
+
+	return msg
+}
+
+func TestParseSharedTopic(t *testing.T) {
+	group, filter, err := ParseSharedTopic([]byte("$share/workers/sensors/+/temp"))
+	assert.NoError(t, true, err, "Error parsing shared topic.")
+	assert.Equal(t, true, "workers", string(group), "Incorrect group name.")
+	assert.Equal(t, true, "sensors/+/temp", string(filter), "Incorrect topic filter.")
+
+	_, _, err = ParseSharedTopic([]byte("sensors/+/temp"))
+	assert.Error(t, true, err)
+
+	_, _, err = ParseSharedTopic([]byte("$share//sensors"))
+	assert.Error(t, true, err)
+
+	_, _, err = ParseSharedTopic([]byte("$share/work+ers/sensors"))
+	assert.Error(t, true, err)
+
+	_, _, err = ParseSharedTopic([]byte("$share/workers/"))
+	assert.Error(t, true, err)
+
+	_, _, err = ParseSharedTopic([]byte("$share/workers"))
+	assert.Error(t, true, err)
+}
+
+func TestSharedSubscriptionsRoundRobin(t *testing.T) {
+	shared := NewSharedSubscriptions(ShareRoundRobin)
+
+	sub := NewSubscribeMessage()
+	sub.AddTopic([]byte("$share/g1/sensors/#"), 1)
+	sub.AddTopic([]byte("sensors/#"), 1)
+
+	assert.NoError(t, true, shared.AddSubscriptions("a", sub), "Error subscribing.")
+	assert.NoError(t, true, shared.Subscribe("b", []byte("$share/g1/sensors/#"), 0), "Error subscribing.")
+	assert.NoError(t, true, shared.Subscribe("c", []byte("$share/g2/sensors/temp"), 2), "Error subscribing.")
+
+	assert.Equal(t, true, 2, len(shared.Groups()), "Incorrect number of groups.")
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		ds := shared.Dispatch(newSharedTestMessage("sensors/humidity", 1))
+		assert.Equal(t, true, 1, len(ds), "Incorrect number of deliveries.")
+		got = append(got, ds[0].Subscriber)
+	}
+	assert.Equal(t, true, []string{"a", "b", "a", "b"}, got, "Incorrect round robin order.")
+
+	ds := shared.Dispatch(newSharedTestMessage("sensors/temp", 2))
+	assert.Equal(t, true, 2, len(ds), "Incorrect number of deliveries.")
+	assert.Equal(t, true, "g1", ds[0].Group, "Incorrect group.")
+	assert.Equal(t, true, "a", ds[0].Subscriber, "Incorrect subscriber.")
+	assert.Equal(t, true, 1, ds[0].Qos, "Incorrect delivery QoS.")
+	assert.Equal(t, true, "g2", ds[1].Group, "Incorrect group.")
+	assert.Equal(t, true, 2, ds[1].Qos, "Incorrect delivery QoS.")
+}
+
+func TestSharedSubscriptionsSticky(t *testing.T) {
+	shared := NewSharedSubscriptions(ShareSticky)
+	shared.Subscribe("a", []byte("$share/g/#"), 1)
+	shared.Subscribe("b", []byte("$share/g/#"), 1)
+	shared.Subscribe("c", []byte("$share/g/#"), 1)
+
+	for _, topic := range []string{"x", "y/z", "sensors/1"} {
+		first := shared.Dispatch(newSharedTestMessage(topic, 0))[0].Subscriber
+
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, true, first, shared.Dispatch(newSharedTestMessage(topic, 0))[0].Subscriber, "Sticky strategy changed subscriber.")
+		}
+	}
+}
+
+func TestSharedSubscriptionsRandom(t *testing.T) {
+	shared := NewSharedSubscriptions(ShareRandom)
+	shared.Subscribe("a", []byte("$share/g/#"), 1)
+	shared.Subscribe("b", []byte("$share/g/#"), 1)
+
+	for i := 0; i < 10; i++ {
+		ds := shared.Dispatch(newSharedTestMessage("x", 0))
+		assert.Equal(t, true, 1, len(ds), "Incorrect number of deliveries.")
+	}
+}
+
+func TestSharedSubscriptionsLeastInflight(t *testing.T) {
+	shared := NewSharedSubscriptions(ShareLeastInflight)
+	shared.Subscribe("a", []byte("$share/g/#"), 1)
+	shared.Subscribe("b", []byte("$share/g/#"), 1)
+
+	d := shared.Dispatch(newSharedTestMessage("x", 1))[0]
+	assert.Equal(t, true, "a", d.Subscriber, "Incorrect subscriber.")
+	shared.Track(d, 1)
+
+	d = shared.Dispatch(newSharedTestMessage("x", 1))[0]
+	assert.Equal(t, true, "b", d.Subscriber, "Incorrect subscriber.")
+	shared.Track(d, 1)
+
+	d = shared.Dispatch(newSharedTestMessage("x", 1))[0]
+	assert.Equal(t, true, "a", d.Subscriber, "Incorrect subscriber.")
+	shared.Track(d, 2)
+
+	shared.Ack("b", 1)
+
+	d = shared.Dispatch(newSharedTestMessage("x", 1))[0]
+	assert.Equal(t, true, "b", d.Subscriber, "Incorrect subscriber.")
+}
+
+func TestSharedSubscriptionsRedistribute(t *testing.T) {
+	shared := NewSharedSubscriptions(ShareRoundRobin)
+	shared.Subscribe("a", []byte("$share/g/#"), 2)
+	shared.Subscribe("b", []byte("$share/g/#"), 2)
+
+	m1 := newSharedTestMessage("x", 1)
+	m2 := newSharedTestMessage("y", 2)
+	m3 := newSharedTestMessage("z", 1)
+
+	d := shared.Dispatch(m1)[0]
+	shared.Track(d, 10)
+	shared.Dispatch(newSharedTestMessage("x", 0))
+	d = shared.Dispatch(m2)[0]
+	shared.Track(d, 11)
+	shared.Dispatch(newSharedTestMessage("x", 0))
+	d = shared.Dispatch(m3)[0]
+	shared.Track(d, 12)
+	assert.Equal(t, true, "a", d.Subscriber, "Incorrect subscriber.")
+
+	shared.Ack("a", 12)
+
+	ds := shared.Leave("a")
+	assert.Equal(t, true, 1, len(ds), "Only unacked QoS 1 messages should be redistributed.")
+	assert.Equal(t, true, "b", ds[0].Subscriber, "Incorrect subscriber.")
+	assert.True(t, true, ds[0].Message == m1, "Incorrect message redistributed.")
+
+	ds, err := shared.Unsubscribe("b", []byte("$share/g/#"))
+	assert.NoError(t, true, err, "Error unsubscribing.")
+	assert.Equal(t, true, 0, len(ds), "Incorrect number of deliveries.")
+	assert.Equal(t, true, 0, len(shared.Groups()), "Empty group should be removed.")
+	assert.Equal(t, true, 0, len(shared.Dispatch(m1)), "Incorrect number of deliveries.")
+}
+
+func TestSharedSubscriptionsGroupsSnapshot(t *testing.T) {
+	shared := NewSharedSubscriptions(ShareLeastInflight)
+	shared.Subscribe("a", []byte("$share/g/#"), 1)
+	shared.Subscribe("b", []byte("$share/g/#"), 1)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			for _, d := range shared.Dispatch(newSharedTestMessage("x", 1)) {
+				shared.Track(d, uint16(i))
+			}
+
+			shared.Unsubscribe("b", []byte("$share/g/#"))
+			shared.Subscribe("b", []byte("$share/g/#"), 1)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		for _, g := range shared.Groups() {
+			for _, m := range g.Members() {
+				m.Inflight()
+			}
+		}
+	}
+
+	<-done
+
+	g := shared.Groups()[0]
+	_, a := g.member("a")
+	n := a.Inflight()
+
+	shared.Track(SharedDelivery{Group: "g", Filter: []byte("#"), Subscriber: "a", Qos: 1}, 1000)
+	assert.Equal(t, true, n, a.Inflight(), "Snapshot should not change.")
+}
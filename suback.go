@@ -93,7 +93,7 @@ func (this *SubackMessage) Decode(src io.Reader) (int, error) {
 	total += n
 
 	if this.packetId, err = readUint16(this.buf); err != nil {
-		return 0, err
+		return 0, this.malformed("Packet Identifier", total, err)
 	}
 	total += 2
 
@@ -102,7 +102,7 @@ func (this *SubackMessage) Decode(src io.Reader) (int, error) {
 
 	for i, code := range this.returnCodes {
 		if code != 0x00 && code != 0x01 && code != 0x02 && code != 0x80 {
-			return total, fmt.Errorf("suback/Decode: Invalid return code %d for topic %d", code, i)
+			return total, this.malformed("Return Code", total-len(this.returnCodes)+i, violation("Invalid return code %d for topic %d", code, i))
 		}
 	}
 
@@ -117,11 +117,13 @@ func (this *SubackMessage) Decode(src io.Reader) (int, error) {
 func (this *SubackMessage) Encode() (io.Reader, int, error) {
 	for i, code := range this.returnCodes {
 		if code != 0x00 && code != 0x01 && code != 0x02 && code != 0x80 {
-			return nil, 0, fmt.Errorf("suback/Encode: Invalid return code %d for topic %d", code, i)
+			return nil, 0, this.malformed("Return Code", -1, violation("Invalid return code %d for topic %d", code, i))
 		}
 	}
 
-	this.SetRemainingLength(2 + int32(len(this.returnCodes)))
+	if err := this.SetRemainingLength(2 + int32(len(this.returnCodes))); err != nil {
+		return nil, 0, this.malformed("Remaining Length", -1, err)
+	}
 
 	_, total, err := this.fixedHeader.Encode()
 	if err != nil {
@@ -148,31 +148,47 @@ func (this *SubscribeMessage) Decode(src io.Reader) (int, error) {
 	}
 	total += n
 
+	opts := this.decodeOptions()
+
 	if this.packetId, err = readUint16(this.buf); err != nil {
-		return 0, err
+		return 0, this.malformed("Packet Identifier", total, err)
 	}
 	total += 2
 
 	for this.buf.Len() > 0 {
 		t, n, err := readLPBytes(this.buf)
 		if err != nil {
-			return total + n, err
+			return total + n, this.malformed("Topic Filter", total, err)
 		}
 		total += n
 
-		this.topics = append(this.topics, t)
+		if !ValidUTF8(t) {
+			return total, this.malformed("Topic Filter", total-n, ErrMalformedUTF8)
+		}
+
+		if err = opts.CheckTopic(t); err != nil {
+			return total, this.malformed("Topic Filter", total-n, err)
+		}
 
 		b, err := this.buf.ReadByte()
 		if err != nil {
-			return total, err
+			return total, this.malformed("Requested QoS", total, io.ErrUnexpectedEOF)
 		}
 		total += 1
 
+		// The upper 6 bits of the Requested QoS byte are reserved, and the QoS must
+		// be 0, 1 or 2 [MQTT-3.8.3-4]
+		if !ValidQos(b) && !opts.lenient() {
+			return total, this.malformed("Requested QoS", total-1, violation("Invalid requested QoS (%d) for topic %s", b, string(t)))
+		}
+
+		// Topics and QoS are added together, so they stay paired if Decode fails.
+		this.topics = append(this.topics, t)
 		this.qos = append(this.qos, b)
 	}
 
 	if len(this.topics) == 0 {
-		return 0, fmt.Errorf("subscribe/Decode: Empty topic list")
+		return 0, this.malformed("Payload", total, violation("Empty topic list"))
 	}
 
 	return total, nil
@@ -188,10 +204,16 @@ func (this *SubscribeMessage) Encode() (io.Reader, int, error) {
 	total := 2
 
 	for _, t := range this.topics {
+		if !ValidUTF8(t) {
+			return nil, 0, this.malformed("Topic Filter", -1, ErrMalformedUTF8)
+		}
+
 		total += 2 + len(t) + 1
 	}
 
-	this.SetRemainingLength(int32(total))
+	if err := this.SetRemainingLength(int32(total)); err != nil {
+		return nil, 0, this.malformed("Remaining Length", -1, err)
+	}
 
 	total = 0
 
@@ -209,7 +231,7 @@ func (this *SubscribeMessage) Encode() (io.Reader, int, error) {
 
 	for i, t := range this.topics {
 		if n, err = writeLPBytes(this.buf, t); err != nil {
-			return nil, total, err
+			return nil, total, this.malformed("Topic Filter", -1, err)
 		}
 		total += n
 
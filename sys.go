@@ -0,0 +1,206 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// SysTopicPrefix is the prefix of all the broker statistics topics. Topics starting
+	// with $ are not matched by filters starting with a wildcard, so clients must
+	// subscribe to $SYS/# explicitly to receive them.
+	SysTopicPrefix = "$SYS/broker/"
+)
+
+// Stats collects broker statistics that are published on the $SYS topic tree. It is
+// fed by the server as packets are read from and written to the network, and is safe
+// for concurrent use.
+type Stats struct {
+	// 64-bit counters are kept at the top of the struct so they are aligned for
+	// atomic access on 32-bit platforms.
+	clients       int64
+	retained      int64
+	subscriptions int64
+
+	bytesIn  uint64
+	bytesOut uint64
+
+	received [RESERVED2 + 1]uint64
+	sent     [RESERVED2 + 1]uint64
+
+	start time.Time
+}
+
+// NewStats creates a new statistics collector. The broker uptime is measured from
+// the time NewStats is called.
+func NewStats() *Stats {
+	return &Stats{
+		start: time.Now(),
+	}
+}
+
+// Received records a message of n bytes that was read from the network.
+func (this *Stats) Received(msg Message, n int) {
+	atomic.AddUint64(&this.bytesIn, uint64(n))
+
+	if t := msg.Type(); t <= RESERVED2 {
+		atomic.AddUint64(&this.received[t], 1)
+	}
+}
+
+// Sent records a message of n bytes that was written to the network.
+func (this *Stats) Sent(msg Message, n int) {
+	atomic.AddUint64(&this.bytesOut, uint64(n))
+
+	if t := msg.Type(); t <= RESERVED2 {
+		atomic.AddUint64(&this.sent[t], 1)
+	}
+}
+
+// ClientConnected increments the number of connected clients.
+func (this *Stats) ClientConnected() {
+	atomic.AddInt64(&this.clients, 1)
+}
+
+// ClientDisconnected decrements the number of connected clients.
+func (this *Stats) ClientDisconnected() {
+	atomic.AddInt64(&this.clients, -1)
+}
+
+// SetRetained sets the number of retained messages currently held by the broker.
+func (this *Stats) SetRetained(n int) {
+	atomic.StoreInt64(&this.retained, int64(n))
+}
+
+// SetSubscriptions sets the number of active subscriptions held by the broker.
+func (this *Stats) SetSubscriptions(n int) {
+	atomic.StoreInt64(&this.subscriptions, int64(n))
+}
+
+// Uptime returns the amount of time since the collector was created.
+func (this *Stats) Uptime() time.Duration {
+	return time.Since(this.start)
+}
+
+// Clients returns the number of currently connected clients.
+func (this *Stats) Clients() int64 {
+	return atomic.LoadInt64(&this.clients)
+}
+
+// MessagesReceived returns the number of messages received of the message type.
+func (this *Stats) MessagesReceived(mtype MessageType) uint64 {
+	if mtype > RESERVED2 {
+		return 0
+	}
+
+	return atomic.LoadUint64(&this.received[mtype])
+}
+
+// MessagesSent returns the number of messages sent of the message type.
+func (this *Stats) MessagesSent(mtype MessageType) uint64 {
+	if mtype > RESERVED2 {
+		return 0
+	}
+
+	return atomic.LoadUint64(&this.sent[mtype])
+}
+
+// BytesReceived returns the total number of bytes read from the network.
+func (this *Stats) BytesReceived() uint64 {
+	return atomic.LoadUint64(&this.bytesIn)
+}
+
+// BytesSent returns the total number of bytes written to the network.
+func (this *Stats) BytesSent() uint64 {
+	return atomic.LoadUint64(&this.bytesOut)
+}
+
+// Messages returns a snapshot of the statistics as a list of retained QoS 0 PUBLISH
+// messages, one per $SYS topic. The topics published are:
+//
+//	$SYS/broker/uptime
+//	$SYS/broker/clients/connected
+//	$SYS/broker/messages/received
+//	$SYS/broker/messages/received/<TYPE>
+//	$SYS/broker/messages/sent
+//	$SYS/broker/messages/sent/<TYPE>
+//	$SYS/broker/bytes/received
+//	$SYS/broker/bytes/sent
+//	$SYS/broker/retained/count
+//	$SYS/broker/subscriptions/count
+//
+// where <TYPE> is the MessageType name, e.g. PUBLISH.
+func (this *Stats) Messages() []*PublishMessage {
+	var msgs []*PublishMessage
+
+	add := func(topic string, v string) {
+		msg := NewPublishMessage()
+		msg.SetTopic([]byte(SysTopicPrefix + topic))
+		msg.SetRetain(true)
+		msg.SetPayload([]byte(v))
+		msgs = append(msgs, msg)
+	}
+
+	add("uptime", strconv.FormatInt(int64(this.Uptime()/time.Second), 10))
+	add("clients/connected", strconv.FormatInt(this.Clients(), 10))
+
+	var recv, sent uint64
+	for t := CONNECT; t < RESERVED2; t++ {
+		recv += this.MessagesReceived(t)
+		sent += this.MessagesSent(t)
+	}
+
+	add("messages/received", strconv.FormatUint(recv, 10))
+	for t := CONNECT; t < RESERVED2; t++ {
+		add("messages/received/"+t.Name(), strconv.FormatUint(this.MessagesReceived(t), 10))
+	}
+
+	add("messages/sent", strconv.FormatUint(sent, 10))
+	for t := CONNECT; t < RESERVED2; t++ {
+		add("messages/sent/"+t.Name(), strconv.FormatUint(this.MessagesSent(t), 10))
+	}
+
+	add("bytes/received", strconv.FormatUint(this.BytesReceived(), 10))
+	add("bytes/sent", strconv.FormatUint(this.BytesSent(), 10))
+	add("retained/count", strconv.FormatInt(atomic.LoadInt64(&this.retained), 10))
+	add("subscriptions/count", strconv.FormatInt(atomic.LoadInt64(&this.subscriptions), 10))
+
+	return msgs
+}
+
+// Publish calls the publish function with each of the $SYS messages every interval,
+// until the done channel is closed or publish returns an error. The error from publish
+// is returned. Publish blocks, so it's usually called in its own goroutine.
+func (this *Stats) Publish(interval time.Duration, done <-chan struct{}, publish func(*PublishMessage) error) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+
+		case <-ticker.C:
+			for _, msg := range this.Messages() {
+				if err := publish(msg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dataence/assert"
+)
+
+func TestStatsCounters(t *testing.T) {
+	stats := NewStats()
+
+	stats.Received(NewConnectMessage(), 60)
+	stats.Received(NewPublishMessage(), 23)
+	stats.Received(NewPublishMessage(), 23)
+	stats.Sent(NewConnackMessage(), 4)
+	stats.ClientConnected()
+	stats.ClientConnected()
+	stats.ClientDisconnected()
+
+	assert.Equal(t, true, 1, stats.MessagesReceived(CONNECT), "Incorrect CONNECT count.")
+	assert.Equal(t, true, 2, stats.MessagesReceived(PUBLISH), "Incorrect PUBLISH count.")
+	assert.Equal(t, true, 1, stats.MessagesSent(CONNACK), "Incorrect CONNACK count.")
+	assert.Equal(t, true, 106, stats.BytesReceived(), "Incorrect bytes received.")
+	assert.Equal(t, true, 4, stats.BytesSent(), "Incorrect bytes sent.")
+	assert.Equal(t, true, 1, stats.Clients(), "Incorrect client count.")
+}
+
+func TestStatsMessages(t *testing.T) {
+	stats := NewStats()
+
+	stats.Received(NewPublishMessage(), 23)
+	stats.Received(NewPingreqMessage(), 2)
+	stats.SetRetained(5)
+	stats.SetSubscriptions(12)
+
+	values := make(map[string]string)
+
+	for _, msg := range stats.Messages() {
+		assert.True(t, true, msg.Retain(), "SYS message should be retained.")
+		assert.Equal(t, true, QosAtMostOnce, msg.QoS(), "Incorrect QoS.")
+
+		_, _, err := msg.Encode()
+		assert.NoError(t, true, err, "Error encoding message.")
+
+		values[string(msg.Topic())] = string(msg.Payload())
+	}
+
+	assert.Equal(t, true, "2", values["$SYS/broker/messages/received"], "Incorrect received count.")
+	assert.Equal(t, true, "1", values["$SYS/broker/messages/received/PUBLISH"], "Incorrect PUBLISH count.")
+	assert.Equal(t, true, "0", values["$SYS/broker/messages/sent/PUBLISH"], "Incorrect PUBLISH count.")
+	assert.Equal(t, true, "25", values["$SYS/broker/bytes/received"], "Incorrect bytes received.")
+	assert.Equal(t, true, "5", values["$SYS/broker/retained/count"], "Incorrect retained count.")
+	assert.Equal(t, true, "12", values["$SYS/broker/subscriptions/count"], "Incorrect subscriptions count.")
+
+	for topic := range values {
+		assert.False(t, true, MatchTopic([]byte("#"), []byte(topic)), "Wildcard should not match", topic)
+		assert.True(t, true, MatchTopic([]byte("$SYS/#"), []byte(topic)), "$SYS/# should match", topic)
+	}
+}
+
+func TestStatsPublish(t *testing.T) {
+	stats := NewStats()
+	done := make(chan struct{})
+	errStop := errors.New("stop")
+
+	count := 0
+	err := stats.Publish(time.Millisecond, done, func(msg *PublishMessage) error {
+		count++
+		return errStop
+	})
+
+	assert.Equal(t, true, errStop, err, "Incorrect error.")
+	assert.Equal(t, true, 1, count, "Incorrect publish count.")
+
+	close(done)
+	err = stats.Publish(time.Hour, done, nil)
+	assert.NoError(t, true, err, "Error publishing.")
+}
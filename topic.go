@@ -0,0 +1,148 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// Topic binds a topic name or filter to the Go type of the payloads published to it,
+// and the codec they're encoded with, so values can be published and received
+// without marshalling payloads by hand:
+//
+//	temps, err := NewTopic[Reading]("sensors/+/temp", CBORCodec{})
+//	if err != nil {
+//		return err
+//	}
+//
+//	sub, err := temps.Subscribe()
+//	if err != nil {
+//		return err
+//	}
+//	...
+//	r, err := temps.Decode(msg)
+//
+// A Topic with a filter can decode messages, but can't publish them.
+type Topic[T any] struct {
+	name  []byte
+	codec Codec
+
+	// Qos is the QoS of published messages and of the subscription.
+	Qos byte
+
+	// Retain sets the RETAIN flag of published messages.
+	Retain bool
+}
+
+// NewTopic creates a Topic for the topic name or filter. If the codec is nil,
+// JSONCodec is used.
+func NewTopic[T any](name string, codec Codec) (*Topic[T], error) {
+	if len(name) == 0 || !ValidUTF8([]byte(name)) {
+		return nil, fmt.Errorf("topic/NewTopic: Invalid topic %q", name)
+	}
+
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+
+	return &Topic[T]{name: []byte(name), codec: codec}, nil
+}
+
+// Name returns the topic name or filter.
+func (this *Topic[T]) Name() []byte {
+	return this.name
+}
+
+// Codec returns the codec of the topic.
+func (this *Topic[T]) Codec() Codec {
+	return this.codec
+}
+
+// Filter returns true if the topic is a filter, containing + or # wildcards.
+func (this *Topic[T]) Filter() bool {
+	return bytes.ContainsAny(this.name, "+#")
+}
+
+// Publish returns a PUBLISH message with v encoded as its payload. The packet ID is
+// left for the caller to set for QoS 1 and 2 messages.
+func (this *Topic[T]) Publish(v T) (*PublishMessage, error) {
+	if this.Filter() {
+		return nil, fmt.Errorf("topic/Publish: Cannot publish to topic filter %q", this.name)
+	}
+
+	payload, err := this.codec.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("topic/Publish: %w", err)
+	}
+
+	msg := NewPublishMessage()
+
+	if err := msg.SetTopic(this.name); err != nil {
+		return nil, err
+	}
+
+	if err := msg.SetQoS(this.Qos); err != nil {
+		return nil, err
+	}
+
+	msg.SetRetain(this.Retain)
+	msg.SetPayload(payload)
+
+	return msg, nil
+}
+
+// Subscribe returns a SUBSCRIBE message for the topic. The packet ID is left for the
+// caller to set.
+func (this *Topic[T]) Subscribe() (*SubscribeMessage, error) {
+	msg := NewSubscribeMessage()
+
+	if err := msg.AddTopic(this.name, this.Qos); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Matches returns true if the message was published to the topic, or to a topic
+// matching the filter.
+func (this *Topic[T]) Matches(msg *PublishMessage) bool {
+	return MatchTopic(this.name, msg.Topic())
+}
+
+// Decode decodes the payload of the message into a T. It returns an error if the
+// message doesn't match the topic, and a *PayloadError if the payload can't be
+// decoded into a T.
+func (this *Topic[T]) Decode(msg *PublishMessage) (T, error) {
+	var v T
+
+	if !this.Matches(msg) {
+		return v, fmt.Errorf("topic/Decode: Topic %q does not match %q", msg.Topic(), this.name)
+	}
+
+	if err := this.codec.Unmarshal(msg.Payload(), &v); err != nil {
+		var zero T
+
+		return zero, &PayloadError{
+			Topic: msg.Topic(),
+			Codec: this.codec.Name(),
+			Type:  reflect.TypeOf(&v).Elem().String(),
+			Err:   err,
+		}
+	}
+
+	return v, nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+type topicTestReading struct {
+	Sensor string  `json:"sensor" cbor:"sensor"`
+	Value  float64 `json:"value" cbor:"value"`
+}
+
+func TestTopicPublishDecode(t *testing.T) {
+	for _, c := range []Codec{JSONCodec{}, CBORCodec{}} {
+		topic, err := NewTopic[topicTestReading]("sensors/1/temp", c)
+		assert.NoError(t, true, err)
+
+		topic.Qos = QosAtLeastOnce
+		topic.Retain = true
+
+		msg, err := topic.Publish(topicTestReading{"1", 21.5})
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, "sensors/1/temp", string(msg.Topic()))
+		assert.Equal(t, true, QosAtLeastOnce, msg.QoS())
+		assert.True(t, true, msg.Retain())
+
+		msg.SetPacketId(1)
+
+		v, err := topic.Decode(roundTripPublish(t, msg))
+		assert.NoError(t, true, err)
+		assert.Equal(t, true, topicTestReading{"1", 21.5}, v)
+	}
+}
+
+func TestTopicFilter(t *testing.T) {
+	topic, err := NewTopic[topicTestReading]("sensors/+/temp", nil)
+	assert.NoError(t, true, err)
+	assert.True(t, true, topic.Filter())
+	assert.Equal(t, true, "json", topic.Codec().Name())
+
+	_, err = topic.Publish(topicTestReading{})
+	assert.Error(t, true, err, "Should not publish to a topic filter.")
+
+	sub, err := topic.Subscribe()
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, [][]byte{[]byte("sensors/+/temp")}, sub.Topics())
+
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("sensors/7/temp"))
+	msg.SetPayload([]byte(`{"sensor":"7","value":3}`))
+
+	v, err := topic.Decode(msg)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, "7", v.Sensor)
+
+	msg.SetTopic([]byte("sensors/7/humidity"))
+	assert.False(t, true, topic.Matches(msg))
+
+	_, err = topic.Decode(msg)
+	assert.Error(t, true, err)
+	assert.False(t, true, errors.Is(err, ErrPayloadSchema), "Wrong topic is not a schema error.")
+}
+
+func TestTopicSchemaMismatch(t *testing.T) {
+	topic, _ := NewTopic[topicTestReading]("sensors/1/temp", JSONCodec{})
+
+	msg := NewPublishMessage()
+	msg.SetTopic([]byte("sensors/1/temp"))
+	msg.SetPayload([]byte(`{"sensor":"1","value":"hot"}`))
+
+	_, err := topic.Decode(msg)
+	assert.True(t, true, errors.Is(err, ErrPayloadSchema))
+
+	var perr *PayloadError
+	assert.True(t, true, errors.As(err, &perr))
+	assert.Equal(t, true, "sensors/1/temp", string(perr.Topic))
+	assert.Equal(t, true, "json", perr.Codec)
+	assert.Equal(t, true, "mqtt.topicTestReading", perr.Type)
+
+	ctopic, _ := NewTopic[topicTestReading]("sensors/1/temp", CBORCodec{})
+	_, err = ctopic.Decode(msg)
+	assert.True(t, true, errors.Is(err, ErrPayloadSchema))
+}
+
+func TestTopicProto(t *testing.T) {
+	topic, _ := NewTopic[*protoTestMessage]("counter", ProtoCodec{})
+
+	msg, err := topic.Publish(&protoTestMessage{Value: 42})
+	assert.NoError(t, true, err)
+
+	v, err := topic.Decode(msg)
+	assert.NoError(t, true, err)
+	assert.Equal(t, true, uint32(42), v.Value)
+}
+
+func TestTopicInvalid(t *testing.T) {
+	_, err := NewTopic[string]("", nil)
+	assert.Error(t, true, err)
+
+	_, err = NewTopic[string]("a/\xff", nil)
+	assert.Error(t, true, err)
+}
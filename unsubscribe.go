@@ -16,7 +16,6 @@ package mqtt
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 )
 
@@ -105,22 +104,30 @@ func (this *UnsubscribeMessage) Decode(src io.Reader) (int, error) {
 	total += n
 
 	if this.packetId, err = readUint16(this.buf); err != nil {
-		return 0, err
+		return 0, this.malformed("Packet Identifier", total, err)
 	}
 	total += 2
 
 	for this.buf.Len() > 0 {
 		t, n, err := readLPBytes(this.buf)
 		if err != nil {
-			return total + n, err
+			return total + n, this.malformed("Topic Filter", total, err)
 		}
 		total += n
 
+		if !ValidUTF8(t) {
+			return total, this.malformed("Topic Filter", total-n, ErrMalformedUTF8)
+		}
+
+		if err = this.decodeOptions().CheckTopic(t); err != nil {
+			return total, this.malformed("Topic Filter", total-n, err)
+		}
+
 		this.topics = append(this.topics, t)
 	}
 
 	if len(this.topics) == 0 {
-		return 0, fmt.Errorf("unsubscribe/Decode: Empty topic list")
+		return 0, this.malformed("Payload", total, violation("Empty topic list"))
 	}
 
 	return total, nil
@@ -136,10 +143,16 @@ func (this *UnsubscribeMessage) Encode() (io.Reader, int, error) {
 	total := 2
 
 	for _, t := range this.topics {
+		if !ValidUTF8(t) {
+			return nil, 0, this.malformed("Topic Filter", -1, ErrMalformedUTF8)
+		}
+
 		total += 2 + len(t)
 	}
 
-	this.SetRemainingLength(int32(total))
+	if err := this.SetRemainingLength(int32(total)); err != nil {
+		return nil, 0, this.malformed("Remaining Length", -1, err)
+	}
 
 	_, total, err := this.fixedHeader.Encode()
 	if err != nil {
@@ -155,7 +168,7 @@ func (this *UnsubscribeMessage) Encode() (io.Reader, int, error) {
 
 	for _, t := range this.topics {
 		if n, err = writeLPBytes(this.buf, t); err != nil {
-			return nil, 0, err
+			return nil, 0, this.malformed("Topic Filter", -1, err)
 		}
 		total += n
 	}
@@ -0,0 +1,33 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrMalformedUTF8 is returned when a topic name, topic filter, client ID or user
+// name is not a well-formed UTF-8 string as defined in section 1.5.3 of the spec.
+// A Server receiving such a packet MUST close the Network Connection [MQTT-1.5.3-1].
+var ErrMalformedUTF8 = errors.New("mqtt: Malformed UTF-8 encoded string")
+
+// ValidUTF8 checks to see if the bytes are a well-formed UTF-8 string as required by
+// the spec. The string must not include encodings of the UTF-16 surrogates U+D800 to
+// U+DFFF [MQTT-1.5.3-1], or the null character U+0000 [MQTT-1.5.3-2].
+func ValidUTF8(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) == -1
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func TestValidUTF8(t *testing.T) {
+	assert.True(t, true, ValidUTF8([]byte("sport/tennis/player1")), "Expecting valid string.")
+	assert.True(t, true, ValidUTF8([]byte("A≢Α.")), "Expecting valid string.")
+	assert.True(t, true, ValidUTF8([]byte("\U0002A6D4")), "Expecting valid string.")
+	assert.True(t, true, ValidUTF8([]byte{}), "Expecting valid string.")
+
+	assert.False(t, true, ValidUTF8([]byte{'a', 0x00, 'b'}), "Expecting U+0000 to be rejected.")
+	assert.False(t, true, ValidUTF8([]byte{0xed, 0xa0, 0x80}), "Expecting surrogate U+D800 to be rejected.")
+	assert.False(t, true, ValidUTF8([]byte{0xed, 0xbf, 0xbf}), "Expecting surrogate U+DFFF to be rejected.")
+	assert.False(t, true, ValidUTF8([]byte{0xc0, 0xaf}), "Expecting overlong encoding to be rejected.")
+	assert.False(t, true, ValidUTF8([]byte{0xe2, 0x89}), "Expecting truncated sequence to be rejected.")
+	assert.False(t, true, ValidUTF8([]byte{0xff}), "Expecting invalid byte to be rejected.")
+}
+
+func TestPublishMessageMalformedUTF8(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBLISH<<4) | 2,
+		10,
+		0, // topic name MSB (0)
+		3, // topic name LSB (3)
+		'a', 0xed, 0xa0,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		's', 'e', 'n',
+	}
+
+	msg := NewPublishMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8.")
+
+	msg = NewPublishMessage()
+	assert.Error(t, true, msg.SetTopic([]byte{'a', 0x00}), "Expecting error setting topic with U+0000.")
+
+	msg.topic = []byte{'a', 0x00}
+	msg.SetPayload([]byte("send me home"))
+	_, _, err = msg.Encode()
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8.")
+}
+
+func TestSubscribeMessageMalformedUTF8(t *testing.T) {
+	msgBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		8,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic filter MSB (0)
+		3, // topic filter LSB (3)
+		'a', 0x00, '#',
+		1, // QoS
+	}
+
+	msg := NewSubscribeMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8.")
+
+	msg = NewSubscribeMessage()
+	msg.SetPacketId(7)
+	msg.AddTopic([]byte{'a', 0xff}, 1)
+	_, _, err = msg.Encode()
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8.")
+}
+
+func TestUnsubscribeMessageMalformedUTF8(t *testing.T) {
+	msgBytes := []byte{
+		byte(UNSUBSCRIBE<<4) | 2,
+		7,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+		0, // topic filter MSB (0)
+		3, // topic filter LSB (3)
+		'a', 0xed, 0xbf,
+	}
+
+	msg := NewUnsubscribeMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8.")
+
+	msg = NewUnsubscribeMessage()
+	msg.SetPacketId(7)
+	msg.AddTopic([]byte{'a', 0x00})
+	_, _, err = msg.Encode()
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8.")
+}
+
+func TestConnectMessageMalformedUTF8(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		20,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,   // Protocol level 4
+		194, // connect flags 11000010, username, password, clean session
+		0,   // Keep Alive MSB (0)
+		10,  // Keep Alive LSB (10)
+		0,   // Client ID MSB (0)
+		2,   // Client ID LSB (2)
+		'a', 'b',
+		0, // Username MSB (0)
+		2, // Username LSB (2)
+		'a', 0x00,
+		0, // Password MSB (0)
+		0, // Password LSB (0)
+	}
+
+	msg := NewConnectMessage()
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8 for username.")
+
+	msgBytes[14] = 0xc0
+	msg = NewConnectMessage()
+	_, err = msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8 for client ID.")
+
+	msg = NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetClientId([]byte("surgemq"))
+	msg.SetWillFlag(true)
+	msg.SetWillTopic([]byte{'w', 0xed, 0xa0, 0x80})
+	msg.SetWillMessage([]byte("bye"))
+	_, _, err = msg.Encode()
+	assert.True(t, true, errors.Is(err, ErrMalformedUTF8), "Expecting ErrMalformedUTF8 for will topic.")
+}
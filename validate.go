@@ -0,0 +1,307 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Violation describes a message that does not conform to one of the normative
+// statements of the MQTT 3.1.1 spec.
+type Violation struct {
+	// Id is the identifier of the normative statement in the spec, such as
+	// "MQTT-3.1.2-3".
+	Id string
+
+	// Type is the type of the message.
+	Type MessageType
+
+	// Field is the name of the field that's in violation, as it's named in the spec.
+	Field string
+
+	// Desc describes the violation.
+	Desc string
+}
+
+// String returns a string representation of the violation.
+func (this Violation) String() string {
+	return fmt.Sprintf("[%s] %s %s: %s", this.Id, this.Type.Name(), this.Field, this.Desc)
+}
+
+// ValidateMessage checks the message against the spec for the protocol version,
+// 0x3 or 0x4. It returns nil if the message conforms, or if the message is not one
+// of the types defined in this package.
+//
+// Decode stops at the first problem it finds. To lint messages from third-party
+// devices, decode them with LenientDecodeOptions, and then call Validate to get all
+// the violations at once.
+func ValidateMessage(msg Message, version byte) []Violation {
+	if v, ok := msg.(interface {
+		Validate(byte) []Violation
+	}); ok {
+		return v.Validate(version)
+	}
+
+	return nil
+}
+
+type violations []Violation
+
+func (this *violations) add(id string, mtype MessageType, field, format string, args ...interface{}) {
+	*this = append(*this, Violation{
+		Id:    id,
+		Type:  mtype,
+		Field: field,
+		Desc:  fmt.Sprintf(format, args...),
+	})
+}
+
+// utf8String checks a UTF-8 encoded string against section 1.5.3 of the spec.
+func (this *violations) utf8String(mtype MessageType, field string, b []byte) {
+	if !utf8.Valid(b) {
+		this.add("MQTT-1.5.3-1", mtype, field, "Not a well-formed UTF-8 string")
+	}
+
+	if bytes.IndexByte(b, 0) != -1 {
+		this.add("MQTT-1.5.3-2", mtype, field, "Includes the null character U+0000")
+	}
+}
+
+// topicFilter checks a topic filter against sections 4.7.1 and 4.7.3 of the spec.
+func (this *violations) topicFilter(mtype MessageType, field string, filter []byte) {
+	this.utf8String(mtype, field, filter)
+
+	if len(filter) == 0 {
+		this.add("MQTT-4.7.3-1", mtype, field, "Topic filter is empty")
+		return
+	}
+
+	levels := bytes.Split(filter, []byte("/"))
+	for i, l := range levels {
+		if bytes.IndexByte(l, '#') != -1 && (len(l) != 1 || i != len(levels)-1) {
+			this.add("MQTT-4.7.1-2", mtype, field, "Multi-level wildcard must occupy the last level of %q", filter)
+		}
+
+		if bytes.IndexByte(l, '+') != -1 && len(l) != 1 {
+			this.add("MQTT-4.7.1-3", mtype, field, "Single-level wildcard must occupy an entire level of %q", filter)
+		}
+	}
+}
+
+// flagsId returns the normative statement for the fixed header flags of the message type.
+func flagsId(mtype MessageType) string {
+	switch mtype {
+	case PUBREL:
+		return "MQTT-3.6.1-1"
+	case SUBSCRIBE:
+		return "MQTT-3.8.1-1"
+	case UNSUBSCRIBE:
+		return "MQTT-3.10.1-1"
+	}
+
+	return "MQTT-2.2.2-1"
+}
+
+func (this *fixedHeader) validate(v *violations) {
+	if this.mtype != PUBLISH && this.flags != this.mtype.DefaultFlags() {
+		v.add(flagsId(this.mtype), this.mtype, "Flags", "Flags are %04b, must be %04b", this.flags, this.mtype.DefaultFlags())
+	}
+}
+
+// Validate checks the fixed header flags. Messages that have no variable header or
+// payload that can be checked use this as their Validate method.
+func (this *fixedHeader) Validate(version byte) []Violation {
+	var v violations
+	this.validate(&v)
+	return v
+}
+
+// Validate checks the message against the spec for the protocol version, 0x3 or
+// 0x4, and returns all the violations found.
+func (this *ConnectMessage) Validate(version byte) []Violation {
+	var v violations
+	this.validate(&v)
+
+	if verstr, ok := SupportedVersions[version]; ok && string(this.protoName) != verstr && this.protoName != nil {
+		v.add("MQTT-3.1.2-1", CONNECT, "Protocol Name", "Protocol name is %q, must be %q", this.protoName, verstr)
+	}
+
+	if this.version != version {
+		v.add("MQTT-3.1.2-2", CONNECT, "Protocol Level", "Protocol level is %d, must be %d", this.version, version)
+	}
+
+	if this.connectFlags&0x1 != 0 {
+		v.add("MQTT-3.1.2-3", CONNECT, "Connect Flags", "Reserved flag is not 0")
+	}
+
+	if this.WillFlag() {
+		if this.WillQos() > QosExactlyOnce {
+			v.add("MQTT-3.1.2-14", CONNECT, "Connect Flags", "Will QoS is %d, must be 0, 1 or 2", this.WillQos())
+		}
+
+		this.validateWillTopic(&v)
+	} else {
+		if this.WillQos() != QosAtMostOnce {
+			v.add("MQTT-3.1.2-13", CONNECT, "Connect Flags", "Will QoS is %d, must be 0 if the Will Flag is 0", this.WillQos())
+		}
+
+		if this.WillRetain() {
+			v.add("MQTT-3.1.2-15", CONNECT, "Connect Flags", "Will Retain must be 0 if the Will Flag is 0")
+		}
+	}
+
+	if !this.UsernameFlag() && len(this.username) > 0 {
+		v.add("MQTT-3.1.2-18", CONNECT, "User Name", "User name is present, but the User Name Flag is 0")
+	}
+
+	if !this.PasswordFlag() && len(this.password) > 0 {
+		v.add("MQTT-3.1.2-20", CONNECT, "Password", "Password is present, but the Password Flag is 0")
+	}
+
+	// In 3.1, the Password can be sent without a User Name.
+	if version >= 0x4 && this.PasswordFlag() && !this.UsernameFlag() {
+		v.add("MQTT-3.1.2-22", CONNECT, "Connect Flags", "Password Flag must be 0 if the User Name Flag is 0")
+	}
+
+	v.utf8String(CONNECT, "Client Identifier", this.clientId)
+
+	if version >= 0x4 && len(this.clientId) == 0 && !this.CleanSession() {
+		v.add("MQTT-3.1.3-7", CONNECT, "Client Identifier", "Client identifier is empty, and Clean Session is 0")
+	}
+
+	if this.UsernameFlag() {
+		v.utf8String(CONNECT, "User Name", this.username)
+	}
+
+	return v
+}
+
+func (this *ConnectMessage) validateWillTopic(v *violations) {
+	v.utf8String(CONNECT, "Will Topic", this.willTopic)
+
+	if len(this.willTopic) == 0 {
+		v.add("MQTT-4.7.3-1", CONNECT, "Will Topic", "Will topic is empty")
+	}
+
+	if bytes.IndexAny(this.willTopic, "+#") != -1 {
+		v.add("MQTT-3.3.2-2", CONNECT, "Will Topic", "Will topic %q must not contain wildcard characters", this.willTopic)
+	}
+}
+
+// Validate checks the message against the spec for the protocol version, 0x3 or
+// 0x4, and returns all the violations found.
+func (this *ConnackMessage) Validate(version byte) []Violation {
+	var v violations
+	this.validate(&v)
+
+	if this.sessionPresent && this.returnCode != ConnectionAccepted {
+		v.add("MQTT-3.2.2-4", CONNACK, "Session Present", "Session Present must be 0 if the return code is not 0")
+	}
+
+	return v
+}
+
+// Validate checks the message against the spec for the protocol version, 0x3 or
+// 0x4, and returns all the violations found.
+func (this *PublishMessage) Validate(version byte) []Violation {
+	var v violations
+
+	if this.QoS() > QosExactlyOnce {
+		v.add("MQTT-3.3.1-4", PUBLISH, "QoS", "QoS bits must not both be 1")
+	}
+
+	if this.QoS() == QosAtMostOnce && this.Dup() {
+		v.add("MQTT-3.3.1-2", PUBLISH, "DUP", "DUP must be 0 for QoS 0 messages")
+	}
+
+	v.utf8String(PUBLISH, "Topic Name", this.topic)
+
+	if len(this.topic) == 0 {
+		v.add("MQTT-4.7.3-1", PUBLISH, "Topic Name", "Topic name is empty")
+	}
+
+	if bytes.IndexAny(this.topic, "+#") != -1 {
+		v.add("MQTT-3.3.2-2", PUBLISH, "Topic Name", "Topic name %q must not contain wildcard characters", this.topic)
+	}
+
+	if this.QoS() != QosAtMostOnce && this.packetId == 0 {
+		v.add("MQTT-2.3.1-1", PUBLISH, "Packet Identifier", "Packet identifier must be non-zero for QoS %d messages", this.QoS())
+	}
+
+	return v
+}
+
+// Validate checks the message against the spec for the protocol version, 0x3 or
+// 0x4, and returns all the violations found.
+func (this *SubscribeMessage) Validate(version byte) []Violation {
+	var v violations
+	this.validate(&v)
+
+	if this.packetId == 0 {
+		v.add("MQTT-2.3.1-1", SUBSCRIBE, "Packet Identifier", "Packet identifier must be non-zero")
+	}
+
+	if len(this.topics) == 0 {
+		v.add("MQTT-3.8.3-3", SUBSCRIBE, "Payload", "Payload must contain at least one topic filter")
+	}
+
+	for i, t := range this.topics {
+		v.topicFilter(SUBSCRIBE, "Topic Filter", t)
+
+		if i < len(this.qos) && !ValidQos(this.qos[i]) {
+			v.add("MQTT-3.8.3-4", SUBSCRIBE, "Requested QoS", "Requested QoS %d for topic filter %q must be 0, 1 or 2", this.qos[i], t)
+		}
+	}
+
+	return v
+}
+
+// Validate checks the message against the spec for the protocol version, 0x3 or
+// 0x4, and returns all the violations found. Version 0x3 has no failure return code.
+func (this *SubackMessage) Validate(version byte) []Violation {
+	var v violations
+	this.validate(&v)
+
+	for i, c := range this.returnCodes {
+		if !ValidQos(c) && (c != QosFailure || version < 0x4) {
+			v.add("MQTT-3.9.3-2", SUBACK, "Return Code", "Return code %d for topic %d is reserved", c, i)
+		}
+	}
+
+	return v
+}
+
+// Validate checks the message against the spec for the protocol version, 0x3 or
+// 0x4, and returns all the violations found.
+func (this *UnsubscribeMessage) Validate(version byte) []Violation {
+	var v violations
+	this.validate(&v)
+
+	if this.packetId == 0 {
+		v.add("MQTT-2.3.1-1", UNSUBSCRIBE, "Packet Identifier", "Packet identifier must be non-zero")
+	}
+
+	if len(this.topics) == 0 {
+		v.add("MQTT-3.10.3-2", UNSUBSCRIBE, "Payload", "Payload must contain at least one topic filter")
+	}
+
+	for _, t := range this.topics {
+		v.topicFilter(UNSUBSCRIBE, "Topic Filter", t)
+	}
+
+	return v
+}
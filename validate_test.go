@@ -0,0 +1,160 @@
+// Copyright (c) 2014 Dataence, LLC. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dataence/assert"
+)
+
+func violationIds(v []Violation) []string {
+	ids := make([]string, 0, len(v))
+	for _, x := range v {
+		ids = append(ids, x.Id)
+	}
+
+	return ids
+}
+
+func TestConnectMessageValidate(t *testing.T) {
+	msgBytes := []byte{
+		byte(CONNECT << 4),
+		19,
+		0, // Length MSB (0)
+		4, // Length LSB (4)
+		'M', 'Q', 'T', 'T',
+		4,    // Protocol level 4
+		0x4b, // connect flags 01001011, password, will qos 1 without will flag, clean session, reserved
+		0,    // Keep Alive MSB (0)
+		10,   // Keep Alive LSB (10)
+		0,    // Client ID MSB (0)
+		2,    // Client ID LSB (2)
+		'a', 'b',
+		0, // Password MSB (0)
+		3, // Password LSB (3)
+		'p', 'w', 'd',
+	}
+
+	msg := NewConnectMessage()
+	msg.SetDecodeOptions(&LenientDecodeOptions)
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	v := msg.Validate(0x4)
+	assert.Equal(t, true, []string{"MQTT-3.1.2-3", "MQTT-3.1.2-13", "MQTT-3.1.2-22"}, violationIds(v), "Incorrect violations.")
+	assert.Equal(t, true, "Connect Flags", v[0].Field, "Incorrect field.")
+	assert.Equal(t, true, CONNECT, v[0].Type, "Incorrect type.")
+
+	v = msg.Validate(0x3)
+	assert.Equal(t, true, []string{"MQTT-3.1.2-1", "MQTT-3.1.2-2", "MQTT-3.1.2-3", "MQTT-3.1.2-13"}, violationIds(v), "Incorrect violations.")
+}
+
+func TestConnectMessageValidateWill(t *testing.T) {
+	msg := NewConnectMessage()
+	msg.SetVersion(0x4)
+	msg.SetClientId([]byte("surgemq"))
+	msg.SetWillFlag(true)
+	msg.SetWillTopic([]byte("will/#"))
+	msg.SetWillMessage([]byte("bye"))
+
+	v := msg.Validate(0x4)
+	assert.Equal(t, true, []string{"MQTT-3.3.2-2"}, violationIds(v), "Incorrect violations.")
+
+	msg.SetWillTopic([]byte("will"))
+	assert.Equal(t, true, 0, len(msg.Validate(0x4)), "Expecting no violations.")
+}
+
+func TestPublishMessageValidate(t *testing.T) {
+	msg := NewPublishMessage()
+	msg.topic = []byte("a/+/c\x00")
+	msg.SetDup(true)
+	msg.SetPayload([]byte("send me home"))
+
+	v := msg.Validate(0x4)
+	assert.Equal(t, true, []string{"MQTT-3.3.1-2", "MQTT-1.5.3-2", "MQTT-3.3.2-2"}, violationIds(v), "Incorrect violations.")
+
+	msg = NewPublishMessage()
+	msg.SetTopic([]byte("a/b/c"))
+	msg.SetQoS(1)
+	msg.SetPayload([]byte("send me home"))
+
+	v = msg.Validate(0x4)
+	assert.Equal(t, true, []string{"MQTT-2.3.1-1"}, violationIds(v), "Incorrect violations.")
+
+	msg.SetPacketId(7)
+	assert.Equal(t, true, 0, len(msg.Validate(0x4)), "Expecting no violations.")
+}
+
+func TestSubscribeMessageValidate(t *testing.T) {
+	msg := NewSubscribeMessage()
+
+	v := msg.Validate(0x4)
+	assert.Equal(t, true, []string{"MQTT-2.3.1-1", "MQTT-3.8.3-3"}, violationIds(v), "Incorrect violations.")
+
+	msg.SetPacketId(7)
+	msg.topics = [][]byte{[]byte("a/#/c"), []byte("a/b+"), []byte("a/+/#"), []byte("")}
+	msg.qos = []byte{0, 1, 3, 0}
+
+	v = msg.Validate(0x4)
+	assert.Equal(t, true, []string{"MQTT-4.7.1-2", "MQTT-4.7.1-3", "MQTT-3.8.3-4", "MQTT-4.7.3-1"}, violationIds(v), "Incorrect violations.")
+}
+
+func TestSubackMessageValidate(t *testing.T) {
+	msg := NewSubackMessage()
+	msg.SetPacketId(7)
+	msg.returnCodes = []byte{0, 1, 2, 0x80, 3}
+
+	v := msg.Validate(0x4)
+	assert.Equal(t, true, []string{"MQTT-3.9.3-2"}, violationIds(v), "Incorrect violations.")
+
+	v = msg.Validate(0x3)
+	assert.Equal(t, true, []string{"MQTT-3.9.3-2", "MQTT-3.9.3-2"}, violationIds(v), "Incorrect violations.")
+}
+
+func TestUnsubscribeMessageValidate(t *testing.T) {
+	msg := NewUnsubscribeMessage()
+	msg.SetPacketId(7)
+
+	v := msg.Validate(0x4)
+	assert.Equal(t, true, []string{"MQTT-3.10.3-2"}, violationIds(v), "Incorrect violations.")
+}
+
+func TestValidateMessageFlags(t *testing.T) {
+	msgBytes := []byte{
+		byte(PUBREL<<4) | 0,
+		2,
+		0, // packet ID MSB (0)
+		7, // packet ID LSB (7)
+	}
+
+	msg := NewPubrelMessage()
+	msg.SetDecodeOptions(&LenientDecodeOptions)
+	_, err := msg.Decode(bytes.NewBuffer(msgBytes))
+	assert.NoError(t, true, err, "Error decoding message.")
+
+	v := ValidateMessage(msg, 0x4)
+	assert.Equal(t, true, []string{"MQTT-3.6.1-1"}, violationIds(v), "Incorrect violations.")
+	assert.Equal(t, true, "[MQTT-3.6.1-1] PUBREL Flags: Flags are 0000, must be 0010", v[0].String(), "Incorrect string.")
+
+	ping := NewPingreqMessage()
+	ping.flags = 1
+	assert.Equal(t, true, []string{"MQTT-2.2.2-1"}, violationIds(ValidateMessage(ping, 0x4)), "Incorrect violations.")
+
+	ack := NewPubackMessage()
+	ack.SetPacketId(7)
+	assert.Equal(t, true, 0, len(ValidateMessage(ack, 0x4)), "Expecting no violations.")
+}